@@ -0,0 +1,198 @@
+package cloudfrontgate
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adminConfig holds the protection settings of the admin endpoints.
+type adminConfig struct {
+	path       string
+	tokenHash  [sha256.Size]byte
+	allowedIPs []net.IPNet
+	stealth    bool
+
+	// routes maps an endpoint, relative to path, to its handler.
+	routes map[string]adminRoute
+}
+
+// adminRoute is an admin endpoint.
+type adminRoute struct {
+	method string
+	// minInterval limits calls per token; zero means unlimited.
+	minInterval time.Duration
+	handle      func(rw http.ResponseWriter, req *http.Request)
+}
+
+// adminLimiter remembers the last call per endpoint and token.
+type adminLimiter struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// allow records a call and reports whether it respects minInterval.
+func (l *adminLimiter) allow(key string, minInterval time.Duration, now time.Time) bool {
+	if minInterval <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+	}
+	if last, ok := l.last[key]; ok && now.Sub(last) < minInterval {
+		return false
+	}
+	l.last[key] = now
+	return true
+}
+
+// newAdminConfig validates the admin settings. It returns nil when no admin
+// path is configured.
+func newAdminConfig(config *Config, groups cidrGroups) (*adminConfig, error) {
+	if config.AdminPath == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(config.AdminPath, "/") {
+		return nil, fmt.Errorf("invalid adminPath %q: must start with /", config.AdminPath)
+	}
+
+	token := config.AdminToken
+	if config.AdminTokenFile != "" {
+		if token != "" {
+			return nil, errors.New("adminToken and adminTokenFile are mutually exclusive")
+		}
+		raw, err := os.ReadFile(config.AdminTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read admin token file: %w", err)
+		}
+		token = strings.TrimSpace(string(raw))
+	}
+	if token == "" {
+		return nil, errors.New("adminPath requires adminToken or adminTokenFile")
+	}
+
+	allowedIPs, _, err := groups.parse(config.AdminAllowedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse admin allowed IPs: %w", err)
+	}
+
+	return &adminConfig{
+		path:       strings.TrimSuffix(config.AdminPath, "/"),
+		tokenHash:  sha256.Sum256([]byte(token)),
+		allowedIPs: allowedIPs,
+		stealth:    config.AdminStealth,
+		routes:     make(map[string]adminRoute),
+	}, nil
+}
+
+// matches reports whether path belongs to the admin endpoints.
+func (a *adminConfig) matches(path string) bool {
+	return path == a.path || strings.HasPrefix(path, a.path+"/")
+}
+
+// authorize checks the direct peer and the bearer token. The token is
+// compared through its hash, in constant time.
+func (a *adminConfig) authorize(req *http.Request) (status int, reason string) {
+	if len(a.allowedIPs) > 0 {
+		peer := peerIP(req)
+		if peer == nil || !containsIP(a.allowedIPs, peer) {
+			return http.StatusForbidden, "peer not allowed"
+		}
+	}
+
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return http.StatusUnauthorized, "missing token"
+	}
+	hash := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	if subtle.ConstantTimeCompare(hash[:], a.tokenHash[:]) != 1 {
+		return http.StatusUnauthorized, "invalid token"
+	}
+	return http.StatusOK, ""
+}
+
+// serveAdmin authenticates, rate limits and dispatches an admin request to
+// the endpoint of route, its routePath, writing an audit log line with the
+// outcome.
+func (cf *CloudFrontGate) serveAdmin(rw http.ResponseWriter, req *http.Request, route string) {
+	a := cf.admin
+	outcome := "ok"
+	defer func() {
+		cf.logger.infof("CloudFrontGate %s: admin %s %s from %s: %s", cf.name, req.Method, req.URL.Path, req.RemoteAddr, outcome)
+	}()
+
+	if status, reason := a.authorize(req); status != http.StatusOK {
+		outcome = "denied: " + reason
+		if a.stealth {
+			http.NotFound(rw, req)
+			return
+		}
+		if status == http.StatusUnauthorized {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="cloudfrontgate"`)
+		}
+		http.Error(rw, http.StatusText(status), status)
+		return
+	}
+
+	endpoint := strings.TrimPrefix(route, a.path)
+	handler, ok := a.routes[endpoint]
+	if !ok {
+		outcome = "unknown endpoint"
+		http.NotFound(rw, req)
+		return
+	}
+	if !allowMethod(rw, req, handler.method) {
+		outcome = "method not allowed"
+		return
+	}
+	if !cf.state.adminLimiter.allow(endpoint+"\x00"+string(a.tokenHash[:]), handler.minInterval, cf.now()) {
+		outcome = "rate limited"
+		rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(handler.minInterval.Seconds())))
+		http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	handler.handle(rw, req)
+}
+
+// Minimum intervals between calls of the built-in endpoints per token. The
+// endpoints that change state or serialize the whole dataset are limited;
+// the cheap read-only ones are not.
+const (
+	adminMutateInterval = 10 * time.Second
+	adminDumpInterval   = time.Second
+)
+
+// registerAdminRoutes adds the built-in endpoints to the admin routes.
+func (cf *CloudFrontGate) registerAdminRoutes() {
+	if cf.admin == nil {
+		return
+	}
+	cf.admin.routes["/status"] = adminRoute{method: http.MethodGet, handle: cf.serveStatus}
+	cf.admin.routes["/snapshot"] = adminRoute{method: http.MethodGet, minInterval: adminDumpInterval, handle: cf.serveSnapshot}
+	cf.admin.routes["/explain"] = adminRoute{method: http.MethodGet, handle: cf.serveExplain}
+	cf.admin.routes["/ip-allowlist"] = adminRoute{method: http.MethodGet, minInterval: adminDumpInterval, handle: cf.serveIPAllowList}
+	cf.admin.routes["/learning"] = adminRoute{method: http.MethodGet, minInterval: adminDumpInterval, handle: cf.serveLearning}
+	cf.admin.routes["/accept-shrink"] = adminRoute{method: http.MethodPost, minInterval: adminMutateInterval, handle: cf.serveAcceptShrink}
+}
+
+// containsIP reports whether ip is in any of the prefixes.
+func containsIP(prefixes []net.IPNet, ip net.IP) bool {
+	for _, ipNet := range prefixes {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newAdminGate(t *testing.T, mutate func(*Config)) *CloudFrontGate {
+	t.Helper()
+
+	cfg := CreateConfig()
+	cfg.AdminPath = "/_cfgate"
+	cfg.AdminToken = "s3cret"
+	if mutate != nil {
+		mutate(cfg)
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+	})
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	t.Cleanup(func() { _ = cf.Close() })
+
+	cf.admin.routes["/ping"] = adminRoute{
+		method:      http.MethodPost,
+		minInterval: time.Minute,
+		handle: func(rw http.ResponseWriter, _ *http.Request) {
+			rw.WriteHeader(http.StatusNoContent)
+		},
+	}
+	return cf
+}
+
+func adminRequest(cf *CloudFrontGate, method, path, remoteAddr, token string) int {
+	req := httptest.NewRequest(method, "http://example.com"+path, nil)
+	req.RemoteAddr = remoteAddr
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	cf.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func TestNewAdminConfig(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  Config
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "disabled", config: Config{}, wantNil: true},
+		{name: "token", config: Config{AdminPath: "/_cfgate", AdminToken: "t"}},
+		{name: "token file", config: Config{AdminPath: "/_cfgate", AdminTokenFile: tokenFile}},
+		{name: "missing token", config: Config{AdminPath: "/_cfgate"}, wantErr: true},
+		{name: "both tokens", config: Config{AdminPath: "/_cfgate", AdminToken: "t", AdminTokenFile: tokenFile}, wantErr: true},
+		{name: "unreadable file", config: Config{AdminPath: "/_cfgate", AdminTokenFile: tokenFile + ".missing"}, wantErr: true},
+		{name: "relative path", config: Config{AdminPath: "_cfgate", AdminToken: "t"}, wantErr: true},
+		{name: "invalid CIDR", config: Config{AdminPath: "/_cfgate", AdminToken: "t", AdminAllowedIPs: []string{"nope"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin, err := newAdminConfig(&tt.config, cidrGroups(builtinGroups))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newAdminConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (admin == nil) != tt.wantNil {
+				t.Errorf("newAdminConfig() = %v, wantNil %v", admin, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestServeAdmin(t *testing.T) {
+	cf := newAdminGate(t, func(cfg *Config) {
+		cfg.AdminAllowedIPs = []string{"10.0.0.0/8"}
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		remoteAddr string
+		token      string
+		want       int
+	}{
+		{name: "missing token", method: http.MethodPost, path: "/_cfgate/ping", remoteAddr: "10.0.0.1:1234", want: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodPost, path: "/_cfgate/ping", remoteAddr: "10.0.0.1:1234", token: "guess", want: http.StatusUnauthorized},
+		{name: "peer outside admin CIDRs", method: http.MethodPost, path: "/_cfgate/ping", remoteAddr: "192.168.1.1:1234", token: "s3cret", want: http.StatusForbidden},
+		{name: "unknown endpoint", method: http.MethodGet, path: "/_cfgate/nope", remoteAddr: "10.0.0.1:1234", token: "s3cret", want: http.StatusNotFound},
+		{name: "wrong method", method: http.MethodGet, path: "/_cfgate/ping", remoteAddr: "10.0.0.1:1234", token: "s3cret", want: http.StatusMethodNotAllowed},
+		{name: "authorized", method: http.MethodPost, path: "/_cfgate/ping", remoteAddr: "10.0.0.1:1234", token: "s3cret", want: http.StatusNoContent},
+		{name: "rate limited", method: http.MethodPost, path: "/_cfgate/ping", remoteAddr: "10.0.0.2:1234", token: "s3cret", want: http.StatusTooManyRequests},
+		{name: "non-admin path is gated", method: http.MethodGet, path: "/_cfgateway", remoteAddr: "10.0.0.1:1234", token: "s3cret", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := adminRequest(cf, tt.method, tt.path, tt.remoteAddr, tt.token); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeAdminStealth(t *testing.T) {
+	cf := newAdminGate(t, func(cfg *Config) {
+		cfg.AdminStealth = true
+	})
+
+	if got := adminRequest(cf, http.MethodPost, "/_cfgate/ping", "10.0.0.1:1234", "guess"); got != http.StatusNotFound {
+		t.Errorf("Expected 404 for failed auth in stealth mode, got %d", got)
+	}
+	if got := adminRequest(cf, http.MethodPost, "/_cfgate/ping", "10.0.0.1:1234", "s3cret"); got != http.StatusNoContent {
+		t.Errorf("Expected authorized call to succeed, got %d", got)
+	}
+}
+
+func TestServeAdminDisabled(t *testing.T) {
+	cf := newAdminGate(t, nil)
+	cf.admin = nil
+
+	// Without an admin path the request is an ordinary one and gets gated.
+	if got := adminRequest(cf, http.MethodPost, "/_cfgate/ping", "10.0.0.1:1234", "s3cret"); got != http.StatusForbidden {
+		t.Errorf("Expected non-CloudFront peer to be denied, got %d", got)
+	}
+}
+
+func TestAdminRoutesRateLimited(t *testing.T) {
+	cf := newAdminGate(t, nil)
+	now := time.Now()
+	cf.now = func() time.Time { return now }
+
+	tests := []struct {
+		method   string
+		path     string
+		want     int
+		interval time.Duration
+	}{
+		{method: http.MethodPost, path: "/_cfgate/accept-shrink", want: http.StatusConflict, interval: adminMutateInterval},
+		{method: http.MethodGet, path: "/_cfgate/snapshot", want: http.StatusOK, interval: adminDumpInterval},
+		{method: http.MethodGet, path: "/_cfgate/learning", want: http.StatusOK, interval: adminDumpInterval},
+	}
+	for _, tt := range tests {
+		if got := adminRequest(cf, tt.method, tt.path, "10.0.0.1:1234", "s3cret"); got != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, got, tt.want)
+		}
+		if got := adminRequest(cf, tt.method, tt.path, "10.0.0.1:1234", "s3cret"); got != http.StatusTooManyRequests {
+			t.Errorf("Expected a repeated %s %s to be rate limited, got %d", tt.method, tt.path, got)
+		}
+	}
+
+	now = now.Add(adminMutateInterval)
+	for _, tt := range tests {
+		if got := adminRequest(cf, tt.method, tt.path, "10.0.0.1:1234", "s3cret"); got != tt.want {
+			t.Errorf("Expected %s %s to be allowed after the interval, got %d", tt.method, tt.path, got)
+		}
+	}
+}
+
+func TestAdminLimiter(t *testing.T) {
+	var l adminLimiter
+	now := time.Now()
+
+	if !l.allow("refresh", time.Minute, now) {
+		t.Fatalf("Expected first call to be allowed")
+	}
+	if l.allow("refresh", time.Minute, now.Add(30*time.Second)) {
+		t.Errorf("Expected call within the interval to be limited")
+	}
+	if !l.allow("status", time.Minute, now) {
+		t.Errorf("Expected other endpoints to have their own limit")
+	}
+	if !l.allow("refresh", time.Minute, now.Add(time.Minute)) {
+		t.Errorf("Expected call after the interval to be allowed")
+	}
+	if !l.allow("dump", 0, now) || !l.allow("dump", 0, now) {
+		t.Errorf("Expected unlimited endpoints to always be allowed")
+	}
+}
@@ -0,0 +1,74 @@
+package cloudfrontgate
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// routePath returns the path of u the middleware matches its own endpoints
+// against: decoded once, with dot segments and repeated and trailing slashes
+// removed, as most backends would see it. A path with an encoded slash or
+// an invalid escape matches no endpoint and returns "". The request itself
+// is never changed, so a request that matches no endpoint reaches the
+// backend as it came.
+func routePath(u *url.URL) string {
+	if u.RawPath == "" {
+		if u.Path == "" {
+			return "/"
+		}
+		// Clean does not allocate for a path that is clean already.
+		return path.Clean(u.Path)
+	}
+	segments := strings.Split(u.RawPath, "/")
+	for i, segment := range segments {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil || strings.Contains(decoded, "/") {
+			return ""
+		}
+		segments[i] = decoded
+	}
+	return path.Clean("/" + strings.Join(segments, "/"))
+}
+
+// cleanRoutePath returns a configured endpoint path in the form routePath
+// matches, or "" for an unset one.
+func cleanRoutePath(p string) string {
+	if p == "" {
+		return ""
+	}
+	return path.Clean(p)
+}
+
+// allowMethod answers 405 unless the request uses method, and reports
+// whether it does.
+func allowMethod(rw http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method == method {
+		return true
+	}
+	rw.Header().Set("Allow", method)
+	http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+// endpointFor returns the handler of the statusPath, refreshPath or
+// metricsPath endpoint the request is for, or nil for a request to be
+// forwarded.
+func (cf *CloudFrontGate) endpointFor(req *http.Request) http.HandlerFunc {
+	if cf.statusPath == "" && cf.refreshPath == "" && cf.metricsPath == "" {
+		return nil
+	}
+	route := routePath(req.URL)
+	switch {
+	case route == "":
+		return nil
+	case route == cf.statusPath:
+		return cf.serveStatusPath
+	case route == cf.refreshPath:
+		return cf.serveRefreshPath
+	case route == cf.metricsPath:
+		return cf.serveMetricsPath
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRoutePath(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"/_cloudfrontgate/status", "/_cloudfrontgate/status"},
+		{"", "/"},
+		{"/_cloudfrontgate/status/", "/_cloudfrontgate/status"},
+		{"//_cloudfrontgate///status", "/_cloudfrontgate/status"},
+		{"/app/../_cloudfrontgate/./status", "/_cloudfrontgate/status"},
+		{"/%5Fcloudfrontgate/%73tatus", "/_cloudfrontgate/status"},
+		{"/_cloudfrontgate/%2e%2e/app", "/app"},
+		{"/_cloudfrontgate%2Fstatus", ""},
+		{"/_cloudfrontgate/%252Fstatus", "/_cloudfrontgate/%2Fstatus"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse("http://example.com" + tt.raw)
+		if err != nil {
+			t.Fatalf("url.Parse(%q) error = %v", tt.raw, err)
+		}
+		if got := routePath(u); got != tt.want {
+			t.Errorf("routePath(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestRoutePathDoesNotAllocate(t *testing.T) {
+	u, _ := url.Parse("/assets/app.js")
+	if allocs := testing.AllocsPerRun(100, func() { _ = routePath(u) }); allocs != 0 {
+		t.Errorf("Expected a clean path not to allocate, got %.0f allocations", allocs)
+	}
+}
+
+func TestAdminPathsAdversarialURLs(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.AllowedIPs = []string{"198.51.100.0/24"}
+	cfg.HealthPath = "/_cloudfrontgate/health"
+	cfg.StatusPath = "/_cloudfrontgate/status/"
+	cfg.RefreshPath = "/_cloudfrontgate/refresh"
+	cfg.MetricsPath = "/_cloudfrontgate/metrics"
+	cfg.AdminPath = "/_cfgate"
+	cfg.AdminToken = "s3cret"
+	var forwarded *http.Request
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req
+		rw.WriteHeader(http.StatusTeapot)
+	})
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	const (
+		operator   = "198.51.100.7:1234"
+		cloudFront = "205.251.249.10:1234"
+	)
+	tests := []struct {
+		method, target, remoteAddr string
+		// want is the status; http.StatusTeapot means forwarded.
+		want int
+	}{
+		// Variants of the endpoints are answered by the middleware.
+		{http.MethodGet, "/_cloudfrontgate/status", operator, http.StatusOK},
+		{http.MethodGet, "/_cloudfrontgate/status/?pretty=1", operator, http.StatusOK},
+		{http.MethodGet, "//_cloudfrontgate//status", operator, http.StatusOK},
+		{http.MethodGet, "/app/../_cloudfrontgate/./status", operator, http.StatusOK},
+		{http.MethodGet, "/%5Fcloudfrontgate/%73tatus", operator, http.StatusOK},
+		{http.MethodGet, "/_cloudfrontgate/metrics/", operator, http.StatusOK},
+		{http.MethodGet, "/x/../_cloudfrontgate/health", cloudFront, http.StatusOK},
+		{http.MethodPost, "/_cloudfrontgate/refresh/", operator, http.StatusAccepted},
+
+		// Only the expected method is served.
+		{http.MethodPost, "/_cloudfrontgate/status", operator, http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/%5Fcloudfrontgate/metrics", operator, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/_cloudfrontgate/refresh", operator, http.StatusMethodNotAllowed},
+
+		// CloudFront peers are refused the endpoints in every spelling,
+		// rather than reaching the backend with them.
+		{http.MethodGet, "/%5Fcloudfrontgate/status", cloudFront, http.StatusForbidden},
+		{http.MethodPost, "/app/../_cloudfrontgate/refresh", cloudFront, http.StatusForbidden},
+		{http.MethodGet, "/_cloudfrontgate/metrics/.", cloudFront, http.StatusForbidden},
+
+		// The admin endpoints are found through the cleaned path and keep
+		// requiring the token.
+		{http.MethodGet, "/x/../_cfgate/./status", cloudFront, http.StatusUnauthorized},
+		{http.MethodGet, "/%5Fcfgate/status", operator, http.StatusUnauthorized},
+
+		// Paths that are not an endpoint once cleaned are forwarded.
+		{http.MethodGet, "/_cloudfrontgate/status/../../app", cloudFront, http.StatusTeapot},
+		{http.MethodGet, "/_CloudFrontGate/status", cloudFront, http.StatusTeapot},
+		{http.MethodGet, "/_cloudfrontgate%2Fstatus", cloudFront, http.StatusTeapot},
+		{http.MethodGet, "/_cloudfrontgate/%252Fstatus", cloudFront, http.StatusTeapot},
+		{http.MethodGet, "/_cloudfrontgate/status.json", cloudFront, http.StatusTeapot},
+		{http.MethodGet, "/_cloudfrontgate/statusx", cloudFront, http.StatusTeapot},
+		{http.MethodGet, "/_cfgate/../app", cloudFront, http.StatusTeapot},
+		{http.MethodGet, "/_cfgatex/status", cloudFront, http.StatusTeapot},
+	}
+	for _, tt := range tests {
+		forwarded = nil
+		req := httptest.NewRequest(tt.method, "http://example.com"+tt.target, nil)
+		req.RemoteAddr = tt.remoteAddr
+		requestURI, path, rawPath := req.RequestURI, req.URL.Path, req.URL.RawPath
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+
+		if rw.Code != tt.want {
+			t.Errorf("%s %s from %s: status = %d, want %d", tt.method, tt.target, tt.remoteAddr, rw.Code, tt.want)
+			continue
+		}
+		if (forwarded != nil) != (tt.want == http.StatusTeapot) {
+			t.Errorf("%s %s: forwarded = %v, want %v", tt.method, tt.target, forwarded != nil, tt.want == http.StatusTeapot)
+			continue
+		}
+		if forwarded != nil && (forwarded.RequestURI != requestURI || forwarded.URL.Path != path || forwarded.URL.RawPath != rawPath) {
+			t.Errorf("%s: expected the backend to get the URL as sent, got %q (%q, %q)", tt.target, forwarded.RequestURI, forwarded.URL.Path, forwarded.URL.RawPath)
+		}
+		if tt.want == http.StatusMethodNotAllowed && rw.Header().Get("Allow") == "" {
+			t.Errorf("%s %s: expected an Allow header with the 405", tt.method, tt.target)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"net/netip"
+	"sort"
+)
+
+// aggregate returns the minimal set of prefixes covering exactly the same
+// addresses: duplicates and prefixes covered by others are dropped, and
+// sibling pairs are merged into their parent. The result is sorted and
+// canonical, so equal address sets always aggregate to equal slices.
+func aggregate(prefixes []netip.Prefix) []netip.Prefix {
+	nets := make([]netip.Prefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		nets = append(nets, maskedPrefix(prefix))
+	}
+
+	for {
+		sort.Slice(nets, func(i, j int) bool { return comparePrefixes(nets[i], nets[j]) < 0 })
+
+		out := nets[:0:0]
+		for _, prefix := range nets {
+			if n := len(out); n > 0 && out[n-1].Bits() <= prefix.Bits() && out[n-1].Contains(prefix.Addr()) {
+				continue // covered
+			}
+			out = append(out, prefix)
+		}
+
+		merged := false
+		result := out[:0:0]
+		for i := 0; i < len(out); i++ {
+			if i+1 < len(out) {
+				if parent, ok := mergeSiblings(out[i], out[i+1]); ok {
+					result = append(result, parent)
+					i++
+					merged = true
+					continue
+				}
+			}
+			result = append(result, out[i])
+		}
+		nets = result
+		if !merged {
+			return nets
+		}
+	}
+}
+
+// comparePrefixes orders prefixes by address, IPv4 ones as IPv4-mapped,
+// then shorter masks first.
+func comparePrefixes(a, b netip.Prefix) int {
+	addrA, addrB := a.Addr().As16(), b.Addr().As16()
+	if c := bytes.Compare(addrA[:], addrB[:]); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// mergeSiblings returns the parent of a and b when they are the two halves
+// of it.
+func mergeSiblings(a, b netip.Prefix) (netip.Prefix, bool) {
+	if a.Bits() != b.Bits() || a.Addr().BitLen() != b.Addr().BitLen() || a.Bits() <= 0 {
+		return netip.Prefix{}, false
+	}
+
+	parentA, parentB := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked(), netip.PrefixFrom(b.Addr(), b.Bits()-1).Masked()
+	if parentA != parentB || a.Addr() == b.Addr() {
+		return netip.Prefix{}, false
+	}
+	return parentA, true
+}
+
+// normalize returns cidrs without the prefixes that cannot change a match,
+// in their original order. Lookups return the earliest prefix containing an
+// address, so a prefix equal to or covered by an earlier one is dropped
+// without changing the label of any address; with covered false only the
+// exact duplicates are. With merge, two halves of a parent that share a
+// label and contain no narrower prefix are replaced by the parent, at the
+// place of the earlier half, and sources gains the label of the parent.
+func normalize(cidrs []netip.Prefix, sources map[string]trustSource, covered, merge bool) []netip.Prefix {
+	for {
+		cidrs = dropCovered(cidrs, covered)
+		if !merge {
+			return cidrs
+		}
+		var merged bool
+		cidrs, merged = mergeLabeled(cidrs, sources)
+		if !merged {
+			return cidrs
+		}
+	}
+}
+
+// dropCovered drops the prefixes equal to an earlier one and, with covered,
+// those within an earlier one.
+func dropCovered(cidrs []netip.Prefix, covered bool) []netip.Prefix {
+	seen := make(map[netip.Prefix]bool, len(cidrs))
+	out := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix := maskedPrefix(cidr)
+		shortest := prefix.Bits()
+		if covered {
+			shortest = 0
+		}
+		dropped := false
+		for length := shortest; length <= prefix.Bits() && !dropped; length++ {
+			dropped = seen[netip.PrefixFrom(prefix.Addr(), length).Masked()]
+		}
+		if dropped {
+			continue
+		}
+		seen[prefix] = true
+		out = append(out, cidr)
+	}
+	return out
+}
+
+// mergeLabeled makes one pass merging sibling pairs of the same label, and
+// reports whether any was merged. In address order, a narrower prefix within
+// a half sorts between the two halves or right after them.
+func mergeLabeled(cidrs []netip.Prefix, sources map[string]trustSource) ([]netip.Prefix, bool) {
+	prefixes := make([]netip.Prefix, len(cidrs))
+	order := make([]int, 0, len(cidrs))
+	for i, cidr := range cidrs {
+		prefixes[i] = maskedPrefix(cidr)
+		order = append(order, i)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := prefixes[order[i]], prefixes[order[j]]
+		if a.Addr().BitLen() != b.Addr().BitLen() {
+			return a.Addr().BitLen() < b.Addr().BitLen()
+		}
+		return comparePrefixes(a, b) < 0
+	})
+	label := func(i int) trustSource {
+		if source, ok := sources[cidrs[i].String()]; ok {
+			return source
+		}
+		return sourceCloudFrontGlobal
+	}
+
+	dropped := make(map[int]bool)
+	for k := 0; k+1 < len(order); k++ {
+		first, second := order[k], order[k+1]
+		parent, ok := mergeSiblings(prefixes[first], prefixes[second])
+		if !ok || label(first) != label(second) {
+			continue
+		}
+		if k+2 < len(order) {
+			next := prefixes[order[k+2]]
+			if prefixes[second].Contains(next.Addr()) {
+				continue
+			}
+		}
+		if second < first {
+			first, second = second, first
+		}
+		sources[parent.String()] = label(first)
+		cidrs[first] = parent
+		dropped[second] = true
+		k++
+	}
+	if len(dropped) == 0 {
+		return cidrs, false
+	}
+
+	out := cidrs[:0]
+	for i, cidr := range cidrs {
+		if !dropped[i] {
+			out = append(out, cidr)
+		}
+	}
+	return out, true
+}
@@ -0,0 +1,175 @@
+package cloudfrontgate
+
+import (
+	"math/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want string
+	}{
+		{name: "empty", in: nil, want: ""},
+		{name: "duplicates", in: []string{"10.0.0.0/24", "10.0.0.0/24"}, want: "10.0.0.0/24"},
+		{name: "covered", in: []string{"10.0.0.0/24", "10.0.0.128/25", "10.0.0.0/8"}, want: "10.0.0.0/8"},
+		{name: "siblings", in: []string{"10.0.1.0/24", "10.0.0.0/24"}, want: "10.0.0.0/23"},
+		{name: "cascading merge", in: []string{"10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/25"}, want: "10.0.0.0/24"},
+		{name: "non-siblings", in: []string{"10.0.1.0/24", "10.0.2.0/24"}, want: "10.0.1.0/24 10.0.2.0/24"},
+		{name: "host bits", in: []string{"10.0.0.7/24"}, want: "10.0.0.0/24"},
+		{name: "mixed families", in: []string{"2600:9000::/29", "2600:9008::/29", "13.32.0.0/16", "13.33.0.0/16"}, want: "13.32.0.0/15 2600:9000::/28"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefixes, err := parsePrefixes(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, prefix := range aggregate(prefixes) {
+				got = append(got, prefix.String())
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("aggregate() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []string
+		covered bool
+		merge   bool
+		want    string
+	}{
+		{name: "duplicates", in: []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.0.0/24"}, want: "10.0.0.0/24 10.0.1.0/24"},
+		{name: "covered kept without covered", in: []string{"10.0.0.0/8", "10.0.0.0/24"}, want: "10.0.0.0/8 10.0.0.0/24"},
+		{name: "covered", in: []string{"10.0.0.0/8", "10.0.0.0/24", "10.1.0.0/16"}, covered: true, want: "10.0.0.0/8"},
+		{name: "covered by a later prefix", in: []string{"10.0.0.0/24", "10.0.0.0/8"}, covered: true, want: "10.0.0.0/24 10.0.0.0/8"},
+		{name: "siblings kept without merge", in: []string{"10.0.0.0/24", "10.0.1.0/24"}, covered: true, want: "10.0.0.0/24 10.0.1.0/24"},
+		{name: "siblings", in: []string{"192.0.2.0/24", "10.0.1.0/24", "10.0.0.0/24"}, covered: true, merge: true, want: "192.0.2.0/24 10.0.0.0/23"},
+		{name: "cascading merge", in: []string{"10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/25"}, covered: true, merge: true, want: "10.0.0.0/24"},
+		{name: "merged into a duplicate", in: []string{"10.0.0.0/25", "10.0.0.128/25", "10.0.0.0/24"}, covered: true, merge: true, want: "10.0.0.0/24"},
+		{name: "siblings of other lists", in: []string{"13.32.0.0/16", "13.33.0.0/16"}, covered: true, merge: true, want: "13.32.0.0/16 13.33.0.0/16"},
+		{name: "narrower prefix within a half", in: []string{"10.0.0.192/26", "10.0.0.0/25", "10.0.0.128/25"}, covered: true, merge: true, want: "10.0.0.192/26 10.0.0.0/25 10.0.0.128/25"},
+		{name: "IPv6 siblings", in: []string{"2600:9000::/29", "2600:9008::/29"}, covered: true, merge: true, want: "2600:9000::/28"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefixes, err := parsePrefixes(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sources := map[string]trustSource{"13.33.0.0/16": sourceCloudFrontRegional, "10.0.0.192/26": sourceAdditional}
+			var got []string
+			for _, prefix := range normalize(prefixes, sources, tt.covered, tt.merge) {
+				got = append(got, prefix.String())
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("normalize() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeKeepsMatches(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	cidrs := randomPrefixes(r, 300)
+	// Add duplicates, narrower prefixes and both halves of some prefixes.
+	for _, cidr := range cidrs[:150] {
+		ones, bits := cidr.Mask.Size()
+		switch {
+		case r.Intn(4) == 0:
+			cidrs = append(cidrs, cidr)
+		case ones+2 <= bits:
+			for _, half := range []int{0, 1} {
+				mask := net.CIDRMask(ones+1, bits)
+				ip := append(net.IP(nil), cidr.IP...)
+				ip[ones/8] |= byte(half<<(7-ones%8)) & mask[ones/8]
+				cidrs = append(cidrs, net.IPNet{IP: ip, Mask: mask})
+			}
+		}
+	}
+	labels := []trustSource{sourceCloudFrontGlobal, sourceCloudFrontRegional, sourceAdditional}
+	sources := make(map[string]trustSource, len(cidrs))
+	for _, cidr := range cidrs {
+		if _, ok := sources[cidr.String()]; !ok {
+			sources[cidr.String()] = labels[r.Intn(len(labels))]
+		}
+	}
+	match := func(set *prefixSet, sources map[string]trustSource, ip net.IP) (trustSource, bool) {
+		i, ok := set.lookup(addrOf(ip), nil)
+		if !ok {
+			return 0, false
+		}
+		return sources[set.keys[i]], true
+	}
+
+	before := newPrefixSet(netipPrefixes(cidrs))
+	normalized := map[string]trustSource{}
+	for prefix, source := range sources {
+		normalized[prefix] = source
+	}
+	after := newPrefixSet(normalize(netipPrefixes(cidrs), normalized, true, true))
+	if len(after.prefixes) >= len(before.prefixes) {
+		t.Errorf("Expected fewer prefixes, got %d of %d", len(after.prefixes), len(before.prefixes))
+	}
+	for n := 0; n < 50000; n++ {
+		ip := randomAddress(r, cidrs)
+		wantSource, want := match(before, sources, ip)
+		gotSource, got := match(after, normalized, ip)
+		if got != want || gotSource != wantSource {
+			t.Fatalf("match(%s) = %s, %t, want %s, %t", ip, gotSource, got, wantSource, want)
+		}
+	}
+}
+
+func TestApplyNormalizes(t *testing.T) {
+	data := &dataset{
+		cidrs: mustParseCIDRs(t, "13.32.0.0/15", "13.32.0.0/16", "13.35.0.0/16", "13.34.0.0/16", "13.32.0.0/15"),
+		sources: map[string]trustSource{
+			"13.32.0.0/15": sourceCloudFrontGlobal, "13.32.0.0/16": sourceCloudFrontGlobal,
+			"13.34.0.0/16": sourceCloudFrontRegional, "13.35.0.0/16": sourceCloudFrontRegional,
+		},
+	}
+	tests := []struct {
+		name       string
+		aggregate  bool
+		quarantine time.Duration
+		want       string
+	}{
+		{name: "default", want: "13.32.0.0/15 13.35.0.0/16 13.34.0.0/16"},
+		{name: "aggregate", aggregate: true, want: "13.32.0.0/15 13.34.0.0/15"},
+		{name: "quarantine", aggregate: true, quarantine: time.Hour, want: "13.32.0.0/15 13.32.0.0/16 13.35.0.0/16 13.34.0.0/16"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips := newIPStore(fixtureURL)
+			ips.aggregate = tt.aggregate
+			ips.quarantine = tt.quarantine
+			ips.apply(nil, data)
+			var got []string
+			for _, prefix := range ips.prefixes() {
+				got = append(got, prefix.String())
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("prefixes() = %v, want %s", got, tt.want)
+			}
+			if source, ok := ips.match(netip.MustParseAddr("13.35.1.1")); !ok || source != sourceCloudFrontRegional {
+				t.Errorf("Expected a regional match, got %s, %t", source, ok)
+			}
+			if ips.fetched.Load() != 5 {
+				t.Errorf("Expected the fetched count to be that of the source, got %d", ips.fetched.Load())
+			}
+		})
+	}
+}
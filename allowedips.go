@@ -0,0 +1,93 @@
+package cloudfrontgate
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// allowedSet is the parsed allowedIPs of an instance. It is immutable and
+// replaced as a whole by SetAllowedIPs, so requests read it without a lock.
+type allowedSet struct {
+	prefixes []net.IPNet
+	// labels has one entry per configured entry, for the snapshot.
+	labels    []string
+	carveOuts []net.IPNet
+	// hosts are the hostname entries, which the hostAllowlist resolves.
+	hosts []string
+}
+
+// noAllowedIPs is the set of instances built without applyConfig.
+var noAllowedIPs = &allowedSet{}
+
+// parseAllowedIPs parses the entries of allowedIPs followed by extra, the
+// groups added by allowPrivateNetworks and allowLoopback.
+func parseAllowedIPs(entries, extra []string, groups cidrGroups) (*allowedSet, error) {
+	entries, carveOutEntries := splitCarveOuts(entries)
+	static, hosts := splitHostnames(entries)
+	static = append(static, extra...)
+	prefixes, labels, err := groups.parse(static)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trusted IPs: %w", err)
+	}
+	for _, host := range hosts {
+		labels = append(labels, host+" (DNS)")
+	}
+	carveOuts, carveOutLabels, err := groups.parse(carveOutEntries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse allowedIPs carve-outs: %w", err)
+	}
+	for _, label := range carveOutLabels {
+		labels = append(labels, carveOutPrefix+label)
+	}
+	return &allowedSet{
+		prefixes:  uniquePrefixes(prefixes),
+		labels:    labels,
+		carveOuts: uniquePrefixes(carveOuts),
+		hosts:     hosts,
+	}, nil
+}
+
+// allowedSet returns the current allowedIPs.
+func (cf *CloudFrontGate) allowedSet() *allowedSet {
+	if set, ok := cf.allowedIPs.Load().(*allowedSet); ok {
+		return set
+	}
+	return noAllowedIPs
+}
+
+// SetAllowedIPs replaces the allowedIPs of the instance without rebuilding
+// it, for programs that embed the package: the requests checked from then
+// on use ips, written as the allowedIPs option, along with the groups,
+// allowPrivateNetworks and allowLoopback the instance was built with. The
+// CloudFront ranges are kept apart from them, so nothing is fetched.
+//
+// An invalid list is rejected as a whole with a *ConfigError, leaving the
+// current one in place. The hostname entries cannot change, as their
+// resolution is set up when the instance is built.
+func (cf *CloudFrontGate) SetAllowedIPs(ips []string) error {
+	set, err := parseAllowedIPs(ips, cf.allowedExtra, cf.groups)
+	if err != nil {
+		return invalidConfig("allowedIPs", err)
+	}
+	if !sameHosts(set.hosts, cf.allowedSet().hosts) {
+		return invalidConfig("allowedIPs", errors.New("the hostname entries of allowedIPs cannot change without building a new instance"))
+	}
+	cf.allowedIPs.Store(set)
+	cf.logger.infof("CloudFrontGate %s: allowedIPs replaced: %d prefixes, %d carve-outs", cf.name, len(set.prefixes), len(set.carveOuts))
+	return nil
+}
+
+// sameHosts reports whether a and b hold the same hostnames in any order.
+func sameHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, "\n") == strings.Join(b, "\n")
+}
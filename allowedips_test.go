@@ -0,0 +1,154 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newAllowedIPsGate builds an instance over a counting source.
+func newAllowedIPsGate(t *testing.T, allowedIPs ...string) (*CloudFrontGate, *atomic.Int32) {
+	t.Helper()
+	server, requests, _ := countingSource(t)
+	cfg := CreateConfig()
+	cfg.IPListURL = server.URL
+	cfg.AllowPrivateSources = true
+	cfg.AllowLoopback = true
+	cfg.AllowedIPs = allowedIPs
+	handler, err := New(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	t.Cleanup(func() { _ = cf.Close() })
+	return cf, requests
+}
+
+// serveFrom returns the status of a request from remoteAddr.
+func serveFrom(cf *CloudFrontGate, remoteAddr string) int {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = remoteAddr
+	rw := httptest.NewRecorder()
+	cf.ServeHTTP(rw, req)
+	return rw.Code
+}
+
+func TestSetAllowedIPs(t *testing.T) {
+	cf, requests := newAllowedIPsGate(t, "192.0.2.0/24")
+	fetched := requests.Load()
+	if code := serveFrom(cf, "198.51.100.1:1234"); code != http.StatusForbidden {
+		t.Fatalf("Expected 198.51.100.1 to be denied before the change, got %d", code)
+	}
+
+	if err := cf.SetAllowedIPs([]string{"198.51.100.0/24", "!198.51.100.128/25"}); err != nil {
+		t.Fatalf("SetAllowedIPs() error = %v", err)
+	}
+	check := func() {
+		t.Helper()
+		for remoteAddr, want := range map[string]int{
+			"198.51.100.1:1234":   http.StatusOK,
+			"198.51.100.200:1234": http.StatusForbidden,
+			"192.0.2.1:1234":      http.StatusForbidden,
+			// allowLoopback and the CloudFront ranges are kept.
+			"127.0.0.1:1234":      http.StatusOK,
+			"205.251.249.10:1234": http.StatusOK,
+		} {
+			if code := serveFrom(cf, remoteAddr); code != want {
+				t.Errorf("%s: status = %d, want %d", remoteAddr, code, want)
+			}
+		}
+	}
+	check()
+	if got := requests.Load(); got != fetched {
+		t.Errorf("Expected no fetch for the change, got %d", got-fetched)
+	}
+	if got := cf.status().AllowedIPs; !reflect.DeepEqual(got, []string{"::1/128", "127.0.0.0/8", "198.51.100.0/24"}) {
+		t.Errorf("Expected the new list in the status, got %q", got)
+	}
+
+	// Refreshes keep the list that was set.
+	if err := cf.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	check()
+
+	for _, ips := range [][]string{{"198.51.100.0/33"}, {"10.0.0.0/8", "!not-a-cidr"}, {"@unknown"}, {"office.example.net"}} {
+		err := cf.SetAllowedIPs(ips)
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) || configErr.Field != "allowedIPs" {
+			t.Errorf("SetAllowedIPs(%q): expected an allowedIPs error, got %v", ips, err)
+		}
+	}
+	check()
+}
+
+func TestSetAllowedIPsKeepsHostnames(t *testing.T) {
+	useResolver(t, &stubResolver{addrs: map[string][]string{"office.example.net": {"203.0.113.9"}}})
+	cf, _ := newAllowedIPsGate(t, "192.0.2.0/24", "office.example.net")
+
+	if err := cf.SetAllowedIPs([]string{"OFFICE.example.net.", "198.51.100.0/24"}); err != nil {
+		t.Fatalf("SetAllowedIPs() error = %v", err)
+	}
+	if code := serveFrom(cf, "203.0.113.9:1234"); code != http.StatusOK {
+		t.Errorf("Expected the host to stay allowed, got %d", code)
+	}
+	if code := serveFrom(cf, "192.0.2.1:1234"); code != http.StatusForbidden {
+		t.Errorf("Expected the removed prefix to be denied, got %d", code)
+	}
+	if err := cf.SetAllowedIPs([]string{"198.51.100.0/24"}); err == nil {
+		t.Error("Expected dropping a hostname entry to be rejected")
+	}
+}
+
+func TestSetAllowedIPsConcurrentRequests(t *testing.T) {
+	cf, _ := newAllowedIPsGate(t, "192.0.2.0/24")
+	lists := [][]string{{"192.0.2.0/24"}, {"198.51.100.0/24"}}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if code := serveFrom(cf, "205.251.249.10:1234"); code != http.StatusOK {
+					t.Errorf("Expected CloudFront to stay allowed, got %d", code)
+					return
+				}
+				a, b := serveFrom(cf, "192.0.2.1:1234"), serveFrom(cf, "198.51.100.1:1234")
+				if (a != http.StatusOK && a != http.StatusForbidden) || (b != http.StatusOK && b != http.StatusForbidden) {
+					t.Errorf("Unexpected statuses %d, %d", a, b)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			_ = cf.Refresh(context.Background())
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		if err := cf.SetAllowedIPs(lists[i%2]); err != nil {
+			t.Fatalf("SetAllowedIPs() error = %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if code := serveFrom(cf, "198.51.100.1:1234"); code != http.StatusOK {
+		t.Errorf("Expected the last list to apply, got %d", code)
+	}
+}
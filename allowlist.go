@@ -0,0 +1,161 @@
+package cloudfrontgate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the rendered ipAllowList middleware.
+const (
+	allowListYAML = "yaml"
+	allowListJSON = "json"
+)
+
+// defaultAllowListMiddleware names the rendered middleware by default.
+const defaultAllowListMiddleware = "cloudfrontgate"
+
+// allowListDoc is the Traefik dynamic configuration of an ipAllowList
+// middleware.
+type allowListDoc struct {
+	HTTP struct {
+		Middlewares map[string]allowListMiddleware `json:"middlewares"`
+	} `json:"http"`
+}
+
+type allowListMiddleware struct {
+	IPAllowList struct {
+		SourceRange []string `json:"sourceRange"`
+	} `json:"ipAllowList"`
+}
+
+// RenderIPAllowList renders the prefixes the instance currently trusts at
+// any time as a Traefik dynamic configuration file with an ipAllowList
+// middleware named middleware, in format "yaml" or "json". An empty name
+// selects "cloudfrontgate". The allowedIPs carve-outs are subtracted from
+// the allowedIPs prefixes. Quarantined prefixes, maintenance windows and
+// health checkers restricted to paths are left out. The denylist and the
+// checks beyond the peer address cannot be expressed in an ipAllowList.
+func (cf *CloudFrontGate) RenderIPAllowList(format, middleware string) ([]byte, error) {
+	var updated time.Time
+	if t, ok := cf.ips.updated.Load().(time.Time); ok {
+		updated = t
+	}
+	return renderIPAllowList(format, middleware, cf.effectivePrefixes(), cf.ips.version.Load(), updated)
+}
+
+// effectivePrefixes returns the sorted prefixes trusted regardless of the
+// request path and time.
+func (cf *CloudFrontGate) effectivePrefixes() []string {
+	stored := cf.ips.prefixes()
+	prefixes := append(subtractPrefixes(cf.allowedPrefixes(), cf.allowedSet().carveOuts), stored...)
+	if cf.healthChecks != nil && len(cf.healthPaths) == 0 {
+		health := cf.healthChecks.prefixes()
+		prefixes = append(prefixes, health...)
+	}
+
+	var quarantined map[string]bool
+	if cf.ips.quarantine > 0 {
+		quarantined = make(map[string]bool)
+		for _, q := range cf.ips.quarantineStatus(cf.ips.now()) {
+			quarantined[q.Prefix] = true
+		}
+	}
+
+	var out []string
+	for _, prefix := range sortedPrefixes(prefixes) {
+		if quarantined[prefix] || (len(out) > 0 && out[len(out)-1] == prefix) {
+			continue
+		}
+		out = append(out, prefix)
+	}
+	return out
+}
+
+// renderIPAllowList renders prefixes in the given order. The YAML form
+// starts with a comment naming the store version and update time; JSON
+// cannot carry comments, so the admin endpoint sends them as headers.
+func renderIPAllowList(format, middleware string, prefixes []string, version uint64, updated time.Time) ([]byte, error) {
+	if middleware == "" {
+		middleware = defaultAllowListMiddleware
+	}
+	if !validMiddlewareName(middleware) {
+		return nil, fmt.Errorf("invalid middleware name %q", middleware)
+	}
+	if prefixes == nil {
+		prefixes = []string{}
+	}
+
+	switch format {
+	case "", allowListYAML:
+		var b strings.Builder
+		fmt.Fprintf(&b, "# Generated by cloudfrontgate from store version %d, updated %s.\n", version, formatUpdated(updated))
+		b.WriteString("# Do not edit: regenerate it instead.\n")
+		b.WriteString("http:\n  middlewares:\n")
+		fmt.Fprintf(&b, "    %s:\n      ipAllowList:\n        sourceRange:", middleware)
+		if len(prefixes) == 0 {
+			b.WriteString(" []")
+		}
+		b.WriteString("\n")
+		for _, prefix := range prefixes {
+			fmt.Fprintf(&b, "          - %q\n", prefix)
+		}
+		return []byte(b.String()), nil
+	case allowListJSON:
+		var doc allowListDoc
+		var mw allowListMiddleware
+		mw.IPAllowList.SourceRange = prefixes
+		doc.HTTP.Middlewares = map[string]allowListMiddleware{middleware: mw}
+		body, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode ipAllowList: %w", err)
+		}
+		return append(body, '\n'), nil
+	default:
+		return nil, fmt.Errorf("invalid format %q: must be %q or %q", format, allowListYAML, allowListJSON)
+	}
+}
+
+// formatUpdated formats the store update time, "never" for the zero time.
+func formatUpdated(updated time.Time) string {
+	if updated.IsZero() {
+		return "never"
+	}
+	return updated.UTC().Format(time.RFC3339)
+}
+
+// validMiddlewareName reports whether name is safe to render unquoted.
+func validMiddlewareName(name string) bool {
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// serveIPAllowList writes the ipAllowList middleware in the format and
+// with the name given by the "format" and "middleware" query parameters.
+func (cf *CloudFrontGate) serveIPAllowList(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	format := query.Get("format")
+	body, err := cf.RenderIPAllowList(format, query.Get("middleware"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set(headerStoreVersion, strconv.FormatUint(cf.ips.version.Load(), 10))
+	if updated, ok := cf.ips.updated.Load().(time.Time); ok {
+		rw.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	}
+	if format == allowListJSON {
+		rw.Header().Set("Content-Type", "application/json")
+	} else {
+		rw.Header().Set("Content-Type", "application/yaml")
+	}
+	_, _ = rw.Write(body)
+}
@@ -0,0 +1,88 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderIPAllowListGolden(t *testing.T) {
+	prefixes := []string{"13.32.0.0/15", "120.52.22.96/27", "2600:9000::/28"}
+	updated := time.Date(2024, 1, 3, 12, 0, 0, 0, time.FixedZone("", 3600))
+
+	for _, format := range []string{allowListYAML, allowListJSON} {
+		t.Run(format, func(t *testing.T) {
+			got, err := renderIPAllowList(format, "cloudfront-only", prefixes, 7, updated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, _ := renderIPAllowList(format, "cloudfront-only", prefixes, 7, updated)
+			if string(got) != string(again) {
+				t.Error("Expected rendering to be deterministic")
+			}
+			want, err := os.ReadFile(filepath.Join("testdata", "ipallowlist."+format+".golden"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("ipAllowList =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestRenderIPAllowListErrors(t *testing.T) {
+	if _, err := renderIPAllowList("toml", "", nil, 0, time.Time{}); err == nil {
+		t.Error("Expected an unknown format to be rejected")
+	}
+	if _, err := renderIPAllowList(allowListYAML, "a: b", nil, 0, time.Time{}); err == nil {
+		t.Error("Expected a middleware name needing quotes to be rejected")
+	}
+	got, err := renderIPAllowList(allowListYAML, "", nil, 0, time.Time{})
+	if err != nil || !strings.Contains(string(got), "cloudfrontgate:") || !strings.Contains(string(got), "sourceRange: []") || !strings.Contains(string(got), "updated never") {
+		t.Errorf("Expected an empty default list, got %q (%v)", got, err)
+	}
+}
+
+func TestServeIPAllowList(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.AdminPath = "/_cfgate"
+	cfg.AdminToken = "s3cret"
+	cfg.AllowedIPs = []string{"10.0.0.0/8", "120.52.22.96/27"}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/_cfgate/ip-allowlist?format=json", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rw := httptest.NewRecorder()
+	cf.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if rw.Header().Get(headerStoreVersion) == "" || rw.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected headers %v", rw.Header())
+	}
+
+	var doc allowListDoc
+	if err := json.Unmarshal(rw.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	got := doc.HTTP.Middlewares[defaultAllowListMiddleware].IPAllowList.SourceRange
+	// The trusted IPs are included, and their overlap with the fetched
+	// ranges is listed once.
+	want := 8 + 1
+	if len(got) != want || got[0] != "10.0.0.0/8" {
+		t.Errorf("Expected %d sorted prefixes starting with 10.0.0.0/8, got %v", want, got)
+	}
+}
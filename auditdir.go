@@ -0,0 +1,267 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Audit directory defaults.
+const (
+	auditPollInterval     = time.Second
+	defaultAuditRetention = 90 * 24 * time.Hour
+	defaultAuditMaxFiles  = 1000
+)
+
+// auditTimeFormat names the audit files; it sorts chronologically.
+const auditTimeFormat = "20060102T150405.000Z"
+
+// auditSeparator follows the instance name in file names. metricName never
+// produces it, so no instance's files match the prefix of another.
+const auditSeparator = "."
+
+// auditKey changes whenever the trusted prefixes may have: the store
+// versions, the active maintenance windows and the quarantined count.
+type auditKey struct {
+	version       uint64
+	healthVersion uint64
+	windows       string
+	quarantined   int
+	// allowed is the allowedIPs set, which SetAllowedIPs replaces.
+	allowed *allowedSet
+}
+
+// auditContent is the part of the snapshot compared between checks.
+type auditContent struct {
+	Sources     []sourcePrefixes `json:"sources"`
+	Quarantined []string         `json:"quarantined"`
+}
+
+// auditLog writes a snapshot file to a directory whenever the effective
+// allowlist of an instance changes.
+type auditLog struct {
+	cf        *CloudFrontGate
+	dir       string
+	prefix    string
+	retention time.Duration
+	maxFiles  int
+
+	// last is the prefix content of the last file written and lastKey the
+	// change key it was checked at, both owned by the writer goroutine.
+	last    []byte
+	lastKey auditKey
+	checked bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newAuditLog validates the audit settings. It returns nil when no
+// directory is configured.
+func newAuditLog(cf *CloudFrontGate, config *Config) (*auditLog, error) {
+	if config.AuditDir == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(config.AuditDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("auditDir %s is not a directory", config.AuditDir)
+	}
+
+	a := &auditLog{
+		cf:        cf,
+		dir:       config.AuditDir,
+		prefix:    metricName(cf.name) + auditSeparator,
+		retention: defaultAuditRetention,
+		maxFiles:  defaultAuditMaxFiles,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if config.AuditRetention != "" {
+		a.retention, err = time.ParseDuration(config.AuditRetention)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse audit retention: %w", err)
+		}
+		if a.retention <= 0 {
+			return nil, errors.New("auditRetention must be positive")
+		}
+	}
+	if config.AuditMaxFiles < 0 {
+		return nil, fmt.Errorf("invalid auditMaxFiles %d: must not be negative", config.AuditMaxFiles)
+	}
+	if config.AuditMaxFiles > 0 {
+		a.maxFiles = config.AuditMaxFiles
+	}
+	return a, nil
+}
+
+// start writes the current state and then polls the change key.
+func (a *auditLog) start() {
+	go func() {
+		defer close(a.done)
+
+		a.check()
+		ticker := time.NewTicker(auditPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+				a.check()
+			}
+		}
+	}()
+}
+
+// close stops polling.
+func (a *auditLog) close() {
+	close(a.stop)
+	<-a.done
+}
+
+// changeKey returns the current change key, which is cheap to compute.
+func (a *auditLog) changeKey() auditKey {
+	cf := a.cf
+	key := auditKey{version: cf.ips.version.Load(), allowed: cf.allowedSet()}
+	if cf.healthChecks != nil {
+		key.healthVersion = cf.healthChecks.version.Load()
+	}
+	if cf.ips.quarantine > 0 {
+		key.quarantined = len(cf.ips.quarantineStatus(cf.ips.now()))
+	}
+	now := cf.now()
+	windows := make([]byte, 0, len(cf.windows))
+	for _, mw := range cf.windows {
+		if cf.isActive(mw, now) {
+			windows = append(windows, '1')
+		} else {
+			windows = append(windows, '0')
+		}
+	}
+	key.windows = string(windows)
+	return key
+}
+
+// check writes a file when the trusted prefixes differ from the last file
+// written. The snapshot is only built when the change key moved, and a
+// refresh that fetches the same prefixes writes nothing. Failures are
+// logged and retried on the next check; they never affect enforcement.
+func (a *auditLog) check() {
+	key := a.changeKey()
+	if a.checked && key == a.lastKey {
+		return
+	}
+
+	snap := a.cf.snapshot()
+	content, err := json.Marshal(auditContent{Sources: snap.Sources, Quarantined: snap.Quarantined})
+	if err != nil {
+		a.cf.logger.errorf("CloudFrontGate %s: failed to encode audit snapshot: %v", a.cf.name, err)
+		return
+	}
+	if a.checked && bytes.Equal(content, a.last) {
+		a.lastKey = key
+		return
+	}
+
+	body, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		a.cf.logger.errorf("CloudFrontGate %s: failed to encode audit snapshot: %v", a.cf.name, err)
+		return
+	}
+	if err := a.write(append(body, '\n'), a.cf.now()); err != nil {
+		a.cf.logger.errorf("CloudFrontGate %s: failed to write audit file: %v", a.cf.name, err)
+		return
+	}
+	a.last, a.lastKey, a.checked = content, key, true
+	a.prune(a.cf.now())
+}
+
+// write stores body atomically as a timestamped file and points the latest
+// symlink at it.
+func (a *auditLog) write(body []byte, now time.Time) error {
+	name := a.prefix + now.UTC().Format(auditTimeFormat) + ".json"
+	if err := writeFileAtomic(filepath.Join(a.dir, name), body); err != nil {
+		return err
+	}
+
+	link := filepath.Join(a.dir, a.prefix+"latest.json")
+	tmp := link + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(name, tmp); err != nil {
+		return fmt.Errorf("failed to link latest audit file: %w", err)
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to link latest audit file: %w", err)
+	}
+	return nil
+}
+
+// prune removes files older than the retention and beyond the maximum
+// count, always keeping the newest.
+func (a *auditLog) prune(now time.Time) {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		a.cf.logger.errorf("CloudFrontGate %s: failed to prune audit files: %v", a.cf.name, err)
+		return
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, a.prefix) && strings.HasSuffix(name, ".json") {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+
+	for i, name := range files {
+		if i == len(files)-1 {
+			break
+		}
+		written, err := time.Parse(auditTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, a.prefix), ".json"))
+		if err != nil {
+			continue
+		}
+		if len(files)-i > a.maxFiles || now.Sub(written) > a.retention {
+			if err := os.Remove(filepath.Join(a.dir, name)); err != nil {
+				a.cf.logger.errorf("CloudFrontGate %s: failed to prune audit file %s: %v", a.cf.name, name, err)
+			}
+		}
+	}
+}
+
+// writeFileAtomic writes body to a temporary file in the same directory and
+// renames it over path.
+func writeFileAtomic(path string, body []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(body); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+	return nil
+}
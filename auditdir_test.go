@@ -0,0 +1,149 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestAuditLogWritesChanges(t *testing.T) {
+	dir := t.TempDir()
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	handler, err := NewWithOptions(context.Background(), next, CreateConfig(), t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cf.now = func() time.Time { return now }
+
+	cfg := CreateConfig()
+	cfg.AuditDir = dir
+	a, err := newAuditLog(cf, cfg)
+	if err != nil {
+		t.Fatalf("newAuditLog() error = %v", err)
+	}
+
+	a.check()
+	now = now.Add(time.Minute)
+	a.check() // unchanged, nothing written
+
+	// A refresh that fetches the same prefixes writes nothing either.
+	if err := cf.ips.Update(context.Background()); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	now = now.Add(time.Minute)
+	a.check()
+
+	// A change of the fetched prefixes writes a new file.
+	changed, _ := parsePrefixes([]string{"192.0.2.0/24"})
+	cf.ips.apply(nil, &dataset{cidrs: changed})
+	t.Cleanup(func() { _ = cf.ips.Update(context.Background()) })
+	a.check()
+
+	files := auditFiles(t, dir, a.prefix)
+	want := []string{
+		a.prefix + "20240501T120000.000Z.json",
+		a.prefix + "20240501T120200.000Z.json",
+	}
+	if len(files) != 2 || files[0] != want[0] || files[1] != want[1] {
+		t.Fatalf("Audit files = %v, want %v", files, want)
+	}
+
+	target, err := os.Readlink(filepath.Join(dir, a.prefix+"latest.json"))
+	if err != nil || target != want[1] {
+		t.Errorf("Expected latest to link %s, got %q (%v)", want[1], target, err)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(dir, want[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		t.Fatalf("Expected the snapshot schema, got %v", err)
+	}
+	if len(snap.Sources[0].Prefixes) != 1 || snap.Sources[0].Prefixes[0] != "192.0.2.0/24" {
+		t.Errorf("Expected the audit file to hold the new prefixes, got %+v", snap.Sources[0])
+	}
+}
+
+func TestAuditLogPrune(t *testing.T) {
+	dir := t.TempDir()
+	a := &auditLog{cf: &CloudFrontGate{name: "test"}, dir: dir, prefix: "test" + auditSeparator, retention: 24 * time.Hour, maxFiles: 3}
+
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	for _, at := range []time.Time{
+		now.Add(-72 * time.Hour), // too old
+		now.Add(-4 * time.Hour),  // beyond the count
+		now.Add(-3 * time.Hour),
+		now.Add(-2 * time.Hour),
+		now.Add(-time.Hour),
+	} {
+		if err := a.write([]byte("{}\n"), at); err != nil {
+			t.Fatalf("write() error = %v", err)
+		}
+	}
+	// Files of other instances, including one whose name extends this one,
+	// are not counted or removed.
+	others := []string{"other.20240101T000000.000Z.json", "test-2.20240510T113000.000Z.json", "test-2.20240101T000000.000Z.json"}
+	for _, name := range others {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a.prune(now)
+	files := auditFiles(t, dir, a.prefix)
+	want := []string{"test.20240510T090000.000Z.json", "test.20240510T100000.000Z.json", "test.20240510T110000.000Z.json"}
+	if len(files) != 3 || files[0] != want[0] || files[2] != want[2] {
+		t.Errorf("Audit files after pruning = %v, want %v", files, want)
+	}
+	for _, name := range others {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s of another instance to be kept", name)
+		}
+	}
+}
+
+func TestNewAuditLogValidation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []Config{
+		{AuditDir: file},
+		{AuditDir: file + ".missing"},
+		{AuditDir: t.TempDir(), AuditRetention: "forever"},
+		{AuditDir: t.TempDir(), AuditMaxFiles: -1},
+	} {
+		if _, err := newAuditLog(&CloudFrontGate{name: "test"}, &config); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
+
+// auditFiles returns the sorted audit files with prefix, without the link.
+func auditFiles(t *testing.T, dir, prefix string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && len(entry.Name()) > len(prefix) && entry.Name()[:len(prefix)] == prefix {
+			files = append(files, entry.Name())
+		}
+	}
+	sort.Strings(files)
+	return files
+}
@@ -0,0 +1,153 @@
+package cloudfrontgate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// awsIPRangesURL is the AWS ip-ranges.json document.
+const awsIPRangesURL = "https://ip-ranges.amazonaws.com/ip-ranges.json"
+
+// ip-ranges.json services and the region of the global prefixes.
+const (
+	serviceRoute53HealthChecks = "ROUTE53_HEALTHCHECKS"
+	serviceCloudFront          = "CLOUDFRONT"
+	regionGlobal               = "GLOBAL"
+)
+
+// Values of the ipSource option.
+const (
+	ipSourceCloudFrontTools = "cloudfront-tools"
+	ipSourceAWSIPRanges     = "aws-ip-ranges"
+	ipSourceAuto            = "auto"
+)
+
+// awsIPRanges is the AWS ip-ranges.json document.
+type awsIPRanges struct {
+	SyncToken string `json:"syncToken"`
+	Prefixes  []struct {
+		IPPrefix string `json:"ip_prefix"`
+		Region   string `json:"region"`
+		Service  string `json:"service"`
+	} `json:"prefixes"`
+	IPv6Prefixes []struct {
+		IPv6Prefix string `json:"ipv6_prefix"`
+		Region     string `json:"region"`
+		Service    string `json:"service"`
+	} `json:"ipv6_prefixes"`
+}
+
+// parseIPSource selects the CloudFront source document of src from the
+// ipSource and ipRegions options, and the default URL for it.
+func parseIPSource(config *Config, src *sourceConfig) error {
+	switch config.IPSource {
+	case "", ipSourceCloudFrontTools:
+		src.URL = ipListURL
+		if len(config.IPRegions) > 0 {
+			return invalidConfig("ipRegions", fmt.Errorf("ipRegions requires ipSource %q or %q", ipSourceAWSIPRanges, ipSourceAuto))
+		}
+	case ipSourceAWSIPRanges:
+		src.URL = awsIPRangesURL
+		src.Service = serviceCloudFront
+	case ipSourceAuto:
+		src.URL = ipListURL
+		src.DetectFormat = true
+	default:
+		return invalidConfig("ipSource", fmt.Errorf("invalid ipSource %q: must be %q, %q or %q",
+			config.IPSource, ipSourceCloudFrontTools, ipSourceAWSIPRanges, ipSourceAuto))
+	}
+	for _, region := range config.IPRegions {
+		if region == "" || strings.ContainsAny(region, " \t") {
+			return invalidConfig("ipRegions", fmt.Errorf("invalid ipRegions entry %q", region))
+		}
+	}
+	src.Regions = config.IPRegions
+	lists, err := parseIPLists(config.IPLists)
+	if err != nil {
+		return invalidConfig("ipLists", err)
+	}
+	src.IPLists = lists
+	return nil
+}
+
+// isAWSIPRanges reports whether body has the keys of an ip-ranges.json
+// document rather than those of the CloudFront tools endpoint.
+func isAWSIPRanges(body []byte) bool {
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(body, &keys) != nil {
+		return false
+	}
+	_, v4 := keys["prefixes"]
+	_, v6 := keys["ipv6_prefixes"]
+	return v4 || v6
+}
+
+// parseAWSIPRanges returns the prefixes of service from an ip-ranges.json
+// document, restricted to regions and the CloudFront lists when any are
+// given.
+func parseAWSIPRanges(body []byte, service string, regions, lists []string) (*dataset, error) {
+	var ranges awsIPRanges
+	if err := json.Unmarshal(body, &ranges); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal ip-ranges response: %w", err)
+	}
+
+	var entries, entryRegions []string
+	for _, prefix := range ranges.Prefixes {
+		if prefix.Service == service && inRegions(regions, prefix.Region) && listSelected(lists, awsServiceSource(service, prefix.Region)) {
+			entries = append(entries, prefix.IPPrefix)
+			entryRegions = append(entryRegions, prefix.Region)
+		}
+	}
+	for _, prefix := range ranges.IPv6Prefixes {
+		if prefix.Service == service && inRegions(regions, prefix.Region) && listSelected(lists, awsServiceSource(service, prefix.Region)) {
+			entries = append(entries, prefix.IPv6Prefix)
+			entryRegions = append(entryRegions, prefix.Region)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no prefixes for service " + service + " in ip-ranges response")
+	}
+
+	cidrs, err := parsePrefixes(entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s CIDRs: %w", service, err)
+	}
+
+	// One sample per source label, as for the CloudFront tools lists.
+	var samples []net.IP
+	sampled := make(map[trustSource]bool)
+	sources := make(map[string]trustSource, len(cidrs))
+	for i, cidr := range cidrs {
+		source := awsServiceSource(service, entryRegions[i])
+		sources[cidr.String()] = source
+		if !sampled[source] {
+			sampled[source] = true
+			samples = append(samples, netIP(cidr.Addr()))
+		}
+	}
+	return &dataset{cidrs: cidrs, samples: samples, sources: sources}, nil
+}
+
+// inRegions reports whether region is selected; no regions select all.
+func inRegions(regions []string, region string) bool {
+	return len(regions) == 0 || containsFold(regions, region)
+}
+
+// awsServiceSource returns the source label of a prefix of an ip-ranges.json
+// service in region.
+func awsServiceSource(service, region string) trustSource {
+	switch service {
+	case serviceRoute53HealthChecks:
+		return sourceRoute53HealthChecks
+	case serviceCloudFront:
+		if region == regionGlobal {
+			return sourceCloudFrontGlobal
+		}
+		return sourceCloudFrontRegional
+	default:
+		return sourceCustom
+	}
+}
@@ -0,0 +1,252 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testAWSIPRanges = `{
+	"syncToken": "1700000000",
+	"createDate": "2023-11-14-22-13-20",
+	"prefixes": [
+		{"ip_prefix": "15.177.0.0/18", "region": "GLOBAL", "service": "ROUTE53_HEALTHCHECKS", "network_border_group": "GLOBAL"},
+		{"ip_prefix": "54.183.255.128/26", "region": "us-west-1", "service": "ROUTE53_HEALTHCHECKS", "network_border_group": "us-west-1"},
+		{"ip_prefix": "3.5.140.0/22", "region": "ap-northeast-2", "service": "AMAZON", "network_border_group": "ap-northeast-2"},
+		{"ip_prefix": "205.251.249.0/24", "region": "GLOBAL", "service": "CLOUDFRONT", "network_border_group": "GLOBAL"}
+	],
+	"ipv6_prefixes": [
+		{"ipv6_prefix": "2a05:d018:fff:f800::/56", "region": "eu-west-1", "service": "ROUTE53_HEALTHCHECKS", "network_border_group": "eu-west-1"},
+		{"ipv6_prefix": "2600:9000::/28", "region": "GLOBAL", "service": "CLOUDFRONT", "network_border_group": "GLOBAL"}
+	]
+}`
+
+func TestParseAWSIPRanges(t *testing.T) {
+	data, err := parseAWSIPRanges([]byte(testAWSIPRanges), serviceRoute53HealthChecks, nil, nil)
+	if err != nil {
+		t.Fatalf("parseAWSIPRanges() error = %v", err)
+	}
+
+	want := []string{"15.177.0.0/18", "54.183.255.128/26", "2a05:d018:fff:f800::/56"}
+	if len(data.cidrs) != len(want) {
+		t.Fatalf("Expected %d prefixes, got %v", len(want), data.cidrs)
+	}
+	for i, cidr := range want {
+		if data.cidrs[i].String() != cidr {
+			t.Errorf("prefix %d = %s, want %s", i, data.cidrs[i].String(), cidr)
+		}
+		if data.sources[cidr] != sourceRoute53HealthChecks {
+			t.Errorf("Expected %s to be labeled %s", cidr, sourceRoute53HealthChecks)
+		}
+	}
+
+	if _, err := parseAWSIPRanges([]byte(testAWSIPRanges), "NOPE", nil, nil); err == nil {
+		t.Errorf("Expected an error for a service without prefixes")
+	}
+	if _, err := parseAWSIPRanges([]byte("{"), serviceRoute53HealthChecks, nil, nil); err == nil {
+		t.Errorf("Expected an error for an invalid document")
+	}
+}
+
+func TestServeHTTPRoute53HealthChecks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testAWSIPRanges))
+	}))
+	defer server.Close()
+
+	client := WithHTTPClient(fixtureClient(map[string]string{ipListURL: fixtureURL, awsIPRangesURL: server.URL}))
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	cfg := CreateConfig()
+	cfg.AllowRoute53HealthChecks = true
+	cfg.Route53HealthCheckPaths = []string{"/healthz"}
+	cfg.SourceHeader = true
+
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), client)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+
+	if sharedRegistry.size() != 2 {
+		t.Errorf("Expected a separate shared entry for the health check ranges, got %d entries", sharedRegistry.size())
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		want       int
+	}{
+		{name: "health checker on health path", path: "/healthz", remoteAddr: "15.177.1.1:1234", want: http.StatusOK},
+		{name: "health checker elsewhere", path: "/admin", remoteAddr: "15.177.1.1:1234", want: http.StatusForbidden},
+		{name: "other AWS service", path: "/healthz", remoteAddr: "3.5.140.1:1234", want: http.StatusForbidden},
+		{name: "CloudFront unaffected by the path scope", path: "/admin", remoteAddr: "205.251.249.10:1234", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			recorder := httptest.NewRecorder()
+			cf.ServeHTTP(recorder, req)
+			if recorder.Code != tt.want {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.want)
+			}
+		})
+	}
+
+	status := cf.status()
+	if got := status.AllowedBy[sourceRoute53HealthChecks.String()]; got != 1 {
+		t.Errorf("Expected 1 request admitted as %s, got %d", sourceRoute53HealthChecks, got)
+	}
+	if got := status.DeniedBy[denyHealthCheckPath.String()]; got != 1 {
+		t.Errorf("Expected 1 %s denial, got %d", denyHealthCheckPath, got)
+	}
+}
+
+const testAWSCloudFrontRanges = `{
+	"syncToken": "1700000001",
+	"createDate": "2023-11-14-22-13-21",
+	"prefixes": [
+		{"ip_prefix": "13.32.0.0/15", "region": "GLOBAL", "service": "CLOUDFRONT", "network_border_group": "GLOBAL"},
+		{"ip_prefix": "54.192.0.0/16", "region": "GLOBAL", "service": "CLOUDFRONT", "network_border_group": "GLOBAL"},
+		{"ip_prefix": "205.251.249.0/24", "region": "GLOBAL", "service": "CLOUDFRONT", "network_border_group": "GLOBAL"},
+		{"ip_prefix": "3.172.0.0/18", "region": "us-east-1", "service": "CLOUDFRONT", "network_border_group": "us-east-1"},
+		{"ip_prefix": "3.5.140.0/22", "region": "ap-northeast-2", "service": "AMAZON", "network_border_group": "ap-northeast-2"}
+	],
+	"ipv6_prefixes": [
+		{"ipv6_prefix": "2600:9000::/28", "region": "GLOBAL", "service": "CLOUDFRONT", "network_border_group": "GLOBAL"}
+	]
+}`
+
+func TestParseAWSIPRangesCloudFront(t *testing.T) {
+	data, err := parseAWSIPRanges([]byte(testAWSCloudFrontRanges), serviceCloudFront, nil, nil)
+	if err != nil {
+		t.Fatalf("parseAWSIPRanges() error = %v", err)
+	}
+	want := map[string]trustSource{
+		"13.32.0.0/15":     sourceCloudFrontGlobal,
+		"54.192.0.0/16":    sourceCloudFrontGlobal,
+		"205.251.249.0/24": sourceCloudFrontGlobal,
+		"3.172.0.0/18":     sourceCloudFrontRegional,
+		"2600:9000::/28":   sourceCloudFrontGlobal,
+	}
+	if len(data.cidrs) != len(want) {
+		t.Fatalf("Expected %d prefixes, got %v", len(want), data.cidrs)
+	}
+	for cidr, source := range want {
+		if data.sources[cidr] != source {
+			t.Errorf("Expected %s to be labeled %s, got %s", cidr, source, data.sources[cidr])
+		}
+	}
+	if len(data.samples) != 2 {
+		t.Errorf("Expected a sample per source label, got %v", data.samples)
+	}
+
+	regional, err := parseAWSIPRanges([]byte(testAWSCloudFrontRanges), serviceCloudFront, []string{"US-EAST-1"}, nil)
+	if err != nil {
+		t.Fatalf("parseAWSIPRanges() error = %v", err)
+	}
+	if len(regional.cidrs) != 1 || regional.cidrs[0].String() != "3.172.0.0/18" {
+		t.Errorf("Expected only the us-east-1 prefix, got %v", regional.cidrs)
+	}
+	if _, err := parseAWSIPRanges([]byte(testAWSCloudFrontRanges), serviceCloudFront, []string{"eu-west-3"}, nil); err == nil {
+		t.Error("Expected an error for a region without prefixes")
+	}
+}
+
+func TestIsAWSIPRanges(t *testing.T) {
+	if !isAWSIPRanges([]byte(testAWSCloudFrontRanges)) {
+		t.Error("Expected ip-ranges.json to be detected")
+	}
+	if isAWSIPRanges([]byte(testCFResponse)) || isAWSIPRanges([]byte("[")) {
+		t.Error("Expected other documents not to be detected")
+	}
+}
+
+func TestNewIPSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testAWSCloudFrontRanges))
+	}))
+	defer server.Close()
+
+	client := WithHTTPClient(fixtureClient(map[string]string{ipListURL: fixtureURL, awsIPRangesURL: server.URL}))
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) { rw.WriteHeader(http.StatusOK) })
+	tests := []struct {
+		name    string
+		mutate  func(*Config)
+		allowed []string
+		denied  []string
+	}{
+		{
+			name:    "aws-ip-ranges",
+			mutate:  func(cfg *Config) { cfg.IPSource = ipSourceAWSIPRanges },
+			allowed: []string{"205.251.249.10", "3.172.0.1", "192.168.1.1"},
+			denied:  []string{"3.5.140.1", "120.52.22.100"},
+		},
+		{
+			name: "aws-ip-ranges in a region",
+			mutate: func(cfg *Config) {
+				cfg.IPSource = ipSourceAWSIPRanges
+				cfg.IPRegions = []string{"us-east-1"}
+				cfg.SkipAnchorCheck = true
+			},
+			allowed: []string{"3.172.0.1", "192.168.1.1"},
+			denied:  []string{"205.251.249.10"},
+		},
+		{
+			name: "auto-detected ip-ranges.json",
+			mutate: func(cfg *Config) {
+				cfg.IPSource = ipSourceAuto
+				cfg.IPListURL = server.URL + "/mirror"
+				cfg.AllowPrivateSources = true
+			},
+			allowed: []string{"205.251.249.10", "3.172.0.1", "192.168.1.1"},
+			denied:  []string{"3.5.140.1"},
+		},
+		{
+			name:    "auto-detected tools document",
+			mutate:  func(cfg *Config) { cfg.IPSource = ipSourceAuto },
+			allowed: []string{"120.52.22.100", "192.168.1.1"},
+			denied:  []string{"3.172.0.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.AllowedIPs = []string{"192.168.1.0/24"}
+			tt.mutate(cfg)
+			handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), client)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+
+			for _, ip := range tt.allowed {
+				if !cf.allowed(net.ParseIP(ip)) {
+					t.Errorf("Expected %s to be allowed", ip)
+				}
+			}
+			for _, ip := range tt.denied {
+				if cf.allowed(net.ParseIP(ip)) {
+					t.Errorf("Expected %s to be denied", ip)
+				}
+			}
+		})
+	}
+
+	for _, cfg := range []*Config{{IPSource: "tools"}, {IPRegions: []string{"GLOBAL"}}, {IPSource: ipSourceAWSIPRanges, IPRegions: []string{""}}} {
+		if _, err := NewWithOptions(context.Background(), next, cfg, t.Name()+"invalid", client); err == nil {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package cloudfrontgate
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the blocked traffic summary.
+const (
+	defaultBlockSummaryInterval = 5 * time.Minute
+	// blockSummaryTop is the number of addresses logged per summary.
+	blockSummaryTop = 10
+	// maxBlockSummaryAddresses bounds the tracked addresses; denials from
+	// further addresses are only counted, so that a flood of spoofed
+	// sources cannot grow the summary.
+	maxBlockSummaryAddresses = 10000
+)
+
+// blockSummaryShards splits the summary so that concurrent denials rarely
+// contend on the same lock.
+const blockSummaryShards = decisionCacheShards
+
+// blockSummary aggregates the enforced denials per client address between
+// two summaries. It lives in the gateState, so a reload keeps the period
+// under way.
+type blockSummary struct {
+	shards [blockSummaryShards]blockShard
+	// other counts the denials of untracked or unparsable addresses.
+	other atomic.Uint64
+	// since is the UnixNano of the start of the period.
+	since atomic.Int64
+}
+
+// blockShard holds the tracked addresses of one shard.
+type blockShard struct {
+	mu      sync.Mutex
+	entries map[netip.Addr]blockedEntry
+}
+
+// blockedEntry is the tally of an address.
+type blockedEntry struct {
+	count       uint64
+	first, last int64
+}
+
+// blockedAddress is an address of the summary.
+type blockedAddress struct {
+	IP        string    `json:"ip"`
+	Count     uint64    `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// blockSummaryStatus is the summary of the period under way, or of the one
+// just closed.
+type blockSummaryStatus struct {
+	Since time.Time `json:"since"`
+	// Requests counts every denial of the period, Addresses the tracked
+	// addresses and Other the denials beyond them.
+	Requests  uint64           `json:"requests"`
+	Addresses int              `json:"addresses"`
+	Other     uint64           `json:"other"`
+	Top       []blockedAddress `json:"top"`
+}
+
+// parseBlockSummaryInterval parses blockSummaryInterval; zero disables the
+// summary.
+func parseBlockSummaryInterval(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultBlockSummaryInterval, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse block summary interval: %w", err)
+	}
+	if interval < 0 {
+		return 0, errors.New("blockSummaryInterval must not be negative")
+	}
+	return interval, nil
+}
+
+// record counts a denial of addr at now.
+func (b *blockSummary) record(addr netip.Addr, now time.Time) {
+	if !addr.IsValid() {
+		b.other.Add(1)
+		return
+	}
+	addr = addr.Unmap()
+	shard := &b.shards[decisionShardOf(addr)]
+	at := now.UnixNano()
+
+	shard.mu.Lock()
+	entry, ok := shard.entries[addr]
+	if !ok {
+		if len(shard.entries) >= maxBlockSummaryAddresses/blockSummaryShards {
+			shard.mu.Unlock()
+			b.other.Add(1)
+			return
+		}
+		if shard.entries == nil {
+			shard.entries = make(map[netip.Addr]blockedEntry)
+		}
+		entry.first = at
+	}
+	entry.count++
+	entry.last = at
+	shard.entries[addr] = entry
+	shard.mu.Unlock()
+}
+
+// summarize returns the summary of the period and, with reset, empties it.
+// The caller sets Since.
+func (b *blockSummary) summarize(reset bool) blockSummaryStatus {
+	status := blockSummaryStatus{Top: []blockedAddress{}}
+	if reset {
+		status.Other = b.other.Swap(0)
+	} else {
+		status.Other = b.other.Load()
+	}
+	status.Requests = status.Other
+
+	var top []blockedAddress
+	for i := range b.shards {
+		shard := &b.shards[i]
+		shard.mu.Lock()
+		entries := shard.entries
+		if reset {
+			shard.entries = nil
+		}
+		for addr, entry := range entries {
+			status.Requests += entry.count
+			status.Addresses++
+			top = append(top, blockedAddress{
+				IP:        addr.String(),
+				Count:     entry.count,
+				FirstSeen: time.Unix(0, entry.first).UTC(),
+				LastSeen:  time.Unix(0, entry.last).UTC(),
+			})
+		}
+		shard.mu.Unlock()
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].IP < top[j].IP
+	})
+	if len(top) > blockSummaryTop {
+		top = top[:blockSummaryTop]
+	}
+	status.Top = append(status.Top, top...)
+	return status
+}
+
+// recordBlocked counts a denial of addr for the summary and, at the first
+// denial once blockSummaryInterval has elapsed, logs the period and starts
+// a new one. A period without denials is never logged.
+func (cf *CloudFrontGate) recordBlocked(addr netip.Addr) {
+	b := &cf.state.blocked
+	now := cf.now()
+	since := b.since.Load()
+	if since == 0 {
+		b.since.CompareAndSwap(0, now.UnixNano())
+	} else if now.UnixNano()-since >= int64(cf.blockSummaryInterval) && b.since.CompareAndSwap(since, now.UnixNano()) {
+		cf.logBlockSummary(since)
+	}
+	b.record(addr, now)
+}
+
+// blockedStatus returns the summary of the period under way.
+func (cf *CloudFrontGate) blockedStatus() *blockSummaryStatus {
+	status := cf.state.blocked.summarize(false)
+	if since := cf.state.blocked.since.Load(); since != 0 {
+		status.Since = time.Unix(0, since).UTC()
+	}
+	return &status
+}
+
+// logBlockSummary logs the top blocked addresses of the period that began
+// at since, as UnixNano, and empties it.
+func (cf *CloudFrontGate) logBlockSummary(since int64) {
+	s := cf.state.blocked.summarize(true)
+	if s.Requests == 0 {
+		return
+	}
+	cf.logger.infof("CloudFrontGate %s: blocked %d requests from %d addresses since %s, %d of them from untracked addresses",
+		cf.name, s.Requests, s.Addresses, time.Unix(0, since).UTC().Format(time.RFC3339), s.Other)
+	for _, a := range s.Top {
+		cf.logger.infof("CloudFrontGate %s: blocked %s %d times, first at %s, last at %s",
+			cf.name, a.IP, a.Count, a.FirstSeen.Format(time.RFC3339), a.LastSeen.Format(time.RFC3339))
+	}
+}
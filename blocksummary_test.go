@@ -0,0 +1,155 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlockSummary(t *testing.T) {
+	var b blockSummary
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < 3; i++ {
+		b.record(netip.MustParseAddr("192.0.2.1"), start.Add(time.Duration(i)*time.Second))
+	}
+	b.record(netip.MustParseAddr("::ffff:192.0.2.1"), start.Add(5*time.Second))
+	b.record(netip.MustParseAddr("2001:db8::1"), start)
+	b.record(netip.Addr{}, start)
+
+	s := b.summarize(false)
+	if s.Requests != 6 || s.Addresses != 2 || s.Other != 1 {
+		t.Fatalf("summarize() = %+v", s)
+	}
+	top := s.Top[0]
+	if top.IP != "192.0.2.1" || top.Count != 4 || !top.FirstSeen.Equal(start) || !top.LastSeen.Equal(start.Add(5*time.Second)) {
+		t.Errorf("Expected the IPv4-mapped denial to count for 192.0.2.1 first, got %+v", top)
+	}
+	if again := b.summarize(false); again.Requests != 6 {
+		t.Errorf("Expected a summary without reset to keep the period, got %+v", again)
+	}
+
+	if s := b.summarize(true); s.Requests != 6 {
+		t.Errorf("Expected the reset to return the period, got %+v", s)
+	}
+	if s := b.summarize(false); s.Requests != 0 || s.Addresses != 0 || len(s.Top) != 0 {
+		t.Errorf("Expected a new period after the reset, got %+v", s)
+	}
+}
+
+func TestBlockSummaryIsBounded(t *testing.T) {
+	var b blockSummary
+	now := time.Now()
+	total := 2 * maxBlockSummaryAddresses
+	for i := 0; i < total; i++ {
+		b.record(netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}), now)
+	}
+	s := b.summarize(false)
+	if s.Addresses > maxBlockSummaryAddresses || s.Other == 0 || s.Requests != uint64(total) {
+		t.Errorf("Expected at most %d addresses and the rest in other, got %d addresses, %d other of %d", maxBlockSummaryAddresses, s.Addresses, s.Other, s.Requests)
+	}
+	if len(s.Top) != blockSummaryTop {
+		t.Errorf("Expected the top %d addresses, got %d", blockSummaryTop, len(s.Top))
+	}
+}
+
+func TestBlockSummaryConcurrentRecords(t *testing.T) {
+	var b blockSummary
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				b.record(netip.AddrFrom4([4]byte{192, 0, 2, byte(i % 50)}), time.Now())
+				if i%100 == 0 {
+					_ = b.summarize(false)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if s := b.summarize(true); s.Requests != 8000 || s.Addresses != 50 {
+		t.Errorf("Expected 8000 denials from 50 addresses, got %+v", s)
+	}
+}
+
+func TestServeHTTPBlockSummary(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := CreateConfig()
+	cfg.BlockSummaryInterval = "1m"
+	handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+	clock := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	cf.now = func() time.Time { return clock }
+
+	serve := func(remoteAddrs ...string) {
+		for i, remoteAddr := range remoteAddrs {
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://example.com/%d", i), nil)
+			req.RemoteAddr = remoteAddr
+			cf.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	}
+	serve("192.0.2.1:1", "192.0.2.1:2", "192.0.2.2:1", "205.251.249.10:1")
+
+	summary := cf.status().BlockSummary
+	if summary == nil || summary.Requests != 3 || summary.Top[0].IP != "192.0.2.1" || summary.Top[0].Count != 2 || !summary.Since.Equal(clock) {
+		t.Fatalf("Expected the status to summarize the denials, got %+v", summary)
+	}
+	if strings.Contains(logs.String(), "blocked 3 requests") {
+		t.Fatalf("Expected no summary before the interval elapsed, got:\n%s", logs.String())
+	}
+
+	// The first denial after the interval logs the period it closes.
+	clock = clock.Add(time.Minute)
+	serve("198.51.100.200:1")
+	for _, want := range []string{
+		"blocked 3 requests from 2 addresses since 2026-01-02T03:04:05Z, 0 of them from untracked addresses",
+		"blocked 192.0.2.1 2 times, first at 2026-01-02T03:04:05Z, last at 2026-01-02T03:04:05Z",
+		"blocked 192.0.2.2 1 times, first at ",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("Expected %q in the logs, got:\n%s", want, logs.String())
+		}
+	}
+	if summary := cf.status().BlockSummary; summary.Requests != 1 || summary.Top[0].IP != "198.51.100.200" || !summary.Since.Equal(clock) {
+		t.Errorf("Expected a new period once logged, got %+v", summary)
+	}
+}
+
+func TestBlockSummaryInterval(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.BlockSummaryInterval = "0s"
+	handler, err := NewWithOptions(context.Background(), http.NotFoundHandler(), cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+	if cf.blockSummaryInterval != 0 || cf.status().BlockSummary != nil {
+		t.Error("Expected blockSummaryInterval 0s to disable the summary")
+	}
+
+	cfg.BlockSummaryInterval = "-1m"
+	_, err = NewWithOptions(context.Background(), http.NotFoundHandler(), cfg, t.Name()+"-negative", withFixture())
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) || configErr.Field != "blockSummaryInterval" {
+		t.Errorf("Expected a blockSummaryInterval error, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package cloudfrontgate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// defaultCacheMaxAge is the age beyond which a cache file is not loaded.
+const defaultCacheMaxAge = 24 * time.Hour
+
+// cacheDocument is the last-known-good dataset persisted to the cache file.
+type cacheDocument struct {
+	URL       string        `json:"url"`
+	FetchedAt time.Time     `json:"fetchedAt"`
+	Prefixes  []cachedRange `json:"prefixes"`
+}
+
+// cachedRange is a prefix with the label of the list it came from.
+type cachedRange struct {
+	Prefix string `json:"prefix"`
+	Source string `json:"source"`
+}
+
+// writeCache persists data to the cache file. Failures are logged and
+// never fail the update.
+func (ips *ipstore) writeCache(data *dataset, fetchedAt time.Time) {
+	if ips.cacheFile == "" {
+		return
+	}
+	doc := cacheDocument{URL: ips.cfAPI, FetchedAt: fetchedAt.UTC(), Prefixes: make([]cachedRange, 0, len(data.cidrs))}
+	for _, cidr := range data.cidrs {
+		prefix := cidr.String()
+		doc.Prefixes = append(doc.Prefixes, cachedRange{Prefix: prefix, Source: data.sources[prefix].String()})
+	}
+	body, err := json.Marshal(doc)
+	if err == nil {
+		err = writeFileAtomic(ips.cacheFile, body)
+	}
+	if err != nil {
+		ips.logs.errorf("Failed to write cache file %s: %v", ips.cacheFile, err)
+	}
+}
+
+// loadCache populates the empty store from the cache file, unless the file
+// is missing, broken, for another source or older than the maximum age.
+func (ips *ipstore) loadCache(now time.Time) error {
+	raw, err := os.ReadFile(ips.cacheFile)
+	if err != nil {
+		return fmt.Errorf("failed to read cache file: %w", err)
+	}
+	var doc cacheDocument
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("failed to parse cache file: %w", err)
+	}
+	switch {
+	case doc.URL != ips.cfAPI:
+		return fmt.Errorf("cache file was written for %s", doc.URL)
+	case doc.FetchedAt.IsZero() || now.Sub(doc.FetchedAt) > ips.cacheMaxAge:
+		return &classifiedError{class: ErrStaleList, err: fmt.Errorf("cache file fetched at %s is older than %s", doc.FetchedAt.Format(time.RFC3339), ips.cacheMaxAge)}
+	case len(doc.Prefixes) == 0:
+		return errors.New("cache file holds no prefixes")
+	}
+
+	data := &dataset{sources: make(map[string]trustSource, len(doc.Prefixes))}
+	sampled := make(map[trustSource]bool)
+	for _, entry := range doc.Prefixes {
+		cidr, err := netip.ParsePrefix(entry.Prefix)
+		if err != nil {
+			return fmt.Errorf("failed to parse cache file: %w", err)
+		}
+		source, ok := parseTrustSource(entry.Source)
+		if !ok {
+			return fmt.Errorf("failed to parse cache file: unknown source %q", entry.Source)
+		}
+		// A file written before ipLists changed may hold deselected lists.
+		if !listSelected(ips.ipLists, source) {
+			continue
+		}
+		cidr = maskedPrefix(cidr)
+		data.cidrs = append(data.cidrs, cidr)
+		data.sources[cidr.String()] = source
+		if !sampled[source] {
+			sampled[source] = true
+			data.samples = append(data.samples, netIP(cidr.Addr()))
+		}
+	}
+	if err := checkDataset(data.cidrs, len(ips.anchors) > 0); err != nil {
+		return fmt.Errorf("rejecting cache file: %w", err)
+	}
+	if err := checkAnchors(data.cidrs, ips.anchors); err != nil {
+		return fmt.Errorf("rejecting cache file: %w", err)
+	}
+
+	ips.updateMu.Lock()
+	defer ips.updateMu.Unlock()
+	if ips.version.Load() != 0 {
+		return nil
+	}
+	ips.apply(nil, data)
+	// The data is as old as its fetch, not its load.
+	ips.updated.Store(doc.FetchedAt.UTC())
+	return nil
+}
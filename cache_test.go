@@ -0,0 +1,145 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheFileWrittenAfterUpdate(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.CacheFile = filepath.Join(t.TempDir(), "ranges.json")
+	handler, err := NewWithOptions(context.Background(), http.NotFoundHandler(), cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer func() { _ = handler.(*CloudFrontGate).Close() }()
+
+	raw, err := os.ReadFile(cfg.CacheFile)
+	if err != nil {
+		t.Fatalf("Expected a cache file, got %v", err)
+	}
+	var doc cacheDocument
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.URL != ipListURL || doc.FetchedAt.IsZero() || len(doc.Prefixes) == 0 {
+		t.Errorf("Unexpected cache document %+v", doc)
+	}
+}
+
+func TestCacheFileOnStartup(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	tests := []struct {
+		name      string
+		fetchedAt time.Time
+		body      string
+		wantErr   bool
+	}{
+		{name: "Fresh", fetchedAt: time.Now().Add(-time.Hour)},
+		{name: "Stale", fetchedAt: time.Now().Add(-48 * time.Hour), wantErr: true},
+		{name: "Corrupted", body: "{not json", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			path := filepath.Join(t.TempDir(), "ranges.json")
+			body := []byte(tt.body)
+			if tt.body == "" {
+				var err error
+				body, err = json.Marshal(cacheDocument{
+					URL:       failing.URL,
+					FetchedAt: tt.fetchedAt,
+					Prefixes: []cachedRange{
+						{Prefix: "13.32.0.0/15", Source: "cloudfront-global"},
+						{Prefix: "54.192.0.0/16", Source: "cloudfront-global"},
+						{Prefix: "205.251.249.0/24", Source: "cloudfront-regional"},
+					},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(path, body, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := CreateConfig()
+			cfg.IPListURL = failing.URL
+			cfg.AllowPrivateSources = true
+			cfg.CacheFile = path
+			handler, err := New(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name())
+			if tt.wantErr {
+				if err == nil {
+					_ = handler.(*CloudFrontGate).Close()
+					t.Fatal("Expected New() to fail without a usable cache")
+				}
+				if !strings.Contains(logs.String(), "ignoring the cache file") {
+					t.Errorf("Expected a warning about the cache file, got %q", logs.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "205.251.249.10:1234"
+			rw := httptest.NewRecorder()
+			cf.ServeHTTP(rw, req)
+			if rw.Code != http.StatusOK {
+				t.Errorf("Expected the cached ranges to admit the request, got %d", rw.Code)
+			}
+			if updated, _ := cf.ips.updated.Load().(time.Time); !updated.Equal(tt.fetchedAt.UTC()) {
+				t.Errorf("Expected the update time of the cache, got %s", updated)
+			}
+		})
+	}
+}
+
+func TestCacheFileUnwritable(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := CreateConfig()
+	cfg.CacheFile = filepath.Join(t.TempDir(), "missing", "ranges.json")
+	handler, err := NewWithOptions(context.Background(), http.NotFoundHandler(), cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("Expected an unwritable cache file not to fail New(), got %v", err)
+	}
+	defer func() { _ = handler.(*CloudFrontGate).Close() }()
+
+	if !strings.Contains(logs.String(), "ERROR: Failed to write cache file") {
+		t.Errorf("Expected a warning, got %q", logs.String())
+	}
+}
+
+func TestNewCacheMaxAge(t *testing.T) {
+	for _, value := range []string{"soon", "0s", "-1h"} {
+		cfg := CreateConfig()
+		cfg.CacheFile = filepath.Join(t.TempDir(), "ranges.json")
+		cfg.CacheMaxAge = value
+		if handler, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name()); err == nil {
+			_ = handler.(*CloudFrontGate).Close()
+			t.Errorf("Expected cacheMaxAge %q to be rejected", value)
+		}
+	}
+}
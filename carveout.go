@@ -0,0 +1,72 @@
+package cloudfrontgate
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// carveOutPrefix marks an allowedIPs entry, such as "!10.42.0.0/16", whose
+// addresses are not trusted even when a broader entry lists them. A
+// carve-out always wins over every allowedIPs entry, the resolved hosts and
+// allowedIPsFile, whatever their lengths; the addresses it covers fall
+// through to the other stages.
+const carveOutPrefix = "!"
+
+// splitCarveOuts separates the carve-outs of entries, without their mark,
+// from the entries they restrict.
+func splitCarveOuts(entries []string) (allowed, carveOuts []string) {
+	for _, entry := range entries {
+		if cut, ok := strings.CutPrefix(entry, carveOutPrefix); ok {
+			carveOuts = append(carveOuts, cut)
+			continue
+		}
+		allowed = append(allowed, entry)
+	}
+	return allowed, carveOuts
+}
+
+// subtractPrefixes returns prefixes without the addresses of carveOuts, so
+// that a list that cannot express carve-outs, such as an ipAllowList, trusts
+// no more than the instance. A prefix that partly overlaps a carve-out is
+// split into the halves the carve-out leaves out.
+func subtractPrefixes(prefixes, carveOuts []net.IPNet) []netip.Prefix {
+	cuts := netipPrefixes(carveOuts)
+	var out []netip.Prefix
+	for _, prefix := range netipPrefixes(prefixes) {
+		out = subtractPrefix(out, prefix, cuts)
+	}
+	return out
+}
+
+// subtractPrefix appends to out the parts of prefix outside cuts.
+func subtractPrefix(out []netip.Prefix, prefix netip.Prefix, cuts []netip.Prefix) []netip.Prefix {
+	split := false
+	for _, cut := range cuts {
+		if cut.Bits() <= prefix.Bits() && cut.Contains(prefix.Addr()) {
+			return out
+		}
+		if cut.Bits() > prefix.Bits() && prefix.Contains(cut.Addr()) {
+			split = true
+		}
+	}
+	if !split {
+		return append(out, prefix)
+	}
+	low, high := halves(prefix)
+	out = subtractPrefix(out, low, cuts)
+	return subtractPrefix(out, high, cuts)
+}
+
+// halves splits prefix into its two prefixes one bit longer.
+func halves(prefix netip.Prefix) (low, high netip.Prefix) {
+	addr := prefix.Addr()
+	bits := addr.As16()
+	bit := addrOffset(addr) + prefix.Bits()
+	bits[bit/8] |= 0x80 >> uint(bit%8)
+	upper := netip.AddrFrom16(bits)
+	if addr.Is4() {
+		upper = upper.Unmap()
+	}
+	return netip.PrefixFrom(addr, prefix.Bits()+1), netip.PrefixFrom(upper, prefix.Bits()+1)
+}
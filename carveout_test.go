@@ -0,0 +1,146 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCarveOuts(t *testing.T) {
+	allowed, carveOuts := splitCarveOuts([]string{"10.0.0.0/8", "!10.42.0.0/16", "office.example.net", "!@office"})
+	if !reflect.DeepEqual(allowed, []string{"10.0.0.0/8", "office.example.net"}) {
+		t.Errorf("allowed = %q", allowed)
+	}
+	if !reflect.DeepEqual(carveOuts, []string{"10.42.0.0/16", "@office"}) {
+		t.Errorf("carveOuts = %q", carveOuts)
+	}
+}
+
+func TestSubtractPrefixes(t *testing.T) {
+	tests := []struct {
+		name      string
+		prefixes  []string
+		carveOuts []string
+		want      []string
+	}{
+		{name: "no carve-outs", prefixes: []string{"10.0.0.0/8"}, want: []string{"10.0.0.0/8"}},
+		{name: "disjoint", prefixes: []string{"10.0.0.0/8"}, carveOuts: []string{"192.0.2.0/24", "2001:db8::/32"}, want: []string{"10.0.0.0/8"}},
+		{name: "covering", prefixes: []string{"10.42.1.0/24", "192.0.2.0/24"}, carveOuts: []string{"10.42.0.0/16"}, want: []string{"192.0.2.0/24"}},
+		{name: "equal", prefixes: []string{"10.42.0.0/16"}, carveOuts: []string{"10.42.0.0/16"}, want: nil},
+		{
+			name: "nested", prefixes: []string{"10.0.0.0/14"}, carveOuts: []string{"10.2.0.0/16"},
+			want: []string{"10.0.0.0/15", "10.3.0.0/16"},
+		},
+		{
+			name: "two holes", prefixes: []string{"192.0.2.0/24"}, carveOuts: []string{"192.0.2.0/26", "192.0.2.192/26"},
+			want: []string{"192.0.2.64/26", "192.0.2.128/26"},
+		},
+		{
+			name: "IPv6", prefixes: []string{"2001:db8::/32"}, carveOuts: []string{"2001:db8:8000::/33"},
+			want: []string{"2001:db8::/33"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, prefix := range subtractPrefixes(mustParseIPNets(t, tt.prefixes...), mustParseIPNets(t, tt.carveOuts...)) {
+				got = append(got, prefix.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("subtractPrefixes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtractPrefixesCoversTheRest(t *testing.T) {
+	prefixes := mustParseIPNets(t, "10.0.0.0/8")
+	carveOuts := mustParseIPNets(t, "10.42.0.0/16", "10.42.7.0/24", "10.200.3.128/25")
+	rest := subtractPrefixes(prefixes, carveOuts)
+	for _, ip := range []string{"10.0.0.1", "10.41.255.255", "10.42.0.1", "10.42.7.9", "10.43.0.0", "10.200.3.127", "10.200.3.128", "10.255.255.255"} {
+		addr := net.ParseIP(ip)
+		if got, want := containsAddr(rest, addrOf(addr)), containsIP(prefixes, addr) && !containsIP(carveOuts, addr); got != want {
+			t.Errorf("%s: in the rest = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestHalves(t *testing.T) {
+	low, high := halves(netip.MustParsePrefix("10.0.0.0/8"))
+	if low.String() != "10.0.0.0/9" || high.String() != "10.128.0.0/9" {
+		t.Errorf("halves(10.0.0.0/8) = %s, %s", low, high)
+	}
+	low, high = halves(netip.MustParsePrefix("2001:db8::/127"))
+	if low.String() != "2001:db8::/128" || high.String() != "2001:db8::1/128" {
+		t.Errorf("halves(2001:db8::/127) = %s, %s", low, high)
+	}
+}
+
+func TestAllowedIPsCarveOuts(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Groups = map[string][]string{"partner": {"172.16.5.0/24"}}
+	// 10.42.1.0/24 is more specific than the carve-out, which still wins.
+	cfg.AllowedIPs = []string{"10.0.0.0/8", "!10.42.0.0/16", "10.42.1.0/24", "172.16.0.0/12", "!@partner", "205.251.0.0/16", "!205.251.249.0/24"}
+	handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	tests := []struct {
+		ip        string
+		want      int
+		wantStage string
+	}{
+		{ip: "10.1.2.3", want: http.StatusOK, wantStage: stageAllowedIPs},
+		{ip: "10.42.9.9", want: http.StatusForbidden},
+		{ip: "10.42.1.5", want: http.StatusForbidden},
+		{ip: "172.16.4.1", want: http.StatusOK, wantStage: stageAllowedIPs},
+		{ip: "172.16.5.1", want: http.StatusForbidden},
+		// An address carved out of allowedIPs falls through to CloudFront.
+		{ip: "205.251.249.10", want: http.StatusOK, wantStage: stageCloudFront},
+		{ip: "205.251.1.1", want: http.StatusOK, wantStage: stageAllowedIPs},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		if rw.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.ip, rw.Code, tt.want)
+		}
+		if d, ok := cf.resolve(netip.MustParseAddr(tt.ip)); tt.wantStage != "" && (!ok || d.Stage != tt.wantStage) {
+			t.Errorf("%s: decided by %q, want %q", tt.ip, d.Stage, tt.wantStage)
+		}
+	}
+
+	status := cf.status()
+	if !reflect.DeepEqual(status.AllowedIPsCarveOuts, []string{"10.42.0.0/16", "172.16.5.0/24", "205.251.249.0/24"}) {
+		t.Errorf("Expected the carve-outs in the status, got %q", status.AllowedIPsCarveOuts)
+	}
+	if !containsString(cf.allowedSet().labels, "!partner (1 prefixes)") {
+		t.Errorf("Expected the carve-out labels, got %q", cf.allowedSet().labels)
+	}
+	for _, prefix := range cf.effectivePrefixes() {
+		if strings.HasPrefix(prefix, "10.42.") || strings.HasPrefix(prefix, "172.16.5.") {
+			t.Errorf("Expected the rendered allowlist to leave out the carve-outs, got %s", prefix)
+		}
+	}
+}
+
+func TestNewRejectsInvalidCarveOut(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.AllowedIPs = []string{"10.0.0.0/8", "!office.example.net"}
+	_, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name())
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) || configErr.Field != "allowedIPs" || !strings.Contains(err.Error(), "carve-outs") {
+		t.Errorf("Expected an allowedIPs error, got %v", err)
+	}
+}
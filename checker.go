@@ -0,0 +1,142 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/netip"
+	"time"
+)
+
+// Checker answers whether an address is trusted: a CloudFront edge, an
+// entry of allowedIPs or another source of the configuration. It is the
+// IP check of the middleware without the HTTP handler, for gRPC
+// interceptors, accept filters and the like. A Checker is safe for
+// concurrent use, including while its ranges are refreshed.
+type Checker struct {
+	cf *CloudFrontGate
+}
+
+// NewChecker builds a Checker from config, with the options of
+// NewWithOptions. It fetches and refreshes the ranges as the middleware
+// does, sharing them with the instances of the same sources, and name
+// identifies it in the logs and across reconstructions like the name of
+// a middleware. Checkers are named apart from the middlewares, so a
+// Checker never supersedes a middleware of the same name. Close releases
+// it.
+func NewChecker(ctx context.Context, config *Config, name string, opts ...Option) (*Checker, error) {
+	o, err := applyOptions(config, opts)
+	if err != nil {
+		return nil, err
+	}
+	// The instance behind a Checker never serves a request.
+	o.checker = true
+	handler, err := newGate(ctx, nil, config, name, o)
+	if err != nil {
+		return nil, err
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	return &Checker{cf: cf}, nil
+}
+
+// Checker returns a Checker deciding as the instance does, over the same
+// ranges: the instance serves the HTTP around its decisions. Closing
+// either closes both.
+func (cf *CloudFrontGate) Checker() *Checker {
+	return &Checker{cf: cf}
+}
+
+// Contains reports whether addr is trusted, as the middleware decides for
+// the address of a request: through the resolution stages, staleAction
+// and failOpenOnStartup. The checks of the request itself, such as the
+// forwarding headers, allowedHosts, the viewer and the secret headers, do
+// not apply, nor do the audit modes, and nothing is counted. IPv4-mapped
+// addresses are checked as IPv4; addresses with a zone are not trusted.
+func (c *Checker) Contains(addr netip.Addr) bool {
+	if !addr.IsValid() || addr.Zone() != "" {
+		return false
+	}
+	switch c.check(addr.Unmap()).outcome {
+	case checkAllowed, checkStaleAdmitted, checkFailedOpen:
+		return true
+	}
+	return false
+}
+
+// Refresh updates the ranges now, as CloudFrontGate.Refresh does.
+func (c *Checker) Refresh(ctx context.Context) error {
+	return c.cf.Refresh(ctx)
+}
+
+// LastUpdated returns when the CloudFront ranges were last stored, or the
+// zero Time before the first successful fetch.
+func (c *Checker) LastUpdated() time.Time {
+	updated, _ := c.cf.ips.updated.Load().(time.Time)
+	return updated
+}
+
+// Close stops the refreshes of the Checker, as CloudFrontGate.Close does.
+func (c *Checker) Close() error {
+	return c.cf.Close()
+}
+
+// checkOutcome is how a Checker decided for an address.
+type checkOutcome int
+
+const (
+	// checkAllowed and checkDenied are the verdict of a stage, or the
+	// denial of an address no stage knows.
+	checkAllowed checkOutcome = iota
+	checkDenied
+	// checkStaleAdmitted and checkStaleDenied apply staleAction to data
+	// beyond maxStaleness.
+	checkStaleAdmitted
+	checkStaleDenied
+	// checkFailedOpen and checkUnavailable decide for an address no stage
+	// knows while the gate is degraded, with and without failOpenOnStartup.
+	checkFailedOpen
+	checkUnavailable
+)
+
+// addrCheck is the decision of a Checker for an address.
+type addrCheck struct {
+	outcome checkOutcome
+	// verdict is the decision of the stage, or a denyIP decision for an
+	// address no stage knows.
+	verdict decision
+	// age is the age of the stale data, and cause the cause of the
+	// degradation.
+	age   time.Duration
+	cause string
+}
+
+// check decides for addr, an unmapped address, through the resolution
+// stages, staleAction and failOpenOnStartup. It counts nothing: serveGate
+// records the outcome for the requests it decides.
+func (c *Checker) check(addr netip.Addr) addrCheck {
+	cf := c.cf
+	verdict, ok := cf.resolve(addr)
+	if (!ok || verdict.Allow) && verdict.Stage != stageAllowedIPs {
+		if age, stale := cf.stale(); stale {
+			if cf.staleAction != staleFailOpen {
+				return addrCheck{outcome: checkStaleDenied, age: age}
+			}
+			if !ok {
+				return addrCheck{outcome: checkStaleAdmitted, age: age}
+			}
+		}
+	}
+	if !ok {
+		// Without data the gate cannot tell, which is our failure rather
+		// than a policy decision about the client.
+		if cause, degraded := cf.degraded(); degraded {
+			if cf.failingOpen() {
+				return addrCheck{outcome: checkFailedOpen, cause: cause}
+			}
+			return addrCheck{outcome: checkUnavailable, cause: cause}
+		}
+		return addrCheck{outcome: checkDenied, verdict: decision{Reason: denyIP}}
+	}
+	if !verdict.Allow {
+		return addrCheck{outcome: checkDenied, verdict: verdict}
+	}
+	return addrCheck{outcome: checkAllowed, verdict: verdict}
+}
@@ -0,0 +1,150 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChecker(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.AllowedIPs = []string{"198.51.100.0/24", "!198.51.100.128/25"}
+	checker, err := NewChecker(context.Background(), cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("NewChecker() error = %v", err)
+	}
+	defer func() { _ = checker.Close() }()
+
+	for addr, want := range map[string]bool{
+		"205.251.249.10":        true,
+		"::ffff:205.251.249.10": true,
+		"13.113.203.1":          true,
+		"198.51.100.7":          true,
+		"198.51.100.200":        false,
+		"192.0.2.1":             false,
+		"2001:db8::1":           false,
+		"fe80::1%eth0":          false,
+	} {
+		if got := checker.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if checker.Contains(netip.Addr{}) {
+		t.Error("Expected the zero Addr not to be trusted")
+	}
+
+	updated := checker.LastUpdated()
+	if updated.IsZero() {
+		t.Fatal("Expected LastUpdated to be set after the first fetch")
+	}
+	if err := checker.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if checker.LastUpdated().Before(updated) {
+		t.Errorf("Expected Refresh to move LastUpdated forward from %v, got %v", updated, checker.LastUpdated())
+	}
+}
+
+func TestCheckerMatchesHandler(t *testing.T) {
+	cf, _ := newAllowedIPsGate(t, "198.51.100.0/24")
+	checker := cf.Checker()
+	for _, addr := range []string{"205.251.249.10", "52.199.127.200", "198.51.100.7", "127.0.0.1", "192.0.2.1", "2001:db8::1"} {
+		ip := netip.MustParseAddr(addr)
+		served := serveFrom(cf, netip.AddrPortFrom(ip, 1234).String()) == http.StatusOK
+		if got := checker.Contains(ip); got != served {
+			t.Errorf("Contains(%s) = %v, but the handler served it: %v", addr, got, served)
+		}
+	}
+}
+
+func TestCheckerFailClosedWhenStale(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.AllowedIPs = []string{"198.51.100.0/24"}
+	cfg.MaxStaleness = "1h"
+	cfg.StaleAction = staleFailClosed
+	checker, err := NewChecker(context.Background(), cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("NewChecker() error = %v", err)
+	}
+	defer func() { _ = checker.Close() }()
+	previous := checker.cf.ips.updated.Load()
+	checker.cf.ips.updated.Store(time.Now().Add(-2 * time.Hour))
+	defer checker.cf.ips.updated.Store(previous)
+
+	if checker.Contains(netip.MustParseAddr("205.251.249.10")) {
+		t.Error("Expected stale CloudFront ranges not to be trusted with staleAction failClosed")
+	}
+	if !checker.Contains(netip.MustParseAddr("198.51.100.7")) {
+		t.Error("Expected allowedIPs to stay trusted while stale")
+	}
+}
+
+func TestCheckerNamedApartFromMiddlewares(t *testing.T) {
+	handler, err := NewWithOptions(context.Background(), http.NotFoundHandler(), CreateConfig(), t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+	checker, err := NewChecker(context.Background(), CreateConfig(), t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("NewChecker() error = %v", err)
+	}
+	defer func() { _ = checker.Close() }()
+
+	// The middleware is not superseded: it keeps its reference and state.
+	if cf.entry != checker.cf.entry || cf.entry.refs != 2 {
+		t.Errorf("Expected the middleware and the Checker to hold the shared entry")
+	}
+	if cf.state == checker.cf.state {
+		t.Error("Expected the Checker not to share the runtime state of the middleware")
+	}
+	if !checker.Contains(netip.MustParseAddr("205.251.249.10")) {
+		t.Error("Expected the Checker to trust a CloudFront address")
+	}
+}
+
+func TestCheckerConcurrentUse(t *testing.T) {
+	checker, err := NewChecker(context.Background(), CreateConfig(), t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("NewChecker() error = %v", err)
+	}
+	defer func() { _ = checker.Close() }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				if !checker.Contains(netip.MustParseAddr("205.251.249.10")) || checker.Contains(netip.MustParseAddr("192.0.2.1")) {
+					t.Error("Unexpected decision during the refreshes")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := checker.Refresh(context.Background()); err != nil {
+			t.Errorf("Refresh() error = %v", err)
+		}
+	}
+	wg.Wait()
+}
+
+func ExampleNewChecker() {
+	checker, err := NewChecker(context.Background(), CreateConfig(), "grpc-edge")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer func() { _ = checker.Close() }()
+
+	// In an accept filter or a gRPC interceptor, with the peer address:
+	peer := netip.MustParseAddrPort("205.251.249.10:443")
+	fmt.Println(checker.Contains(peer.Addr()))
+}
@@ -0,0 +1,214 @@
+package cloudfrontgate
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cidrFilePollInterval is how often a CIDR file is checked for changes.
+const cidrFilePollInterval = 5 * time.Second
+
+// cidrFile holds prefixes loaded from a file and reloaded when it changes:
+// the denylistFile, denied even when otherwise allowed, and the
+// allowedIPsFile, merged into allowedIPs. Both are kept apart from the
+// allow store.
+type cidrFile struct {
+	path string
+	// what names the option in errors and logs.
+	what string
+	// optional files may be missing, and are then empty until created.
+	optional bool
+	now      func() time.Time
+	// logger receives the reload failures.
+	logger *gateLogger
+
+	// prefixes holds the []net.IPNet of the last successful load.
+	prefixes atomic.Value
+
+	mu       sync.Mutex
+	modTime  time.Time
+	loadedAt time.Time
+	lastErr  error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// cidrFileStatus describes a CIDR file in the status document.
+type cidrFileStatus struct {
+	Path      string    `json:"path"`
+	Entries   int       `json:"entries"`
+	LoadedAt  time.Time `json:"loadedAt"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// newDenylist loads the denylist file at path. It returns nil when path is
+// empty.
+func newDenylist(path string, now func() time.Time, logger *gateLogger) (*cidrFile, error) {
+	return newCIDRFile(path, "denylist", false, now, logger)
+}
+
+// newAllowedIPsFile loads the allowedIPsFile at path. It returns nil when
+// path is empty.
+func newAllowedIPsFile(path string, optional bool, now func() time.Time, logger *gateLogger) (*cidrFile, error) {
+	return newCIDRFile(path, "allowedIPsFile", optional, now, logger)
+}
+
+// newCIDRFile loads the file at path. A missing optional file is not an
+// error. It returns nil when path is empty.
+func newCIDRFile(path, what string, optional bool, now func() time.Time, logger *gateLogger) (*cidrFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	d := &cidrFile{path: path, what: what, optional: optional, now: now, logger: logger}
+	if err := d.reload(); err != nil && !d.missing(err) {
+		return nil, err
+	}
+	return d, nil
+}
+
+// missing reports whether err is that of an optional file that does not
+// exist.
+func (d *cidrFile) missing(err error) bool {
+	return d.optional && errors.Is(err, fs.ErrNotExist)
+}
+
+// start polls the file for changes in the background.
+func (d *cidrFile) start() {
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+
+	go func() {
+		defer close(d.done)
+
+		ticker := time.NewTicker(cidrFilePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				if err := d.reloadIfChanged(); err != nil && !d.missing(err) {
+					d.logger.errorf("Failed to reload %s %s, keeping previous entries: %v", d.what, d.path, err)
+				}
+			}
+		}
+	}()
+}
+
+// close stops polling.
+func (d *cidrFile) close() {
+	if d.stop != nil {
+		close(d.stop)
+		<-d.done
+	}
+}
+
+// reloadIfChanged reloads the file when its modification time changed.
+func (d *cidrFile) reloadIfChanged() error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		d.setError(err)
+		return err
+	}
+
+	d.mu.Lock()
+	unchanged := info.ModTime().Equal(d.modTime)
+	d.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	return d.reload()
+}
+
+// reload reads and parses the file. On failure the previous entries stay
+// in force.
+func (d *cidrFile) reload() error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		d.setError(err)
+		return fmt.Errorf("failed to read %s: %w", d.what, err)
+	}
+	raw, err := os.ReadFile(d.path)
+	if err != nil {
+		d.setError(err)
+		return fmt.Errorf("failed to read %s: %w", d.what, err)
+	}
+	prefixes, err := parseCIDRFile(raw)
+	if err != nil {
+		d.setError(err)
+		return fmt.Errorf("failed to parse %s: %w", d.what, err)
+	}
+
+	d.prefixes.Store(prefixes)
+
+	d.mu.Lock()
+	d.modTime = info.ModTime()
+	d.loadedAt = d.now()
+	d.lastErr = nil
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *cidrFile) setError(err error) {
+	d.mu.Lock()
+	d.lastErr = err
+	d.mu.Unlock()
+}
+
+// contains reports whether ip is listed.
+func (d *cidrFile) contains(ip net.IP) bool {
+	return containsIP(d.entries(), ip)
+}
+
+// entries returns the prefixes of the last successful load.
+func (d *cidrFile) entries() []net.IPNet {
+	prefixes, _ := d.prefixes.Load().([]net.IPNet)
+	return prefixes
+}
+
+// status returns the status of the file.
+func (d *cidrFile) status() *cidrFileStatus {
+	prefixes, _ := d.prefixes.Load().([]net.IPNet)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status := &cidrFileStatus{Path: d.path, Entries: len(prefixes), LoadedAt: d.loadedAt}
+	if d.lastErr != nil {
+		status.LastError = d.lastErr.Error()
+	}
+	return status
+}
+
+// parseCIDRFile parses one IP or CIDR per line. Blank lines and everything
+// after a "#" are ignored.
+func parseCIDRFile(raw []byte) ([]net.IPNet, error) {
+	var entries []string
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for line := 1; scanner.Scan(); line++ {
+		entry, _, _ := strings.Cut(scanner.Text(), "#")
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, err := parseCIDRs([]string{entry}); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseCIDRs(entries)
+}
@@ -0,0 +1,274 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCIDRFile(t *testing.T) {
+	prefixes, err := parseCIDRFile([]byte("# abuse list\n205.251.249.10\n\n  198.51.100.0/24 # scanner\n"))
+	if err != nil {
+		t.Fatalf("parseCIDRFile() error = %v", err)
+	}
+	if len(prefixes) != 2 || prefixes[0].String() != "205.251.249.10/32" || prefixes[1].String() != "198.51.100.0/24" {
+		t.Errorf("parseCIDRFile() = %v", prefixes)
+	}
+
+	if _, err := parseCIDRFile([]byte("198.51.100.0/24\nnope\n")); err == nil {
+		t.Errorf("Expected an error for an invalid line")
+	}
+}
+
+func TestDenylistIPv6Address(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist.txt")
+	if err := os.WriteFile(path, []byte("2001:db8::1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDenylist(path, time.Now, nil)
+	if err != nil {
+		t.Fatalf("newDenylist() error = %v", err)
+	}
+
+	prefixes, _ := d.prefixes.Load().([]net.IPNet)
+	if len(prefixes) != 1 || prefixes[0].String() != "2001:db8::1/128" {
+		t.Errorf("Expected a bare IPv6 address to be a /128, got %v", prefixes)
+	}
+	if !d.contains(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Expected the listed address to be denied")
+	}
+	if d.contains(net.ParseIP("2001:db8:ffff::5")) {
+		t.Errorf("Expected other addresses of the /32 not to be denied")
+	}
+}
+
+func TestServeHTTPDenylistFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist.txt")
+	write := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("205.251.249.10\n", start)
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	cfg := CreateConfig()
+	cfg.DenylistFile = path
+
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		cf.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if got := serve("205.251.249.10:1234"); got != http.StatusForbidden {
+		t.Errorf("Expected a denylisted CloudFront address to be denied, got %d", got)
+	}
+	if got := serve("205.251.249.11:1234"); got != http.StatusOK {
+		t.Errorf("Expected other CloudFront addresses to be allowed, got %d", got)
+	}
+
+	// An unchanged modification time skips the reload.
+	write("205.251.249.11\n", start)
+	if err := cf.denylist.reloadIfChanged(); err != nil {
+		t.Fatalf("reloadIfChanged() error = %v", err)
+	}
+	if got := serve("205.251.249.11:1234"); got != http.StatusOK {
+		t.Errorf("Expected the file not to be reloaded without an mtime change, got %d", got)
+	}
+
+	// Removing an entry stops enforcing it on the next reload.
+	write("205.251.249.11\n", start.Add(time.Minute))
+	if err := cf.denylist.reloadIfChanged(); err != nil {
+		t.Fatalf("reloadIfChanged() error = %v", err)
+	}
+	if got := serve("205.251.249.10:1234"); got != http.StatusOK {
+		t.Errorf("Expected a removed entry to stop being enforced, got %d", got)
+	}
+	if got := serve("205.251.249.11:1234"); got != http.StatusForbidden {
+		t.Errorf("Expected a new entry to be enforced, got %d", got)
+	}
+
+	// A broken file keeps the previous entries.
+	write("not an address\n", start.Add(2*time.Minute))
+	if err := cf.denylist.reloadIfChanged(); err == nil {
+		t.Errorf("Expected a parse error")
+	}
+	if got := serve("205.251.249.11:1234"); got != http.StatusForbidden {
+		t.Errorf("Expected the previous entries to stay in force, got %d", got)
+	}
+
+	status := cf.status().Denylist
+	if status == nil || status.Entries != 1 || status.LastError == "" || status.LoadedAt.IsZero() {
+		t.Errorf("Expected the denylist status with the last error, got %+v", status)
+	}
+	if got := cf.state.deniedBy[denyDenylist].Load(); got != 3 {
+		t.Errorf("Expected 3 %s denials, got %d", denyDenylist, got)
+	}
+}
+
+func TestNewFailsWithoutDenylistFile(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.DenylistFile = filepath.Join(t.TempDir(), "missing.txt")
+	if _, err := New(context.Background(), next, cfg, t.Name()); err == nil {
+		t.Errorf("Expected a missing denylist file to fail construction")
+	}
+}
+
+func TestServeHTTPBlockedIPs(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.AllowedIPs = []string{"192.168.1.0/24"}
+	cfg.BlockedIPs = []string{"205.251.249.10", "192.168.1.7/32"}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	tests := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{remoteAddr: "205.251.249.10:1234", want: http.StatusForbidden},
+		{remoteAddr: "205.251.249.11:1234", want: http.StatusOK},
+		{remoteAddr: "192.168.1.7:1234", want: http.StatusForbidden},
+		{remoteAddr: "192.168.1.8:1234", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		recorder := httptest.NewRecorder()
+		cf.ServeHTTP(recorder, req)
+		if recorder.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.remoteAddr, recorder.Code, tt.want)
+		}
+	}
+	if got := cf.state.deniedBy[denyDenylist].Load(); got != 2 {
+		t.Errorf("Expected 2 denylist denials, got %d", got)
+	}
+	if e := cf.explain(netip.MustParseAddr("205.251.249.10")); e.DecidedBy != stageDenylist || e.Stages[0].Why != "listed in blockedIPs" {
+		t.Errorf("Expected the denylist stage to decide, got %+v", e)
+	}
+
+	cfg.BlockedIPs = []string{"198.51.100.0/24", "198.51.100.300"}
+	if _, err := NewWithOptions(context.Background(), next, cfg, t.Name()+"invalid", withFixture()); err == nil || !strings.Contains(err.Error(), `"198.51.100.300"`) {
+		t.Errorf("Expected an error naming the invalid entry, got %v", err)
+	}
+}
+
+func TestAllowedIPsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowed.txt")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# office\n198.51.100.0/24\n")
+
+	cfg := CreateConfig()
+	cfg.AllowedIPs = []string{"192.0.2.1"}
+	cfg.AllowedIPsFile = path
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) { rw.WriteHeader(http.StatusOK) })
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	if serve("198.51.100.7:1234") != http.StatusOK || serve("192.0.2.1:1234") != http.StatusOK {
+		t.Errorf("Expected the file to be merged with allowedIPs")
+	}
+	if serve("203.0.113.5:1234") != http.StatusForbidden {
+		t.Errorf("Expected an unlisted address to be denied")
+	}
+
+	write("198.51.100.0/24\n203.0.113.0/24 # vpn\n")
+	if err := cf.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if serve("203.0.113.5:1234") != http.StatusOK {
+		t.Errorf("Expected the new CIDR to be allowed after a refresh")
+	}
+	if got := cf.Status().AllowedIPs; got != 3 {
+		t.Errorf("Expected 3 allowedIPs prefixes, got %d", got)
+	}
+
+	write("198.51.100.0/24\nnope\n")
+	if err := cf.Refresh(context.Background()); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected the failing line to be reported, got %v", err)
+	}
+	if serve("203.0.113.5:1234") != http.StatusOK {
+		t.Errorf("Expected the previous entries to stay in force")
+	}
+	if status := cf.status().AllowedIPsFile; status == nil || status.Entries != 2 || status.LastError == "" {
+		t.Errorf("Expected the allowedIPsFile status with the last error, got %+v", status)
+	}
+}
+
+func TestAllowedIPsFileMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowed.txt")
+	cfg := CreateConfig()
+	cfg.AllowedIPsFile = path
+	if _, err := NewWithOptions(context.Background(), http.NotFoundHandler(), cfg, t.Name(), withFixture()); err == nil {
+		t.Fatal("Expected a missing allowedIPsFile to fail construction")
+	}
+
+	cfg.AllowedIPsFileOptional = true
+	handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("Expected an optional missing file to be accepted, got %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+	if err := cf.Refresh(context.Background()); err != nil {
+		t.Errorf("Expected a refresh without the optional file to succeed, got %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("198.51.100.7\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if !cf.allowedIP(net.ParseIP("198.51.100.7")) {
+		t.Error("Expected the created file to be loaded")
+	}
+}
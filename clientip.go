@@ -0,0 +1,247 @@
+package cloudfrontgate
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Responses to requests whose client address cannot be determined.
+const (
+	unparsableBadRequest = "badRequest"
+	unparsableDeny       = "deny"
+	unparsableStealth    = "stealth"
+)
+
+// Handling of requests whose RemoteAddr is not an address, as behind unix
+// socket listeners or some PROXY protocol setups.
+const (
+	remoteAddrReject       = "reject"
+	remoteAddrAllow        = "allow"
+	remoteAddrUseForwarded = "useForwardedHeader"
+)
+
+// Client address extraction strategies, as named in logs.
+const (
+	strategyRemoteAddr = "remoteAddr"
+	strategyDepth      = "xForwardedFor depth"
+	strategyExcluded   = "xForwardedFor excludedIPs"
+)
+
+// IPStrategyConfig takes the checked address from X-Forwarded-For instead
+// of the direct peer, like Traefik's ipAllowList strategy. The header is
+// only honored when the direct peer is a trusted proxy.
+type IPStrategyConfig struct {
+	// Depth selects the Nth entry from the right of X-Forwarded-For, 1 being the rightmost
+	Depth int `json:"depth,omitempty"`
+	// ExcludedIPs selects the rightmost entry that is not in these CIDRs
+	ExcludedIPs []string `json:"excludedIPs,omitempty"`
+	// TrustedProxies lists the direct peers whose X-Forwarded-For is honored
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+}
+
+// ipStrategy is the validated IPStrategyConfig.
+type ipStrategy struct {
+	depth          int
+	excludedIPs    []net.IPNet
+	trustedProxies []net.IPNet
+}
+
+// key returns a canonical form of s, "" for nil.
+func (s *ipStrategy) key() string {
+	if s == nil {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(s.depth))
+	for _, group := range [][]net.IPNet{s.excludedIPs, s.trustedProxies} {
+		b.WriteByte(';')
+		for i := range group {
+			b.WriteString(group[i].String())
+			b.WriteByte(',')
+		}
+	}
+	return b.String()
+}
+
+// newIPStrategy validates config. It returns nil when the direct peer is
+// checked.
+func newIPStrategy(config *IPStrategyConfig, groups cidrGroups) (*ipStrategy, error) {
+	if config == nil || (config.Depth == 0 && len(config.ExcludedIPs) == 0) {
+		return nil, nil
+	}
+	if config.Depth < 0 {
+		return nil, fmt.Errorf("invalid ipStrategy depth %d: must not be negative", config.Depth)
+	}
+	if config.Depth > 0 && len(config.ExcludedIPs) > 0 {
+		return nil, errors.New("ipStrategy depth and excludedIPs are mutually exclusive")
+	}
+	if len(config.TrustedProxies) == 0 {
+		return nil, errors.New("ipStrategy requires trustedProxies")
+	}
+
+	excluded, _, err := groups.parse(config.ExcludedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ipStrategy excluded IPs: %w", err)
+	}
+	trusted, _, err := groups.parse(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ipStrategy trusted proxies: %w", err)
+	}
+	return &ipStrategy{depth: config.Depth, excludedIPs: excluded, trustedProxies: trusted}, nil
+}
+
+// clientIP returns the address checked for req, or nil when it cannot be
+// determined.
+func (cf *CloudFrontGate) clientIP(req *http.Request) net.IP {
+	return netIP(cf.clientAddr(req))
+}
+
+// clientAddr returns the address checked for req, or the zero Addr when it
+// cannot be determined. Without a strategy, or when the direct peer is not a
+// trusted proxy, it is the direct peer, parsed without allocating.
+//
+// With onUnparsableRemoteAddr useForwardedHeader, a RemoteAddr that is not
+// an address is taken for a trusted proxy.
+func (cf *CloudFrontGate) clientAddr(req *http.Request) netip.Addr {
+	peer := peerAddr(req)
+	s := cf.ipStrategy
+	if s == nil {
+		return peer
+	}
+	if !peer.IsValid() {
+		if cf.onUnparsablePeer != remoteAddrUseForwarded {
+			return peer
+		}
+	} else {
+		var buf [net.IPv6len]byte
+		if !containsIP(s.trustedProxies, addrIP(peer, &buf)) {
+			return peer
+		}
+	}
+
+	chain := forwardedChain(req.Header)
+	if s.depth > 0 {
+		if s.depth > len(chain) {
+			return netip.Addr{}
+		}
+		return addrOf(parseForwardedIP(chain[len(chain)-s.depth]))
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := normalizeIP(parseForwardedIP(chain[i]))
+		if ip == nil {
+			return netip.Addr{}
+		}
+		if !containsIP(s.excludedIPs, ip) {
+			return addrOf(ip)
+		}
+	}
+	return netip.Addr{}
+}
+
+// unparsableReason is the reason code of requests without a client address.
+const unparsableReason = "unparsable-client-ip"
+
+// unparsableLogInterval limits how often unparsable addresses are logged.
+const unparsableLogInterval = 10 * time.Second
+
+// validateUnparsableClientIP checks the unparsableClientIP option.
+func validateUnparsableClientIP(mode string) error {
+	switch mode {
+	case "", unparsableBadRequest, unparsableDeny, unparsableStealth:
+		return nil
+	default:
+		return fmt.Errorf("invalid unparsableClientIP %q: must be %q, %q or %q",
+			mode, unparsableBadRequest, unparsableDeny, unparsableStealth)
+	}
+}
+
+// validateOnUnparsableRemoteAddr checks the onUnparsableRemoteAddr option;
+// useForwardedHeader needs ipStrategy to select the forwarded address.
+func validateOnUnparsableRemoteAddr(mode string, strategy *ipStrategy) error {
+	switch mode {
+	case "", remoteAddrReject, remoteAddrAllow:
+		return nil
+	case remoteAddrUseForwarded:
+		if strategy == nil {
+			return fmt.Errorf("onUnparsableRemoteAddr %q requires ipStrategy", mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid onUnparsableRemoteAddr %q: must be %q, %q or %q",
+			mode, remoteAddrReject, remoteAddrAllow, remoteAddrUseForwarded)
+	}
+}
+
+// admitUnparsablePeer forwards, with onUnparsableRemoteAddr allow, a request
+// whose RemoteAddr is not an address without checking it, an upstream layer
+// having filtered the clients. It is counted apart from the allowed
+// requests.
+func (cf *CloudFrontGate) admitUnparsablePeer(rw http.ResponseWriter, req *http.Request) {
+	cf.state.unparsableAllowed.Add(1)
+	if cf.decisionLog != nil {
+		cf.decisionLog.write(req, cf.now(), 0, "allow", unparsableReason, cf.distributionLabel(req.Host))
+	}
+	cf.forward(rw, req)
+}
+
+// strategyName returns the name of the client address extraction strategy
+// used for req.
+func (cf *CloudFrontGate) strategyName(req *http.Request) string {
+	name := strategyRemoteAddr
+	switch {
+	case cf.ipStrategy == nil:
+	case cf.ipStrategy.depth > 0:
+		name = fmt.Sprintf("%s %d", strategyDepth, cf.ipStrategy.depth)
+	default:
+		name = strategyExcluded
+	}
+	if req.Context().Value(ctxForwardAuth) != nil {
+		return strategyForwardAuth + ", " + name
+	}
+	return name
+}
+
+// unparsable refuses a request whose client address could not be
+// determined. It is our failure or a broken proxy rather than a policy
+// decision, so it is counted apart from the denials and never reaches the
+// fail2ban log.
+func (cf *CloudFrontGate) unparsable(rw http.ResponseWriter, req *http.Request) {
+	cf.state.unparsable.Add(1)
+
+	now := cf.now()
+	last := cf.state.unparsableLoggedAt.Load()
+	if now.UnixNano()-last >= int64(unparsableLogInterval) && cf.state.unparsableLoggedAt.CompareAndSwap(last, now.UnixNano()) {
+		hint := ""
+		if !peerAddr(req).IsValid() {
+			hint = "; RemoteAddr is not an address, as behind a unix socket listener, see onUnparsableRemoteAddr"
+		}
+		cf.logger.errorf("CloudFrontGate %s: could not determine the client IP from RemoteAddr %q using strategy %s, X-Forwarded-For %q%s",
+			cf.name, req.RemoteAddr, cf.strategyName(req), req.Header.Values(headerForwardedFor), hint)
+	}
+
+	status := http.StatusBadRequest
+	switch cf.unparsableMode {
+	case unparsableDeny:
+		status = cf.rejectionResponse().status
+	case unparsableStealth:
+		status = http.StatusNotFound
+	}
+	if cf.decisionLog != nil {
+		cf.decisionLog.write(req, now, status, "unparsable", unparsableReason, cf.distributionLabel(req.Host))
+	}
+
+	switch cf.unparsableMode {
+	case unparsableDeny:
+		cf.writeDenial(rw, req, unparsableReason)
+	case unparsableStealth:
+		http.NotFound(rw, req)
+	default:
+		http.Error(rw, "Bad Request", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,285 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnparsableClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		remoteAddr string
+		wantStatus int
+	}{
+		{name: "Default", remoteAddr: "invalid-ip", wantStatus: http.StatusBadRequest},
+		{name: "Empty RemoteAddr", remoteAddr: "", wantStatus: http.StatusBadRequest},
+		{name: "Unix socket", remoteAddr: "@", wantStatus: http.StatusBadRequest},
+		{name: "Deny", mode: unparsableDeny, remoteAddr: "invalid-ip", wantStatus: http.StatusForbidden},
+		{name: "Stealth", mode: unparsableStealth, remoteAddr: "invalid-ip", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bans := filepath.Join(t.TempDir(), "fail2ban.log")
+			cfg := CreateConfig()
+			cfg.UnparsableClientIP = tt.mode
+			cfg.Fail2banLog = bans
+			next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+				t.Error("Expected the request not to be forwarded")
+			})
+			handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rw := httptest.NewRecorder()
+			cf.ServeHTTP(rw, req)
+
+			if rw.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, rw.Code)
+			}
+			status := cf.status()
+			if status.Unparsable != 1 || status.Denied != 0 {
+				t.Errorf("Expected 1 unparsable and no denied request, got %d and %d", status.Unparsable, status.Denied)
+			}
+			_ = cf.Close()
+			if raw, _ := os.ReadFile(bans); len(raw) != 0 {
+				t.Errorf("Expected no fail2ban line, got %q", raw)
+			}
+		})
+	}
+}
+
+func TestUnparsableClientIPLogIsRateLimited(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	now := time.Now()
+	cf := &CloudFrontGate{
+		name:  t.Name(),
+		ips:   newIPStore(""),
+		now:   func() time.Time { return now },
+		state: &gateState{},
+	}
+	for _, addr := range []string{"bogus:1", "other:2"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = addr
+		cf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	now = now.Add(unparsableLogInterval)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "third:3"
+	cf.ServeHTTP(httptest.NewRecorder(), req)
+
+	got := logs.String()
+	if !strings.Contains(got, `RemoteAddr "bogus:1" using strategy remoteAddr`) || !strings.Contains(got, `"third:3"`) {
+		t.Errorf("Expected warnings with the raw address and strategy, got %q", got)
+	}
+	if strings.Contains(got, "other:2") {
+		t.Errorf("Expected the second warning within the interval to be suppressed, got %q", got)
+	}
+}
+
+func TestValidateUnparsableClientIP(t *testing.T) {
+	if err := validateUnparsableClientIP("drop"); err == nil {
+		t.Error("Expected an invalid mode to be rejected")
+	}
+}
+
+func TestClientIPStrategy(t *testing.T) {
+	depth := func(n int) *IPStrategyConfig {
+		return &IPStrategyConfig{Depth: n, TrustedProxies: []string{"10.0.0.0/8"}}
+	}
+	excluded := &IPStrategyConfig{ExcludedIPs: []string{"172.16.0.0/12"}, TrustedProxies: []string{"10.0.0.0/8"}}
+
+	tests := []struct {
+		name       string
+		strategy   *IPStrategyConfig
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "No strategy", remoteAddr: "10.0.0.1:1234", forwarded: []string{"205.251.249.10"}, want: "10.0.0.1"},
+		{name: "Depth 1", strategy: depth(1), remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.7, 205.251.249.10"}, want: "205.251.249.10"},
+		{name: "Depth 2", strategy: depth(2), remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.7, 205.251.249.10"}, want: "198.51.100.7"},
+		{name: "Multiple headers", strategy: depth(2), remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.7", "205.251.249.10, 10.1.1.1"}, want: "205.251.249.10"},
+		{name: "Whitespace and ports", strategy: depth(1), remoteAddr: "10.0.0.1:1234", forwarded: []string{" 198.51.100.7 ,  205.251.249.10:443  "}, want: "205.251.249.10"},
+		{name: "Bracketed IPv6 with port", strategy: depth(1), remoteAddr: "10.0.0.1:1234", forwarded: []string{"[2600:9000::1]:443"}, want: "2600:9000::1"},
+		{name: "Untrusted peer", strategy: depth(1), remoteAddr: "192.0.2.1:1234", forwarded: []string{"205.251.249.10"}, want: "192.0.2.1"},
+		{name: "Excluded", strategy: excluded, remoteAddr: "10.0.0.1:1234", forwarded: []string{"205.251.249.10, 172.16.0.5, 172.17.0.9"}, want: "205.251.249.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy, err := newIPStrategy(tt.strategy, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cf := &CloudFrontGate{ipStrategy: strategy}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if got := cf.clientIP(req); got.String() != tt.want {
+				t.Errorf("clientIP() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnparsableClientIPPerStrategy(t *testing.T) {
+	tests := []struct {
+		name      string
+		strategy  *IPStrategyConfig
+		forwarded []string
+		want      string
+	}{
+		{name: "Depth beyond chain", strategy: &IPStrategyConfig{Depth: 3, TrustedProxies: []string{"10.0.0.0/8"}}, forwarded: []string{"205.251.249.10"}, want: "xForwardedFor depth 3"},
+		{name: "Empty header", strategy: &IPStrategyConfig{Depth: 1, TrustedProxies: []string{"10.0.0.0/8"}}, forwarded: []string{""}, want: "xForwardedFor depth 1"},
+		{name: "Malformed entry", strategy: &IPStrategyConfig{Depth: 1, TrustedProxies: []string{"10.0.0.0/8"}}, forwarded: []string{"unknown"}, want: "xForwardedFor depth 1"},
+		{name: "All excluded", strategy: &IPStrategyConfig{ExcludedIPs: []string{"0.0.0.0/0"}, TrustedProxies: []string{"10.0.0.0/8"}}, forwarded: []string{"205.251.249.10"}, want: "xForwardedFor excludedIPs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			strategy, err := newIPStrategy(tt.strategy, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cf := &CloudFrontGate{name: t.Name(), ips: newIPStore(""), now: time.Now, state: &gateState{}, ipStrategy: strategy}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			rw := httptest.NewRecorder()
+			cf.ServeHTTP(rw, req)
+
+			if rw.Code != http.StatusBadRequest || cf.state.unparsable.Load() != 1 {
+				t.Errorf("Expected an unparsable outcome, got %d", rw.Code)
+			}
+			if !strings.Contains(logs.String(), "using strategy "+tt.want) {
+				t.Errorf("Expected the strategy %q in the warning, got %q", tt.want, logs.String())
+			}
+		})
+	}
+}
+
+func TestNewIPStrategyValidation(t *testing.T) {
+	for _, config := range []*IPStrategyConfig{
+		{Depth: -1, TrustedProxies: []string{"10.0.0.0/8"}},
+		{Depth: 1},
+		{Depth: 1, ExcludedIPs: []string{"10.0.0.0/8"}, TrustedProxies: []string{"10.0.0.0/8"}},
+		{Depth: 1, TrustedProxies: []string{"not-a-cidr"}},
+	} {
+		if _, err := newIPStrategy(config, nil); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
+
+func TestOnUnparsableRemoteAddr(t *testing.T) {
+	remoteAddrs := []string{"", "@", "pipe", "1.2.3.4", "[::1]:80"}
+	tests := []struct {
+		mode string
+		// want holds the status per entry of remoteAddrs.
+		want                          []int
+		unparsable, unparsableAllowed uint64
+	}{
+		{mode: "", want: []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, http.StatusForbidden, http.StatusForbidden}, unparsable: 3},
+		{mode: remoteAddrReject, want: []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, http.StatusForbidden, http.StatusForbidden}, unparsable: 3},
+		{mode: remoteAddrAllow, want: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusForbidden, http.StatusForbidden}, unparsableAllowed: 3},
+		// The forwarded address is a CloudFront edge; parsable peers outside
+		// trustedProxies are still checked themselves.
+		{mode: remoteAddrUseForwarded, want: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusForbidden, http.StatusForbidden}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			cfg := CreateConfig()
+			cfg.OnUnparsableRemoteAddr = tt.mode
+			cfg.IPStrategy = &IPStrategyConfig{Depth: 1, TrustedProxies: []string{"10.0.0.0/8"}}
+			handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+
+			for i, remoteAddr := range remoteAddrs {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+				req.RemoteAddr = remoteAddr
+				req.Header.Set("X-Forwarded-For", "205.251.249.10")
+				rw := httptest.NewRecorder()
+				cf.ServeHTTP(rw, req)
+				if rw.Code != tt.want[i] {
+					t.Errorf("RemoteAddr %q: status = %d, want %d", remoteAddr, rw.Code, tt.want[i])
+				}
+			}
+			status := cf.status()
+			if status.Unparsable != tt.unparsable || status.UnparsableAllowed != tt.unparsableAllowed || status.Denied != 2 {
+				t.Errorf("Expected %d unparsable, %d admitted unparsable and 2 denied, got %d, %d and %d",
+					tt.unparsable, tt.unparsableAllowed, status.Unparsable, status.UnparsableAllowed, status.Denied)
+			}
+			if tt.unparsable > 0 && !strings.Contains(logs.String(), `RemoteAddr "" using strategy`) {
+				t.Errorf("Expected a warning with the raw RemoteAddr, got %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestOnUnparsableRemoteAddrForwardedDenial(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.OnUnparsableRemoteAddr = remoteAddrUseForwarded
+	cfg.IPStrategy = &IPStrategyConfig{Depth: 1, TrustedProxies: []string{"10.0.0.0/8"}}
+	handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	for forwarded, want := range map[string]int{"192.0.2.1": http.StatusForbidden, "": http.StatusBadRequest} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "@"
+		req.Header.Set("X-Forwarded-For", forwarded)
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		if rw.Code != want {
+			t.Errorf("X-Forwarded-For %q: status = %d, want %d", forwarded, rw.Code, want)
+		}
+	}
+}
+
+func TestValidateOnUnparsableRemoteAddr(t *testing.T) {
+	// useForwardedHeader has no address to select without ipStrategy.
+	for _, mode := range []string{"drop", remoteAddrUseForwarded} {
+		cfg := CreateConfig()
+		cfg.OnUnparsableRemoteAddr = mode
+		_, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name())
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) || configErr.Field != "onUnparsableRemoteAddr" {
+			t.Errorf("%q: expected an onUnparsableRemoteAddr error, got %v", mode, err)
+		}
+	}
+}
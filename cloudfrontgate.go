@@ -3,14 +3,17 @@ package cloudfrontgate
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -19,27 +22,275 @@ type contextKey string
 
 const (
 	// CTXHTTPTimeout is the context key for the HTTP timeout.
+	//
+	// Deprecated: the timeout is set by the httpTimeout option and a value
+	// under this key is ignored.
 	CTXHTTPTimeout contextKey = "HTTPTimeout"
 	// CTXTrustedIPs is the context key for the trusted IP ranges.
+	//
+	// Deprecated: Update layers the ranges the store was given with
+	// setTrusted over every dataset, and a value under this key is ignored.
 	CTXTrustedIPs contextKey = "TrustedIPs"
+	// ctxVerifiedBy is the context key under which an instance records that
+	// it allowed the request, once marksVerified is set. The key type is
+	// unexported, so the marker cannot be set from outside the package.
+	ctxVerifiedBy contextKey = "verifiedBy"
 	// CFAPI is the CloudFront API URL.
 	CFAPI = "https://d7uri8nf7uskq.cloudfront.net/tools/list-cloudfront-ips"
-	// HTTPTimeoutDefault is the default HTTP timeout in seconds.
+	// HTTPTimeoutDefault is the default HTTP timeout of the fetches in seconds.
 	HTTPTimeoutDefault = 5
+	// ipListURL is the IP range source of New unless ipListURL is set.
+	ipListURL = CFAPI
 )
 
 // Config the plugin configuration.
 type Config struct {
 	// RefreshInterval is the interval between IP range updates
 	RefreshInterval string `json:"refreshInterval,omitempty"`
-	// AllowedIPs is a list of custom IP addresses or CIDR ranges that are allowed
+	// MinRefreshInterval is the shortest accepted refreshInterval, 1m by default; lower it only for tests
+	MinRefreshInterval string `json:"minRefreshInterval,omitempty"`
+	// IPListURL is the URL of the CloudFront IP list, such as an internal mirror; CFAPI by default
+	IPListURL string `json:"ipListURL,omitempty"`
+	// IPSource is the document format of the IP list: "cloudfront-tools" (default), "aws-ip-ranges" for ip-ranges.json, or "auto" to detect it
+	IPSource string `json:"ipSource,omitempty"`
+	// IPRegions restricts an ip-ranges.json document to these regions, e.g. "GLOBAL"
+	IPRegions []string `json:"ipRegions,omitempty"`
+	// IPLists selects the trusted CloudFront lists, "global" and "regional" (default both)
+	IPLists []string `json:"ipLists,omitempty"`
+	// AggregateCIDRs merges sibling prefixes of the same list into their parent; it has no effect with newPrefixQuarantine
+	AggregateCIDRs bool `json:"aggregateCIDRs,omitempty"`
+	// Sources lists additional IP lists, such as the edge list of another CDN, merged with the CloudFront list on every refresh
+	Sources []IPListSourceConfig `json:"sources,omitempty"`
+	// PartialOK applies a refresh where some sources failed, keeping their previous lists, as long as one source succeeded
+	PartialOK bool `json:"partialOk,omitempty"`
+	// Groups defines named CIDR lists that CIDR fields can reference as "@name"
+	Groups map[string][]string `json:"groups,omitempty"`
+	// AllowedIPs is a list of custom IP addresses, CIDR ranges or hostnames that are allowed; "!" entries carve out addresses that are not
 	AllowedIPs []string `json:"allowedIPs,omitempty"`
+	// AllowPrivateNetworks adds the private and link-local ranges of both families to AllowedIPs
+	AllowPrivateNetworks bool `json:"allowPrivateNetworks,omitempty"`
+	// AllowLoopback adds 127.0.0.0/8 and ::1 to AllowedIPs
+	AllowLoopback bool `json:"allowLoopback,omitempty"`
+	// AllowedIPsFile is a file of IPs and CIDRs merged into AllowedIPs; it is reloaded on change and by Refresh
+	AllowedIPsFile string `json:"allowedIPsFile,omitempty"`
+	// AllowedIPsFileOptional builds the middleware when AllowedIPsFile is missing, treating it as empty until it is created
+	AllowedIPsFileOptional bool `json:"allowedIPsFileOptional,omitempty"`
+	// DNSRefreshInterval is how often hostnames in AllowedIPs are re-resolved, refreshInterval by default
+	DNSRefreshInterval string `json:"dnsRefreshInterval,omitempty"`
+	// DNSFailurePolicy handles hostnames in AllowedIPs that stop resolving: "keep" (default) their last addresses, "drop" them or "fail" with 503 after DNSStaleGrace
+	DNSFailurePolicy string `json:"dnsFailurePolicy,omitempty"`
+	// DNSStaleGrace is how long a failing hostname keeps its addresses under the drop and fail policies, 1h by default
+	DNSStaleGrace string `json:"dnsStaleGrace,omitempty"`
+	// LenientDNS builds the middleware even when a hostname in AllowedIPs does not resolve at startup
+	LenientDNS bool `json:"lenientDNS,omitempty"`
+	// BlockedIPs is a list of IP addresses or CIDR ranges that are denied even when they are CloudFront or allowedIPs
+	BlockedIPs []string `json:"blockedIPs,omitempty"`
+	// RetryInterval is how often the IP ranges are retried after a failed refresh, 30s by default
+	RetryInterval string `json:"retryInterval,omitempty"`
+	// HTTPTimeout bounds each fetch of the IP ranges, including its sidecars, 5s by default
+	HTTPTimeout string `json:"httpTimeout,omitempty"`
+	// ProxyURL is the forward proxy of the fetches, replacing HTTPS_PROXY and HTTP_PROXY
+	ProxyURL string `json:"proxyURL,omitempty"`
+	// CABundleFile is a PEM file of the roots trusted by the fetches instead of the system ones
+	CABundleFile string `json:"caBundleFile,omitempty"`
+	// InsecureSkipVerify disables the certificate verification of the fetches; discouraged
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// CacheFile persists the last fetched IP ranges, loaded at startup when the source cannot be fetched
+	CacheFile string `json:"cacheFile,omitempty"`
+	// CacheMaxAge is the age beyond which the cache file is not loaded, 24h by default
+	CacheMaxAge string `json:"cacheMaxAge,omitempty"`
+	// VerifyMatcher checks every trie lookup against a linear scan and serves the scan; a debugging aid that slows every request
+	VerifyMatcher bool `json:"verifyMatcher,omitempty"`
+	// DecisionCacheSize is the number of client addresses whose CloudFront match is cached; 0 or -1 disables the cache, the default
+	DecisionCacheSize int `json:"decisionCacheSize,omitempty"`
+	// LogLevel is the verbosity of the logs: "debug", "info" (default) or "error"
+	LogLevel string `json:"logLevel,omitempty"`
+	// LogBlocked logs every blocked request at info level with the client IP and path
+	LogBlocked bool `json:"logBlocked,omitempty"`
+	// BlockSummaryInterval logs the most blocked client IPs of each period of this length, 5m by default; 0s disables it
+	BlockSummaryInterval string `json:"blockSummaryInterval,omitempty"`
+	// FailOpenOnStartup builds the middleware even when the first fetch fails, admitting every request until a fetch succeeds
+	FailOpenOnStartup bool `json:"failOpenOnStartup,omitempty"`
+	// StartupTimeout bounds the first fetch of the ranges when the middleware is built, "10s" by default
+	StartupTimeout string `json:"startupTimeout,omitempty"`
+	// AsyncStartup builds the middleware without waiting for the first fetch, which runs in the background
+	AsyncStartup bool `json:"asyncStartup,omitempty"`
+	// AllowRoute53HealthChecks also allows the Route 53 health checker ranges from ip-ranges.json
+	AllowRoute53HealthChecks bool `json:"allowRoute53HealthChecks,omitempty"`
+	// Route53HealthCheckPaths restricts the Route 53 health checkers to these request paths
+	Route53HealthCheckPaths []string `json:"route53HealthCheckPaths,omitempty"`
+	// Route53HealthChecksRefreshInterval and Route53HealthChecksRetryInterval schedule the health checker ranges; refreshInterval and retryInterval by default
+	Route53HealthChecksRefreshInterval string `json:"route53HealthChecksRefreshInterval,omitempty"`
+	Route53HealthChecksRetryInterval   string `json:"route53HealthChecksRetryInterval,omitempty"`
+	// MaintenanceWindows trust additional CIDRs during scheduled periods
+	MaintenanceWindows []MaintenanceWindow `json:"maintenanceWindows,omitempty"`
+	// AnchorCIDRs are prefixes that every fetched CloudFront dataset must contain or cover
+	AnchorCIDRs []string `json:"anchorCIDRs,omitempty"`
+	// SkipAnchorCheck disables the anchor check for the source
+	SkipAnchorCheck bool `json:"skipAnchorCheck,omitempty"`
+	// ChecksumURL points to a SHA-256 checksum of the IP list document
+	ChecksumURL string `json:"checksumURL,omitempty"`
+	// PublicKey is a base64 ed25519 public key used to verify the IP list document
+	PublicKey string `json:"publicKey,omitempty"`
+	// SignatureURL points to a detached ed25519 signature of the IP list document
+	SignatureURL string `json:"signatureURL,omitempty"`
+	// PinnedSHA256 lists acceptable base64 SHA-256 fingerprints of the IP list server's public keys
+	PinnedSHA256 []string `json:"pinnedSHA256,omitempty"`
+	// SigV4 signs the IP list requests with AWS Signature Version 4, for a mirror in a private S3 bucket
+	SigV4 *SigV4Config `json:"sigV4,omitempty"`
+	// AllowPrivateSources permits fetching non-default sources from loopback, link-local and private addresses
+	AllowPrivateSources bool `json:"allowPrivateSources,omitempty"`
+	// MaxRedirects is the maximum number of redirects followed when fetching the IP list
+	MaxRedirects int `json:"maxRedirects,omitempty"`
+	// SameHostRedirects only follows redirects to the host of the original request
+	SameHostRedirects bool `json:"sameHostRedirects,omitempty"`
+	// SelfCheck controls the startup self-check: "log" (default), "strict" to fail startup, or "off"
+	SelfCheck string `json:"selfCheck,omitempty"`
+	// DetectSpoofedForwarding compares CloudFront-Viewer-Address with the leftmost X-Forwarded-For entry: "off" (default), "log" or "deny"
+	DetectSpoofedForwarding string `json:"detectSpoofedForwarding,omitempty"`
+	// ForwardedHeaderPolicy handles the client address headers passed to the backend: "passthrough" (default), "sanitize" or "rewrite"
+	ForwardedHeaderPolicy string `json:"forwardedHeaderPolicy,omitempty"`
+	// ResolveOverrides maps source host names to "ip:port" addresses dialed instead of resolving the name
+	ResolveOverrides map[string][]string `json:"resolveOverrides,omitempty"`
+	// UnavailableRetryAfter is the Retry-After of 503 responses sent while the gate has no data, "30s" by default
+	UnavailableRetryAfter string `json:"unavailableRetryAfter,omitempty"`
+	// StaleWarningAfter is the data age after which the ranges are considered stale, e.g. "26h"
+	StaleWarningAfter string `json:"staleWarningAfter,omitempty"`
+	// MaxStaleness is the data age after which staleAction applies, e.g. "168h"
+	MaxStaleness string `json:"maxStaleness,omitempty"`
+	// StaleAction is "ignore" (default), "failClosed" to admit only allowedIPs, or "failOpen" to admit everything not denied
+	StaleAction string `json:"staleAction,omitempty"`
+	// DataAgeHeader sets X-CFGate-Data-Age on allowed responses while the data is stale
+	DataAgeHeader bool `json:"dataAgeHeader,omitempty"`
+	// SourceHeader sets X-CFGate-Source on allowed requests to the source that admitted them
+	SourceHeader bool `json:"sourceHeader,omitempty"`
+	// DebugHeaders sets X-CFGate-Match on allowed responses to the list that matched the client
+	DebugHeaders bool `json:"debugHeaders,omitempty"`
+	// AllowedHosts lists the expected Host header values; "*.example.com" matches any subdomain
+	AllowedHosts []string `json:"allowedHosts,omitempty"`
+	// AllowedViewerCountries lists ISO 3166-1 alpha-2 codes accepted in CloudFront-Viewer-Country
+	AllowedViewerCountries []string `json:"allowedViewerCountries,omitempty"`
+	// OnMissingCountry handles requests without CloudFront-Viewer-Country: "deny" (default) or "allow"
+	OnMissingCountry string `json:"onMissingCountry,omitempty"`
+	// ViewerAllowedIPs restricts the viewer address reported by the edge to these CIDRs
+	ViewerAllowedIPs []string `json:"viewerAllowedIPs,omitempty"`
+	// ViewerBlockedIPs denies the viewer addresses in these CIDRs, before viewerAllowedIPs
+	ViewerBlockedIPs []string `json:"viewerBlockedIPs,omitempty"`
+	// ViewerHeader carries the viewer address: "CloudFront-Viewer-Address" (default) or "True-Client-IP"
+	ViewerHeader string `json:"viewerHeader,omitempty"`
+	// DenylistFile is a file of IPs and CIDRs that are denied even when otherwise allowed; it is reloaded on change
+	DenylistFile string `json:"denylistFile,omitempty"`
+	// DecisionLogFile receives one Common Log Format line per allowed or denied request
+	DecisionLogFile string `json:"decisionLogFile,omitempty"`
+	// DecisionLogFormat is "combined" (default) or "common"
+	DecisionLogFormat string `json:"decisionLogFormat,omitempty"`
+	// Fail2banLog receives one line per denied request in a format for fail2ban filters
+	Fail2banLog string `json:"fail2banLog,omitempty"`
+	// DenialMirror posts a capped sample of denied request metadata to an HTTP sink
+	DenialMirror *DenialMirrorConfig `json:"denialMirror,omitempty"`
+	// SecretHeaderRules require secret headers on path prefixes; the first matching rule applies
+	SecretHeaderRules []SecretHeaderRule `json:"secretHeaderRules,omitempty"`
+	// OriginVerifyHeader is a header the distribution adds with one of the OriginVerifySecrets, required on every request and removed before forwarding
+	OriginVerifyHeader string `json:"originVerifyHeader,omitempty"`
+	// OriginVerifySecrets lists the accepted values of OriginVerifyHeader; list several to rotate
+	OriginVerifySecrets []string `json:"originVerifySecrets,omitempty"`
+	// OriginVerifySecretsFile is a file holding the accepted values, one per line, instead of OriginVerifySecrets
+	OriginVerifySecretsFile string `json:"originVerifySecretsFile,omitempty"`
+	// MinSecretLength is the minimum length of secret header values, 16 by default; 0 only rejects placeholders
+	MinSecretLength int `json:"minSecretLength,omitempty"`
+	// StrictSecrets fails construction on weak secret values instead of logging a warning
+	StrictSecrets bool `json:"strictSecrets,omitempty"`
+	// Distributions overlay the base configuration for the hosts of a distribution, keyed by host pattern
+	Distributions map[string]DistributionConfig `json:"distributions,omitempty"`
+	// EnforcePercent is the share of clients whose denials are enforced; the others are logged and allowed
+	EnforcePercent int `json:"enforcePercent,omitempty"`
+	// RejectStatusCode is the status of denied requests, 403 by default
+	RejectStatusCode int `json:"rejectStatusCode,omitempty"`
+	// RejectBody is the body of denied requests, "Forbidden" by default
+	RejectBody string `json:"rejectBody,omitempty"`
+	// RejectContentType is the content type of denied requests; application/json for a JSON rejectBody, text/plain otherwise
+	RejectContentType string `json:"rejectContentType,omitempty"`
+	// Mode is "enforce" (default) or "reportOnly", which logs and allows every request that would be denied
+	Mode string `json:"mode,omitempty"`
+	// ReportLogInterval logs at most one audit line per client IP within this interval, 1m by default; 0s logs every one
+	ReportLogInterval string `json:"reportLogInterval,omitempty"`
+	// ResolutionOrder orders "denylist" and "allowedIPs" for addresses listed in both; the denylist wins by default
+	ResolutionOrder []string `json:"resolutionOrder,omitempty"`
+	// AuditDir receives a snapshot file whenever the effective allowlist changes
+	AuditDir string `json:"auditDir,omitempty"`
+	// AuditRetention removes audit files older than this, 2160h by default
+	AuditRetention string `json:"auditRetention,omitempty"`
+	// AuditMaxFiles keeps at most this many audit files, 1000 by default
+	AuditMaxFiles int `json:"auditMaxFiles,omitempty"`
+	// ShutdownTimeout bounds how long Close waits to flush the StatsD, decision, fail2ban and mirror outputs, 5s by default
+	ShutdownTimeout string `json:"shutdownTimeout,omitempty"`
+	// LearningMode audits every denial and collects the denied source prefixes for the learning admin endpoint
+	LearningMode bool `json:"learningMode,omitempty"`
+	// LearningTTL forgets learned prefixes not seen for this long, 168h by default
+	LearningTTL string `json:"learningTTL,omitempty"`
+	// LearningMaxPrefixes bounds the learned prefixes, 10000 by default
+	LearningMaxPrefixes int `json:"learningMaxPrefixes,omitempty"`
+	// NewPrefixQuarantine is how long prefixes that newly appear in the fetched data are not trusted, e.g. "1h"
+	NewPrefixQuarantine string `json:"newPrefixQuarantine,omitempty"`
+	// QuarantinePolicy handles requests that only match quarantined prefixes: "deny" (default), "log" or "allow"
+	QuarantinePolicy string `json:"quarantinePolicy,omitempty"`
+	// MaxShrinkPercent rejects updates that drop more than this share of the fetched prefixes; 0 disables the check
+	MaxShrinkPercent int `json:"maxShrinkPercent,omitempty"`
+	// ShadowSource is fetched with every refresh and compared with the active source, but never enforced
+	ShadowSource *ShadowSourceConfig `json:"shadowSource,omitempty"`
+	// StatsD pushes metrics to a StatsD server
+	StatsD *StatsDConfig `json:"statsd,omitempty"`
+	// AdminPath is the path prefix of the admin endpoints; they are disabled when empty
+	AdminPath string `json:"adminPath,omitempty"`
+	// AdminToken is the bearer token required by the admin endpoints
+	AdminToken string `json:"adminToken,omitempty"`
+	// AdminTokenFile is a file holding the admin bearer token
+	AdminTokenFile string `json:"adminTokenFile,omitempty"`
+	// AdminAllowedIPs restricts the admin endpoints to direct peers in these CIDRs
+	AdminAllowedIPs []string `json:"adminAllowedIPs,omitempty"`
+	// AdminStealth answers failed admin authentication with 404 instead of 401/403
+	AdminStealth bool `json:"adminStealth,omitempty"`
+	// IPStrategy takes the checked address from X-Forwarded-For when the direct peer is a trusted proxy
+	IPStrategy *IPStrategyConfig `json:"ipStrategy,omitempty"`
+	// UnparsableClientIP answers requests whose client IP cannot be determined: "badRequest" (default, 400), "deny" (the denial response) or "stealth" (404)
+	UnparsableClientIP string `json:"unparsableClientIP,omitempty"`
+	// OnUnparsableRemoteAddr handles a RemoteAddr that is not an address, as behind unix sockets: "reject" (default, per unparsableClientIP), "allow" without checking, or "useForwardedHeader" to check the address ipStrategy selects
+	OnUnparsableRemoteAddr string `json:"onUnparsableRemoteAddr,omitempty"`
+	// ServerTiming adds a Server-Timing entry with the gate's evaluation time: "off" (default), "allow" on allowed responses, or "all"
+	ServerTiming string `json:"serverTiming,omitempty"`
+	// HealthPath is answered by the middleware itself: 200 while the data is loaded and not stale, 503 otherwise
+	HealthPath string `json:"healthPath,omitempty"`
+	// StatusPath serves the Status of the instance as JSON to clients in AllowedIPs; others get the denial response
+	StatusPath string `json:"statusPath,omitempty"`
+	// RefreshPath refreshes the IP ranges on a POST from clients in AllowedIPs; others get the denial response
+	RefreshPath string `json:"refreshPath,omitempty"`
+	// MetricsPath serves Prometheus metrics to clients in AllowedIPs; others get the denial response
+	MetricsPath string `json:"metricsPath,omitempty"`
+	// HealthAllowedIPs restricts the health path to direct peers in these CIDRs
+	HealthAllowedIPs []string `json:"healthAllowedIPs,omitempty"`
+	// HealthBody adds a JSON body with the status, mode and data age to the health path responses
+	HealthBody bool `json:"healthBody,omitempty"`
+	// ForwardAuth answers a path with the verdict for the request described by its forward-auth headers
+	ForwardAuth *ForwardAuthConfig `json:"forwardAuth,omitempty"`
+	// ExcludedPaths bypass the gate: exact paths, "/prefix/*" for everything below a prefix, or path.Match globs
+	ExcludedPaths []string `json:"excludedPaths,omitempty"`
+	// ExcludedMethods bypass the gate on any path, e.g. OPTIONS
+	ExcludedMethods []string `json:"excludedMethods,omitempty"`
+	// SkipIfAlreadyVerified passes requests through when an earlier instance in the same chain already allowed them.
+	// Once any instance of the process sets it, every instance marks the requests it allows, which costs each a copy
+	// of the request and its context
+	SkipIfAlreadyVerified bool `json:"skipIfAlreadyVerified,omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		RefreshInterval: "24h",
+		RefreshInterval:  "24h",
+		AnchorCIDRs:      append([]string(nil), defaultAnchorCIDRs...),
+		MaxRedirects:     defaultMaxRedirects,
+		MaxShrinkPercent: defaultMaxShrinkPercent,
+		MinSecretLength:  defaultMinSecretLength,
+		EnforcePercent:   defaultEnforcePercent,
 	}
 }
 
@@ -48,164 +299,1608 @@ type CloudFrontGate struct {
 	next http.Handler
 
 	name string
-	ips  *ipstore
+	// instance is name in the registry, in the namespace of the Checkers
+	// for the instance behind one.
+	instance instanceName
+	now      func() time.Time
+	ips      *ipstore
+	entry    *registryEntry
+	state    *gateState
 
-	refreshInterval time.Duration
-	trustedIPs      []net.IPNet
+	// healthChecks holds the Route 53 health checker ranges, when enabled.
+	healthChecks *ipstore
+	healthEntry  *registryEntry
+	healthPaths  []string
+
+	// statsd pushes metrics when configured.
+	statsd *statsdPusher
+	// denylist overrides allow decisions when configured.
+	denylist *cidrFile
+	// allowedIPsFile is merged into allowedIPs when configured.
+	allowedIPsFile *cidrFile
+	// hostAllowlist resolves the hostname entries of allowedIPs, if any.
+	hostAllowlist *hostAllowlist
+	// decisionLog writes one access log line per decision when configured.
+	decisionLog *decisionLog
+	// fail2ban writes one line per policy denial when configured.
+	fail2ban *fail2banLog
+	// mirror posts sampled denials when configured.
+	mirror *denialMirror
+	// auditLog writes a snapshot file per allowlist change when configured.
+	auditLog *auditLog
+
+	// quarantinePolicy handles requests that only match quarantined prefixes.
+	quarantinePolicy string
+	// secretHeaderRules are checked in order after the IP check.
+	secretHeaderRules []secretHeaderRule
+	// originVerify is required on every request when set.
+	originVerify *secretHeaderRule
+	// distributions overlay the base configuration, selected by Host.
+	distributions []*distribution
+	// stages decide for the peer address in order.
+	stages []resolutionStage
+	// audit lets denials outside the enforcePercent share through.
+	audit          bool
+	enforcePercent int
+	// reportOnly audits every denial; reportLogInterval limits the lines.
+	reportOnly        bool
+	reportLogInterval time.Duration
+	// learning collects the prefixes of audited IP denials.
+	learning            bool
+	learningTTL         time.Duration
+	learningMaxPrefixes int
+
+	// config is the applied configuration with secrets redacted.
+	config *Config
+
+	// allowedIPs holds the *allowedSet, which SetAllowedIPs replaces;
+	// groups and allowedExtra are kept to parse the replacements.
+	allowedIPs   atomic.Value
+	groups       cidrGroups
+	allowedExtra []string
+
+	refreshInterval       time.Duration
+	blockedIPs            []netip.Prefix
+	windows               []*maintenanceWindow
+	skipIfAlreadyVerified bool
+	spoofMode             string
+	forwardedPolicy       string
+	allowedHosts          hostPatterns
+	retryAfter            time.Duration
+	staleWarningAfter     time.Duration
+	maxStaleness          time.Duration
+	staleAction           string
+	dataAgeHeader         bool
+	sourceHeader          bool
+	debugHeaders          bool
+	viewerCountries       map[string]bool
+	allowMissingCountry   bool
+	unparsableMode        string
+	onUnparsablePeer      string
+	// viewerRules checks the viewer address; nil checks nothing.
+	viewerRules *viewerRules
+	// rejection is the response of denied requests; nil is the default.
+	rejection *rejection
+	// exclusions bypass the gate; nil excludes nothing.
+	exclusions *exclusions
+	// ipStrategy selects the checked address; nil checks the direct peer.
+	ipStrategy *ipStrategy
+	// timeAllowed and timeDenied emit Server-Timing entries.
+	timeAllowed bool
+	timeDenied  bool
+
+	// admin is nil unless an admin path is configured.
+	admin *adminConfig
+	// forwardAuth is nil unless a forward-auth path is configured.
+	forwardAuth *forwardAuth
+	// healthPath is answered by serveHealth unless empty.
+	healthPath       string
+	healthAllowedIPs []net.IPNet
+	healthBody       bool
+	// statusPath is answered by serveStatusPath to allowed IPs unless empty.
+	statusPath string
+	// refreshPath is answered by serveRefreshPath to allowed IPs unless empty.
+	refreshPath string
+	// metricsPath is answered by serveMetricsPath to allowed IPs unless empty.
+	metricsPath string
+
+	// inherited is set when construction could not fetch the ranges and
+	// adopted the data of a previous instance with the same source.
+	inherited bool
+	// failOpenOnStartup admits requests until the sources are first fetched.
+	failOpenOnStartup bool
+	// verifyMatcher checks the trie against a linear scan on every lookup.
+	verifyMatcher bool
+	// decisions caches the CloudFront matches of recent clients.
+	decisions *decisionCache
+	// logger filters and writes the leveled logs; logBlocked logs denials.
+	logger     *gateLogger
+	logBlocked bool
+	// blockSummaryInterval is the period of the blocked summary, zero when
+	// disabled.
+	blockSummaryInterval time.Duration
+
+	stopRelease func() bool
+	closeOnce   sync.Once
+	releaseOnce sync.Once
+	// releaseErr reports the shared entries that did not stop in time.
+	releaseErr error
+	// generation identifies this construction in the registry.
+	generation uint64
+	// shutdownTimeout bounds how long Close waits for the sinks.
+	shutdownTimeout time.Duration
+}
+
+// denyReason identifies why a request was denied.
+type denyReason int
+
+const (
+	denyIP denyReason = iota
+	denySpoofed
+	denyCountry
+	denyHost
+	denyHealthCheckPath
+	denyDenylist
+	denyQuarantined
+	denySecretHeader
+	denyStale
+	denyViewerIP
+	denyViewerMissing
+	denyReasonCount
+)
+
+// String returns the reason code.
+func (r denyReason) String() string {
+	switch r {
+	case denyIP:
+		return "ip"
+	case denySpoofed:
+		return "spoofed_forwarding"
+	case denyCountry:
+		return "viewer_country"
+	case denyHost:
+		return "unexpected-host"
+	case denyHealthCheckPath:
+		return "health-check-path"
+	case denyDenylist:
+		return "denylist"
+	case denyQuarantined:
+		return "quarantined-prefix"
+	case denySecretHeader:
+		return "secret-header"
+	case denyStale:
+		return "stale-data"
+	case denyViewerIP:
+		return "viewer-ip"
+	case denyViewerMissing:
+		return "viewer-ip-missing"
+	default:
+		return "unknown"
+	}
+}
+
+// gateState is the runtime state of a middleware that survives
+// reconstructions whose configuration only differs in soft fields.
+type gateState struct {
+	allowed   atomic.Uint64
+	denied    atomic.Uint64
+	delegated atomic.Uint64
+	spoofed   atomic.Uint64
+	deniedBy  [denyReasonCount]atomic.Uint64
+	// excluded counts requests that bypassed the gate by path or method.
+	excluded atomic.Uint64
+	// secretHeaders counts the decisions of each secret header rule.
+	secretHeaders labeledCounters
+	// distributions counts the decisions of each distribution.
+	distributions labeledCounters
+	// learner collects would-be-denied prefixes in learning mode.
+	learner learner
+	// audited counts denials let through by a partial enforcePercent.
+	audited   atomic.Uint64
+	auditedBy [denyReasonCount]atomic.Uint64
+	// unavailable counts requests refused because the gate is degraded.
+	unavailable atomic.Uint64
+	// unavailableLoggedAt is the UnixNano of the last degraded state log.
+	unavailableLoggedAt atomic.Int64
+	// staleLoggedAt is the UnixNano of the last staleAction log.
+	staleLoggedAt atomic.Int64
+	// failedOpen counts requests admitted before the first successful fetch,
+	// or beyond maxStaleness by the failOpen staleAction.
+	failedOpen atomic.Uint64
+	// matcherDivergences counts lookups where verifyMatcher found the trie
+	// and the linear scan disagree; divergenceLoggedAt is the UnixNano of
+	// the last warning about them.
+	matcherDivergences atomic.Uint64
+	divergenceLoggedAt atomic.Int64
+	// auditLines limits the audit lines per address.
+	auditLines auditLimiter
+	// unparsable counts requests without a parsable client address, and
+	// unparsableLoggedAt is the UnixNano of the last warning about them.
+	unparsable         atomic.Uint64
+	unparsableLoggedAt atomic.Int64
+	allowedBy          [trustSourceCount]atomic.Uint64
+	// unparsableAllowed counts the requests admitted unchecked by
+	// onUnparsableRemoteAddr allow.
+	unparsableAllowed atomic.Uint64
+	// allowedByFamily and deniedByFamily count the decisions per address
+	// family of the client.
+	allowedByFamily [addrFamilyCount]atomic.Uint64
+	deniedByFamily  [addrFamilyCount]atomic.Uint64
+	// viewerLoggedAt is the UnixNano of the last warning about an edge
+	// request without a viewer address.
+	viewerLoggedAt atomic.Int64
+	// mirrored, mirrorFailed and mirrorDropped count the denials sent to,
+	// failed to reach and dropped before the denial mirror.
+	mirrored      atomic.Uint64
+	mirrorFailed  atomic.Uint64
+	mirrorDropped atomic.Uint64
+
+	// blocked aggregates the denials per address for blockSummaryInterval.
+	blocked blockSummary
+	// responses counts the backend responses when they are recorded.
+	responses responseCounters
+
+	adminLimiter adminLimiter
+	statsd       statsdCounters
 }
 
 // New created a new CloudFrontGate plugin.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	ips := newIPStore(CFAPI)
+	return newGate(ctx, next, config, name, options{})
+}
 
-	refreshInterval, err := time.ParseDuration(config.RefreshInterval)
+// newGate builds the instance of New and NewWithOptions.
+func newGate(ctx context.Context, next http.Handler, config *Config, name string, opts options) (http.Handler, error) {
+	// A cancelled context would close the instance as soon as it is built.
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("failed to create middleware: %w", err)
+	}
+	minRefresh, err := parseMinRefreshInterval(config.MinRefreshInterval)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse refresh interval: %w", err)
+		return nil, invalidConfig("minRefreshInterval", err)
 	}
-
-	trustedIPs, err := parseCIDRs(config.AllowedIPs)
+	refreshInterval, err := parseRefreshInterval(config.RefreshInterval, "refreshInterval", minRefresh)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse trusted IPs: %w", err)
+		return nil, invalidConfig("refreshInterval", err)
 	}
 
-	ctxUpdate := createContext(ctx, HTTPTimeoutDefault, trustedIPs)
-
-	if err := ips.Update(ctxUpdate); err != nil {
-		return nil, fmt.Errorf("failed to update CloudFront IP ranges: %w", err)
+	if err := validateSelfCheck(config.SelfCheck); err != nil {
+		return nil, invalidConfig("selfCheck", err)
+	}
+	logLevel, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return nil, invalidConfig("logLevel", err)
 	}
 
 	cf := &CloudFrontGate{
-		next: next,
-		name: name,
+		next:     next,
+		name:     name,
+		instance: instanceName{name: name, checker: opts.checker},
+		now:      time.Now,
 
-		ips:             ips,
-		trustedIPs:      trustedIPs,
 		refreshInterval: refreshInterval,
+		logger:          newGateLogger(logLevel),
+		logBlocked:      config.LogBlocked,
+	}
+
+	if err := cf.applyConfig(config); err != nil {
+		return nil, err
+	}
+
+	retryInterval, err := parseRetryInterval(config.RetryInterval, "retryInterval")
+	if err != nil {
+		return nil, invalidConfig("retryInterval", err)
+	}
+	src := sourceConfig{RefreshInterval: refreshInterval, RetryInterval: retryInterval}
+	src.setHTTPClient(opts.client)
+	if err := parseIPSource(config, &src); err != nil {
+		return nil, err
+	}
+	if src.URL, err = parseIPListURL(config.IPListURL, src.URL); err != nil {
+		return nil, invalidConfig("ipListURL", err)
+	}
+
+	if config.CacheFile != "" {
+		src.CacheFile = config.CacheFile
+		src.CacheMaxAge = defaultCacheMaxAge
+		if config.CacheMaxAge != "" {
+			if src.CacheMaxAge, err = time.ParseDuration(config.CacheMaxAge); err != nil {
+				return nil, invalidConfig("cacheMaxAge", fmt.Errorf("failed to parse cache max age: %w", err))
+			}
+			if src.CacheMaxAge <= 0 {
+				return nil, invalidConfig("cacheMaxAge", fmt.Errorf("invalid cacheMaxAge %q: must be positive", config.CacheMaxAge))
+			}
+		}
+	}
+
+	if config.HTTPTimeout != "" {
+		timeout, err := time.ParseDuration(config.HTTPTimeout)
+		if err != nil {
+			return nil, invalidConfig("httpTimeout", fmt.Errorf("failed to parse http timeout: %w", err))
+		}
+		if timeout <= 0 {
+			return nil, invalidConfig("httpTimeout", fmt.Errorf("invalid httpTimeout %q: must be positive", config.HTTPTimeout))
+		}
+		src.HTTPTimeout = timeout
+	}
+
+	if config.ProxyURL != "" {
+		if _, err := parseProxyURL(config.ProxyURL); err != nil {
+			return nil, invalidConfig("proxyURL", err)
+		}
+		src.ProxyURL = config.ProxyURL
+	}
+	if config.CABundleFile != "" {
+		if src.CABundle, err = loadCABundle(config.CABundleFile); err != nil {
+			return nil, invalidConfig("caBundleFile", err)
+		}
+	}
+	if config.InsecureSkipVerify {
+		cf.logger.errorf("CloudFrontGate %s: insecureSkipVerify accepts any certificate from the IP list servers", name)
+		src.InsecureSkipVerify = true
+	}
+
+	if !config.SkipAnchorCheck {
+		anchors, err := parseCIDRs(config.AnchorCIDRs)
+		if err != nil {
+			return nil, invalidConfig("anchorCIDRs", fmt.Errorf("failed to parse anchor CIDRs: %w", err))
+		}
+		for _, anchor := range anchors {
+			src.Anchors = append(src.Anchors, anchor.String())
+		}
+	}
+
+	src.Integrity = integrityConfig{
+		ChecksumURL:  config.ChecksumURL,
+		PublicKey:    config.PublicKey,
+		SignatureURL: config.SignatureURL,
+	}
+	if err := src.Integrity.validate(); err != nil {
+		return nil, invalidConfig("signatureURL", err)
+	}
+
+	src.AllowPrivate = config.AllowPrivateSources
+
+	sigV4, err := parseSigV4(config.SigV4)
+	if err != nil {
+		return nil, invalidConfig("sigV4", err)
+	}
+	src.SigV4 = sigV4
+
+	if config.MaxRedirects < 0 {
+		return nil, invalidConfig("maxRedirects", fmt.Errorf("invalid maxRedirects %d: must not be negative", config.MaxRedirects))
+	}
+	src.MaxRedirects = config.MaxRedirects
+	src.SameHostRedirects = config.SameHostRedirects
+
+	if config.MaxShrinkPercent < 0 || config.MaxShrinkPercent > 100 {
+		return nil, invalidConfig("maxShrinkPercent", fmt.Errorf("invalid maxShrinkPercent %d: must be between 0 and 100", config.MaxShrinkPercent))
+	}
+	src.MaxShrinkPercent = config.MaxShrinkPercent
+	src.Aggregate = config.AggregateCIDRs
+
+	if config.NewPrefixQuarantine != "" {
+		quarantine, err := time.ParseDuration(config.NewPrefixQuarantine)
+		if err != nil {
+			return nil, invalidConfig("newPrefixQuarantine", fmt.Errorf("failed to parse new prefix quarantine: %w", err))
+		}
+		if quarantine < 0 {
+			return nil, invalidConfig("newPrefixQuarantine", errors.New("newPrefixQuarantine must not be negative"))
+		}
+		src.Quarantine = quarantine
+	}
+
+	if len(config.ResolveOverrides) > 0 {
+		overrides, err := parseResolveOverrides(config.ResolveOverrides)
+		if err != nil {
+			return nil, invalidConfig("resolveOverrides", err)
+		}
+		src.ResolveOverrides = overrides
+	}
+
+	shadow, err := parseShadowSource(config.ShadowSource)
+	if err != nil {
+		return nil, invalidConfig("shadowSource", err)
+	}
+	src.Shadow = shadow
+
+	if src.Extra, err = parseExtraSources(config.Sources); err != nil {
+		return nil, invalidConfig("sources", err)
+	}
+	src.PartialOK = config.PartialOK
+
+	if len(config.PinnedSHA256) > 0 {
+		if _, err := parsePins(config.PinnedSHA256); err != nil {
+			return nil, invalidConfig("pinnedSHA256", err)
+		}
+		if !strings.HasPrefix(src.URL, "https://") {
+			return nil, invalidConfig("pinnedSHA256", errors.New("pinnedSHA256 requires an https IP list URL"))
+		}
+		if len(src.Extra) > 0 {
+			return nil, invalidConfig("pinnedSHA256", errors.New("pinnedSHA256 cannot be combined with sources: the pins would apply to every source"))
+		}
+		if src.InsecureSkipVerify {
+			return nil, invalidConfig("pinnedSHA256", errors.New("pinnedSHA256 cannot be combined with insecureSkipVerify, which leaves no verified chain to pin"))
+		}
+		src.Pins = config.PinnedSHA256
+	}
+
+	startup := startupPolicy{failOpen: config.FailOpenOnStartup, timeout: defaultStartupTimeout, async: config.AsyncStartup}
+	if config.StartupTimeout != "" {
+		if startup.timeout, err = time.ParseDuration(config.StartupTimeout); err != nil {
+			return nil, invalidConfig("startupTimeout", fmt.Errorf("failed to parse startup timeout: %w", err))
+		}
+		if startup.timeout <= 0 {
+			return nil, invalidConfig("startupTimeout", fmt.Errorf("invalid startupTimeout %q: must be positive", config.StartupTimeout))
+		}
+	}
+
+	// Instances with the same source share one store; the trusted IPs are
+	// layered on top per instance and never written into the shared store.
+	cf.failOpenOnStartup = config.FailOpenOnStartup
+	if config.DecisionCacheSize < -1 {
+		return nil, invalidConfig("decisionCacheSize", fmt.Errorf("invalid decisionCacheSize %d: must be positive, or 0 or -1 to disable", config.DecisionCacheSize))
+	}
+	cf.decisions = newDecisionCache(config.DecisionCacheSize)
+	if config.VerifyMatcher {
+		cf.verifyMatcher = true
+		cf.logger.infof("CloudFrontGate %s: verifyMatcher runs the trie and a linear scan on every request and slows each one down; enable it only to validate the matcher", name)
+	}
+	entry, inherited, err := acquireEntry(ctx, src, "CloudFront IP ranges", startup, cf.logger)
+	if err != nil {
+		return nil, err
+	}
+	cf.ips = entry.ips
+	cf.entry = entry
+	cf.inherited = inherited
+
+	if config.AllowRoute53HealthChecks {
+		healthRefresh := refreshInterval
+		if config.Route53HealthChecksRefreshInterval != "" {
+			healthRefresh, err = parseRefreshInterval(config.Route53HealthChecksRefreshInterval, "route53HealthChecksRefreshInterval", minRefresh)
+			if err != nil {
+				_ = releaseEntry(entry, cf.logger)
+				return nil, invalidConfig("route53HealthChecksRefreshInterval", err)
+			}
+		}
+		healthRetry := retryInterval
+		if config.Route53HealthChecksRetryInterval != "" {
+			healthRetry, err = parseRetryInterval(config.Route53HealthChecksRetryInterval, "route53HealthChecksRetryInterval")
+			if err != nil {
+				_ = releaseEntry(entry, cf.logger)
+				return nil, invalidConfig("route53HealthChecksRetryInterval", err)
+			}
+		}
+
+		healthSrc := sourceConfig{
+			URL:                awsIPRangesURL,
+			RefreshInterval:    healthRefresh,
+			RetryInterval:      healthRetry,
+			Service:            serviceRoute53HealthChecks,
+			AllowPrivate:       config.AllowPrivateSources,
+			MaxRedirects:       config.MaxRedirects,
+			SameHostRedirects:  config.SameHostRedirects,
+			ResolveOverrides:   src.ResolveOverrides,
+			MaxShrinkPercent:   src.MaxShrinkPercent,
+			HTTPTimeout:        src.HTTPTimeout,
+			ProxyURL:           src.ProxyURL,
+			CABundle:           src.CABundle,
+			InsecureSkipVerify: src.InsecureSkipVerify,
+		}
+		healthSrc.setHTTPClient(opts.client)
+		healthEntry, _, err := acquireEntry(ctx, healthSrc, "Route 53 health check ranges", startup, cf.logger)
+		if err != nil {
+			_ = releaseEntry(entry, cf.logger)
+			return nil, err
+		}
+		cf.healthChecks = healthEntry.ips
+		cf.healthEntry = healthEntry
+	}
+
+	// Structural changes (the source or the client address strategy) start
+	// from a clean state; anything else is applied in place and keeps the
+	// runtime state.
+	state, reused := sharedRegistry.state(cf.instance, stateKey(src, cf.ipStrategy))
+	cf.state = state
+	if reused {
+		cf.logger.infof("CloudFrontGate %s: configuration applied in place, runtime state kept", name)
+	} else {
+		cf.logger.infof("CloudFrontGate %s: configuration built with a new runtime state", name)
+	}
+
+	decisionLog, err := newDecisionLog(config.DecisionLogFile, config.DecisionLogFormat, cf.logger)
+	if err != nil {
+		_ = cf.Close()
+		return nil, invalidConfig("decisionLogFile", err)
+	}
+	if decisionLog != nil {
+		cf.decisionLog = decisionLog
+		decisionLog.start()
+	}
+
+	fail2ban, err := newFail2banLog(config.Fail2banLog, cf.logger)
+	if err != nil {
+		_ = cf.Close()
+		return nil, invalidConfig("fail2banLog", err)
+	}
+	cf.fail2ban = fail2ban
+
+	mirror, err := newDenialMirror(cf, config.DenialMirror)
+	if err != nil {
+		_ = cf.Close()
+		return nil, invalidConfig("denialMirror", err)
+	}
+	if mirror != nil {
+		cf.mirror = mirror
+		mirror.start()
 	}
 
-	go cf.refreshLoop(ctx)
+	denylist, err := newDenylist(config.DenylistFile, cf.now, cf.logger)
+	if err != nil {
+		_ = cf.Close()
+		return nil, invalidConfig("denylistFile", err)
+	}
+	if denylist != nil {
+		cf.denylist = denylist
+		denylist.start()
+	}
+	allowedIPsFile, err := newAllowedIPsFile(config.AllowedIPsFile, config.AllowedIPsFileOptional, cf.now, cf.logger)
+	if err != nil {
+		_ = cf.Close()
+		return nil, invalidConfig("allowedIPsFile", err)
+	}
+	if allowedIPsFile != nil {
+		cf.allowedIPsFile = allowedIPsFile
+		allowedIPsFile.start()
+	}
+
+	dnsRefreshInterval := refreshInterval
+	if config.DNSRefreshInterval != "" {
+		if dnsRefreshInterval, err = time.ParseDuration(config.DNSRefreshInterval); err != nil {
+			_ = cf.Close()
+			return nil, invalidConfig("dnsRefreshInterval", fmt.Errorf("failed to parse DNS refresh interval: %w", err))
+		}
+		if dnsRefreshInterval <= 0 {
+			_ = cf.Close()
+			return nil, invalidConfig("dnsRefreshInterval", fmt.Errorf("invalid dnsRefreshInterval %q: must be positive", config.DNSRefreshInterval))
+		}
+	}
+	dnsPolicy, err := parseDNSPolicy(config.DNSFailurePolicy, config.DNSStaleGrace)
+	if err != nil {
+		_ = cf.Close()
+		return nil, invalidConfig("dnsFailurePolicy", err)
+	}
+	hostAllowlist, err := newHostAllowlist(ctx, cf.allowedSet().hosts, dnsRefreshInterval, config.LenientDNS, dnsPolicy, cf.now, cf.logger)
+	if err != nil {
+		_ = cf.Close()
+		return nil, err
+	}
+	if hostAllowlist != nil {
+		cf.hostAllowlist = hostAllowlist
+		hostAllowlist.start()
+	}
+
+	// The self-check runs once every resolution stage is in place.
+	if err := cf.selfCheck(config.SelfCheck); err != nil {
+		_ = cf.Close()
+		return nil, err
+	}
+
+	statsd, err := newStatsdPusher(cf, config.StatsD)
+	if err != nil {
+		_ = cf.Close()
+		return nil, invalidConfig("statsd", err)
+	}
+	if statsd != nil {
+		cf.statsd = statsd
+		statsd.start()
+	}
+
+	audit, err := newAuditLog(cf, config)
+	if err != nil {
+		_ = cf.Close()
+		return nil, invalidConfig("auditDir", err)
+	}
+	if audit != nil {
+		cf.auditLog = audit
+		audit.start()
+	}
+
+	// Traefik does not close replaced middlewares, so also close the
+	// instance once the construction context ends or a later construction
+	// of the same name supersedes this one.
+	cf.stopRelease = context.AfterFunc(ctx, func() { _ = cf.Close() })
+	cf.generation = sharedRegistry.register(cf.instance, func() { _ = cf.Close() })
+
 	return cf, nil
 }
 
+// parseIPListURL validates the configured IP list URL, returning fallback
+// when it is empty.
+func parseIPListURL(raw, fallback string) (string, error) {
+	if raw == "" {
+		return fallback, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid ipListURL %q: must be an http or https URL with a host", raw)
+	}
+	return raw, nil
+}
+
+// applyConfig applies the soft configuration fields, which can change
+// without discarding the runtime state or the shared store.
+func (cf *CloudFrontGate) applyConfig(config *Config) error {
+	groups, err := parseGroups(config.Groups)
+	if err != nil {
+		return invalidConfig("groups", err)
+	}
+
+	var allowedExtra []string
+	if config.AllowPrivateNetworks {
+		allowedExtra = append(allowedExtra, groupPrefix+"private", groupPrefix+"link-local")
+	}
+	if config.AllowLoopback {
+		allowedExtra = append(allowedExtra, groupPrefix+"loopback")
+	}
+	allowed, err := parseAllowedIPs(config.AllowedIPs, allowedExtra, groups)
+	if err != nil {
+		return invalidConfig("allowedIPs", err)
+	}
+	blockedIPs, _, err := groups.parse(config.BlockedIPs)
+	if err != nil {
+		return invalidConfig("blockedIPs", fmt.Errorf("failed to parse blocked IPs: %w", err))
+	}
+
+	switch config.DetectSpoofedForwarding {
+	case "", spoofOff, spoofLog, spoofDeny:
+	default:
+		return invalidConfig("detectSpoofedForwarding", fmt.Errorf("invalid detectSpoofedForwarding %q: must be %q, %q or %q",
+			config.DetectSpoofedForwarding, spoofOff, spoofLog, spoofDeny))
+	}
+	switch config.ForwardedHeaderPolicy {
+	case "", forwardedPassthrough, forwardedSanitize, forwardedRewrite:
+	default:
+		return invalidConfig("forwardedHeaderPolicy", fmt.Errorf("invalid forwardedHeaderPolicy %q: must be %q, %q or %q",
+			config.ForwardedHeaderPolicy, forwardedPassthrough, forwardedSanitize, forwardedRewrite))
+	}
+
+	allowedHosts, err := parseHostPatterns(config.AllowedHosts)
+	if err != nil {
+		return invalidConfig("allowedHosts", fmt.Errorf("failed to parse allowed hosts: %w", err))
+	}
+
+	windows, err := parseMaintenanceWindows(config.MaintenanceWindows, groups)
+	if err != nil {
+		return invalidConfig("maintenanceWindows", err)
+	}
+
+	retryAfter := defaultRetryAfter
+	if config.UnavailableRetryAfter != "" {
+		retryAfter, err = time.ParseDuration(config.UnavailableRetryAfter)
+		if err != nil {
+			return invalidConfig("unavailableRetryAfter", fmt.Errorf("failed to parse unavailable retry after: %w", err))
+		}
+		if retryAfter < time.Second {
+			return invalidConfig("unavailableRetryAfter", errors.New("unavailableRetryAfter must be at least 1s"))
+		}
+	}
+
+	var staleWarningAfter time.Duration
+	if config.StaleWarningAfter != "" {
+		staleWarningAfter, err = time.ParseDuration(config.StaleWarningAfter)
+		if err != nil {
+			return invalidConfig("staleWarningAfter", fmt.Errorf("failed to parse stale warning threshold: %w", err))
+		}
+	}
+	if config.DataAgeHeader && staleWarningAfter <= 0 {
+		return invalidConfig("dataAgeHeader", errors.New("dataAgeHeader requires a positive staleWarningAfter"))
+	}
+	maxStaleness, err := parseStaleness(config.MaxStaleness, config.StaleAction)
+	if err != nil {
+		return invalidConfig("maxStaleness", err)
+	}
+
+	countries, err := parseCountries(config.AllowedViewerCountries)
+	if err != nil {
+		return invalidConfig("allowedViewerCountries", err)
+	}
+	switch config.OnMissingCountry {
+	case "", missingCountryAllow, missingCountryDeny:
+	default:
+		return invalidConfig("onMissingCountry", fmt.Errorf("invalid onMissingCountry %q: must be %q or %q",
+			config.OnMissingCountry, missingCountryAllow, missingCountryDeny))
+	}
+
+	viewerRules, err := newViewerRules(config, groups)
+	if err != nil {
+		return invalidConfig("viewerAllowedIPs", err)
+	}
+
+	if err := validateQuarantinePolicy(config.QuarantinePolicy); err != nil {
+		return invalidConfig("quarantinePolicy", err)
+	}
+	if err := validateEnforcePercent(config.EnforcePercent); err != nil {
+		return invalidConfig("enforcePercent", err)
+	}
+	if err := validateMode(config.Mode); err != nil {
+		return invalidConfig("mode", err)
+	}
+	reportLogInterval, err := parseReportLogInterval(config.ReportLogInterval)
+	if err != nil {
+		return invalidConfig("reportLogInterval", err)
+	}
+	blockSummaryInterval, err := parseBlockSummaryInterval(config.BlockSummaryInterval)
+	if err != nil {
+		return invalidConfig("blockSummaryInterval", err)
+	}
+	if err := validateUnparsableClientIP(config.UnparsableClientIP); err != nil {
+		return invalidConfig("unparsableClientIP", err)
+	}
+	if err := validateServerTiming(config.ServerTiming); err != nil {
+		return invalidConfig("serverTiming", err)
+	}
+	if config.MinSecretLength < 0 {
+		return invalidConfig("minSecretLength", fmt.Errorf("invalid minSecretLength %d: must not be negative", config.MinSecretLength))
+	}
+	secrets := secretPolicy{minLength: config.MinSecretLength, strict: config.StrictSecrets, logger: cf.logger}
+	secretHeaderRules, err := parseSecretHeaderRules(config.SecretHeaderRules)
+	if err != nil {
+		return invalidConfig("secretHeaderRules", err)
+	}
+	if err := secrets.checkRules(secretHeaderRules); err != nil {
+		return invalidConfig("secretHeaderRules", err)
+	}
+	originVerify, err := parseOriginVerify(config, secrets)
+	if err != nil {
+		return invalidConfig("originVerifySecrets", err)
+	}
+	distributions, err := parseDistributions(config.Distributions, secrets)
+	if err != nil {
+		return invalidConfig("distributions", err)
+	}
+	learningTTL, learningMaxPrefixes, err := parseLearning(config)
+	if err != nil {
+		return invalidConfig("learningTTL", err)
+	}
+	stages, err := parseResolutionOrder(config.ResolutionOrder)
+	if err != nil {
+		return invalidConfig("resolutionOrder", err)
+	}
+	shutdownTimeout := defaultShutdownTimeout
+	if config.ShutdownTimeout != "" {
+		shutdownTimeout, err = time.ParseDuration(config.ShutdownTimeout)
+		if err != nil {
+			return invalidConfig("shutdownTimeout", fmt.Errorf("failed to parse shutdown timeout: %w", err))
+		}
+		if shutdownTimeout <= 0 {
+			return invalidConfig("shutdownTimeout", errors.New("shutdownTimeout must be positive"))
+		}
+	}
+
+	admin, err := newAdminConfig(config, groups)
+	if err != nil {
+		return invalidConfig("adminPath", err)
+	}
+	forwardAuth, err := newForwardAuth(config.ForwardAuth, groups)
+	if err != nil {
+		return invalidConfig("forwardAuth", err)
+	}
+	ipStrategy, err := newIPStrategy(config.IPStrategy, groups)
+	if err != nil {
+		return invalidConfig("ipStrategy", err)
+	}
+	if err := validateOnUnparsableRemoteAddr(config.OnUnparsableRemoteAddr, ipStrategy); err != nil {
+		return invalidConfig("onUnparsableRemoteAddr", err)
+	}
+	exclusions, err := parseExclusions(config.ExcludedPaths, config.ExcludedMethods)
+	if err != nil {
+		return invalidConfig("excludedPaths", err)
+	}
+	reject, err := parseRejection(config)
+	if err != nil {
+		return invalidConfig("rejectStatusCode", err)
+	}
+	if forwardAuth != nil && reject.status < 300 {
+		return invalidConfig("rejectStatusCode", fmt.Errorf("invalid rejectStatusCode %d: forward-auth callers would admit denied requests", reject.status))
+	}
+	// The endpoint paths are compared in the cleaned form requests are
+	// matched in, so that "/status/" and "/status" cannot coexist.
+	healthPath, statusPath := cleanRoutePath(config.HealthPath), cleanRoutePath(config.StatusPath)
+	refreshPath, metricsPath := cleanRoutePath(config.RefreshPath), cleanRoutePath(config.MetricsPath)
+	if healthPath != "" && !strings.HasPrefix(healthPath, "/") {
+		return invalidConfig("healthPath", fmt.Errorf("invalid healthPath %q: must start with /", config.HealthPath))
+	}
+	if statusPath != "" && (!strings.HasPrefix(statusPath, "/") || statusPath == healthPath) {
+		return invalidConfig("statusPath", fmt.Errorf("invalid statusPath %q: must start with / and differ from healthPath", config.StatusPath))
+	}
+	if refreshPath != "" && (!strings.HasPrefix(refreshPath, "/") ||
+		refreshPath == healthPath || refreshPath == statusPath) {
+		return invalidConfig("refreshPath", fmt.Errorf("invalid refreshPath %q: must start with / and differ from healthPath and statusPath", config.RefreshPath))
+	}
+	if metricsPath != "" && (!strings.HasPrefix(metricsPath, "/") || metricsPath == healthPath ||
+		metricsPath == statusPath || metricsPath == refreshPath) {
+		return invalidConfig("metricsPath", fmt.Errorf("invalid metricsPath %q: must start with / and differ from healthPath, statusPath and refreshPath", config.MetricsPath))
+	}
+	healthAllowedIPs, _, err := groups.parse(config.HealthAllowedIPs)
+	if err != nil {
+		return invalidConfig("healthAllowedIPs", fmt.Errorf("failed to parse health allowed IPs: %w", err))
+	}
+
+	cf.config = redactConfig(config)
+	cf.groups = groups
+	cf.allowedExtra = allowedExtra
+	cf.allowedIPs.Store(allowed)
+	cf.blockedIPs = netipPrefixes(blockedIPs)
+	cf.windows = windows
+	cf.admin = admin
+	cf.registerAdminRoutes()
+	cf.forwardAuth = forwardAuth
+	cf.ipStrategy = ipStrategy
+	cf.exclusions = exclusions
+	cf.healthPath = healthPath
+	cf.statusPath = statusPath
+	cf.refreshPath = refreshPath
+	cf.metricsPath = metricsPath
+	cf.healthAllowedIPs = healthAllowedIPs
+	cf.healthBody = config.HealthBody
+	cf.skipIfAlreadyVerified = config.SkipIfAlreadyVerified
+	if config.SkipIfAlreadyVerified {
+		marksVerified.Store(true)
+	}
+	cf.spoofMode = config.DetectSpoofedForwarding
+	cf.forwardedPolicy = config.ForwardedHeaderPolicy
+	cf.allowedHosts = allowedHosts
+	cf.retryAfter = retryAfter
+	cf.staleWarningAfter = staleWarningAfter
+	cf.maxStaleness = maxStaleness
+	cf.staleAction = config.StaleAction
+	cf.dataAgeHeader = config.DataAgeHeader
+	cf.sourceHeader = config.SourceHeader
+	cf.debugHeaders = config.DebugHeaders
+	cf.healthPaths = config.Route53HealthCheckPaths
+	cf.viewerCountries = countries
+	cf.allowMissingCountry = config.OnMissingCountry == missingCountryAllow
+	cf.viewerRules = viewerRules
+	cf.unparsableMode = config.UnparsableClientIP
+	cf.onUnparsablePeer = config.OnUnparsableRemoteAddr
+	cf.rejection = &reject
+	cf.timeAllowed = config.ServerTiming == serverTimingAllow || config.ServerTiming == serverTimingAll
+	cf.timeDenied = config.ServerTiming == serverTimingAll
+	cf.quarantinePolicy = config.QuarantinePolicy
+	cf.secretHeaderRules = secretHeaderRules
+	cf.originVerify = originVerify
+	cf.distributions = distributions
+	cf.audit = config.EnforcePercent < 100
+	cf.enforcePercent = config.EnforcePercent
+	if config.LearningMode || config.Mode == modeReportOnly {
+		cf.audit = true
+		cf.enforcePercent = 0
+	}
+	cf.reportOnly = config.Mode == modeReportOnly
+	cf.reportLogInterval = reportLogInterval
+	cf.blockSummaryInterval = blockSummaryInterval
+	cf.learning = config.LearningMode
+	cf.learningTTL = learningTTL
+	cf.learningMaxPrefixes = learningMaxPrefixes
+	cf.shutdownTimeout = shutdownTimeout
+	cf.stages = stages
+	return nil
+}
+
 func (cf *CloudFrontGate) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	remoteIP := net.ParseIP(strings.Split(req.RemoteAddr, ":")[0])
-	if remoteIP == nil || !cf.ips.Contains(remoteIP) {
-		http.Error(rw, "Forbidden", http.StatusForbidden)
+	route := routePath(req.URL)
+	if cf.admin != nil && cf.admin.matches(route) {
+		cf.serveAdmin(rw, req, route)
+		return
+	}
+	if cf.healthPath != "" && route == cf.healthPath {
+		cf.serveHealth(rw, req)
+		return
+	}
+	if cf.forwardAuth != nil && cf.forwardAuth.matches(route) {
+		cf.serveForwardAuth(rw, req)
+		return
+	}
+	cf.serveGate(rw, req)
+}
+
+// serveGate decides for req and forwards it when allowed.
+func (cf *CloudFrontGate) serveGate(rw http.ResponseWriter, req *http.Request) {
+	if cf.sourceHeader {
+		req.Header.Del(headerSource)
+	}
+
+	if cf.skipIfAlreadyVerified && req.Context().Value(ctxVerifiedBy) != nil {
+		cf.state.delegated.Add(1)
+		cf.forward(rw, req)
+		return
+	}
+	if cf.exclusions.matches(req) {
+		cf.state.excluded.Add(1)
+		if cf.decisionLog != nil {
+			cf.decisionLog.write(req, cf.now(), 0, "allow", "excluded", cf.distributionLabel(req.Host))
+		}
+		cf.forward(rw, req)
+		return
+	}
+
+	start := cf.timingStart()
+	remoteAddr := cf.clientAddr(req)
+	if !remoteAddr.IsValid() {
+		if cf.onUnparsablePeer == remoteAddrAllow && !peerAddr(req).IsValid() {
+			cf.admitUnparsablePeer(rw, req)
+			return
+		}
+		cf.unparsable(rw, req)
+		return
+	}
+	result := cf.Checker().check(remoteAddr)
+	switch result.outcome {
+	case checkStaleAdmitted:
+		cf.admitStale(rw, req, result.age)
+		return
+	case checkStaleDenied:
+		cf.logStale("refusing every request outside allowedIPs", result.age)
+		cf.deny(rw, req, denyStale, start)
+		return
+	case checkFailedOpen:
+		cf.admitFailOpen(rw, req, result.cause)
+		return
+	case checkUnavailable:
+		cf.unavailable(rw, req, result.cause)
+		return
+	case checkDenied:
+		cf.deny(rw, req, result.verdict.Reason, start)
+		return
+	}
+	verdict := result.verdict
+	if serve := cf.endpointFor(req); serve != nil {
+		// The state is for operators: CloudFront peers are refused it.
+		if verdict.Stage != stageAllowedIPs {
+			cf.deny(rw, req, denyIP, start)
+			return
+		}
+		serve(rw, req)
+		return
+	}
+	source := verdict.Source
+	if verdict.Stage == stageQuarantine && cf.quarantinePolicy == quarantineLog {
+		cf.logger.infof("CloudFrontGate %s: allowing %s from quarantined prefix to %s", cf.name, remoteAddr, req.Host)
+	}
+	// Health checkers only reach the health check paths, when configured.
+	if source == sourceRoute53HealthChecks && len(cf.healthPaths) > 0 && !containsString(cf.healthPaths, req.URL.Path) {
+		cf.deny(rw, req, denyHealthCheckPath, start)
+		return
+	}
+	if len(cf.allowedHosts) > 0 && !cf.allowedHosts.matches(req.Host) {
+		cf.deny(rw, req, denyHost, start)
+		return
+	}
+
+	// The forwarding headers are only meaningful once the peer is known
+	// to be CloudFront; before that they are attacker-controlled.
+	if !cf.checkForwarding(req, remoteAddr) {
+		cf.deny(rw, req, denySpoofed, start)
+		return
+	}
+	dist := cf.distributionFor(req.Host)
+	if !cf.checkViewerCountry(req, dist) {
+		cf.deny(rw, req, denyCountry, start)
+		return
+	}
+	if reason, ok := cf.checkViewerIP(req, remoteAddr, source); !ok {
+		cf.deny(rw, req, reason, start)
+		return
+	}
+	if !cf.checkSecretHeader(req) || !dist.checkSecret(req) || !cf.checkOriginVerify(req) {
+		cf.deny(rw, req, denySecretHeader, start)
 		return
 	}
 
-	cf.next.ServeHTTP(rw, req)
+	cf.writeServerTiming(rw, start, "allow")
+	cf.state.allowed.Add(1)
+	cf.admit(req, source)
+	cf.state.allowedByFamily[familyOf(remoteAddr)].Add(1)
+	if cf.debugHeaders {
+		rw.Header().Set(headerMatch, matchLabel(verdict))
+	}
+	cf.signalDataAge(rw)
+	if marksVerified.Load() && req.Context().Value(ctxVerifiedBy) == nil {
+		req = req.WithContext(context.WithValue(req.Context(), ctxVerifiedBy, cf.name))
+	}
+	cf.forward(rw, req)
 }
 
-// refreshLoop periodically updates the IP ranges.
-func (cf *CloudFrontGate) refreshLoop(ctx context.Context) {
-	ticker := time.NewTicker(cf.refreshInterval)
-	defer ticker.Stop()
+// marksVerified is set once an instance of the process has
+// skipIfAlreadyVerified, from then on the instances mark the requests they
+// allow under ctxVerifiedBy. Until then nothing reads the marker, and
+// allowed requests are forwarded as they came. Instances are built before
+// they serve, so an instance later in a chain is configured by the time the
+// first one allows a request.
+var marksVerified atomic.Bool
 
-	for {
-		select {
-		case <-ctx.Done():
+// peerIP returns the address of the direct peer, or nil.
+func peerIP(req *http.Request) net.IP {
+	return netIP(peerAddr(req))
+}
+
+// peerAddr returns the address of the direct peer, or the zero Addr.
+func peerAddr(req *http.Request) netip.Addr {
+	return parseHostAddr(req.RemoteAddr)
+}
+
+// parseHostAddr parses "host:port", "[v6]:port" or a bare address, without
+// allocating. IPv4-mapped addresses are unmapped, and addresses with a zone,
+// which net.ParseIP rejects, are the zero Addr.
+func parseHostAddr(hostport string) netip.Addr {
+	var addr netip.Addr
+	if addrPort, err := netip.ParseAddrPort(hostport); err == nil {
+		addr = addrPort.Addr()
+	} else {
+		host := hostport
+		if h, _, err := net.SplitHostPort(hostport); err == nil {
+			host = h
+		}
+		if addr, err = netip.ParseAddr(strings.Trim(host, "[]")); err != nil {
+			return netip.Addr{}
+		}
+	}
+	if addr.Zone() != "" {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// normalizeIP returns IPv4 and IPv4-mapped IPv6 addresses in their 4-byte
+// form, so that they match IPv4 prefixes either way.
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+// deny rejects the request as a policy decision, counting it under reason.
+// Outside the enforced share of a partial rollout it is audited instead.
+// start is the beginning of the evaluation, for the Server-Timing entry.
+func (cf *CloudFrontGate) deny(rw http.ResponseWriter, req *http.Request, reason denyReason, start time.Time) {
+	if cf.audit {
+		if ip := cf.clientIP(req); !cf.enforced(ip) {
+			cf.auditDenial(rw, req, ip, reason)
 			return
+		}
+	}
+	cf.state.denied.Add(1)
+	cf.state.deniedBy[reason].Add(1)
+	addr := cf.clientAddr(req)
+	if addr.IsValid() {
+		cf.state.deniedByFamily[familyOf(addr)].Add(1)
+	}
+	if cf.blockSummaryInterval > 0 {
+		cf.recordBlocked(addr)
+	}
+	if reason == denyIP && cf.logger.enabled(0) {
+		cf.logNearMisses(req, addr)
+	}
+	cf.countDistribution(req, false)
+	if cf.logBlocked {
+		cf.logger.infof("CloudFrontGate %s: blocked %s %s from %s: %s", cf.name, req.Method, req.URL.Path, cf.clientIP(req), reason)
+	}
+	if cf.decisionLog != nil {
+		cf.decisionLog.write(req, cf.now(), cf.rejectionResponse().status, "deny", reason.String(), cf.distributionLabel(req.Host))
+	}
+	if cf.fail2ban != nil {
+		cf.fail2ban.write(cf.now(), cf.name, cf.clientIP(req), reason)
+	}
+	if cf.mirror != nil {
+		cf.mirror.mirror(req, cf.now(), reason)
+	}
+	cf.writeServerTiming(rw, start, "deny")
+	cf.writeDenial(rw, req, reason.String())
+}
+
+// writeDenial writes the denial response: the deny page of the request's
+// distribution, or a plain 403. Forward-auth denials carry the reason.
+func (cf *CloudFrontGate) writeDenial(rw http.ResponseWriter, req *http.Request, reason string) {
+	if req.Context().Value(ctxForwardAuth) != nil {
+		rw.Header().Set(headerReason, reason)
+	}
+	r := cf.rejectionResponse()
+	if len(cf.distributions) > 0 && cf.distributionFor(req.Host).writeDenyPage(rw, r.status) {
+		return
+	}
+	r.write(rw)
+}
 
-		case <-ticker.C:
-			ctxUpdate := createContext(ctx, HTTPTimeoutDefault, cf.trustedIPs)
+// rejectionResponse returns the configured rejection.
+func (cf *CloudFrontGate) rejectionResponse() rejection {
+	if cf.rejection == nil {
+		return defaultRejection
+	}
+	return *cf.rejection
+}
 
-			if err := cf.ips.Update(ctxUpdate); err != nil {
-				log.Printf("Failed to update CloudFront IP ranges: %v", err)
-			}
+// Close stops the background work of the instance and releases its
+// references on the shared stores. The last reference on a store waits at
+// most 5s for its refresh loop to exit and its update in flight to land;
+// Close reports those that did not. It is safe to call more than once.
+func (cf *CloudFrontGate) Close() error {
+	cf.closeOnce.Do(func() {
+		if cf.stopRelease != nil {
+			cf.stopRelease()
+		}
+		if cf.denylist != nil {
+			cf.denylist.close()
+		}
+		if cf.allowedIPsFile != nil {
+			cf.allowedIPsFile.close()
+		}
+		if cf.hostAllowlist != nil {
+			cf.hostAllowlist.close()
+		}
+		if cf.auditLog != nil {
+			cf.auditLog.close()
+		}
+		cf.shutdownSinks()
+		cf.releaseEntries()
+		if cf.generation != 0 {
+			sharedRegistry.unregister(cf.instance, cf.generation)
+		}
+	})
+	return cf.releaseErr
+}
+
+// releaseEntries drops the instance's references on the shared entries. The
+// stores stay readable, so requests still in flight on a closed instance
+// are still decided.
+func (cf *CloudFrontGate) releaseEntries() {
+	cf.releaseOnce.Do(func() {
+		var errs []error
+		if cf.entry != nil {
+			errs = append(errs, releaseEntry(cf.entry, cf.logger))
+		}
+		if cf.healthEntry != nil {
+			errs = append(errs, releaseEntry(cf.healthEntry, cf.logger))
+		}
+		cf.releaseErr = errors.Join(errs...)
+	})
+}
+
+// allowed reports whether ip is trusted by this instance or part of the
+// shared CloudFront ranges.
+func (cf *CloudFrontGate) allowed(ip net.IP) bool {
+	_, ok := cf.match(ip)
+	return ok
+}
+
+// match reports whether ip is allowed and which source admitted it.
+func (cf *CloudFrontGate) match(ip net.IP) (trustSource, bool) {
+	for _, stage := range cf.stageList() {
+		if !stage.allowSource {
+			continue
+		}
+		if d, ok := stage.decide(cf, addrOf(ip)); ok {
+			return d.Source, true
 		}
 	}
+	return 0, false
 }
 
 type ipstore struct {
 	cfAPI string
-	atomic.Value
+	// logs receives the log lines of the store; nil logs to the standard
+	// logger.
+	logs *sourceLogger
+	// set holds the *prefixSet of the stored ranges.
+	set atomic.Value
+
+	// anchors must all be covered by every fetched dataset.
+	anchors []netip.Prefix
+	// integrity verifies downloaded documents against a sidecar.
+	integrity integrityConfig
+
+	// pins are acceptable SPKI SHA-256 fingerprints of the server.
+	pins [][]byte
+	// rootCAs overrides the system roots when set; insecureSkipVerify
+	// disables the verification of the server certificate.
+	rootCAs            *x509.CertPool
+	insecureSkipVerify bool
+	// proxyURL replaces the proxy of the environment when set.
+	proxyURL *url.URL
+	// guardPrivate refuses connections to non-public addresses.
+	guardPrivate bool
+	// resolveOverrides maps lower-case host names to "ip:port" addresses.
+	resolveOverrides map[string][]string
+	// maxRedirects and sameHostRedirects restrict followed redirects.
+	maxRedirects      int
+	sameHostRedirects bool
+	// sigV4 signs the requests to the source host when set.
+	sigV4 *sigV4Credentials
+	// awsService selects a service of an ip-ranges.json document instead
+	// of parsing a CloudFront API response.
+	awsService string
+	// awsRegions restricts an ip-ranges.json document to these regions.
+	awsRegions []string
+	// ipLists restricts the CloudFront prefixes to these lists.
+	ipLists []string
+	// detectFormat parses ip-ranges.json documents as the CloudFront
+	// service when awsService is empty.
+	detectFormat bool
+	// httpTimeout bounds each fetch.
+	httpTimeout time.Duration
+	// httpClient is the client of WithHTTPClient, used instead of one
+	// built from the transport options.
+	httpClient *http.Client
+	// cacheFile persists each applied dataset when set; a cache older than
+	// cacheMaxAge is not loaded.
+	cacheFile   string
+	cacheMaxAge time.Duration
+	// extra lists the additional sources merged into every dataset, all of
+	// which must be fetched unless partialOK is set. lastPrimary and
+	// lastExtra hold the lists last fetched from each, owned by the update
+	// in flight.
+	extra       []extraSource
+	partialOK   bool
+	lastPrimary *dataset
+	lastExtra   [][]netip.Prefix
+
+	transportOnce sync.Once
+	transport     *http.Transport
+	clientOnce    sync.Once
+	client        *http.Client
+
+	// samples holds one address per list of the stored dataset.
+	samples atomic.Value
+
+	// rejected counts the fetched datasets refused by the sanity checks,
+	// the anchors or maxShrinkPercent; lastRejection holds the last reason.
+	rejected      atomic.Uint64
+	lastRejection atomic.Value
+
+	// version is incremented on every successful Update; zero means the
+	// store has never been populated.
+	version atomic.Uint64
+	// updated holds the time.Time of the last successful Update.
+	updated atomic.Value
+	// succeeded and failed count the fetches of Update by outcome.
+	succeeded atomic.Uint64
+	failed    atomic.Uint64
+	// sources maps each stored prefix to the trustSource it came from.
+	sources atomic.Value
+
+	// shadow is fetched after every update and compared with the data,
+	// but never enforced; shadowDiff holds the last *shadowDiff.
+	shadow     *ipstore
+	shadowDiff atomic.Value
+
+	// maxShrinkPercent rejects datasets that much smaller than the loaded
+	// one; zero disables the check. fetched counts the loaded prefixes,
+	// excluding trusted IPs.
+	maxShrinkPercent int
+	fetched          atomic.Int64
+	// aggregate merges sibling prefixes of the same source at every update.
+	aggregate bool
+	// quarantine is how long prefixes not covered by the loaded data are
+	// untrusted; quarantined holds a map[string]quarantinedPrefix.
+	quarantine  time.Duration
+	quarantined atomic.Value
+	now         func() time.Time
+	// flight coalesces concurrent updates.
+	flight updateFlight
+	// updateMu serializes applying datasets and guards trusted, pending
+	// and applied, the dataset last applied. trusted is layered over every
+	// dataset; the shared stores hold none, each instance matching its own
+	// allowedIPs.
+	updateMu sync.Mutex
+	trusted  []netip.Prefix
+	pending  *pendingShrink
+	applied  *dataset
+	// validators holds the validators of the applied dataset.
+	validators atomic.Value
 }
 
 func newIPStore(cfURL string) *ipstore {
 	ips := &ipstore{
-		cfAPI: cfURL,
+		cfAPI:        cfURL,
+		maxRedirects: defaultMaxRedirects,
+		httpTimeout:  HTTPTimeoutDefault * time.Second,
+		now:          time.Now,
 	}
-	ips.Store([]net.IPNet{})
+	ips.store([]netip.Prefix{})
 	return ips
 }
 
+// store replaces the stored ranges with prefixes, which it keeps.
+func (ips *ipstore) store(prefixes []netip.Prefix) {
+	ips.set.Store(newPrefixSet(prefixes))
+}
+
+// prefixes returns the stored ranges, which must not be modified.
+func (ips *ipstore) prefixes() []netip.Prefix {
+	set, _ := ips.set.Load().(*prefixSet)
+	if set == nil {
+		return nil
+	}
+	return set.prefixes
+}
+
+// Contains reports whether ip is in the stored ranges. The ranges are loaded
+// once per call, so a concurrent Update never yields a partially swapped set.
 func (ips *ipstore) Contains(ip net.IP) bool {
-	cidrs, ok := ips.Load().([]net.IPNet)
-	if !ok {
+	set, _ := ips.set.Load().(*prefixSet)
+	if set == nil {
 		return false
 	}
-	for _, ipNet := range cidrs {
-		if ipNet.Contains(ip) {
-			return true
-		}
-	}
+	_, ok := set.lookup(addrOf(ip), nil)
+	return ok
+}
 
-	return false
+// match returns the source of the stored prefix containing addr. Prefixes
+// stored without a label, such as in tests, count as CloudFront global.
+func (ips *ipstore) match(addr netip.Addr) (trustSource, bool) {
+	var now time.Time
+	if ips.quarantine > 0 {
+		now = ips.now()
+	}
+	_, source, ok := ips.find(addr, now, false)
+	return source, ok
 }
 
-// Update fetches the latest CloudFront IP ranges and updates the store.
-func (ips *ipstore) Update(ctx context.Context) error {
-	trustedIPs, ok := ctx.Value(CTXTrustedIPs).([]net.IPNet)
+// find returns the stored prefix containing addr and its source, skipping
+// the prefixes quarantined at now. linear scans the list instead of the
+// trie.
+func (ips *ipstore) find(addr netip.Addr, now time.Time, linear bool) (string, trustSource, bool) {
+	set, _ := ips.set.Load().(*prefixSet)
+	if set == nil {
+		return "", 0, false
+	}
+	var skip func(int) bool
+	if ips.quarantine > 0 {
+		skip = func(i int) bool { return ips.isQuarantined(set.keys[i], now) }
+	}
+	var i int
+	var ok bool
+	if linear {
+		i, ok = set.scan(addr, skip)
+	} else {
+		i, ok = set.lookup(addr, skip)
+	}
 	if !ok {
-		return errors.New("invalid trusted IPs value")
+		return "", 0, false
+	}
+	sources, _ := ips.sources.Load().(map[string]trustSource)
+	if source, ok := sources[set.keys[i]]; ok {
+		return set.keys[i], source, true
 	}
+	return set.keys[i], sourceCloudFrontGlobal, true
+}
+
+// Update fetches the latest CloudFront IP ranges and updates the store; ctx
+// only bounds the fetch and carries no values. Concurrent calls are coalesced into a single fetch whose result they all
+// share: a caller arriving while a fetch is in flight waits for it rather
+// than failing, and Status reports the fetch as refreshing meanwhile.
+func (ips *ipstore) Update(ctx context.Context) error {
+	return ips.flight.do(ctx, func(ctx context.Context) error {
+		if err := ips.update(ctx); err != nil {
+			ips.failed.Add(1)
+			return err
+		}
+		ips.succeeded.Add(1)
+		return nil
+	})
+}
 
-	fetchedCIDRs, err := ips.fetch(ctx)
+// update fetches, verifies and applies the source.
+func (ips *ipstore) update(ctx context.Context) error {
+	data, err := ips.fetch(ctx)
+	if errors.Is(err, errNotModified) {
+		ips.confirm()
+		return nil
+	}
 	if err != nil {
+		var fetchErr *FetchError
+		if !errors.As(err, &fetchErr) {
+			err = newFetchError(ips.cfAPI, err)
+		}
 		return err
 	}
+	fetchedCIDRs := data.cidrs
 
-	cidrs := make([]net.IPNet, 0, len(trustedIPs)+len(fetchedCIDRs))
-	cidrs = append(cidrs, trustedIPs...)
-	cidrs = append(cidrs, fetchedCIDRs...)
+	if err := checkDataset(fetchedCIDRs, len(ips.anchors) > 0); err != nil {
+		ips.reject(err)
+		ips.logs.errorf("SECURITY: rejecting IP ranges from %s, keeping previous data of %d prefixes instead of %d: %v",
+			ips.cfAPI, ips.fetched.Load(), len(fetchedCIDRs), err)
+		return &classifiedError{class: ErrListRejected, err: err}
+	}
+	if err := checkAnchors(fetchedCIDRs, ips.anchors); err != nil {
+		ips.reject(err)
+		ips.logs.errorf("SECURITY: rejecting IP ranges from %s, keeping previous data: %v", ips.cfAPI, err)
+		return &classifiedError{class: ErrListRejected, err: err}
+	}
+
+	ips.updateMu.Lock()
+	if err := ips.checkShrink(ips.trusted, data); err != nil {
+		ips.updateMu.Unlock()
+		ips.reject(err)
+		return &classifiedError{class: ErrListRejected, err: err}
+	}
+	ips.apply(ips.trusted, data)
+	ips.updateMu.Unlock()
+	ips.writeCache(data, ips.now())
 
-	ips.Store(cidrs)
+	ips.compareShadow(ctx, fetchedCIDRs)
 	return nil // Return nil if everything is successful
 }
 
-func (ips *ipstore) fetch(ctx context.Context) ([]net.IPNet, error) {
-	timeout, ok := ctx.Value(CTXHTTPTimeout).(int) // Ensure timeout is of type int
-	if !ok {
-		return nil, errors.New("invalid timeout value")
+// setTrusted sets the ranges layered over the datasets of the next updates.
+func (ips *ipstore) setTrusted(trusted []netip.Prefix) {
+	ips.updateMu.Lock()
+	defer ips.updateMu.Unlock()
+	ips.trusted = trusted
+}
+
+// confirm records a refresh that found the stored data still current.
+func (ips *ipstore) confirm() {
+	ips.updateMu.Lock()
+	applied := ips.applied
+	ips.updateMu.Unlock()
+
+	now := ips.now()
+	ips.updated.Store(now.UTC())
+	if applied != nil {
+		ips.writeCache(applied, now)
+	}
+}
+
+// reject records a refused dataset.
+func (ips *ipstore) reject(err error) {
+	ips.rejected.Add(1)
+	ips.lastRejection.Store(err.Error())
+}
+
+// apply stores data, layered over trusted, as the current dataset.
+func (ips *ipstore) apply(trustedIPs []netip.Prefix, data *dataset) {
+	cidrs := make([]netip.Prefix, 0, len(trustedIPs)+len(data.cidrs))
+	cidrs = append(cidrs, trustedIPs...)
+	cidrs = append(cidrs, data.cidrs...)
+
+	sources := make(map[string]trustSource, len(cidrs))
+	for _, cidr := range trustedIPs {
+		sources[cidr.String()] = sourceCustom
+	}
+	for prefix, source := range data.sources {
+		if _, ok := sources[prefix]; !ok {
+			sources[prefix] = source
+		}
+	}
+
+	// Duplicate and covered prefixes never change a match, so they are
+	// dropped once here rather than on every lookup. The quarantine tracks
+	// each published prefix, so it keeps all but the duplicates.
+	cidrs = normalize(cidrs, sources, ips.quarantine == 0, ips.aggregate && ips.quarantine == 0)
+
+	// The labels and the quarantine are stored first, so that prefixes
+	// never become visible before them.
+	ips.updateQuarantine(data.cidrs, ips.now())
+	ips.sources.Store(sources)
+	ips.store(cidrs)
+	ips.samples.Store(data.samples)
+	ips.fetched.Store(int64(len(data.cidrs)))
+	ips.validators.Store(data.validators)
+	ips.applied = data
+	ips.updated.Store(time.Now().UTC())
+	ips.version.Add(1)
+}
+
+// dataset is a fetched and parsed source document.
+type dataset struct {
+	cidrs []netip.Prefix
+	// samples holds one address from each published list, used as
+	// self-check vectors.
+	samples []net.IP
+	// sources labels each prefix with the list it was published in.
+	sources map[string]trustSource
+	// validators are those of the response the dataset was parsed from.
+	validators validators
+}
+
+// fetch downloads and parses the source. The connections are closed once
+// done: refreshes are too far apart to gain from keeping them.
+func (ips *ipstore) fetch(ctx context.Context) (*dataset, error) {
+	defer ips.closeIdleConnections()
+
+	client := ips.fetchClient()
+	if len(ips.extra) > 0 {
+		return ips.fetchAll(ctx, client)
 	}
+	return ips.fetchPrimary(ctx, client)
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ips.cfAPI, nil)
+// fetchPrimary downloads and parses the primary source.
+func (ips *ipstore) fetchPrimary(ctx context.Context, client *http.Client) (*dataset, error) {
+	body, received, err := downloadConditional(ctx, client, ips.cfAPI, ips.fetchValidators())
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, err
 	}
 
-	client := http.Client{
-		Timeout: time.Duration(timeout) * time.Second,
+	if err := ips.integrity.verify(ctx, client, body); err != nil {
+		return nil, err
 	}
 
-	res, err := client.Do(req)
+	data, err := ips.parse(body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
+		return nil, err
 	}
-	defer func() {
-		err = res.Body.Close()
-		if err != nil {
-			log.Printf("failed to close response body: %v", err)
-		}
-	}()
+	data.validators = received
+	return data, nil
+}
 
-	// Check for a successful response
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected response status: %s", res.Status)
+// parse parses a source document in the format of the store.
+func (ips *ipstore) parse(body []byte) (*dataset, error) {
+	if ips.awsService != "" {
+		return parseAWSIPRanges(body, ips.awsService, ips.awsRegions, ips.ipLists)
+	}
+	if ips.detectFormat && isAWSIPRanges(body) {
+		return parseAWSIPRanges(body, serviceCloudFront, ips.awsRegions, ips.ipLists)
 	}
 
 	resp := CFResponse{}
-	body, err := io.ReadAll(res.Body)
+	err := json.Unmarshal(body, &resp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
 	}
+	resp = resp.selected(ips.ipLists)
 
-	err = json.Unmarshal(body, &resp)
+	cidrs, err := parseResponse(resp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+		return nil, err
 	}
-	return parseResponse(resp)
+	return &dataset{
+		cidrs:   cidrs,
+		samples: responseSamples(resp),
+		sources: responseSources(resp),
+	}, nil
+}
+
+// download fetches url and returns the response body.
+func download(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	body, _, err := downloadConditional(ctx, client, url, validators{})
+	return body, err
+}
+
+// downloadConditional fetches url, conditionally on cond, and returns the
+// response body and validators. A 304 answer yields errNotModified, unless
+// the request was not conditional.
+func downloadConditional(ctx context.Context, client *http.Client, url string, cond validators) ([]byte, validators, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, validators{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	cond.set(req)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, validators{}, fmt.Errorf("failed to execute request: %w", err)
+	}
+	// The body is read in full, so failing to close it loses nothing.
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode == http.StatusNotModified && cond.conditional() {
+		return nil, cond, errNotModified
+	}
+	// Check for a successful response
+	if res.StatusCode != http.StatusOK {
+		// S3 explains authentication failures in the body.
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, validators{}, newStatusError(res, s3Error(detail), time.Now())
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, validators{}, fmt.Errorf("failed to read response body: %w", err)
+	}
+	return body, responseValidators(res), nil
 }
 
 // CFResponse is a CloudFront API response.
@@ -220,17 +1915,12 @@ type CFResponse struct {
 	RegionalEdgeIPList []string `json:"CLOUDFRONT_REGIONAL_EDGE_IP_LIST"`
 }
 
-func createContext(ctx context.Context, timeout int, trustedIPs []net.IPNet) context.Context {
-	ctx = context.WithValue(ctx, CTXHTTPTimeout, timeout)
-	return context.WithValue(ctx, CTXTrustedIPs, trustedIPs)
-}
-
-func parseResponse(resp CFResponse) ([]net.IPNet, error) {
-	globalIPList, err := parseCIDRs(resp.GlobalIPList)
+func parseResponse(resp CFResponse) ([]netip.Prefix, error) {
+	globalIPList, err := parsePrefixes(resp.GlobalIPList)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse CLOUDFRONT_GLOBAL_IP_LIST CIDRs: %w", err)
 	}
-	regionalEdgeIPList, err := parseCIDRs(resp.RegionalEdgeIPList)
+	regionalEdgeIPList, err := parsePrefixes(resp.RegionalEdgeIPList)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse CLOUDFRONT_REGIONAL_EDGE_IP_LIST CIDRs: %w", err)
 	}
@@ -238,16 +1928,42 @@ func parseResponse(resp CFResponse) ([]net.IPNet, error) {
 }
 
 func parseCIDRs(ips []string) ([]net.IPNet, error) {
-	trustedIPs := make([]net.IPNet, 0, len(ips))
-	for _, ip := range ips {
-		if !strings.Contains(ip, "/") {
-			ip += "/32"
-		}
-		_, ipNet, err := net.ParseCIDR(ip)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse CIDR: %w", err)
-		}
-		trustedIPs = append(trustedIPs, *ipNet)
+	prefixes, err := parsePrefixes(ips)
+	if err != nil {
+		return nil, err
+	}
+	trustedIPs := make([]net.IPNet, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		trustedIPs = append(trustedIPs, prefixIPNet(prefix))
 	}
 	return trustedIPs, nil
 }
+
+// parsePrefixes parses CIDRs and bare addresses into canonical prefixes:
+// host bits are masked, and IPv4-mapped prefixes become IPv4 ones, as
+// net.IPNet.Contains matched them.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		var prefix netip.Prefix
+		if !strings.Contains(value, "/") {
+			// A bare address is a single host of its own family.
+			addr, err := netip.ParseAddr(value)
+			if err == nil && addr.Zone() != "" {
+				err = errors.New("unexpected zone")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse CIDR %q: %w", value, err)
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		} else {
+			var err error
+			if prefix, err = netip.ParsePrefix(value); err != nil {
+				return nil, fmt.Errorf("failed to parse CIDR %q: %w", value, err)
+			}
+		}
+		prefixes = append(prefixes, maskedPrefix(prefix))
+	}
+	return prefixes, nil
+}
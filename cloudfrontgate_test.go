@@ -5,10 +5,66 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
 
+const testCFResponse = `{
+	"CLOUDFRONT_GLOBAL_IP_LIST": ["120.52.22.96/27", "205.251.249.0/24", "180.163.57.128/26", "13.32.0.0/15", "54.192.0.0/16"],
+	"CLOUDFRONT_REGIONAL_EDGE_IP_LIST": ["13.113.196.64/26", "13.113.203.0/24", "52.199.127.192/26"]
+}`
+
+// fixtureURL serves testCFResponse, and testClient fetches the default
+// CloudFront list from it: instances built with withFixture, and stores
+// created on fixtureURL, run offline.
+var (
+	fixtureURL string
+	testClient *http.Client
+)
+
+func TestMain(m *testing.M) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	fixtureURL = server.URL
+	testClient = fixtureClient(map[string]string{ipListURL: fixtureURL})
+
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+// withFixture fetches the default sources from the fixture of TestMain.
+func withFixture() Option {
+	return WithHTTPClient(testClient)
+}
+
+// fixtureClient returns a client fetching the default source URLs that are
+// keys of routes from the URLs they map to, and every other URL as is.
+func fixtureClient(routes map[string]string) *http.Client {
+	return &http.Client{Transport: fixtureTransport(routes)}
+}
+
+// fixtureTransport maps default source URLs to the servers standing in for
+// them.
+type fixtureTransport map[string]string
+
+func (routes fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if route, ok := routes[req.URL.String()]; ok {
+		target, err := url.Parse(route)
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.URL, req.Host = target, ""
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
 // Test ipstore.Contains
 func Test_ipstore_Contains(t *testing.T) {
 	testCases := []struct {
@@ -46,11 +102,11 @@ func Test_ipstore_Contains(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			ips := newIPStore(CFAPI)
-			ipnets, err := parseCIDRs(tc.trustedIPs)
+			ipnets, err := parsePrefixes(tc.trustedIPs)
 			if err != nil {
-				t.Errorf("parseCIDRs() = %v", err)
+				t.Errorf("parsePrefixes() = %v", err)
 			}
-			ips.Store(ipnets)
+			ips.store(ipnets)
 
 			if got := ips.Contains(tc.ip); got != tc.want {
 				t.Errorf("ipstore.Contains() = %v, want %v", got, tc.want)
@@ -90,8 +146,8 @@ func TestIPStoreUpdate(t *testing.T) {
                 "CLOUDFRONT_GLOBAL_IP_LIST": [],
                 "CLOUDFRONT_REGIONAL_EDGE_IP_LIST": []
             }`,
-			expectedCIDRs: []string{},
-			expectedError: false,
+			expectedCIDRs: nil,
+			expectedError: true,
 		},
 	}
 
@@ -108,24 +164,21 @@ func TestIPStoreUpdate(t *testing.T) {
 
 			ips := newIPStore(server.URL)
 
-			ctx := createContext(context.Background(), 5, []net.IPNet{})
+			ctx := context.Background()
 			err := ips.Update(ctx)
 			if (err != nil) != tt.expectedError {
 				t.Fatalf("Update() error = %v, expectedError %v", err, tt.expectedError)
 			}
 
 			if !tt.expectedError {
-				cidrs, ok := ips.Load().([]net.IPNet)
-				if !ok {
-					t.Fatalf("Failed to load CIDRs")
-				}
+				cidrs := ips.prefixes()
 				if len(cidrs) != len(tt.expectedCIDRs) {
 					t.Fatalf("Expected %d CIDRs, got %d", len(tt.expectedCIDRs), len(cidrs))
 				}
 
 				for i, cidr := range tt.expectedCIDRs {
 					_, expectedIPNet, _ := net.ParseCIDR(cidr)
-					if !cidrs[i].IP.Equal(expectedIPNet.IP) || cidrs[i].Mask.String() != expectedIPNet.Mask.String() {
+					if cidrs[i].String() != expectedIPNet.String() {
 						t.Errorf("Expected CIDR %s, got %s", expectedIPNet.String(), cidrs[i].String())
 					}
 				}
@@ -134,6 +187,30 @@ func TestIPStoreUpdate(t *testing.T) {
 	}
 }
 
+func TestIPStoreUpdateWithoutContextValues(t *testing.T) {
+	ips := newIPStore(fixtureURL)
+	if err := ips.Update(context.Background()); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if got := len(ips.prefixes()); got != 8 {
+		t.Errorf("Expected the 8 fetched prefixes, got %d", got)
+	}
+
+	// The deprecated context key is ignored; the trusted ranges of the
+	// store are layered over the next dataset.
+	ignored := context.WithValue(context.Background(), CTXTrustedIPs, "not a prefix list")
+	ips.setTrusted(mustParseCIDRs(t, "198.51.100.0/24"))
+	if err := ips.Update(ignored); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if got := ips.prefixes(); len(got) != 9 || got[0].String() != "198.51.100.0/24" {
+		t.Errorf("Expected the trusted prefix first, got %v", got)
+	}
+	if source, ok := ips.match(netip.MustParseAddr("198.51.100.7")); !ok || source != sourceCustom {
+		t.Errorf("Expected the trusted prefix to match as custom, got %s, %t", source, ok)
+	}
+}
+
 func TestCloudFrontGate_ServeHTTP(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -157,7 +234,7 @@ func TestCloudFrontGate_ServeHTTP(t *testing.T) {
 			name:           "Invalid IP format",
 			remoteAddr:     "invalid-ip",
 			cidrs:          []string{"173.245.48.0/20"},
-			expectedStatus: http.StatusForbidden,
+			expectedStatus: http.StatusBadRequest,
 		},
 	}
 
@@ -170,16 +247,18 @@ func TestCloudFrontGate_ServeHTTP(t *testing.T) {
 
 			// Create IPStore and add CIDRs
 			ips := newIPStore("")
-			ipNets, err := parseCIDRs(tt.cidrs)
+			ipNets, err := parsePrefixes(tt.cidrs)
 			if err != nil {
-				t.Fatalf("parseCIDRs() = %v", err)
+				t.Fatalf("parsePrefixes() = %v", err)
 			}
-			ips.Store(ipNets)
+			ips.store(ipNets)
 
 			// Create CloudFrontGate instance
 			cf := &CloudFrontGate{
-				ips:  ips,
-				next: nextHandler,
+				ips:   ips,
+				next:  nextHandler,
+				now:   time.Now,
+				state: &gateState{},
 			}
 
 			// Create request and response recorder
@@ -198,11 +277,10 @@ func TestCloudFrontGate_ServeHTTP(t *testing.T) {
 	}
 }
 
-func TestCloudFrontGate_refreshLoop(t *testing.T) {
+func TestRegistryEntry_refreshLoop(t *testing.T) {
 	tests := []struct {
 		name            string
 		refreshInterval time.Duration
-		trustedIPs      []string
 		mockResponse    string
 		expectedCIDRs   []string
 		expectedError   bool
@@ -210,18 +288,16 @@ func TestCloudFrontGate_refreshLoop(t *testing.T) {
 		{
 			name:            "Valid update",
 			refreshInterval: 1 * time.Second,
-			trustedIPs:      []string{"192.168.1.0/24"},
 			mockResponse: `{
                 "CLOUDFRONT_GLOBAL_IP_LIST": ["120.52.22.96/27", "205.251.249.0/24", "180.163.57.128/26"],
 				"CLOUDFRONT_REGIONAL_EDGE_IP_LIST": ["13.113.196.64/26", "13.113.203.0/24", "52.199.127.192/26"]
             }`,
-			expectedCIDRs: []string{"192.168.1.0/24", "120.52.22.96/27", "205.251.249.0/24", "180.163.57.128/26", "13.113.196.64/26", "13.113.203.0/24", "52.199.127.192/26"},
+			expectedCIDRs: []string{"120.52.22.96/27", "205.251.249.0/24", "180.163.57.128/26", "13.113.196.64/26", "13.113.203.0/24", "52.199.127.192/26"},
 			expectedError: false,
 		},
 		{
 			name:            "Invalid JSON response",
 			refreshInterval: 1 * time.Second,
-			trustedIPs:      []string{"192.168.1.0/24"},
 			mockResponse: `{
                 "CLOUDFRONT_GLOBAL_IP_LIST": ["120.52.22.96/27", "205.251.249.0/24", "180.163.57.128/26"]
 				"CLOUDFRONT_REGIONAL_EDGE_IP_LIST": ["13.113.196.64/26", "13.113.203.0/24", "52.199.127.192/26"
@@ -246,18 +322,10 @@ func TestCloudFrontGate_refreshLoop(t *testing.T) {
 
 			ips.cfAPI = server.URL
 
-			// Parse trusted IPs
-			var trustedIPNets []net.IPNet
-			for _, cidr := range tt.trustedIPs {
-				_, ipNet, _ := net.ParseCIDR(cidr)
-				trustedIPNets = append(trustedIPNets, *ipNet)
-			}
-
-			// Create CloudFrontGate instance
-			cf := &CloudFrontGate{
-				ips:             ips,
-				refreshInterval: tt.refreshInterval,
-				trustedIPs:      trustedIPNets,
+			// Create the shared entry owning the loop
+			entry := &registryEntry{
+				ips:    ips,
+				source: sourceConfig{URL: server.URL, RefreshInterval: tt.refreshInterval},
 			}
 
 			// Create context with cancel
@@ -265,7 +333,7 @@ func TestCloudFrontGate_refreshLoop(t *testing.T) {
 			defer cancel()
 
 			// Run refreshLoop in a separate goroutine
-			go cf.refreshLoop(ctx)
+			go entry.refreshLoop(ctx)
 
 			// Wait for a bit more than the refresh interval to ensure the loop runs
 			time.Sleep(tt.refreshInterval + 500*time.Millisecond)
@@ -274,17 +342,14 @@ func TestCloudFrontGate_refreshLoop(t *testing.T) {
 			cancel()
 
 			// Check the updated CIDRs
-			cidrs, ok := ips.Load().([]net.IPNet)
-			if !ok {
-				t.Fatalf("Failed to load CIDRs")
-			}
+			cidrs := ips.prefixes()
 			if len(cidrs) != len(tt.expectedCIDRs) {
 				t.Fatalf("Expected %d CIDRs, got %d", len(tt.expectedCIDRs), len(cidrs))
 			}
 
 			for i, cidr := range tt.expectedCIDRs {
 				_, expectedIPNet, _ := net.ParseCIDR(cidr)
-				if !cidrs[i].IP.Equal(expectedIPNet.IP) || cidrs[i].Mask.String() != expectedIPNet.Mask.String() {
+				if cidrs[i].String() != expectedIPNet.String() {
 					t.Errorf("Expected CIDR %s, got %s", expectedIPNet.String(), cidrs[i].String())
 				}
 			}
@@ -334,7 +399,7 @@ func TestNewCloudFrontGate(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			nextHandler := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
 
-			cfHandler, err := New(context.Background(), nextHandler, tt.config, "test")
+			cfHandler, err := NewWithOptions(context.Background(), nextHandler, tt.config, "test", withFixture())
 			if tt.expectedError {
 				if err == nil {
 					t.Errorf("Expected error, got nil")
@@ -346,6 +411,7 @@ func TestNewCloudFrontGate(t *testing.T) {
 			if !ok {
 				t.Fatalf("New() = %v", cfHandler)
 			}
+			defer cf.Close()
 
 			if err != nil {
 				t.Errorf("Unexpected error: %v", err)
@@ -360,9 +426,470 @@ func TestNewCloudFrontGate(t *testing.T) {
 				t.Errorf("Expected refresh interval %v, got %v", tt.expectedRefresh, cf.refreshInterval)
 			}
 
-			if len(cf.trustedIPs) != len(tt.config.AllowedIPs) {
-				t.Errorf("Expected %d trusted IPs, got %d", len(tt.config.AllowedIPs), len(cf.trustedIPs))
+			if len(cf.allowedSet().prefixes) != len(tt.config.AllowedIPs) {
+				t.Errorf("Expected %d trusted IPs, got %d", len(tt.config.AllowedIPs), len(cf.allowedSet().prefixes))
+			}
+		})
+	}
+}
+
+func TestCloudFrontGate_skipIfAlreadyVerified(t *testing.T) {
+	newGate := func(name string, allowed []string, skip bool, next http.Handler) *CloudFrontGate {
+		t.Helper()
+
+		cfg := CreateConfig()
+		cfg.AllowedIPs = allowed
+		cfg.SkipIfAlreadyVerified = skip
+
+		handler, err := NewWithOptions(context.Background(), next, cfg, name, withFixture())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		t.Cleanup(func() { _ = cf.Close() })
+		return cf
+	}
+	final := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		build      func() (http.Handler, []*CloudFrontGate)
+		status     int
+		delegated  []uint64
+	}{
+		{
+			name:       "Second instance delegates",
+			remoteAddr: "10.1.2.3:1234",
+			build: func() (http.Handler, []*CloudFrontGate) {
+				inner := newGate("chain2-inner", nil, true, final)
+				outer := newGate("chain2-outer", []string{"10.0.0.0/8"}, false, inner)
+				return outer, []*CloudFrontGate{outer, inner}
+			},
+			status:    http.StatusOK,
+			delegated: []uint64{0, 1},
+		},
+		{
+			name:       "Second instance re-evaluates without skip",
+			remoteAddr: "10.1.2.3:1234",
+			build: func() (http.Handler, []*CloudFrontGate) {
+				inner := newGate("chain2-strict-inner", nil, false, final)
+				outer := newGate("chain2-strict-outer", []string{"10.0.0.0/8"}, false, inner)
+				return outer, []*CloudFrontGate{outer, inner}
+			},
+			status:    http.StatusForbidden,
+			delegated: []uint64{0, 0},
+		},
+		{
+			name:       "Denied by the first instance",
+			remoteAddr: "10.1.2.3:1234",
+			build: func() (http.Handler, []*CloudFrontGate) {
+				inner := newGate("chain2-denied-inner", []string{"10.0.0.0/8"}, true, final)
+				outer := newGate("chain2-denied-outer", nil, false, inner)
+				return outer, []*CloudFrontGate{outer, inner}
+			},
+			status:    http.StatusForbidden,
+			delegated: []uint64{0, 0},
+		},
+		{
+			name:       "Chain of three",
+			remoteAddr: "10.1.2.3:1234",
+			build: func() (http.Handler, []*CloudFrontGate) {
+				last := newGate("chain3-last", []string{"10.1.0.0/16"}, false, final)
+				middle := newGate("chain3-middle", nil, true, last)
+				first := newGate("chain3-first", []string{"10.0.0.0/8"}, false, middle)
+				return first, []*CloudFrontGate{first, middle, last}
+			},
+			status:    http.StatusOK,
+			delegated: []uint64{0, 1, 0},
+		},
+		{
+			name:       "Chain of three all delegating",
+			remoteAddr: "205.251.249.10:1234",
+			build: func() (http.Handler, []*CloudFrontGate) {
+				last := newGate("chain3-all-last", nil, true, final)
+				middle := newGate("chain3-all-middle", nil, true, last)
+				first := newGate("chain3-all-first", nil, true, middle)
+				return first, []*CloudFrontGate{first, middle, last}
+			},
+			status:    http.StatusOK,
+			delegated: []uint64{0, 1, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, gates := tt.build()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			if rw.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, rw.Code)
+			}
+			for i, cf := range gates {
+				if got := cf.state.delegated.Load(); got != tt.delegated[i] {
+					t.Errorf("Instance %d: expected %d delegated, got %d", i, tt.delegated[i], got)
+				}
+			}
+		})
+	}
+}
+
+// useMarksVerified sets marksVerified for the duration of the test.
+func useMarksVerified(t testing.TB, marks bool) {
+	previous := marksVerified.Load()
+	marksVerified.Store(marks)
+	t.Cleanup(func() { marksVerified.Store(previous) })
+}
+
+func TestVerifiedMarkerOnlyWhenRead(t *testing.T) {
+	var forwarded *http.Request
+	next := http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) { forwarded = req })
+	handler, err := NewWithOptions(context.Background(), next, CreateConfig(), t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	for _, marks := range []bool{false, true} {
+		useMarksVerified(t, marks)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.RemoteAddr = "205.251.249.10:1234"
+		cf.ServeHTTP(httptest.NewRecorder(), req)
+
+		if got := forwarded.Context().Value(ctxVerifiedBy); (got != nil) != marks {
+			t.Errorf("marksVerified %v: expected the marker to be set only when read, got %v", marks, got)
+		}
+		if !marks && forwarded != req {
+			t.Error("Expected the request to be forwarded as it came without the marker")
+		}
+	}
+
+	// Building an instance with skipIfAlreadyVerified turns the marker on.
+	useMarksVerified(t, false)
+	cfg := CreateConfig()
+	cfg.SkipIfAlreadyVerified = true
+	skipper, err := NewWithOptions(context.Background(), next, cfg, t.Name()+"-skip", withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer func() { _ = skipper.(*CloudFrontGate).Close() }()
+	if !marksVerified.Load() {
+		t.Error("Expected skipIfAlreadyVerified to turn the marker on")
+	}
+}
+
+func TestPeerIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{name: "IPv4 with port", remoteAddr: "205.251.249.10:443", want: "205.251.249.10"},
+		{name: "Bare IPv4", remoteAddr: "205.251.249.10", want: "205.251.249.10"},
+		{name: "Bracketed IPv6 with port", remoteAddr: "[2a05:d014::1]:54321", want: "2a05:d014::1"},
+		{name: "Bare IPv6", remoteAddr: "2a05:d014::1", want: "2a05:d014::1"},
+		{name: "Bracketed IPv6 without port", remoteAddr: "[2a05:d014::1]", want: "2a05:d014::1"},
+		{name: "IPv4-mapped IPv6", remoteAddr: "[::ffff:205.251.249.10]:443", want: "205.251.249.10"},
+		{name: "Bare IPv4-mapped IPv6", remoteAddr: "::ffff:205.251.249.10", want: "205.251.249.10"},
+		{name: "Named port", remoteAddr: "205.251.249.10:https", want: "205.251.249.10"},
+		{name: "Zone", remoteAddr: "[fe80::1%eth0]:443"},
+		{name: "Host name", remoteAddr: "localhost:80"},
+		{name: "Empty", remoteAddr: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			got := peerIP(req)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("peerIP(%q) = %s, want nil", tt.remoteAddr, got)
+				}
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("peerIP(%q) = %v, want %s", tt.remoteAddr, got, tt.want)
+			}
+		})
+	}
+}
+
+// legacyParseHostIP is the net.ParseIP parser parseHostAddr replaced.
+func legacyParseHostIP(addr string) net.IP {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	return normalizeIP(net.ParseIP(strings.Trim(host, "[]")))
+}
+
+func TestParseHostAddrMatchesNetParseIP(t *testing.T) {
+	for _, hostport := range []string{
+		"205.251.249.10:443", "205.251.249.10", "[::ffff:205.251.249.10]:443", "::ffff:205.251.249.10",
+		"[::ffff:cdfb:f90a]:443", "::ffff:cdfb:f90a", "[2a05:d014::1]:54321", "2a05:d014::1", "[2a05:d014::1]",
+		"[::1]:80", "::", "0.0.0.0:0", "[fe80::1%eth0]:443", "fe80::1%eth0", "205.251.249.010:443",
+		"205.251.249.10:", "205.251.249.10:http", "[205.251.249.10]:443", "::ffff:205.251.249.10:443",
+		"localhost:80", "@", "/run/traefik.sock", "", "[]:80", ":443",
+	} {
+		want := legacyParseHostIP(hostport)
+		got := parseHostAddr(hostport)
+		if (want == nil) != !got.IsValid() || (want != nil && !want.Equal(netIP(got))) {
+			t.Errorf("parseHostAddr(%q) = %s, want %s", hostport, got, want)
+		}
+		if got.Is4In6() {
+			t.Errorf("Expected parseHostAddr(%q) to unmap %s", hostport, got)
+		}
+	}
+}
+
+func TestServeHTTPIPv6(t *testing.T) {
+	ips := newIPStore("")
+	cidrs, err := parsePrefixes([]string{"2600:9000::/28", "205.251.249.0/24", "::ffff:13.32.0.0/111"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips.store(cidrs)
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) { rw.WriteHeader(http.StatusOK) })
+	cf := &CloudFrontGate{ips: ips, next: next, now: time.Now, state: &gateState{}}
+
+	tests := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{remoteAddr: "[2600:9000:2000::1]:54321", want: http.StatusOK},
+		{remoteAddr: "2600:9000:2000::1", want: http.StatusOK},
+		{remoteAddr: "[2a05:d014::1]:54321", want: http.StatusForbidden},
+		{remoteAddr: "205.251.249.10:443", want: http.StatusOK},
+		{remoteAddr: "[::ffff:205.251.249.10]:443", want: http.StatusOK},
+		// A mapped prefix matches the plain IPv4 form too.
+		{remoteAddr: "13.33.1.1:443", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rw := httptest.NewRecorder()
+			cf.ServeHTTP(rw, req)
+			if rw.Code != tt.want {
+				t.Errorf("Expected status %d, got %d", tt.want, rw.Code)
 			}
 		})
 	}
 }
+
+func TestParseResponseKeepsIPv6(t *testing.T) {
+	cidrs, err := parseResponse(CFResponse{
+		GlobalIPList:       []string{"205.251.249.0/24", "2600:9000::/28"},
+		RegionalEdgeIPList: []string{"2a05:d018::/33"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cidrs) != 3 || cidrs[1].String() != "2600:9000::/28" || cidrs[2].String() != "2a05:d018::/33" {
+		t.Errorf("Expected the IPv6 prefixes to be kept, got %v", cidrs)
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "205.251.249.0/24", want: "205.251.249.0/24"},
+		{value: "205.251.249.10/24", want: "205.251.249.0/24"},
+		{value: "2600:9000:1::/28", want: "2600:9000::/28"},
+		{value: "::ffff:13.32.0.0/111", want: "13.32.0.0/15"},
+		{value: "::ffff:0:0/96", want: "0.0.0.0/0"},
+		{value: "::ffff:13.32.0.0/80", want: "::/80"},
+		{value: "205.251.249.10", want: "205.251.249.10/32"},
+		{value: "2600:9000::1", want: "2600:9000::1/128"},
+		{value: "::ffff:205.251.249.10", want: "205.251.249.10/32"},
+	}
+	for _, tt := range tests {
+		prefixes, err := parsePrefixes([]string{tt.value})
+		if err != nil {
+			t.Errorf("parsePrefixes(%q) error = %v", tt.value, err)
+			continue
+		}
+		if got := prefixes[0].String(); got != tt.want {
+			t.Errorf("parsePrefixes(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+	for _, value := range []string{"", "example.com", "205.251.249.0/33", "fe80::1%eth0", "fe80::%eth0/64"} {
+		if _, err := parsePrefixes([]string{value}); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestParseCIDRsMatchesNetParseCIDR(t *testing.T) {
+	values := []string{
+		"205.251.249.0/24", "205.251.249.10/24", "13.32.0.0/15", "0.0.0.0/0", "2600:9000::/28",
+		"::ffff:13.32.0.0/111", "::ffff:0:0/96", "::ffff:13.32.0.0/80", "::/0",
+	}
+	cidrs, err := parseCIDRs(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := []string{
+		"205.251.249.10", "::ffff:205.251.249.10", "205.251.250.1", "13.33.255.255", "::ffff:13.33.0.1",
+		"13.34.0.0", "2600:9000::1", "2600:9010::1", "::1", "::", "::ffff:0:0",
+	}
+	for i, value := range values {
+		_, legacy, err := net.ParseCIDR(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if got, want := cidrs[i].Contains(ip), legacy.Contains(ip); got != want {
+				t.Errorf("%s contains %s = %t, want %t as before", cidrs[i], addr, got, want)
+			}
+		}
+	}
+}
+
+func TestAllowPathDoesNotAllocate(t *testing.T) {
+	useMarksVerified(t, false)
+	var forwarded int
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) { forwarded++ })
+	handler, err := NewWithOptions(context.Background(), next, CreateConfig(), t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	rw := discardWriter{header: http.Header{}}
+	for _, remoteAddr := range []string{"205.251.249.10:443", "[::ffff:205.251.249.10]:443"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		forwarded = 0
+		allocs := testing.AllocsPerRun(100, func() { cf.ServeHTTP(rw, req) })
+		if forwarded == 0 {
+			t.Fatalf("Expected %s to be forwarded", remoteAddr)
+		}
+		if allocs != 0 {
+			t.Errorf("Expected serving %s not to allocate, got %.0f allocations", remoteAddr, allocs)
+		}
+	}
+}
+
+// discardWriter is a ResponseWriter that keeps nothing, so that benchmarks
+// count the allocations of the gate alone.
+type discardWriter struct{ header http.Header }
+
+func (w discardWriter) Header() http.Header       { return w.header }
+func (discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (discardWriter) WriteHeader(int)             {}
+
+// BenchmarkServeHTTPAllow measures an admitted CloudFront request. The
+// check itself allocates nothing; once skipIfAlreadyVerified is in use, a
+// request not yet marked as verified costs the copy carrying the marker in
+// its context.
+func BenchmarkServeHTTPAllow(b *testing.B) {
+	handler, err := New(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), CreateConfig(), b.Name())
+	if err != nil {
+		b.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "205.251.249.10:443"
+	marked := req.WithContext(context.WithValue(req.Context(), ctxVerifiedBy, b.Name()))
+	rw := discardWriter{header: http.Header{}}
+
+	b.Run("unmarked", func(b *testing.B) {
+		useMarksVerified(b, false)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cf.ServeHTTP(rw, req)
+		}
+	})
+	b.Run("marking", func(b *testing.B) {
+		useMarksVerified(b, true)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cf.ServeHTTP(rw, req)
+		}
+	})
+	b.Run("marked", func(b *testing.B) {
+		useMarksVerified(b, true)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cf.ServeHTTP(rw, marked)
+		}
+	})
+}
+
+func TestNewIPListURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"CLOUDFRONT_GLOBAL_IP_LIST": ["198.51.100.0/24", "205.251.249.0/24"], "CLOUDFRONT_REGIONAL_EDGE_IP_LIST": []}`))
+	}))
+	defer server.Close()
+
+	cfg := CreateConfig()
+	cfg.IPListURL = server.URL
+	cfg.SkipAnchorCheck = true
+	cfg.AllowPrivateSources = true
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) { rw.WriteHeader(http.StatusOK) })
+	handler, err := New(context.Background(), next, cfg, t.Name())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	if !cf.allowed(net.ParseIP("198.51.100.7")) {
+		t.Error("Expected the ranges of the configured URL to be loaded")
+	}
+
+	for _, raw := range []string{"ftp://mirror.internal/ips", "https://", "mirror.internal/ips", "://bad"} {
+		cfg := CreateConfig()
+		cfg.IPListURL = raw
+		if _, err := New(context.Background(), next, cfg, t.Name()+"invalid"); err == nil || !strings.Contains(err.Error(), "invalid ipListURL") {
+			t.Errorf("Expected %q to fail construction, got %v", raw, err)
+		}
+	}
+}
+
+func TestNewHTTPTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) { rw.WriteHeader(http.StatusOK) })
+	build := func(timeout string) error {
+		cfg := CreateConfig()
+		cfg.IPListURL = server.URL
+		cfg.AllowPrivateSources = true
+		cfg.HTTPTimeout = timeout
+		handler, err := New(context.Background(), next, cfg, t.Name()+timeout)
+		if err != nil {
+			return err
+		}
+		return handler.(*CloudFrontGate).Close()
+	}
+
+	if err := build(""); err != nil {
+		t.Errorf("Expected the default timeout to be kept, got %v", err)
+	}
+	if err := build("50ms"); err == nil || !strings.Contains(err.Error(), "Client.Timeout") {
+		t.Errorf("Expected the configured timeout to abort the fetch, got %v", err)
+	}
+	for _, timeout := range []string{"0s", "-1s", "soon"} {
+		if err := build(timeout); err == nil {
+			t.Errorf("Expected httpTimeout %q to be rejected, got %v", timeout, err)
+		}
+	}
+}
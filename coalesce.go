@@ -0,0 +1,102 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// updateFlightTimeout bounds a shared update, which runs detached from the
+// contexts of the callers waiting for it.
+const updateFlightTimeout = 2 * time.Minute
+
+// updateCall is an Update in flight. Callers arriving meanwhile wait for it
+// and share its result.
+type updateCall struct {
+	done chan struct{}
+	err  error
+	// dups counts the callers that joined the call.
+	dups int
+}
+
+// updateFlight coalesces concurrent updates of a store.
+type updateFlight struct {
+	mu   sync.Mutex
+	call *updateCall
+}
+
+// do runs update unless one is in flight, in which case it waits for that
+// one. The update gets the values of the first caller's ctx but not its
+// cancellation, so that one caller giving up does not fail the others;
+// cancelling ctx only stops the caller's wait.
+func (f *updateFlight) do(ctx context.Context, update func(context.Context) error) error {
+	f.mu.Lock()
+	call := f.call
+	if call != nil {
+		call.dups++
+	} else {
+		call = &updateCall{done: make(chan struct{})}
+		f.call = call
+
+		shared, cancel := context.WithTimeout(context.WithoutCancel(ctx), updateFlightTimeout)
+		go func() {
+			defer cancel()
+
+			err := update(shared)
+
+			f.mu.Lock()
+			call.err = err
+			f.call = nil
+			f.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait waits at most timeout for the update in flight, if any, to land. It
+// reports whether none is left.
+func (f *updateFlight) wait(timeout time.Duration) bool {
+	f.mu.Lock()
+	call := f.call
+	f.mu.Unlock()
+	if call == nil {
+		return true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// running reports whether an update is in flight.
+func (f *updateFlight) running() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.call != nil
+}
+
+// joined returns the number of callers waiting on the update in flight
+// besides the one that started it.
+func (f *updateFlight) joined() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.call == nil {
+		return 0
+	}
+	return f.call.dups
+}
@@ -0,0 +1,160 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowSource serves testCFResponse once release is closed and signals every
+// request on hit.
+func slowSource(t *testing.T) (server *httptest.Server, fetches *atomic.Int32, hit chan struct{}, release chan struct{}) {
+	t.Helper()
+
+	fetches = &atomic.Int32{}
+	hit = make(chan struct{}, 100)
+	release = make(chan struct{})
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches.Add(1)
+		hit <- struct{}{}
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	t.Cleanup(server.Close)
+	return server, fetches, hit, release
+}
+
+// waitFor fails the test unless cond holds within five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUpdateCoalescesConcurrentCalls(t *testing.T) {
+	server, fetches, hit, release := slowSource(t)
+	ips := newIPStore(server.URL)
+
+	const callers = 50
+	errs := make(chan error, callers)
+	var wg sync.WaitGroup
+	call := func() {
+		defer wg.Done()
+		errs <- ips.Update(context.Background())
+	}
+
+	wg.Add(1)
+	go call()
+	select {
+	case <-hit:
+	case err := <-errs:
+		t.Fatalf("Expected the first Update to fetch, got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the first fetch")
+	}
+
+	wg.Add(callers - 1)
+	for range callers - 1 {
+		go call()
+	}
+	waitFor(t, "the callers to join", func() bool { return ips.flight.joined() == callers-1 })
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Update() error = %v", err)
+		}
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("Expected exactly one fetch, got %d", got)
+	}
+	if got := ips.version.Load(); got != 1 {
+		t.Errorf("Expected the dataset to be applied once, got version %d", got)
+	}
+
+	// A call after the flight has landed fetches again.
+	if err := ips.Update(context.Background()); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("Expected a later call to fetch again, got %d fetches", got)
+	}
+}
+
+func TestUpdateSurvivesFirstCallerCancel(t *testing.T) {
+	server, fetches, hit, release := slowSource(t)
+	ips := newIPStore(server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() { first <- ips.Update(ctx) }()
+	select {
+	case <-hit:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the first fetch")
+	}
+
+	second := make(chan error, 1)
+	go func() { second <- ips.Update(context.Background()) }()
+	waitFor(t, "the second caller to join", func() bool { return ips.flight.joined() == 1 })
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancelled caller to get context.Canceled, got %v", err)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("Expected the waiter to share a successful update, got %v", err)
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("Expected exactly one fetch, got %d", got)
+	}
+}
+
+func TestStatusReportsRefreshInFlight(t *testing.T) {
+	server, fetches, hit, release := slowSource(t)
+	ips := newIPStore(server.URL)
+	cf := &CloudFrontGate{name: t.Name(), ips: ips, now: time.Now, state: &gateState{}}
+	if cf.Status().Refreshing {
+		t.Fatal("Expected no refresh in flight before the first Update")
+	}
+
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() { errs <- ips.Update(context.Background()) }()
+	}
+	<-hit
+	waitFor(t, "the second caller to join", func() bool { return ips.flight.joined() == 1 })
+	if !cf.Status().Refreshing {
+		t.Error("Expected the refresh in flight to be reported")
+	}
+
+	close(release)
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Errorf("Update() error = %v", err)
+		}
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("Expected exactly one fetch, got %d", got)
+	}
+	if cf.Status().Refreshing {
+		t.Error("Expected no refresh in flight once the update landed")
+	}
+}
@@ -0,0 +1,49 @@
+package cloudfrontgate
+
+import (
+	"errors"
+	"net/http"
+)
+
+// errNotModified is returned by fetch when the source answered a
+// conditional request with 304: the stored data is still current.
+var errNotModified = errors.New("source not modified")
+
+// validators are the cache validators of a source response, sent back as
+// If-None-Match and If-Modified-Since on the next fetch.
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+// responseValidators returns the validators of res.
+func responseValidators(res *http.Response) validators {
+	return validators{etag: res.Header.Get("ETag"), lastModified: res.Header.Get("Last-Modified")}
+}
+
+// set adds the conditional headers of v to req. A server that sent neither
+// validator gets an unconditional request.
+func (v validators) set(req *http.Request) {
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+	if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+}
+
+// conditional reports whether v makes a request conditional.
+func (v validators) conditional() bool {
+	return v.etag != "" || v.lastModified != ""
+}
+
+// fetchValidators returns the validators of the stored dataset, none while
+// the store is empty or merges additional sources, whose changes the
+// validators of the primary source cannot vouch for.
+func (ips *ipstore) fetchValidators() validators {
+	if ips.version.Load() == 0 || len(ips.extra) > 0 {
+		return validators{}
+	}
+	v, _ := ips.validators.Load().(validators)
+	return v
+}
@@ -0,0 +1,99 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpdateConditionalFetch(t *testing.T) {
+	const (
+		etag         = `"v1"`
+		lastModified = "Mon, 05 Oct 2026 10:00:00 GMT"
+	)
+	var requests, notModified atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) == 1 {
+			if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+				t.Errorf("Expected an unconditional first request, got %v", req.Header)
+			}
+		} else if req.Header.Get("If-None-Match") != etag || req.Header.Get("If-Modified-Since") != lastModified {
+			t.Errorf("Expected the validators of the first response, got %v", req.Header)
+		} else {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+
+	ips := sourceConfig{URL: server.URL, AllowPrivate: true}.newStore()
+	now := time.Date(2026, 10, 5, 12, 0, 0, 0, time.UTC)
+	ips.now = func() time.Time { return now }
+	ctx := context.Background()
+	if err := ips.Update(ctx); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	first := ips.prefixes()
+
+	now = now.Add(time.Hour)
+	if err := ips.Update(ctx); err != nil {
+		t.Fatalf("Expected a 304 to be a successful refresh, got %v", err)
+	}
+	if notModified.Load() != 1 {
+		t.Fatalf("Expected one 304 answer, got %d", notModified.Load())
+	}
+	if got := ips.prefixes(); len(got) != len(first) || &got[0] != &first[0] {
+		t.Error("Expected the stored prefixes to be kept as they are")
+	}
+	if got := ips.version.Load(); got != 1 {
+		t.Errorf("Expected the version to stay 1, got %d", got)
+	}
+	if updated, _ := ips.updated.Load().(time.Time); !updated.Equal(now) {
+		t.Errorf("Expected the refresh to be recorded at %s, got %s", now, updated)
+	}
+}
+
+func TestUpdateWithoutValidators(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+			t.Errorf("Expected unconditional requests, got %v", req.Header)
+		}
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+
+	ips := sourceConfig{URL: server.URL, AllowPrivate: true}.newStore()
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := ips.Update(ctx); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+	}
+	if requests.Load() != 2 || ips.version.Load() != 2 {
+		t.Errorf("Expected two full fetches, got %d requests and version %d", requests.Load(), ips.version.Load())
+	}
+}
+
+func TestUpdateNotModifiedOnFirstFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	ips := sourceConfig{URL: server.URL, AllowPrivate: true}.newStore()
+	if err := ips.Update(context.Background()); err == nil {
+		t.Fatal("Expected a 304 without a stored dataset to fail")
+	}
+	if ips.version.Load() != 0 || !ips.empty() {
+		t.Error("Expected the store to stay empty")
+	}
+}
@@ -0,0 +1,94 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headerViewerCountry is set by CloudFront when geo headers are enabled on
+// the distribution.
+const headerViewerCountry = "CloudFront-Viewer-Country"
+
+// Handling of requests without a viewer country.
+const (
+	missingCountryAllow = "allow"
+	missingCountryDeny  = "deny"
+)
+
+// iso3166Alpha2 holds the officially assigned ISO 3166-1 alpha-2 codes.
+const iso3166Alpha2 = "" +
+	"AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ " +
+	"BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS BT BV BW BY BZ " +
+	"CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ " +
+	"DE DJ DK DM DO DZ " +
+	"EC EE EG EH ER ES ET " +
+	"FI FJ FK FM FO FR " +
+	"GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY " +
+	"HK HM HN HR HT HU " +
+	"ID IE IL IM IN IO IQ IR IS IT " +
+	"JE JM JO JP " +
+	"KE KG KH KI KM KN KP KR KW KY KZ " +
+	"LA LB LC LI LK LR LS LT LU LV LY " +
+	"MA MC MD ME MF MG MH MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ " +
+	"NA NC NE NF NG NI NL NO NP NR NU NZ " +
+	"OM " +
+	"PA PE PF PG PH PK PL PM PN PR PS PT PW PY " +
+	"QA " +
+	"RE RO RS RU RW " +
+	"SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ " +
+	"TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ " +
+	"UA UG UM US UY UZ " +
+	"VA VC VE VG VI VN VU " +
+	"WF WS " +
+	"YE YT " +
+	"ZA ZM ZW"
+
+// parseCountries validates country codes against ISO 3166-1 alpha-2 and
+// returns them as an upper-case set. It returns nil for an empty list.
+func parseCountries(codes []string) (map[string]bool, error) {
+	if len(codes) == 0 {
+		return nil, nil
+	}
+
+	assigned := strings.Fields(iso3166Alpha2)
+	countries := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		upper := strings.ToUpper(strings.TrimSpace(code))
+		if len(upper) != 2 || !containsString(assigned, upper) {
+			return nil, fmt.Errorf("invalid viewer country %q: not an ISO 3166-1 alpha-2 code", code)
+		}
+		countries[upper] = true
+	}
+	return countries, nil
+}
+
+// checkViewerCountry reports whether the request may proceed given its
+// CloudFront-Viewer-Country header. It assumes the peer already passed the
+// IP check, since the header is only trustworthy when set by CloudFront.
+// The countries of the request's distribution replace the base ones.
+func (cf *CloudFrontGate) checkViewerCountry(req *http.Request, dist *distribution) bool {
+	countries := cf.viewerCountries
+	if dist != nil && dist.countries != nil {
+		countries = dist.countries
+	}
+	if len(countries) == 0 {
+		return true
+	}
+
+	country := strings.ToUpper(strings.TrimSpace(req.Header.Get(headerViewerCountry)))
+	if country == "" {
+		return cf.allowMissingCountry
+	}
+	return countries[country]
+}
+
+// containsString reports whether values contains s.
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCountries(t *testing.T) {
+	tests := []struct {
+		name    string
+		codes   []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", codes: nil},
+		{name: "valid", codes: []string{"DE", "FR", "NL"}, want: []string{"DE", "FR", "NL"}},
+		{name: "lower case", codes: []string{"de", " fr "}, want: []string{"DE", "FR"}},
+		{name: "unassigned", codes: []string{"DE", "XX"}, wantErr: true},
+		{name: "alpha-3", codes: []string{"DEU"}, wantErr: true},
+		{name: "empty code", codes: []string{""}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCountries(tt.codes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCountries() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseCountries() = %v, want %v", got, tt.want)
+			}
+			for _, code := range tt.want {
+				if !got[code] {
+					t.Errorf("parseCountries() is missing %s", code)
+				}
+			}
+		})
+	}
+}
+
+func TestServeHTTPViewerCountry(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		onMissing  string
+		remoteAddr string
+		country    string
+		want       int
+		wantReason denyReason
+	}{
+		{name: "allowed country", remoteAddr: "205.251.249.10:1234", country: "DE", want: http.StatusOK},
+		{name: "lower-case header", remoteAddr: "205.251.249.10:1234", country: "nl", want: http.StatusOK},
+		{name: "other country", remoteAddr: "205.251.249.10:1234", country: "US", want: http.StatusForbidden, wantReason: denyCountry},
+		{name: "missing header denied by default", remoteAddr: "205.251.249.10:1234", want: http.StatusForbidden, wantReason: denyCountry},
+		{name: "missing header allowed", onMissing: missingCountryAllow, remoteAddr: "205.251.249.10:1234", want: http.StatusOK},
+		{name: "IP check comes first", remoteAddr: "10.0.0.1:1234", country: "DE", want: http.StatusForbidden, wantReason: denyIP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.AllowedViewerCountries = []string{"DE", "FR", "NL"}
+			cfg.OnMissingCountry = tt.onMissing
+
+			handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer cf.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.country != "" {
+				req.Header.Set(headerViewerCountry, tt.country)
+			}
+			recorder := httptest.NewRecorder()
+			cf.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.want {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.want)
+			}
+			if tt.want == http.StatusForbidden && cf.state.deniedBy[tt.wantReason].Load() != 1 {
+				t.Errorf("Expected the denial to be counted as %s", tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidCountryConfig(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.AllowedViewerCountries = []string{"EU"}
+	if _, err := New(context.Background(), next, cfg, "test"); err == nil {
+		t.Errorf("Expected an error for a code that is not ISO 3166-1 alpha-2")
+	}
+
+	cfg = CreateConfig()
+	cfg.OnMissingCountry = "maybe"
+	if _, err := New(context.Background(), next, cfg, "test"); err == nil {
+		t.Errorf("Expected an error for an invalid onMissingCountry")
+	}
+}
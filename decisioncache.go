@@ -0,0 +1,128 @@
+package cloudfrontgate
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// decisionCacheShards splits the cache so that concurrent requests rarely
+// contend on the same lock.
+const decisionCacheShards = 16
+
+// decisionCache remembers the match of the CloudFront store for recently
+// seen addresses. CloudFront reaches the origin from a small pool of edge
+// addresses, so nearly every request hits, but a trie lookup costs about as
+// much as a hit and takes no lock, so the cache is off unless configured
+// (see BenchmarkDecisionCache). Each entry records the prefix set it was
+// computed from and is ignored once the store swapped in another one, so
+// that an update is seen by the next request.
+type decisionCache struct {
+	shards [decisionCacheShards]decisionShard
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// decisionShard is a bounded LRU of the addresses of one shard.
+type decisionShard struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[netip.Addr]*list.Element
+	order    *list.List
+}
+
+// decisionEntry is the cached match of an address.
+type decisionEntry struct {
+	key    netip.Addr
+	set    *prefixSet
+	source trustSource
+	ok     bool
+}
+
+// newDecisionCache returns a cache of about size addresses, or nil when
+// size is not positive.
+func newDecisionCache(size int) *decisionCache {
+	if size <= 0 {
+		return nil
+	}
+	capacity := (size + decisionCacheShards - 1) / decisionCacheShards
+	c := &decisionCache{}
+	for i := range c.shards {
+		c.shards[i].capacity = capacity
+		c.shards[i].entries = make(map[netip.Addr]*list.Element, capacity)
+		c.shards[i].order = list.New()
+	}
+	return c
+}
+
+// match returns the match of addr in ips, from the cache when the entry was
+// computed from the current prefix set.
+func (c *decisionCache) match(ips *ipstore, addr netip.Addr) (trustSource, bool) {
+	if !addr.IsValid() {
+		return ips.match(addr)
+	}
+	key := addr.Unmap()
+	shard := &c.shards[decisionShardOf(key)]
+	// The set is loaded before the lookup, so that an entry never claims a
+	// newer set than the one it was computed from.
+	set, _ := ips.set.Load().(*prefixSet)
+
+	shard.mu.Lock()
+	if elem, ok := shard.entries[key]; ok {
+		entry := elem.Value.(*decisionEntry)
+		if entry.set == set {
+			shard.order.MoveToFront(elem)
+			source, matched := entry.source, entry.ok
+			shard.mu.Unlock()
+			c.hits.Add(1)
+			return source, matched
+		}
+	}
+	shard.mu.Unlock()
+
+	c.misses.Add(1)
+	source, matched := ips.match(key)
+	shard.store(&decisionEntry{key: key, set: set, source: source, ok: matched})
+	return source, matched
+}
+
+// store adds or replaces an entry, evicting the least recently used one
+// beyond the capacity.
+func (s *decisionShard) store(entry *decisionEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[entry.key]; ok {
+		elem.Value = entry
+		s.order.MoveToFront(elem)
+		return
+	}
+	s.entries[entry.key] = s.order.PushFront(entry)
+	if s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*decisionEntry).key)
+	}
+}
+
+// len returns the number of cached addresses.
+func (c *decisionCache) len() int {
+	n := 0
+	for i := range c.shards {
+		c.shards[i].mu.Lock()
+		n += c.shards[i].order.Len()
+		c.shards[i].mu.Unlock()
+	}
+	return n
+}
+
+// decisionShardOf hashes the 16-byte form of addr to its shard with FNV-1a.
+func decisionShardOf(addr netip.Addr) int {
+	hash := uint32(2166136261)
+	for _, b := range addr.As16() {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	return int(hash % decisionCacheShards)
+}
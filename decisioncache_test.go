@@ -0,0 +1,138 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestDecisionCache(t *testing.T) {
+	ips := newIPStore("")
+	ips.store(mustParseCIDRs(t, "205.251.249.0/24"))
+	cache := newDecisionCache(32)
+	cf := &CloudFrontGate{ips: ips, decisions: cache}
+
+	allowed, denied := netip.MustParseAddr("205.251.249.10"), netip.MustParseAddr("198.51.100.7")
+	for range 3 {
+		if _, ok := cf.matchStore(ips, allowed); !ok {
+			t.Error("Expected the CloudFront address to match")
+		}
+		if _, ok := cf.matchStore(ips, denied); ok {
+			t.Error("Expected the other address not to match")
+		}
+	}
+	if cache.hits.Load() != 4 || cache.misses.Load() != 2 {
+		t.Errorf("Expected 4 hits and 2 misses, got %d and %d", cache.hits.Load(), cache.misses.Load())
+	}
+
+	// A new list is seen by the next lookup of a cached address.
+	ips.store(mustParseCIDRs(t, "198.51.100.0/24"))
+	if _, ok := cf.matchStore(ips, denied); !ok {
+		t.Error("Expected the formerly denied address to match the new list")
+	}
+	if _, ok := cf.matchStore(ips, allowed); ok {
+		t.Error("Expected the formerly allowed address not to match the new list")
+	}
+
+	for i := range 200 {
+		cf.matchStore(ips, netip.AddrFrom4([4]byte{198, 51, byte(i / 250), byte(i % 250)}))
+	}
+	if got := cache.len(); got > 32 {
+		t.Errorf("Expected at most 32 cached addresses, got %d", got)
+	}
+
+	if newDecisionCache(0) != nil || newDecisionCache(-1) != nil {
+		t.Error("Expected a size of 0 or -1 to disable the cache")
+	}
+}
+
+func TestDecisionCacheConcurrentUpdates(t *testing.T) {
+	ips := newIPStore("")
+	ips.store(mustParseCIDRs(t, "205.251.249.0/24"))
+	cf := &CloudFrontGate{ips: ips, decisions: newDecisionCache(0)}
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 1000 {
+				cf.matchStore(ips, netip.AddrFrom4([4]byte{205, 251, 249, byte(g*16 + i%16)}))
+			}
+		}()
+	}
+	for i := range 50 {
+		if i%2 == 0 {
+			ips.store(mustParseCIDRs(t, "198.51.100.0/24"))
+		} else {
+			ips.store(mustParseCIDRs(t, "205.251.249.0/24"))
+		}
+	}
+	wg.Wait()
+
+	ips.store(mustParseCIDRs(t, "198.51.100.0/24"))
+	for g := range 8 {
+		if _, ok := cf.matchStore(ips, netip.AddrFrom4([4]byte{205, 251, 249, byte(g * 16)})); ok {
+			t.Fatalf("Expected no stale match after the last update")
+		}
+	}
+}
+
+func TestNewRejectsInvalidDecisionCacheSize(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DecisionCacheSize = -2
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name()); err == nil {
+		t.Error("Expected a decisionCacheSize below -1 to be rejected")
+	}
+}
+
+// BenchmarkDecisionCache matches 50 recurring edge addresses, as CloudFront
+// sends them, against a list of CloudFront's size, from one goroutine and
+// from parallel ones, where the cache contends on its shard locks.
+func BenchmarkDecisionCache(b *testing.B) {
+	values := make([]string, 0, 1000)
+	for i := range 1000 {
+		values = append(values, fmt.Sprintf("%d.%d.%d.0/24", 13+i/65536%200, i/256%256, i%256))
+	}
+	ips := newIPStore("")
+	ips.store(mustParseCIDRs(b, values...))
+	clients := make([]netip.Addr, 50)
+	for i := range clients {
+		clients[i] = netip.AddrFrom4([4]byte{13, 0, byte(i * 5), 10})
+	}
+
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ips.find(clients[i%len(clients)], ips.now(), true)
+		}
+	})
+	b.Run("trie", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ips.match(clients[i%len(clients)])
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		cf := &CloudFrontGate{ips: ips, decisions: newDecisionCache(1024)}
+		for i := 0; i < b.N; i++ {
+			cf.matchStore(ips, clients[i%len(clients)])
+		}
+	})
+	b.Run("trie parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				ips.match(clients[i%len(clients)])
+			}
+		})
+	})
+	b.Run("cached parallel", func(b *testing.B) {
+		cf := &CloudFrontGate{ips: ips, decisions: newDecisionCache(1024)}
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				cf.matchStore(ips, clients[i%len(clients)])
+			}
+		})
+	})
+}
@@ -0,0 +1,266 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Decision log formats.
+const (
+	decisionLogCommon   = "common"
+	decisionLogCombined = "combined"
+)
+
+// decisionLogFlushInterval is how often buffered decision lines are written.
+const decisionLogFlushInterval = time.Second
+
+// decisionLogBufferSize is the size at which buffered lines are written
+// before the next flush.
+const decisionLogBufferSize = 64 * 1024
+
+// clfTime is the Common Log Format timestamp layout.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// decisionLog writes one Common Log Format line per decision, with the
+// decision and its reason or source appended as quoted fields. The status
+// of allowed requests is not known yet when they are logged, so it is "-".
+//
+// Several instances may append to the same file, so every write to it holds
+// complete lines only: the file is opened with O_APPEND, and a line that
+// does not fit the buffer flushes the buffer first rather than being split.
+type decisionLog struct {
+	combined bool
+	// logger receives the write failures.
+	logger *gateLogger
+
+	mu     sync.Mutex
+	closed bool
+	file   *os.File
+	buf    []byte
+	line   []byte
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newDecisionLog opens path for appending. It returns nil when path is empty.
+func newDecisionLog(path, format string, logger *gateLogger) (*decisionLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	switch format {
+	case "", decisionLogCombined, decisionLogCommon:
+	default:
+		return nil, fmt.Errorf("invalid decisionLogFormat %q: must be %q or %q", format, decisionLogCombined, decisionLogCommon)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open decision log: %w", err)
+	}
+
+	return &decisionLog{
+		combined: format != decisionLogCommon,
+		logger:   logger,
+		file:     file,
+		buf:      make([]byte, 0, decisionLogBufferSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// start flushes the buffer periodically in the background.
+func (d *decisionLog) start() {
+	go func() {
+		defer close(d.done)
+
+		ticker := time.NewTicker(decisionLogFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				d.flush()
+			}
+		}
+	}()
+}
+
+// close stops the flusher, flushes the buffer and closes the file. Lines
+// written afterwards are dropped.
+func (d *decisionLog) close() error {
+	close(d.stop)
+	<-d.done
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	err := d.flushLocked()
+	if closeErr := d.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to flush decision log: %w", err)
+	}
+	return nil
+}
+
+func (d *decisionLog) flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+	if err := d.flushLocked(); err != nil {
+		d.logger.errorf("Failed to write decision log: %v", err)
+	}
+}
+
+// flushLocked writes the buffered lines in a single write.
+func (d *decisionLog) flushLocked() error {
+	if len(d.buf) == 0 {
+		return nil
+	}
+	_, err := d.file.Write(d.buf)
+	d.buf = d.buf[:0]
+	return err
+}
+
+// write buffers the line of a decision. A zero status is written as "-",
+// and a non-empty distribution is appended as a third quoted field.
+func (d *decisionLog) write(req *http.Request, now time.Time, status int, decision, detail, distribution string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+	d.line = appendDecisionLine(d.line[:0], req, now, status, d.combined, decision, detail, distribution)
+	if len(d.buf)+len(d.line) > cap(d.buf) {
+		if err := d.flushLocked(); err != nil {
+			d.logger.errorf("Failed to write decision log: %v", err)
+		}
+	}
+	d.buf = append(d.buf, d.line...)
+}
+
+// appendDecisionLine appends the log line of a decision to b.
+func appendDecisionLine(b []byte, req *http.Request, now time.Time, status int, combined bool, decision, detail, distribution string) []byte {
+	host := req.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	b = appendField(b, host)
+	b = append(b, " - "...)
+
+	user := "-"
+	if req.URL.User != nil {
+		user = req.URL.User.Username()
+	} else if name, _, ok := req.BasicAuth(); ok {
+		user = name
+	}
+	b = appendField(b, user)
+
+	b = append(b, " ["...)
+	b = now.AppendFormat(b, clfTime)
+	b = append(b, "] "...)
+
+	b = append(b, '"')
+	b = appendEscapedString(b, req.Method)
+	b = append(b, ' ')
+	b = appendEscapedString(b, req.URL.RequestURI())
+	b = append(b, ' ')
+	b = appendEscapedString(b, req.Proto)
+	b = append(b, '"')
+	b = append(b, ' ')
+	if status == 0 {
+		b = append(b, '-')
+	} else {
+		b = strconv.AppendInt(b, int64(status), 10)
+	}
+	b = append(b, " -"...)
+
+	if combined {
+		b = append(b, ' ')
+		b = appendQuoted(b, req.Referer())
+		b = append(b, ' ')
+		b = appendQuoted(b, req.UserAgent())
+	}
+
+	b = append(b, ' ')
+	b = appendQuoted(b, decision)
+	b = append(b, ' ')
+	b = appendQuoted(b, detail)
+	if distribution != "" {
+		b = append(b, ' ')
+		b = appendQuoted(b, distribution)
+	}
+	return append(b, '\n')
+}
+
+// appendField appends an unquoted field, "-" when empty. Spaces and control
+// characters are escaped so that the field cannot be split.
+func appendField(b []byte, value string) []byte {
+	if value == "" {
+		return append(b, '-')
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c <= ' ' || c == '"' || c == '\\' || c >= 0x7f {
+			b = appendEscaped(b, c)
+			continue
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// appendQuoted appends a double-quoted field, "-" when empty, escaping
+// quotes, backslashes and non-printable bytes.
+func appendQuoted(b []byte, value string) []byte {
+	b = append(b, '"')
+	if value == "" {
+		b = append(b, '-')
+	}
+	b = appendEscapedString(b, value)
+	return append(b, '"')
+}
+
+// appendEscapedString appends value for use inside a quoted field.
+func appendEscapedString(b []byte, value string) []byte {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < ' ' || c == '"' || c == '\\' || c >= 0x7f {
+			b = appendEscaped(b, c)
+			continue
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// appendEscaped appends c the way Apache escapes log fields.
+func appendEscaped(b []byte, c byte) []byte {
+	switch c {
+	case '"':
+		return append(b, '\\', '"')
+	case '\\':
+		return append(b, '\\', '\\')
+	case '\n':
+		return append(b, '\\', 'n')
+	case '\t':
+		return append(b, '\\', 't')
+	default:
+		const hex = "0123456789abcdef"
+		return append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+	}
+}
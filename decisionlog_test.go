@@ -0,0 +1,186 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDecisionLogSharedFileKeepsLinesWhole(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.log")
+
+	// Two instances append long lines to the same file, overflowing their
+	// buffers many times.
+	const perLog = 2000
+	agent := strings.Repeat("a", 300)
+	var logs []*decisionLog
+	for range 2 {
+		d, err := newDecisionLog(path, decisionLogCombined, nil)
+		if err != nil {
+			t.Fatalf("newDecisionLog() error = %v", err)
+		}
+		logs = append(logs, d)
+	}
+
+	var wg sync.WaitGroup
+	for i, d := range logs {
+		wg.Add(1)
+		go func(i int, d *decisionLog) {
+			defer wg.Done()
+			for range perLog {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+				req.RemoteAddr = "10.0.0.1:1234"
+				req.Header.Set("User-Agent", agent)
+				d.write(req, time.Now(), http.StatusForbidden, "deny", "ip", fmt.Sprintf("log%d", i))
+			}
+		}(i, d)
+	}
+	wg.Wait()
+	for _, d := range logs {
+		d.start()
+		if err := d.close(); err != nil {
+			t.Fatalf("close() error = %v", err)
+		}
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+	if len(lines) != 2*perLog {
+		t.Fatalf("Expected %d lines, got %d", 2*perLog, len(lines))
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "10.0.0.1 - - [") || !strings.Contains(line, `"`+agent+`" "deny" "ip" "log`) {
+			t.Fatalf("Expected only whole lines, got %q", line)
+		}
+	}
+}
+
+func TestAppendDecisionLine(t *testing.T) {
+	now := time.Date(2024, 1, 3, 12, 0, 0, 0, time.FixedZone("", -7*3600))
+
+	tests := []struct {
+		name     string
+		setup    func(*http.Request)
+		combined bool
+		status   int
+		want     string
+	}{
+		{
+			name:   "common denied",
+			status: http.StatusForbidden,
+			want:   `10.0.0.1 - - [03/Jan/2024:12:00:00 -0700] "GET /a?b=c HTTP/1.1" 403 - "deny" "ip"` + "\n",
+		},
+		{
+			name:     "combined with missing fields",
+			combined: true,
+			want:     `10.0.0.1 - - [03/Jan/2024:12:00:00 -0700] "GET /a?b=c HTTP/1.1" - - "-" "-" "deny" "ip"` + "\n",
+		},
+		{
+			name:     "escaping",
+			combined: true,
+			setup: func(req *http.Request) {
+				req.Header.Set("User-Agent", `evil" "agent\`+"\n")
+				req.Header.Set("Referer", "https://example.com/")
+				req.SetBasicAuth("bob smith", "x")
+			},
+			want: `10.0.0.1 - bob\x20smith [03/Jan/2024:12:00:00 -0700] "GET /a?b=c HTTP/1.1" - - "https://example.com/" "evil\" \"agent\\\n" "deny" "ip"` + "\n",
+		},
+		{
+			name:  "IPv6 peer",
+			setup: func(req *http.Request) { req.RemoteAddr = "[2001:db8::1]:443" },
+			want:  `2001:db8::1 - - [03/Jan/2024:12:00:00 -0700] "GET /a?b=c HTTP/1.1" - - "deny" "ip"` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/a?b=c", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			if tt.setup != nil {
+				tt.setup(req)
+			}
+
+			got := string(appendDecisionLine(nil, req, now, tt.status, tt.combined, "deny", "ip", ""))
+			if got != tt.want {
+				t.Errorf("appendDecisionLine() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecisionLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.log")
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.DecisionLogFile = path
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+
+	for _, remoteAddr := range []string{"205.251.249.10:1234", "10.0.0.1:1234"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		cf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Close flushes the buffered lines.
+	_ = cf.Close()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", raw)
+	}
+	if !strings.HasSuffix(lines[0], `"allow" "cloudfront-global"`) || !strings.HasPrefix(lines[0], "205.251.249.10 ") {
+		t.Errorf("Unexpected allow line %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], `403 - "-" "-" "deny" "ip"`) {
+		t.Errorf("Unexpected deny line %q", lines[1])
+	}
+}
+
+func TestNewRejectsInvalidDecisionLogFormat(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.DecisionLogFile = filepath.Join(t.TempDir(), "decisions.log")
+	cfg.DecisionLogFormat = "json"
+	if _, err := New(context.Background(), next, cfg, t.Name()); err == nil {
+		t.Errorf("Expected an invalid format to fail")
+	}
+}
+
+func BenchmarkDecisionLogWrite(b *testing.B) {
+	d, err := newDecisionLog(filepath.Join(b.TempDir(), "decisions.log"), decisionLogCombined, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	d.start()
+	defer d.close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/path?query=1", nil)
+	req.RemoteAddr = "205.251.249.10:1234"
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)")
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		d.write(req, now, 0, "allow", "cloudfront-global", "")
+	}
+}
@@ -0,0 +1,80 @@
+package cloudfrontgate
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultRetryAfter is the Retry-After of responses sent while degraded.
+const defaultRetryAfter = 30 * time.Second
+
+// unavailableLogInterval limits how often the degraded state is logged.
+const unavailableLogInterval = 10 * time.Second
+
+// degraded reports whether the gate lacks the data needed to decide, and why.
+func (cf *CloudFrontGate) degraded() (cause string, ok bool) {
+	if cf.ips.empty() {
+		return "CloudFront IP ranges not loaded", true
+	}
+	if cf.healthChecks != nil && cf.healthChecks.empty() {
+		return "Route 53 health check ranges not loaded", true
+	}
+	if cf.hostAllowlist != nil {
+		if host, ok := cf.hostAllowlist.unresolved(); ok {
+			return "allowedIPs host " + host + " unresolved beyond dnsStaleGrace", true
+		}
+	}
+	return "", false
+}
+
+// empty reports whether the store holds no prefixes.
+func (ips *ipstore) empty() bool {
+	cidrs := ips.prefixes()
+	return len(cidrs) == 0
+}
+
+// failingOpen reports whether failOpenOnStartup admits the requests because
+// a source was never fetched. Once every source was fetched, the gate
+// enforces again for good.
+func (cf *CloudFrontGate) failingOpen() bool {
+	if !cf.failOpenOnStartup {
+		return false
+	}
+	return cf.ips.version.Load() == 0 || (cf.healthChecks != nil && cf.healthChecks.version.Load() == 0)
+}
+
+// admitFailOpen forwards a request that no stage decided while the sources
+// were never fetched. Denials by earlier stages, such as the denylist, still
+// apply; every other request is admitted, not only the allowedIPs.
+func (cf *CloudFrontGate) admitFailOpen(rw http.ResponseWriter, req *http.Request, cause string) {
+	cf.state.failedOpen.Add(1)
+
+	now := cf.now()
+	last := cf.state.unavailableLoggedAt.Load()
+	if now.UnixNano()-last >= int64(unavailableLogInterval) && cf.state.unavailableLoggedAt.CompareAndSwap(last, now.UnixNano()) {
+		cf.logger.errorf("CloudFrontGate %s: admitting requests unchecked until the first successful fetch: %s", cf.name, cause)
+	}
+	if cf.decisionLog != nil {
+		cf.decisionLog.write(req, now, 0, "allow", "fail-open", cf.distributionLabel(req.Host))
+	}
+	cf.forward(rw, req)
+}
+
+// unavailable refuses the request with 503 because the gate is degraded. It
+// is not counted as a denial, and never reaches the fail2ban log.
+func (cf *CloudFrontGate) unavailable(rw http.ResponseWriter, req *http.Request, cause string) {
+	cf.state.unavailable.Add(1)
+
+	now := cf.now()
+	last := cf.state.unavailableLoggedAt.Load()
+	if now.UnixNano()-last >= int64(unavailableLogInterval) && cf.state.unavailableLoggedAt.CompareAndSwap(last, now.UnixNano()) {
+		cf.logger.errorf("CloudFrontGate %s: refusing requests with 503, the gate is degraded: %s", cf.name, cause)
+	}
+	if cf.decisionLog != nil {
+		cf.decisionLog.write(req, now, http.StatusServiceUnavailable, "unavailable", cause, cf.distributionLabel(req.Host))
+	}
+
+	rw.Header().Set("Retry-After", strconv.Itoa(int(cf.retryAfter/time.Second)))
+	http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,188 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPDegraded(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	build := func(t *testing.T, mutate func(*Config)) *CloudFrontGate {
+		t.Helper()
+		cfg := CreateConfig()
+		cfg.AllowedIPs = []string{"192.168.1.0/24"}
+		cfg.Fail2banLog = filepath.Join(t.TempDir(), "fail2ban.log")
+		if mutate != nil {
+			mutate(cfg)
+		}
+		handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		t.Cleanup(func() { _ = cf.Close() })
+		return cf
+	}
+	serve := func(cf *CloudFrontGate, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		cf.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("empty CloudFront dataset", func(t *testing.T) {
+		// Fetched empty datasets are rejected, so the store is emptied here.
+		cf := build(t, func(cfg *Config) {
+			cfg.UnavailableRetryAfter = "2m"
+		})
+		cf.ips = newIPStore("")
+
+		recorder := serve(cf, "10.0.0.1:1234")
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+		}
+		if got := recorder.Header().Get("Retry-After"); got != "120" {
+			t.Errorf("Retry-After = %q, want %q", got, "120")
+		}
+		if got := serve(cf, "192.168.1.1:1234").Code; got != http.StatusOK {
+			t.Errorf("Expected trusted IPs to keep working while degraded, got %d", got)
+		}
+		if cf.state.unavailable.Load() != 1 || cf.state.denied.Load() != 0 {
+			t.Errorf("Expected 1 unavailable and no denied requests, got %d and %d",
+				cf.state.unavailable.Load(), cf.state.denied.Load())
+		}
+		if status := cf.status(); status.Unavailable != 1 || status.Denied != 0 {
+			t.Errorf("Expected the status to report 1 unavailable and no denied requests, got %d and %d",
+				status.Unavailable, status.Denied)
+		}
+		if raw, _ := os.ReadFile(cf.fail2ban.path); len(raw) != 0 {
+			t.Errorf("Expected degraded refusals to stay out of the fail2ban log, got %q", raw)
+		}
+	})
+
+	t.Run("empty Route 53 health check ranges", func(t *testing.T) {
+		cf := build(t, nil)
+		cf.healthChecks = newIPStore("")
+
+		recorder := serve(cf, "15.177.1.1:1234")
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+		}
+		if got := recorder.Header().Get("Retry-After"); got != "30" {
+			t.Errorf("Retry-After = %q, want the default %q", got, "30")
+		}
+		if got := serve(cf, "205.251.249.10:1234").Code; got != http.StatusOK {
+			t.Errorf("Expected CloudFront peers to be allowed, got %d", got)
+		}
+	})
+
+	t.Run("policy denials stay 403", func(t *testing.T) {
+		cf := build(t, nil)
+
+		if got := serve(cf, "10.0.0.1:1234").Code; got != http.StatusForbidden {
+			t.Errorf("status = %d, want %d", got, http.StatusForbidden)
+		}
+		if cf.state.unavailable.Load() != 0 {
+			t.Errorf("Expected no unavailable requests")
+		}
+	})
+}
+
+func TestIPStoreEmpty(t *testing.T) {
+	ips := newIPStore("")
+	if !ips.empty() {
+		t.Errorf("Expected a new store to be empty")
+	}
+	ipNets, _ := parsePrefixes([]string{"205.251.249.0/24"})
+	ips.store(ipNets)
+	if ips.empty() {
+		t.Errorf("Expected a populated store not to be empty")
+	}
+
+	ips.store([]netip.Prefix{})
+	if !ips.empty() {
+		t.Errorf("Expected a store holding an empty dataset to be empty")
+	}
+}
+
+func TestNewRejectsShortRetryAfter(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.UnavailableRetryAfter = "100ms"
+	if _, err := New(context.Background(), next, cfg, t.Name()); err == nil {
+		t.Errorf("Expected a sub-second Retry-After to fail")
+	}
+}
+
+func TestFailOpenOnStartup(t *testing.T) {
+	var recovered atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !recovered.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+	client := WithHTTPClient(fixtureClient(map[string]string{ipListURL: server.URL}))
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	cfg := CreateConfig()
+	cfg.RetryInterval = "1s"
+	if _, err := NewWithOptions(context.Background(), next, cfg, t.Name()+"closed", client); err == nil {
+		t.Fatal("Expected New to fail without failOpenOnStartup")
+	}
+
+	cfg.FailOpenOnStartup = true
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), client)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		cf.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	if got := serve("10.0.0.1:1234"); got != http.StatusOK {
+		t.Fatalf("Expected requests to be admitted before the first fetch, got %d", got)
+	}
+	if got := cf.status().FailedOpen; got != 1 {
+		t.Errorf("Expected 1 request admitted unchecked, got %d", got)
+	}
+
+	recovered.Store(true)
+	deadline := time.Now().Add(5 * time.Second)
+	for cf.ips.version.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the source to be retried after recovery")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := serve("10.0.0.1:1234"); got != http.StatusForbidden {
+		t.Errorf("Expected enforcement once the ranges are loaded, got %d", got)
+	}
+	if got := serve("205.251.249.10:1234"); got != http.StatusOK {
+		t.Errorf("Expected CloudFront to be allowed, got %d", got)
+	}
+	if got := cf.status().FailedOpen; got != 1 {
+		t.Errorf("Expected no more unchecked requests, got %d", got)
+	}
+}
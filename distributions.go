@@ -0,0 +1,180 @@
+package cloudfrontgate
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DistributionConfig overlays the base configuration for the hosts of one
+// CloudFront distribution.
+type DistributionConfig struct {
+	// SecretHeader is the name of a header the distribution must send
+	SecretHeader string `json:"secretHeader,omitempty"`
+	// SecretValues lists the accepted SecretHeader values
+	SecretValues []string `json:"secretValues,omitempty"`
+	// AllowedViewerCountries replaces the base allowedViewerCountries
+	AllowedViewerCountries []string `json:"allowedViewerCountries,omitempty"`
+	// DenyPageFile is an HTML file served with denials
+	DenyPageFile string `json:"denyPageFile,omitempty"`
+}
+
+// distribution is a validated DistributionConfig selected by a host pattern.
+type distribution struct {
+	name      string
+	pattern   hostPatterns
+	secret    *secretHeaderRule
+	countries map[string]bool
+	denyPage  []byte
+}
+
+// distributionStatus describes a distribution in the status endpoint.
+type distributionStatus struct {
+	Name    string `json:"name"`
+	Allowed uint64 `json:"allowed"`
+	Denied  uint64 `json:"denied"`
+}
+
+// parseDistributions validates the distributions and orders them for
+// lookup: exact host names before wildcards, longer wildcards first.
+func parseDistributions(configs map[string]DistributionConfig, policy secretPolicy) ([]*distribution, error) {
+	distributions := make([]*distribution, 0, len(configs))
+	for host, config := range configs {
+		pattern, err := parseHostPatterns([]string{host})
+		if err != nil {
+			return nil, fmt.Errorf("invalid distribution: %w", err)
+		}
+		d := &distribution{name: pattern[0], pattern: pattern}
+
+		if len(config.SecretValues) > 0 || config.SecretHeader != "" {
+			if config.SecretHeader == "" || len(config.SecretValues) == 0 {
+				return nil, fmt.Errorf("distribution %s: secretHeader and secretValues must be set together", host)
+			}
+			rules, err := parseSecretHeaderRules([]SecretHeaderRule{
+				{PathPrefix: "/", Name: config.SecretHeader, Values: config.SecretValues},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("distribution %s: %w", host, err)
+			}
+			if err := policy.check("the secret of distribution "+host, config.SecretValues); err != nil {
+				return nil, err
+			}
+			d.secret = &rules[0]
+		}
+
+		d.countries, err = parseCountries(config.AllowedViewerCountries)
+		if err != nil {
+			return nil, fmt.Errorf("distribution %s: %w", host, err)
+		}
+
+		if config.DenyPageFile != "" {
+			d.denyPage, err = os.ReadFile(config.DenyPageFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read deny page of distribution %s: %w", host, err)
+			}
+		}
+		distributions = append(distributions, d)
+	}
+
+	sort.Slice(distributions, func(i, j int) bool {
+		a, b := distributions[i].name, distributions[j].name
+		aWild, bWild := strings.HasPrefix(a, "*."), strings.HasPrefix(b, "*.")
+		if aWild != bWild {
+			return bWild
+		}
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	for i := 1; i < len(distributions); i++ {
+		if distributions[i].name == distributions[i-1].name {
+			return nil, errors.New("duplicate distribution " + distributions[i].name)
+		}
+	}
+	return distributions, nil
+}
+
+// distributionFor returns the distribution of the Host header, or nil for
+// the base configuration.
+func (cf *CloudFrontGate) distributionFor(host string) *distribution {
+	for _, d := range cf.distributions {
+		if d.pattern.matches(host) {
+			return d
+		}
+	}
+	return nil
+}
+
+// distributionLabel returns the distribution name logged for host: empty
+// without distributions, "-" for the base configuration.
+func (cf *CloudFrontGate) distributionLabel(host string) string {
+	if len(cf.distributions) == 0 {
+		return ""
+	}
+	if d := cf.distributionFor(host); d != nil {
+		return d.name
+	}
+	return "-"
+}
+
+// checkSecret checks the secret header of the distribution.
+func (d *distribution) checkSecret(req *http.Request) bool {
+	return d == nil || d.secret == nil || d.secret.accepts(req.Header.Get(d.secret.name))
+}
+
+// writeDenyPage writes the deny page of the distribution with status, if it
+// has one.
+func (d *distribution) writeDenyPage(rw http.ResponseWriter, status int) bool {
+	if d == nil || d.denyPage == nil {
+		return false
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(status)
+	_, _ = rw.Write(d.denyPage)
+	return true
+}
+
+// countDistribution counts a decision under the distribution of req.
+func (cf *CloudFrontGate) countDistribution(req *http.Request, allowed bool) {
+	if len(cf.distributions) == 0 {
+		return
+	}
+	d := cf.distributionFor(req.Host)
+	if d == nil {
+		return
+	}
+	counters := cf.state.distributions.get(d.name)
+	if allowed {
+		counters.allowed.Add(1)
+	} else {
+		counters.denied.Add(1)
+	}
+}
+
+// distributionStatus returns the counters of the distributions.
+func (cf *CloudFrontGate) distributionStatus() []distributionStatus {
+	status := make([]distributionStatus, 0, len(cf.distributions))
+	for _, d := range cf.distributions {
+		counters := cf.state.distributions.get(d.name)
+		status = append(status, distributionStatus{
+			Name:    d.name,
+			Allowed: counters.allowed.Load(),
+			Denied:  counters.denied.Load(),
+		})
+	}
+	return status
+}
+
+// metricName replaces characters that are not safe in metric names.
+func metricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if validMetricLabel(string(r)) {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,137 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDistributions(t *testing.T) {
+	distributions, err := parseDistributions(map[string]DistributionConfig{
+		"*.example.com":   {},
+		"WWW.example.com": {},
+		"*.a.example.com": {},
+		"api.example.com": {},
+	}, secretPolicy{})
+	if err != nil {
+		t.Fatalf("parseDistributions() error = %v", err)
+	}
+	var names []string
+	for _, d := range distributions {
+		names = append(names, d.name)
+	}
+	want := "api.example.com www.example.com *.a.example.com *.example.com"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("Expected lookup order %q, got %q", want, got)
+	}
+
+	invalid := []map[string]DistributionConfig{
+		{"www.example.com": {SecretValues: []string{"s"}}},
+		{"www.example.com": {SecretHeader: "X-Secret"}},
+		{"www.example.com": {AllowedViewerCountries: []string{"XX"}}},
+		{"www.example.com": {DenyPageFile: filepath.Join(t.TempDir(), "missing.html")}},
+		{"www.example.com": {}, "WWW.EXAMPLE.COM": {}},
+		{"bad host": {}},
+	}
+	for _, configs := range invalid {
+		if _, err := parseDistributions(configs, secretPolicy{}); err == nil {
+			t.Errorf("Expected an error for %+v", configs)
+		}
+	}
+}
+
+func TestParseDistributionsWeakSecret(t *testing.T) {
+	configs := map[string]DistributionConfig{
+		"www.example.com": {SecretHeader: "X-Secret", SecretValues: []string{"changeme"}},
+	}
+	if _, err := parseDistributions(configs, secretPolicy{minLength: defaultMinSecretLength, strict: true}); err == nil {
+		t.Errorf("Expected a placeholder distribution secret to fail in strict mode")
+	}
+	if _, err := parseDistributions(configs, secretPolicy{minLength: defaultMinSecretLength}); err != nil {
+		t.Errorf("Expected a placeholder distribution secret to only warn, got %v", err)
+	}
+}
+
+func TestServeHTTPDistributions(t *testing.T) {
+	dir := t.TempDir()
+	denyPage := filepath.Join(dir, "deny.html")
+	if err := os.WriteFile(denyPage, []byte("<h1>www says no</h1>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(dir, "decisions.log")
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	cfg := CreateConfig()
+	cfg.AllowedViewerCountries = []string{"US"}
+	cfg.DecisionLogFile = logPath
+	cfg.Distributions = map[string]DistributionConfig{
+		"www.example.com": {SecretHeader: "X-Origin-Secret", SecretValues: []string{"www-secret"}, DenyPageFile: denyPage},
+		"*.shop.example":  {AllowedViewerCountries: []string{"DE"}},
+	}
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+
+	tests := []struct {
+		name     string
+		host     string
+		secret   string
+		country  string
+		want     int
+		wantBody string
+	}{
+		{name: "www with secret", host: "www.example.com", secret: "www-secret", country: "US", want: http.StatusOK},
+		{name: "www without secret", host: "www.example.com", country: "US", want: http.StatusForbidden, wantBody: "<h1>www says no</h1>"},
+		{name: "shop country overlay", host: "de.shop.example", country: "DE", want: http.StatusOK},
+		{name: "shop base country", host: "de.shop.example", country: "US", want: http.StatusForbidden, wantBody: "Forbidden\n"},
+		{name: "base", host: "other.example", country: "US", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+		req.RemoteAddr = "205.251.249.10:1234"
+		req.Header.Set(headerViewerCountry, tt.country)
+		if tt.secret != "" {
+			req.Header.Set("X-Origin-Secret", tt.secret)
+		}
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		if rw.Code != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.want, rw.Code)
+		}
+		if tt.wantBody != "" && rw.Body.String() != tt.wantBody {
+			t.Errorf("%s: expected body %q, got %q", tt.name, tt.wantBody, rw.Body.String())
+		}
+	}
+
+	want := []distributionStatus{
+		{Name: "www.example.com", Allowed: 1, Denied: 1},
+		{Name: "*.shop.example", Allowed: 1, Denied: 1},
+	}
+	got := cf.status().Distributions
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Distributions = %+v, want %+v", got, want)
+	}
+
+	_ = cf.Close()
+	raw, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != len(tests) {
+		t.Fatalf("Expected %d decision lines, got %d", len(tests), len(lines))
+	}
+	for i, suffix := range []string{`"www.example.com"`, `"www.example.com"`, `"*.shop.example"`, `"*.shop.example"`, `"-"`} {
+		if !strings.HasSuffix(lines[i], suffix) {
+			t.Errorf("Expected decision line %d to end with %s, got %s", i, suffix, lines[i])
+		}
+	}
+}
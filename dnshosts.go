@@ -0,0 +1,386 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dnsLookupTimeout bounds each resolution of a hostname entry.
+const dnsLookupTimeout = 5 * time.Second
+
+// Policies for hostname entries that stop resolving.
+const (
+	// dnsKeep keeps the last resolved addresses indefinitely.
+	dnsKeep = "keep"
+	// dnsDrop drops them once the host failed for longer than the grace.
+	dnsDrop = "drop"
+	// dnsFail degrades the gate once the host failed for longer than the
+	// grace, so that requests no other stage admits get 503.
+	dnsFail = "fail"
+)
+
+// defaultDNSStaleGrace is how long a failing host keeps its addresses under
+// the drop and fail policies.
+const defaultDNSStaleGrace = time.Hour
+
+// dnsPolicy is how hostname entries that stop resolving are handled.
+type dnsPolicy struct {
+	mode  string
+	grace time.Duration
+}
+
+// parseDNSPolicy validates dnsFailurePolicy and dnsStaleGrace.
+func parseDNSPolicy(mode, grace string) (dnsPolicy, error) {
+	policy := dnsPolicy{mode: mode, grace: defaultDNSStaleGrace}
+	switch mode {
+	case "":
+		policy.mode = dnsKeep
+	case dnsKeep, dnsDrop, dnsFail:
+	default:
+		return dnsPolicy{}, fmt.Errorf("invalid dnsFailurePolicy %q: must be %q, %q or %q", mode, dnsKeep, dnsDrop, dnsFail)
+	}
+	if grace != "" {
+		var err error
+		if policy.grace, err = time.ParseDuration(grace); err != nil {
+			return dnsPolicy{}, fmt.Errorf("failed to parse DNS stale grace: %w", err)
+		}
+		if policy.grace <= 0 {
+			return dnsPolicy{}, fmt.Errorf("invalid dnsStaleGrace %q: must be positive", grace)
+		}
+	}
+	return policy, nil
+}
+
+// hostResolver resolves hostnames; *net.Resolver implements it.
+type hostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// dnsResolver resolves the hostname entries of allowedIPs. Tests replace it.
+var dnsResolver hostResolver = net.DefaultResolver
+
+// hostAllowlist holds the addresses of the hostname entries of allowedIPs,
+// re-resolved periodically. A failed resolution keeps the previous
+// addresses of the host.
+type hostAllowlist struct {
+	resolver hostResolver
+	interval time.Duration
+	policy   dnsPolicy
+	now      func() time.Time
+	// logger receives the resolution failures and recoveries.
+	logger *gateLogger
+	// started bounds the grace of hosts that never resolved.
+	started time.Time
+
+	// prefixes holds the []net.IPNet of every resolved address, and
+	// deadline the hostDeadline of the first failing host to expire.
+	prefixes atomic.Value
+	deadline atomic.Value
+
+	mu    sync.Mutex
+	hosts []*allowedHost
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// allowedHost is a hostname entry and its last resolution, guarded by the
+// mutex of its hostAllowlist.
+type allowedHost struct {
+	name       string
+	addrs      []net.IPNet
+	resolvedAt time.Time
+	lastErr    error
+	// notFound is set while the host fails with NXDOMAIN rather than a
+	// transient error, and dropped once the drop policy removed addrs.
+	notFound bool
+	dropped  bool
+}
+
+// hostDeadline is when a failing host exceeds the grace.
+type hostDeadline struct {
+	name string
+	at   time.Time
+}
+
+// hostStatus describes a hostname entry in the status document.
+type hostStatus struct {
+	Name        string     `json:"name"`
+	Addresses   []string   `json:"addresses"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	NotFound    bool       `json:"notFound,omitempty"`
+	// Expired is set once the host failed for longer than dnsStaleGrace.
+	Expired bool `json:"expired,omitempty"`
+}
+
+// splitHostnames separates the hostname entries from the addresses, CIDRs
+// and group references of entries.
+func splitHostnames(entries []string) (static, hosts []string) {
+	for _, entry := range entries {
+		if isHostname(entry) {
+			hosts = append(hosts, strings.ToLower(strings.TrimSuffix(entry, ".")))
+			continue
+		}
+		static = append(static, entry)
+	}
+	return static, hosts
+}
+
+// isHostname reports whether entry is a DNS name. Names whose last label is
+// numeric are left to the CIDR parser, so that a mistyped address such as
+// 10.0.0.300 is reported as such.
+func isHostname(entry string) bool {
+	name := strings.TrimSuffix(entry, ".")
+	if name == "" || len(name) > 253 || strings.HasPrefix(name, groupPrefix) || net.ParseIP(name) != nil {
+		return false
+	}
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	last := labels[len(labels)-1]
+	return strings.Trim(last, "0123456789") != ""
+}
+
+// newHostAllowlist resolves names. A name that does not resolve is an
+// error, unless lenient is set. It returns nil when names is empty.
+func newHostAllowlist(ctx context.Context, names []string, interval time.Duration, lenient bool, policy dnsPolicy, now func() time.Time, logger *gateLogger) (*hostAllowlist, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	h := &hostAllowlist{resolver: dnsResolver, interval: interval, policy: policy, now: now, started: now(), logger: logger}
+	for _, name := range names {
+		host := &allowedHost{name: name}
+		h.hosts = append(h.hosts, host)
+		if err := h.resolve(ctx, host); err != nil {
+			if !lenient {
+				return nil, fmt.Errorf("failed to resolve allowedIPs host %q: %w", name, err)
+			}
+			logger.errorf("Failed to resolve allowedIPs host %q, retrying every %s: %v", name, interval, err)
+		}
+	}
+	h.publish()
+	return h, nil
+}
+
+// start re-resolves the hosts in the background.
+func (h *hostAllowlist) start() {
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+
+	go func() {
+		defer close(h.done)
+
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+				h.refresh()
+			}
+		}
+	}()
+}
+
+// close stops resolving.
+func (h *hostAllowlist) close() {
+	if h.stop != nil {
+		close(h.stop)
+		<-h.done
+	}
+}
+
+// refresh re-resolves every host. Failing hosts keep their previous
+// addresses, unless the drop policy expires them.
+func (h *hostAllowlist) refresh() {
+	for _, host := range h.hosts {
+		_ = h.resolve(context.Background(), host)
+	}
+	h.publish()
+}
+
+// resolve looks host up and records the outcome, logging the transitions
+// between resolving, failing and dropped.
+func (h *hostAllowlist) resolve(ctx context.Context, host *allowedHost) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+
+	addrs, err := h.resolver.LookupIPAddr(ctx, host.name)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses for %s", host.name)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.failed(host, err)
+		return err
+	}
+	if host.lastErr != nil {
+		h.logger.infof("allowedIPs host %q resolves again", host.name)
+	}
+	host.lastErr, host.notFound, host.dropped = nil, false, false
+	host.addrs = host.addrs[:0:0]
+	for _, addr := range addrs {
+		bits := 8 * net.IPv6len
+		ip := addr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			bits, ip = 8*net.IPv4len, ip4
+		}
+		host.addrs = append(host.addrs, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	host.resolvedAt = h.now()
+	return nil
+}
+
+// failed records a failed resolution of host. Callers must hold mu.
+func (h *hostAllowlist) failed(host *allowedHost, err error) {
+	var dnsErr *net.DNSError
+	notFound := errors.As(err, &dnsErr) && dnsErr.IsNotFound
+	if host.lastErr == nil || notFound != host.notFound {
+		// A name that no longer exists is likely an obsolete entry.
+		if notFound {
+			h.logger.errorf("allowedIPs host %q does not exist (NXDOMAIN), the entry may be obsolete; keeping %d previous addresses under policy %s: %v",
+				host.name, len(host.addrs), h.policy.mode, err)
+		} else {
+			h.logger.errorf("Failed to resolve allowedIPs host %q, keeping %d previous addresses under policy %s: %v",
+				host.name, len(host.addrs), h.policy.mode, err)
+		}
+	}
+	host.lastErr, host.notFound = err, notFound
+
+	if h.policy.mode == dnsDrop && !host.dropped && h.expired(host) {
+		h.logger.errorf("Dropping the %d addresses of allowedIPs host %q, unresolved for longer than %s", len(host.addrs), host.name, h.policy.grace)
+		host.addrs, host.dropped = nil, true
+	}
+}
+
+// expired reports whether host has failed for longer than the grace.
+// Callers must hold mu.
+func (h *hostAllowlist) expired(host *allowedHost) bool {
+	if host.lastErr == nil {
+		return false
+	}
+	return h.now().After(h.expiry(host))
+}
+
+// expiry returns when host exceeds the grace, counted from its last
+// success or from the start when it never resolved. Callers must hold mu.
+func (h *hostAllowlist) expiry(host *allowedHost) time.Time {
+	since := host.resolvedAt
+	if since.IsZero() {
+		since = h.started
+	}
+	return since.Add(h.policy.grace)
+}
+
+// unresolved returns a host expired under the fail policy. It takes no
+// lock, as it runs for every request no stage admitted.
+func (h *hostAllowlist) unresolved() (string, bool) {
+	if h.policy.mode != dnsFail {
+		return "", false
+	}
+	deadline, _ := h.deadline.Load().(hostDeadline)
+	if deadline.name == "" || !h.now().After(deadline.at) {
+		return "", false
+	}
+	return deadline.name, true
+}
+
+// status describes every host.
+func (h *hostAllowlist) status() []hostStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	statuses := make([]hostStatus, 0, len(h.hosts))
+	for _, host := range h.hosts {
+		status := hostStatus{Name: host.name, Addresses: []string{}, NotFound: host.notFound, Expired: h.expired(host)}
+		for _, addr := range host.addrs {
+			status.Addresses = append(status.Addresses, addr.IP.String())
+		}
+		if !host.resolvedAt.IsZero() {
+			resolvedAt := host.resolvedAt
+			status.LastSuccess = &resolvedAt
+		}
+		if host.lastErr != nil {
+			status.LastError = host.lastErr.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// publish stores the addresses of every host.
+func (h *hostAllowlist) publish() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var prefixes []net.IPNet
+	var deadline hostDeadline
+	for _, host := range h.hosts {
+		prefixes = append(prefixes, host.addrs...)
+		if host.lastErr == nil {
+			continue
+		}
+		if at := h.expiry(host); deadline.name == "" || at.Before(deadline.at) {
+			deadline = hostDeadline{name: host.name, at: at}
+		}
+	}
+	h.prefixes.Store(prefixes)
+	h.deadline.Store(deadline)
+}
+
+// resolved returns the addresses of every host.
+func (h *hostAllowlist) resolved() []net.IPNet {
+	prefixes, _ := h.prefixes.Load().([]net.IPNet)
+	return prefixes
+}
+
+// allowedPrefixes returns the allowedIPs prefixes, including the addresses
+// hostname entries currently resolve to.
+func (cf *CloudFrontGate) allowedPrefixes() []net.IPNet {
+	set := cf.allowedSet()
+	if cf.hostAllowlist == nil && cf.allowedIPsFile == nil {
+		return set.prefixes
+	}
+	prefixes := append([]net.IPNet(nil), set.prefixes...)
+	if cf.hostAllowlist != nil {
+		prefixes = append(prefixes, cf.hostAllowlist.resolved()...)
+	}
+	if cf.allowedIPsFile != nil {
+		prefixes = append(prefixes, cf.allowedIPsFile.entries()...)
+	}
+	return prefixes
+}
+
+// allowedIP reports whether ip is in allowedIPs and outside its carve-outs.
+func (cf *CloudFrontGate) allowedIP(ip net.IP) bool {
+	set := cf.allowedSet()
+	if containsIP(set.carveOuts, ip) {
+		return false
+	}
+	if containsIP(set.prefixes, ip) {
+		return true
+	}
+	if cf.hostAllowlist != nil && containsIP(cf.hostAllowlist.resolved(), ip) {
+		return true
+	}
+	return cf.allowedIPsFile != nil && cf.allowedIPsFile.contains(ip)
+}
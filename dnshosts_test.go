@@ -0,0 +1,277 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubResolver answers lookups from a map; missing names fail.
+type stubResolver struct {
+	mu    sync.Mutex
+	addrs map[string][]string
+	err   error
+}
+
+func (r *stubResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	values, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	addrs := make([]net.IPAddr, 0, len(values))
+	for _, value := range values {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(value)})
+	}
+	return addrs, nil
+}
+
+func (r *stubResolver) set(host string, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs[host] = addrs
+}
+
+func (r *stubResolver) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+// useResolver replaces dnsResolver for the duration of the test.
+func useResolver(t *testing.T, r hostResolver) {
+	t.Helper()
+	previous := dnsResolver
+	dnsResolver = r
+	t.Cleanup(func() { dnsResolver = previous })
+}
+
+func TestIsHostname(t *testing.T) {
+	for entry, want := range map[string]bool{
+		"office.example.net":  true,
+		"Office.Example.NET.": true,
+		"localhost":           true,
+		"203.0.113.7":         false,
+		"10.0.0.300":          false,
+		"10.0.0.0/8":          false,
+		"2001:db8::1":         false,
+		"@private":            false,
+		"-bad.example.net":    false,
+		"bad..example.net":    false,
+		"under_score.example": false,
+	} {
+		if got := isHostname(entry); got != want {
+			t.Errorf("isHostname(%q) = %t, want %t", entry, got, want)
+		}
+	}
+}
+
+func TestAllowedIPsHostname(t *testing.T) {
+	resolver := &stubResolver{addrs: map[string][]string{"office.example.net": {"198.51.100.7", "2001:db8::7"}}}
+	useResolver(t, resolver)
+
+	cfg := CreateConfig()
+	cfg.AllowedIPs = []string{"192.0.2.0/24", "office.example.net"}
+	handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	for _, addr := range []string{"192.0.2.1:1234", "198.51.100.7:1234", "[2001:db8::7]:1234"} {
+		if got := serve(addr); got != http.StatusOK {
+			t.Errorf("Expected %s to be allowed, got %d", addr, got)
+		}
+	}
+	if got := serve("198.51.100.8:1234"); got != http.StatusForbidden {
+		t.Errorf("Expected only the resolved address to be allowed, got %d", got)
+	}
+
+	// The host moves.
+	resolver.set("office.example.net", "198.51.100.9")
+	cf.hostAllowlist.refresh()
+	if serve("198.51.100.7:1234") != http.StatusForbidden || serve("198.51.100.9:1234") != http.StatusOK {
+		t.Error("Expected the re-resolved address to replace the previous ones")
+	}
+
+	// A failed resolution keeps the previous addresses.
+	resolver.fail(errors.New("i/o timeout"))
+	cf.hostAllowlist.refresh()
+	if got := serve("198.51.100.9:1234"); got != http.StatusOK {
+		t.Errorf("Expected the previous address to be kept, got %d", got)
+	}
+	if got := cf.Status().AllowedIPs; got != 2 {
+		t.Errorf("Expected the CIDR and the resolved address in the status, got %d", got)
+	}
+}
+
+func TestAllowedIPsHostnameUnresolved(t *testing.T) {
+	useResolver(t, &stubResolver{addrs: map[string][]string{}})
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.AllowedIPs = []string{"gone.example.net"}
+	if handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture()); err == nil {
+		_ = handler.(*CloudFrontGate).Close()
+		t.Fatal("Expected an unresolvable host to be a construction error")
+	}
+
+	cfg.LenientDNS = true
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("Expected lenientDNS to tolerate the host, got %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+	if len(cf.allowedPrefixes()) != 0 {
+		t.Errorf("Expected no resolved addresses, got %v", cf.allowedPrefixes())
+	}
+}
+
+func TestNewRejectsInvalidDNSRefreshInterval(t *testing.T) {
+	useResolver(t, &stubResolver{addrs: map[string][]string{"office.example.net": {"198.51.100.7"}}})
+	for _, value := range []string{"often", "0s"} {
+		cfg := CreateConfig()
+		cfg.AllowedIPs = []string{"office.example.net"}
+		cfg.DNSRefreshInterval = value
+		if handler, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name()); err == nil {
+			_ = handler.(*CloudFrontGate).Close()
+			t.Errorf("Expected dnsRefreshInterval %q to be rejected", value)
+		}
+	}
+}
+
+func TestParseDNSPolicy(t *testing.T) {
+	policy, err := parseDNSPolicy("", "")
+	if err != nil || policy.mode != dnsKeep || policy.grace != defaultDNSStaleGrace {
+		t.Errorf("parseDNSPolicy() = %+v, %v, want the defaults", policy, err)
+	}
+	for _, tt := range [][2]string{{"forget", ""}, {dnsDrop, "soon"}, {dnsFail, "0s"}} {
+		if _, err := parseDNSPolicy(tt[0], tt[1]); err == nil {
+			t.Errorf("Expected policy %q with grace %q to be rejected", tt[0], tt[1])
+		}
+	}
+}
+
+func TestDNSFailurePolicy(t *testing.T) {
+	tests := []struct {
+		policy     string
+		wantHost   int
+		wantOther  int
+		wantCached int
+	}{
+		{policy: dnsKeep, wantHost: http.StatusOK, wantOther: http.StatusForbidden, wantCached: 1},
+		{policy: dnsDrop, wantHost: http.StatusForbidden, wantOther: http.StatusForbidden},
+		{policy: dnsFail, wantHost: http.StatusOK, wantOther: http.StatusServiceUnavailable, wantCached: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			resolver := &stubResolver{addrs: map[string][]string{"office.example.net": {"198.51.100.7"}}}
+			useResolver(t, resolver)
+
+			cfg := CreateConfig()
+			cfg.AllowedIPs = []string{"office.example.net"}
+			cfg.DNSFailurePolicy = tt.policy
+			cfg.DNSStaleGrace = "1h"
+			handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+			now := time.Now()
+			cf.hostAllowlist.now = func() time.Time { return now }
+
+			serve := func(remoteAddr string) int {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+				req.RemoteAddr = remoteAddr
+				rw := httptest.NewRecorder()
+				cf.ServeHTTP(rw, req)
+				return rw.Code
+			}
+
+			// Within the grace every policy keeps the addresses.
+			resolver.fail(errors.New("i/o timeout"))
+			now = now.Add(30 * time.Minute)
+			cf.hostAllowlist.refresh()
+			if serve("198.51.100.7:1234") != http.StatusOK || serve("192.0.2.1:1234") != http.StatusForbidden {
+				t.Fatal("Expected the addresses to be kept within the grace")
+			}
+
+			now = now.Add(time.Hour)
+			cf.hostAllowlist.refresh()
+			if got := serve("198.51.100.7:1234"); got != tt.wantHost {
+				t.Errorf("Expected the host to get %d, got %d", tt.wantHost, got)
+			}
+			if got := serve("192.0.2.1:1234"); got != tt.wantOther {
+				t.Errorf("Expected other peers to get %d, got %d", tt.wantOther, got)
+			}
+			if got := serve("205.251.249.10:1234"); got != http.StatusOK {
+				t.Errorf("Expected CloudFront peers to be allowed, got %d", got)
+			}
+			hosts := cf.status().AllowedHosts
+			if len(hosts) != 1 || len(hosts[0].Addresses) != tt.wantCached || !hosts[0].Expired || hosts[0].LastSuccess == nil {
+				t.Errorf("Unexpected host status %+v", hosts)
+			}
+		})
+	}
+}
+
+func TestDNSFailureLogs(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	resolver := &stubResolver{addrs: map[string][]string{"office.example.net": {"198.51.100.7"}}}
+	useResolver(t, resolver)
+	h, err := newHostAllowlist(context.Background(), []string{"office.example.net"}, time.Hour, false, dnsPolicy{mode: dnsKeep, grace: time.Hour}, time.Now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver.fail(errors.New("i/o timeout"))
+	h.refresh()
+	h.refresh()
+	if got := strings.Count(logs.String(), "ERROR: Failed to resolve allowedIPs host"); got != 1 {
+		t.Errorf("Expected the failure to be logged once, got %d in %q", got, logs.String())
+	}
+
+	resolver.fail(nil)
+	resolver.mu.Lock()
+	delete(resolver.addrs, "office.example.net")
+	resolver.mu.Unlock()
+	h.refresh()
+	if !strings.Contains(logs.String(), `ERROR: allowedIPs host "office.example.net" does not exist (NXDOMAIN)`) {
+		t.Errorf("Expected NXDOMAIN to be logged as an error, got %q", logs.String())
+	}
+	if status := h.status(); len(status) != 1 || !status[0].NotFound || len(status[0].Addresses) != 1 {
+		t.Errorf("Unexpected host status %+v", status)
+	}
+
+	resolver.set("office.example.net", "198.51.100.8")
+	h.refresh()
+	if !strings.Contains(logs.String(), `allowedIPs host "office.example.net" resolves again`) {
+		t.Errorf("Expected the recovery to be logged, got %q", logs.String())
+	}
+}
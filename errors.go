@@ -0,0 +1,113 @@
+package cloudfrontgate
+
+import "errors"
+
+// Classes of the errors of New, Update and Refresh, matched with errors.Is.
+var (
+	// ErrInvalidConfig is a configuration New refused; retrying cannot help.
+	ErrInvalidConfig = errors.New("invalid configuration")
+	// ErrFetchFailed is an IP list that could not be downloaded, verified or
+	// parsed; the refresh is retried.
+	ErrFetchFailed = errors.New("failed to fetch IP list")
+	// ErrListRejected is a fetched IP list refused by a safety check, such
+	// as maxShrinkPercent or anchorCIDRs; the previous list is kept.
+	ErrListRejected = errors.New("IP list rejected")
+	// ErrStaleList is an IP list too old to be used, such as an expired
+	// cache file.
+	ErrStaleList = errors.New("IP list is stale")
+)
+
+// ConfigError is an invalid option of the configuration.
+type ConfigError struct {
+	// Field is the JSON name of the option, e.g. "refreshInterval".
+	Field string
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrInvalidConfig.
+func (e *ConfigError) Is(target error) bool {
+	return target == ErrInvalidConfig
+}
+
+// invalidConfig marks err as caused by the option field, unless it already
+// names one.
+func invalidConfig(field string, err error) error {
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		return err
+	}
+	return &ConfigError{Field: field, Err: err}
+}
+
+// FetchError is a failed fetch of an IP list.
+type FetchError struct {
+	URL string
+	// StatusCode is that of an unexpected response, or 0.
+	StatusCode int
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrFetchFailed.
+func (e *FetchError) Is(target error) bool {
+	return target == ErrFetchFailed
+}
+
+// newFetchError describes the failed fetch of url, with the status code of
+// the StatusError err wraps, if any.
+func newFetchError(url string, err error) *FetchError {
+	e := &FetchError{URL: url, Err: err}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		e.StatusCode = statusErr.StatusCode
+	}
+	return e
+}
+
+// classifiedError tags err with one of the error classes.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.class
+}
+
+// errorKind names the class of err for the status, or returns "".
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidConfig):
+		return "config"
+	case errors.Is(err, ErrFetchFailed):
+		return "fetch"
+	case errors.Is(err, ErrListRejected):
+		return "rejected"
+	case errors.Is(err, ErrStaleList):
+		return "stale"
+	}
+	return ""
+}
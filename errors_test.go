@@ -0,0 +1,140 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewConfigErrors(t *testing.T) {
+	tests := []struct {
+		field     string
+		configure func(*Config)
+	}{
+		{field: "refreshInterval", configure: func(cfg *Config) { cfg.RefreshInterval = "soon" }},
+		{field: "allowedIPs", configure: func(cfg *Config) { cfg.AllowedIPs = []string{"10.0.0.0/33"} }},
+		{field: "ipListURL", configure: func(cfg *Config) { cfg.IPListURL = "ftp://example.com/ips" }},
+		{field: "ipLists", configure: func(cfg *Config) { cfg.IPLists = []string{"edge"} }},
+		{field: "httpTimeout", configure: func(cfg *Config) { cfg.HTTPTimeout = "0s" }},
+		{field: "maxRedirects", configure: func(cfg *Config) { cfg.MaxRedirects = -1 }},
+		{field: "healthPath", configure: func(cfg *Config) { cfg.HealthPath = "health" }},
+		{field: "forwardAuth", configure: func(cfg *Config) { cfg.ForwardAuth = &ForwardAuthConfig{Path: "/_verdict"} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			cfg := CreateConfig()
+			tt.configure(cfg)
+			_, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name())
+			if !errors.Is(err, ErrInvalidConfig) || errors.Is(err, ErrFetchFailed) {
+				t.Fatalf("Expected ErrInvalidConfig, got %v", err)
+			}
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) || configErr.Field != tt.field {
+				t.Errorf("Expected field %s, got %+v", tt.field, configErr)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := New(ctx, http.NotFoundHandler(), CreateConfig(), t.Name()); errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected a cancelled context not to be a configuration error, got %v", err)
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	garbled := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte("{"))
+	}))
+	defer garbled.Close()
+
+	tests := []struct {
+		name       string
+		url        string
+		anchors    []string
+		class      error
+		statusCode int
+	}{
+		{name: "status", url: unavailable.URL, class: ErrFetchFailed, statusCode: http.StatusServiceUnavailable},
+		{name: "parse", url: garbled.URL, class: ErrFetchFailed},
+		{name: "unreachable", url: "http://127.0.0.1:1/ips", class: ErrFetchFailed},
+		{name: "rejected", url: fixtureURL, anchors: []string{"192.0.2.0/24"}, class: ErrListRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips := newIPStore(tt.url)
+			ips.anchors = mustParseCIDRs(t, tt.anchors...)
+			err := ips.Update(context.Background())
+			if !errors.Is(err, tt.class) {
+				t.Fatalf("Expected %v, got %v", tt.class, err)
+			}
+			var fetchErr *FetchError
+			if fetched := errors.As(err, &fetchErr); fetched != (tt.class == ErrFetchFailed) {
+				t.Fatalf("Expected a FetchError only for fetch failures, got %v", err)
+			}
+			if fetchErr != nil && (fetchErr.URL != tt.url || fetchErr.StatusCode != tt.statusCode) {
+				t.Errorf("Expected %s with status %d, got %s with %d", tt.url, tt.statusCode, fetchErr.URL, fetchErr.StatusCode)
+			}
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) != (tt.statusCode != 0) {
+				t.Errorf("Expected the StatusError to be wrapped with the status code, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStaleCacheError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	ips := newIPStore(ipListURL)
+	ips.cacheFile = path
+	ips.cacheMaxAge = time.Hour
+	raw, err := json.Marshal(cacheDocument{
+		URL:       ipListURL,
+		FetchedAt: time.Now().Add(-2 * time.Hour),
+		Prefixes:  []cachedRange{{Prefix: "205.251.249.0/24", Source: sourceCloudFrontGlobal.String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ips.loadCache(time.Now()); !errors.Is(err, ErrStaleList) {
+		t.Errorf("Expected ErrStaleList, got %v", err)
+	}
+	if ips.Contains(net.ParseIP("205.251.249.1")) {
+		t.Error("Expected the stale cache not to be loaded")
+	}
+}
+
+func TestStatusLastErrorKind(t *testing.T) {
+	server, _, failing := countingSource(t)
+	cfg := CreateConfig()
+	cfg.IPListURL = server.URL
+	cfg.AllowPrivateSources = true
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	failing.Store(1)
+	if err := cf.Refresh(context.Background()); !errors.Is(err, ErrFetchFailed) {
+		t.Fatalf("Expected ErrFetchFailed, got %v", err)
+	}
+	if kind := cf.Status().LastErrorKind; kind != "fetch" {
+		t.Errorf("Expected the fetch class in the status, got %q", kind)
+	}
+}
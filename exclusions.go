@@ -0,0 +1,85 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// exclusions are the requests that bypass the gate, compiled once by
+// applyConfig.
+type exclusions struct {
+	exact    map[string]bool
+	prefixes []string
+	globs    []string
+	methods  map[string]bool
+}
+
+// parseExclusions compiles the excluded paths and methods. A path ending in
+// "/*" excludes everything below it, other wildcards follow path.Match, and
+// any other path must match exactly. It returns nil when nothing is
+// excluded.
+func parseExclusions(paths, methods []string) (*exclusions, error) {
+	if len(paths) == 0 && len(methods) == 0 {
+		return nil, nil
+	}
+
+	e := &exclusions{exact: make(map[string]bool), methods: make(map[string]bool)}
+	for _, pattern := range paths {
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("invalid excluded path %q: must start with /", pattern)
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && !strings.ContainsAny(prefix, "*?[\\") {
+			e.prefixes = append(e.prefixes, prefix+"/")
+			continue
+		}
+		if strings.ContainsAny(pattern, "*?[\\") {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid excluded path %q: %w", pattern, err)
+			}
+			e.globs = append(e.globs, pattern)
+			continue
+		}
+		e.exact[pattern] = true
+	}
+	for _, method := range methods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" || strings.ContainsAny(method, " \t/") {
+			return nil, fmt.Errorf("invalid excluded method %q", method)
+		}
+		e.methods[method] = true
+	}
+	return e, nil
+}
+
+// matches reports whether req bypasses the gate. Paths that are not in
+// canonical form, such as "/healthz/../admin", never match, so that an
+// exclusion cannot be stretched to other paths.
+func (e *exclusions) matches(req *http.Request) bool {
+	if e == nil {
+		return false
+	}
+	if e.methods[req.Method] {
+		return true
+	}
+
+	p := req.URL.Path
+	if clean := path.Clean(p); clean != p && clean+"/" != p {
+		return false
+	}
+	if e.exact[p] {
+		return true
+	}
+	for _, prefix := range e.prefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	for _, glob := range e.globs {
+		if ok, _ := path.Match(glob, p); ok {
+			return true
+		}
+	}
+	return false
+}
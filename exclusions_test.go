@@ -0,0 +1,92 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExclusionsMatches(t *testing.T) {
+	e, err := parseExclusions([]string{"/healthz", "/internal/*", "/api/*/status"}, []string{"options"})
+	if err != nil {
+		t.Fatalf("parseExclusions() error = %v", err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{method: http.MethodGet, path: "/healthz", want: true},
+		{method: http.MethodGet, path: "/healthz/more", want: false},
+		{method: http.MethodGet, path: "/healthzz", want: false},
+		{method: http.MethodGet, path: "/internal/metrics", want: true},
+		{method: http.MethodGet, path: "/internal/a/b", want: true},
+		{method: http.MethodGet, path: "/internal", want: false},
+		{method: http.MethodGet, path: "/api/v1/status", want: true},
+		{method: http.MethodGet, path: "/api/v1/users", want: false},
+		{method: http.MethodGet, path: "/internal/../admin", want: false},
+		{method: http.MethodGet, path: "/healthz/../admin", want: false},
+		{method: http.MethodOptions, path: "/anything", want: true},
+		{method: http.MethodGet, path: "/", want: false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Method = tt.method
+		req.URL.Path = tt.path
+		if got := e.matches(req); got != tt.want {
+			t.Errorf("matches(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseExclusionsValidation(t *testing.T) {
+	for _, paths := range [][]string{{"healthz"}, {"/api/[v1/status"}} {
+		if _, err := parseExclusions(paths, nil); err == nil {
+			t.Errorf("Expected %q to be rejected", paths)
+		}
+	}
+	if _, err := parseExclusions(nil, []string{"GET POST"}); err == nil {
+		t.Error("Expected an invalid method to be rejected")
+	}
+	if e, err := parseExclusions(nil, nil); e != nil || err != nil {
+		t.Errorf("Expected no exclusions, got %+v, %v", e, err)
+	}
+}
+
+func TestServeHTTPExcludedPaths(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ExcludedPaths = []string{"/healthz", "/internal/*"}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	for path, want := range map[string]int{
+		"/healthz":          http.StatusOK,
+		"/internal/metrics": http.StatusOK,
+		"/login":            http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		if rw.Code != want {
+			t.Errorf("%s: status = %d, want %d", path, rw.Code, want)
+		}
+	}
+	if got := cf.status().Excluded; got != 2 {
+		t.Errorf("Expected 2 excluded requests, got %d", got)
+	}
+
+	cfg.ExcludedPaths = []string{"healthz"}
+	if _, err := NewWithOptions(context.Background(), next, cfg, t.Name()+"invalid", withFixture()); err == nil {
+		t.Error("Expected an invalid excluded path to fail construction")
+	}
+}
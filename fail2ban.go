@@ -0,0 +1,131 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// fail2banReopenInterval is how often the fail2ban log path is checked for
+// rotation.
+const fail2banReopenInterval = time.Second
+
+// fail2banLog writes one line per policy denial:
+//
+//	2024-01-03T12:00:00Z cloudfrontgate[<name>]: denied <ip> reason=<reason>
+//
+// The timestamp is RFC3339 in UTC and the format is stable, so that a
+// fail2ban filter such as
+//
+//	failregex = cloudfrontgate\[[^\]]*\]: denied <HOST> reason=\S+$
+//
+// keeps matching. The file is reopened when it is rotated away.
+type fail2banLog struct {
+	path string
+	// logger receives the write failures.
+	logger *gateLogger
+
+	mu        sync.Mutex
+	closed    bool
+	file      *os.File
+	checkedAt time.Time
+	line      []byte
+}
+
+// newFail2banLog opens path for appending. It returns nil when path is empty.
+func newFail2banLog(path string, logger *gateLogger) (*fail2banLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f := &fail2banLog{path: path, logger: logger}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fail2banLog) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open fail2ban log: %w", err)
+	}
+	f.file = file
+	return nil
+}
+
+// write appends the line of a denial. Denials without a parsable peer
+// address are skipped, since there is nothing to ban.
+func (f *fail2banLog) write(now time.Time, name string, ip net.IP, reason denyReason) {
+	if ip == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return
+	}
+	f.reopenIfRotated(now)
+	if f.file == nil {
+		return
+	}
+
+	f.line = appendFail2banLine(f.line[:0], now, name, ip, reason)
+	if _, err := f.file.Write(f.line); err != nil {
+		f.logger.errorf("Failed to write fail2ban log: %v", err)
+	}
+}
+
+// reopenIfRotated reopens the file when the path no longer refers to it.
+func (f *fail2banLog) reopenIfRotated(now time.Time) {
+	if now.Sub(f.checkedAt) < fail2banReopenInterval && f.file != nil {
+		return
+	}
+	f.checkedAt = now
+
+	if f.file != nil {
+		current, err := f.file.Stat()
+		onDisk, statErr := os.Stat(f.path)
+		if err == nil && statErr == nil && os.SameFile(current, onDisk) {
+			return
+		}
+		_ = f.file.Close()
+		f.file = nil
+	}
+	if err := f.open(); err != nil {
+		f.logger.errorf("Failed to reopen fail2ban log: %v", err)
+	}
+}
+
+// close closes the file; denials written afterwards are dropped.
+func (f *fail2banLog) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close fail2ban log: %w", err)
+	}
+	return nil
+}
+
+// appendFail2banLine appends the log line of a denial to b.
+func appendFail2banLine(b []byte, now time.Time, name string, ip net.IP, reason denyReason) []byte {
+	b = now.UTC().AppendFormat(b, time.RFC3339)
+	b = append(b, " cloudfrontgate["...)
+	b = appendField(b, name)
+	b = append(b, "]: denied "...)
+	b = append(b, ip.String()...)
+	b = append(b, " reason="...)
+	b = append(b, reason.String()...)
+	return append(b, '\n')
+}
@@ -0,0 +1,95 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fail2banRegex is the documented failregex with <HOST> expanded the way
+// fail2ban does.
+var fail2banRegex = regexp.MustCompile(`cloudfrontgate\[[^\]]*\]: denied (?P<host>\S+) reason=\S+$`)
+
+func TestFail2banLineGolden(t *testing.T) {
+	start := time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC)
+	denials := []struct {
+		at     time.Time
+		ip     string
+		reason denyReason
+	}{
+		{at: start, ip: "10.0.0.1", reason: denyIP},
+		{at: start.Add(time.Second), ip: "205.251.249.10", reason: denyDenylist},
+		{at: start.Add(2 * time.Second), ip: "2001:db8::1", reason: denyHost},
+		// Local times are written in UTC.
+		{at: start.Add(3 * time.Second).In(time.FixedZone("", -7*3600)), ip: "198.51.100.7", reason: denyCountry},
+	}
+
+	var got []byte
+	for _, d := range denials {
+		got = appendFail2banLine(got, d.at, "gate@file", net.ParseIP(d.ip), d.reason)
+	}
+
+	want, err := os.ReadFile(filepath.Join("testdata", "fail2ban.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("fail2ban lines =\n%s\nwant\n%s", got, want)
+	}
+
+	for i, line := range strings.Split(strings.TrimSpace(string(want)), "\n") {
+		match := fail2banRegex.FindStringSubmatch(line)
+		if match == nil || match[1] != denials[i].ip {
+			t.Errorf("Expected the documented failregex to extract %s from %q, got %v", denials[i].ip, line, match)
+		}
+	}
+}
+
+func TestFail2banLogReopensAfterRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fail2ban.log")
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.Fail2banLog = path
+	cfg.AllowedIPs = []string{"192.168.1.0/24"}
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+
+	now := time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC)
+	cf.now = func() time.Time { return now }
+	serve := func(remoteAddr string) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		cf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve("10.0.0.1:1234")
+	serve("192.168.1.1:1234") // allowed, not written
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * fail2banReopenInterval)
+	serve("10.0.0.2:1234")
+
+	rotated, _ := os.ReadFile(path + ".1")
+	current, _ := os.ReadFile(path)
+	if got := string(rotated); got != "2024-01-03T12:00:00Z cloudfrontgate[TestFail2banLogReopensAfterRotation]: denied 10.0.0.1 reason=ip\n" {
+		t.Errorf("Unexpected rotated file %q", got)
+	}
+	if got := string(current); got != "2024-01-03T12:00:02Z cloudfrontgate[TestFail2banLogReopensAfterRotation]: denied 10.0.0.2 reason=ip\n" {
+		t.Errorf("Expected the log to be reopened after rotation, got %q", got)
+	}
+}
@@ -0,0 +1,207 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Forward-auth header names, as sent by Traefik's forwardAuth middleware.
+const (
+	headerForwardedHost   = "X-Forwarded-Host"
+	headerForwardedProto  = "X-Forwarded-Proto"
+	headerForwardedURI    = "X-Forwarded-Uri"
+	headerForwardedMethod = "X-Forwarded-Method"
+	// headerReason carries the reason code of forward-auth denials.
+	headerReason = "X-CFGate-Reason"
+)
+
+// strategyForwardAuth names the extraction strategy of forward-auth
+// requests in logs.
+const strategyForwardAuth = "forwardAuth"
+
+// ctxForwardAuth marks a request rebuilt from forward-auth headers. Such
+// requests are answered with the verdict instead of being forwarded.
+const ctxForwardAuth contextKey = "forwardAuth"
+
+// ForwardAuthConfig configures answering forward-auth requests with the
+// verdict of the gate.
+type ForwardAuthConfig struct {
+	// Path is the request path answered with the verdict; the endpoint is disabled when empty
+	Path string `json:"path,omitempty"`
+	// ClientIPHeader, when set, echoes the evaluated client IP in this header of allowed responses
+	ClientIPHeader string `json:"clientIPHeader,omitempty"`
+	// AllowedCallers lists the direct peers allowed to ask for a verdict; required
+	AllowedCallers []string `json:"allowedCallers,omitempty"`
+}
+
+// forwardAuth holds the validated forward-auth settings.
+type forwardAuth struct {
+	path           string
+	clientIPHeader string
+	allowedCallers []net.IPNet
+	// all answers every path, for NewForwardAuthHandler.
+	all bool
+}
+
+// newForwardAuth validates config. It returns nil when no path is set.
+func newForwardAuth(config *ForwardAuthConfig, groups cidrGroups) (*forwardAuth, error) {
+	if config == nil || config.Path == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(config.Path, "/") {
+		return nil, fmt.Errorf("invalid forwardAuth path %q: must start with /", config.Path)
+	}
+	// Any peer could otherwise have the gate vouch for a forged
+	// X-Forwarded-For.
+	if len(config.AllowedCallers) == 0 {
+		return nil, errors.New("forwardAuth requires allowedCallers")
+	}
+	callers, _, err := groups.parse(config.AllowedCallers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse forwardAuth allowed callers: %w", err)
+	}
+	return &forwardAuth{
+		path:           cleanRoutePath(config.Path),
+		clientIPHeader: http.CanonicalHeaderKey(config.ClientIPHeader),
+		allowedCallers: callers,
+	}, nil
+}
+
+// NewForwardAuthHandler creates a handler that answers every request with
+// the verdict of the gate for the request described by its forward-auth
+// headers: 200 when allowed, 403 with X-CFGate-Reason otherwise. It lets
+// one instance serve as the authority for several routers through
+// Traefik's forwardAuth middleware. The path of config.ForwardAuth is
+// ignored; its allowedCallers are required.
+func NewForwardAuthHandler(ctx context.Context, config *Config, name string) (http.Handler, error) {
+	fa := ForwardAuthConfig{}
+	if config.ForwardAuth != nil {
+		fa = *config.ForwardAuth
+	}
+	fa.Path = "/"
+	standalone := *config
+	standalone.ForwardAuth = &fa
+
+	handler, err := New(ctx, http.NotFoundHandler(), &standalone, name)
+	if err != nil {
+		return nil, err
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	cf.forwardAuth.all = true
+	return cf, nil
+}
+
+// matches reports whether route, as routePath returns it, asks for a
+// verdict.
+func (fa *forwardAuth) matches(route string) bool {
+	return fa.all || (route != "" && route == fa.path)
+}
+
+// serveForwardAuth rebuilds the original request from the forward-auth
+// headers and runs it through the decision pipeline.
+func (cf *CloudFrontGate) serveForwardAuth(rw http.ResponseWriter, req *http.Request) {
+	if peer := peerIP(req); peer == nil || !containsIP(cf.forwardAuth.allowedCallers, peer) {
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	original, err := forwardedRequest(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cf.serveGate(rw, original)
+}
+
+// forwardedRequest returns the request described by the forward-auth
+// headers of req. The rightmost X-Forwarded-For entry, appended by the
+// asking proxy, becomes the peer address; the remaining entries stay in
+// the header as the original request carried them.
+func forwardedRequest(req *http.Request) (*http.Request, error) {
+	method := req.Header.Get(headerForwardedMethod)
+	if method == "" {
+		method = http.MethodGet
+	}
+	uri := req.Header.Get(headerForwardedURI)
+	if uri == "" {
+		uri = "/"
+	}
+	target, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil, errors.New("invalid X-Forwarded-Uri")
+	}
+	target.Scheme = req.Header.Get(headerForwardedProto)
+	target.Host = req.Header.Get(headerForwardedHost)
+	if target.Host == "" {
+		target.Host = req.Host
+	}
+
+	original := req.Clone(context.WithValue(req.Context(), ctxForwardAuth, true))
+	original.Method = method
+	original.URL = target
+	original.RequestURI = target.RequestURI()
+	original.Host = target.Host
+	original.Body = http.NoBody
+	original.ContentLength = 0
+
+	chain := forwardedChain(req.Header)
+	original.Header.Del(headerForwardedFor)
+	original.RemoteAddr = ""
+	if len(chain) > 0 {
+		peer := chain[len(chain)-1]
+		original.RemoteAddr = peer
+		if ip := parseForwardedIP(peer); ip != nil {
+			original.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		}
+		if len(chain) > 1 {
+			original.Header.Set(headerForwardedFor, strings.Join(chain[:len(chain)-1], ", "))
+		}
+	}
+	for _, name := range []string{headerForwardedMethod, headerForwardedURI, headerForwardedProto, headerForwardedHost} {
+		original.Header.Del(name)
+	}
+	return original, nil
+}
+
+// forwardedChain returns the X-Forwarded-For entries across all header
+// lines, leftmost first.
+func forwardedChain(header http.Header) []string {
+	var chain []string
+	for _, line := range header.Values(headerForwardedFor) {
+		for _, entry := range strings.Split(line, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				chain = append(chain, entry)
+			}
+		}
+	}
+	return chain
+}
+
+// forward passes an admitted request on: to the next handler, or, for a
+// forward-auth request, back to the asking proxy as a 200.
+func (cf *CloudFrontGate) forward(rw http.ResponseWriter, req *http.Request) {
+	if req.Context().Value(ctxForwardAuth) == nil {
+		// The origin secret never reaches the backend.
+		if cf.originVerify != nil {
+			req.Header.Del(cf.originVerify.name)
+		}
+		cf.applyForwardedPolicy(req)
+		if cf.recordsResponses() {
+			cf.serveRecorded(rw, req)
+			return
+		}
+		cf.next.ServeHTTP(rw, req)
+		return
+	}
+	if cf.forwardAuth != nil && cf.forwardAuth.clientIPHeader != "" {
+		if ip := cf.clientIP(req); ip != nil {
+			rw.Header().Set(cf.forwardAuth.clientIPHeader, ip.String())
+		}
+	}
+	rw.WriteHeader(http.StatusOK)
+}
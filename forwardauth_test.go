@@ -0,0 +1,129 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardAuthPath(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.AllowedHosts = []string{"app.example.com"}
+	cfg.ForwardAuth = &ForwardAuthConfig{
+		Path:           "/_verdict",
+		ClientIPHeader: "X-Client-IP",
+		AllowedCallers: []string{"127.0.0.0/8"},
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		t.Errorf("Expected verdict requests not to be forwarded, got %s", req.URL)
+	})
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		forwarded  string
+		host       string
+		wantStatus int
+		wantReason string
+		wantIP     string
+	}{
+		{name: "CloudFront peer", remoteAddr: "127.0.0.1:1234", forwarded: "198.51.100.7, 205.251.249.10", host: "app.example.com", wantStatus: http.StatusOK, wantIP: "205.251.249.10"},
+		{name: "Other peer", remoteAddr: "127.0.0.1:1234", forwarded: "10.0.0.1", host: "app.example.com", wantStatus: http.StatusForbidden, wantReason: "ip"},
+		{name: "Unexpected host", remoteAddr: "127.0.0.1:1234", forwarded: "205.251.249.10", host: "other.example.com", wantStatus: http.StatusForbidden, wantReason: "unexpected-host"},
+		{name: "Caller not allowed", remoteAddr: "10.0.0.1:1234", forwarded: "205.251.249.10", host: "app.example.com", wantStatus: http.StatusForbidden},
+		{name: "No forwarded address", remoteAddr: "127.0.0.1:1234", host: "app.example.com", wantStatus: http.StatusBadRequest},
+		{name: "Trailing slash", path: "/_verdict/", remoteAddr: "127.0.0.1:1234", forwarded: "10.0.0.1", host: "app.example.com", wantStatus: http.StatusForbidden, wantReason: "ip"},
+		{name: "Dot segments", path: "//x/../_verdict", remoteAddr: "127.0.0.1:1234", forwarded: "10.0.0.1", host: "app.example.com", wantStatus: http.StatusForbidden, wantReason: "ip"},
+		{name: "Escaped path", path: "/%5Fverdict", remoteAddr: "127.0.0.1:1234", forwarded: "205.251.249.10", host: "app.example.com", wantStatus: http.StatusOK, wantIP: "205.251.249.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path
+			if path == "" {
+				path = "/_verdict"
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://gate.internal"+path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			req.Header.Set("X-Forwarded-Host", tt.host)
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Uri", "/login?next=%2F")
+			rw := httptest.NewRecorder()
+			cf.ServeHTTP(rw, req)
+
+			if rw.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, rw.Code)
+			}
+			if got := rw.Header().Get(headerReason); got != tt.wantReason {
+				t.Errorf("Expected reason %q, got %q", tt.wantReason, got)
+			}
+			if got := rw.Header().Get("X-Client-IP"); got != tt.wantIP {
+				t.Errorf("Expected client IP %q, got %q", tt.wantIP, got)
+			}
+		})
+	}
+}
+
+func TestNewForwardAuthHandler(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.IPListURL = fixtureURL
+	cfg.AllowPrivateSources = true
+	cfg.ForwardAuth = &ForwardAuthConfig{AllowedCallers: []string{"192.0.2.0/24"}}
+	handler, err := NewForwardAuthHandler(context.Background(), cfg, t.Name())
+	if err != nil {
+		t.Fatalf("NewForwardAuthHandler() error = %v", err)
+	}
+	defer func() { _ = handler.(*CloudFrontGate).Close() }()
+
+	for _, path := range []string{"/", "/auth"} {
+		req := httptest.NewRequest(http.MethodGet, "http://gate.internal"+path, nil)
+		req.Header.Set("X-Forwarded-For", "205.251.249.10")
+		req.Header.Set("X-Forwarded-Uri", "/anything")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Errorf("Expected %s to answer 200, got %d", path, rw.Code)
+		}
+	}
+}
+
+func TestForwardedRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://gate.internal/_verdict", nil)
+	req.Header.Add("X-Forwarded-For", "198.51.100.7")
+	req.Header.Add("X-Forwarded-For", "203.0.113.1, 205.251.249.10")
+	req.Header.Set("X-Forwarded-Method", http.MethodPost)
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
+	req.Header.Set("X-Forwarded-Uri", "/login?next=%2F")
+
+	original, err := forwardedRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original.Method != http.MethodPost || original.Host != "app.example.com" || original.URL.Path != "/login" || original.URL.RawQuery != "next=%2F" {
+		t.Errorf("Unexpected request %s %s%s", original.Method, original.Host, original.URL.RequestURI())
+	}
+	if original.RemoteAddr != "205.251.249.10:0" {
+		t.Errorf("Expected the rightmost entry as the peer, got %q", original.RemoteAddr)
+	}
+	if got := original.Header.Get("X-Forwarded-For"); got != "198.51.100.7, 203.0.113.1" {
+		t.Errorf("Expected the remaining chain, got %q", got)
+	}
+	if original.Header.Get("X-Forwarded-Uri") != "" {
+		t.Error("Expected the forward-auth headers to be removed")
+	}
+
+	req.Header.Set("X-Forwarded-Uri", "not a uri")
+	if _, err := forwardedRequest(req); err == nil {
+		t.Error("Expected an invalid X-Forwarded-Uri to be rejected")
+	}
+}
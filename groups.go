@@ -0,0 +1,117 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// groupPrefix marks a reference to a named group in a CIDR list.
+const groupPrefix = "@"
+
+// builtinGroups are available to every configuration.
+var builtinGroups = map[string][]string{
+	"loopback":   {"127.0.0.0/8", "::1/128"},
+	"private":    {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+	"link-local": {"169.254.0.0/16", "fe80::/10"},
+}
+
+// cidrGroups maps group names to their expanded CIDR entries.
+type cidrGroups map[string][]string
+
+// parseGroups validates the user-defined groups and merges them with the
+// built-in ones. User groups may reference built-in groups, but not each
+// other, so expansion never recurses.
+func parseGroups(user map[string][]string) (cidrGroups, error) {
+	groups := make(cidrGroups, len(builtinGroups)+len(user))
+	for name, cidrs := range builtinGroups {
+		groups[name] = cidrs
+	}
+
+	for name, entries := range user {
+		if _, ok := builtinGroups[name]; ok {
+			return nil, fmt.Errorf("group %q shadows a built-in group", name)
+		}
+		if name == "" || strings.ContainsAny(name, "@/ ") {
+			return nil, fmt.Errorf("invalid group name %q", name)
+		}
+
+		var cidrs []string
+		for _, entry := range entries {
+			ref, ok := strings.CutPrefix(entry, groupPrefix)
+			if !ok {
+				cidrs = append(cidrs, entry)
+				continue
+			}
+			builtin, ok := builtinGroups[ref]
+			if !ok {
+				if _, isUser := user[ref]; isUser {
+					return nil, fmt.Errorf("group %q references user group %q: only built-in groups may be referenced", name, ref)
+				}
+				return nil, fmt.Errorf("group %q references unknown group %q (built-in: %s)", name, entry, builtinGroupNames())
+			}
+			cidrs = append(cidrs, builtin...)
+		}
+		if _, err := parseCIDRs(cidrs); err != nil {
+			return nil, fmt.Errorf("invalid group %q: %w", name, err)
+		}
+		groups[name] = cidrs
+	}
+	return groups, nil
+}
+
+// parse expands group references in entries and parses the result. It also
+// returns one label per entry for status output, such as "office (3 prefixes)"
+// for a group reference.
+func (g cidrGroups) parse(entries []string) ([]net.IPNet, []string, error) {
+	var cidrs, labels []string
+	for _, entry := range entries {
+		ref, ok := strings.CutPrefix(entry, groupPrefix)
+		if !ok {
+			cidrs = append(cidrs, entry)
+			labels = append(labels, entry)
+			continue
+		}
+		group, ok := g[ref]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown group %q (available: %s)", entry, g.names())
+		}
+		cidrs = append(cidrs, group...)
+		labels = append(labels, fmt.Sprintf("%s (%d prefixes)", ref, len(group)))
+	}
+
+	prefixes, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return prefixes, labels, nil
+}
+
+// uniquePrefixes drops the repeated prefixes of prefixes, keeping the order.
+func uniquePrefixes(prefixes []net.IPNet) []net.IPNet {
+	seen := make(map[string]bool, len(prefixes))
+	out := prefixes[:0:0]
+	for _, prefix := range prefixes {
+		if key := prefix.String(); !seen[key] {
+			seen[key] = true
+			out = append(out, prefix)
+		}
+	}
+	return out
+}
+
+// names returns the sorted group references.
+func (g cidrGroups) names() string {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, groupPrefix+name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// builtinGroupNames returns the sorted built-in group references.
+func builtinGroupNames() string {
+	return cidrGroups(builtinGroups).names()
+}
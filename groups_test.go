@@ -0,0 +1,143 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    map[string][]string
+		wantErr string
+	}{
+		{name: "none"},
+		{name: "plain", user: map[string][]string{"office": {"198.51.100.0/24", "203.0.113.7"}}},
+		{name: "built-in reference", user: map[string][]string{"internal": {"@private", "@loopback"}}},
+		{name: "user reference", user: map[string][]string{"office": {"198.51.100.0/24"}, "all": {"@office"}}, wantErr: "only built-in groups"},
+		{name: "self reference", user: map[string][]string{"office": {"@office"}}, wantErr: "only built-in groups"},
+		{name: "unknown reference", user: map[string][]string{"office": {"@nope"}}, wantErr: "@link-local, @loopback, @private"},
+		{name: "shadows built-in", user: map[string][]string{"private": {"10.0.0.0/8"}}, wantErr: "built-in"},
+		{name: "invalid name", user: map[string][]string{"@office": {"10.0.0.0/8"}}, wantErr: "invalid group name"},
+		{name: "invalid CIDR", user: map[string][]string{"office": {"nope"}}, wantErr: "invalid group"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGroups(tt.user)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("parseGroups() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseGroups() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCIDRGroupsParse(t *testing.T) {
+	groups, err := parseGroups(map[string][]string{
+		"office": {"198.51.100.0/24", "203.0.113.7"},
+		"vpn":    {"192.0.2.0/28", "@link-local"},
+	})
+	if err != nil {
+		t.Fatalf("parseGroups() error = %v", err)
+	}
+
+	prefixes, labels, err := groups.parse([]string{"@office", "10.1.0.0/16", "@vpn"})
+	if err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+	if len(prefixes) != 6 {
+		t.Errorf("Expected 6 expanded prefixes, got %d", len(prefixes))
+	}
+	wantLabels := []string{"office (2 prefixes)", "10.1.0.0/16", "vpn (3 prefixes)"}
+	if !reflect.DeepEqual(labels, wantLabels) {
+		t.Errorf("labels = %v, want %v", labels, wantLabels)
+	}
+
+	_, _, err = groups.parse([]string{"@nope"})
+	if err == nil || !strings.Contains(err.Error(), "@office") || !strings.Contains(err.Error(), "@private") {
+		t.Errorf("Expected the error to name the available groups, got %v", err)
+	}
+}
+
+func TestNewExpandsGroups(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.Groups = map[string][]string{"office": {"198.51.100.0/24"}}
+	cfg.AllowedIPs = []string{"@office"}
+	cfg.AdminPath = "/_cfgate"
+	cfg.AdminToken = "t"
+	cfg.AdminAllowedIPs = []string{"@office", "@loopback"}
+
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+
+	if !cf.allowed(net.ParseIP("198.51.100.9")) {
+		t.Errorf("Expected group members to be trusted")
+	}
+	if !containsIP(cf.admin.allowedIPs, net.ParseIP("127.0.0.1")) {
+		t.Errorf("Expected built-in groups to expand in admin allowed IPs")
+	}
+
+	cfg.AllowedIPs = []string{"@vpn"}
+	if _, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture()); err == nil {
+		t.Errorf("Expected an unknown group reference to fail")
+	}
+}
+
+func TestAllowPrivateNetworksAndLoopback(t *testing.T) {
+	build := func(t *testing.T, private, loopback bool) *CloudFrontGate {
+		t.Helper()
+		cfg := CreateConfig()
+		cfg.AllowedIPs = []string{"10.0.0.0/8", "198.51.100.0/24"}
+		cfg.AllowPrivateNetworks = private
+		cfg.AllowLoopback = loopback
+		handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), withFixture())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		t.Cleanup(func() { _ = cf.Close() })
+		return cf
+	}
+	serve := func(cf *CloudFrontGate, remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	cf := build(t, true, true)
+	for _, addr := range []string{"192.168.1.1:1", "172.16.0.1:1", "[fd00::1]:1", "169.254.1.1:1", "[fe80::1]:1", "127.0.0.1:1", "[::1]:1", "198.51.100.1:1"} {
+		if got := serve(cf, addr); got != http.StatusOK {
+			t.Errorf("Expected %s to be allowed, got %d", addr, got)
+		}
+	}
+	status := cf.status()
+	if len(status.AllowedIPs) != 9 {
+		t.Errorf("Expected 9 distinct prefixes without a second 10.0.0.0/8, got %v", status.AllowedIPs)
+	}
+
+	cf = build(t, false, false)
+	for _, addr := range []string{"192.168.1.1:1", "127.0.0.1:1"} {
+		if got := serve(cf, addr); got != http.StatusForbidden {
+			t.Errorf("Expected %s to be denied by default, got %d", addr, got)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package cloudfrontgate
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Forwarding header names.
+const (
+	headerViewerAddress = "CloudFront-Viewer-Address"
+	headerForwardedFor  = "X-Forwarded-For"
+	headerRealIP        = "X-Real-IP"
+	headerForwarded     = "Forwarded"
+)
+
+// Forwarding header policies.
+const (
+	forwardedPassthrough = "passthrough"
+	forwardedSanitize    = "sanitize"
+	forwardedRewrite     = "rewrite"
+)
+
+// Spoofed forwarding detection modes.
+const (
+	spoofOff  = "off"
+	spoofLog  = "log"
+	spoofDeny = "deny"
+)
+
+// checkForwarding reports whether the request may proceed given its
+// forwarding headers. It assumes the peer already passed the IP check.
+func (cf *CloudFrontGate) checkForwarding(req *http.Request, peer netip.Addr) bool {
+	if cf.spoofMode != spoofLog && cf.spoofMode != spoofDeny {
+		return true
+	}
+
+	viewer := parseViewerAddress(req.Header.Get(headerViewerAddress))
+	forwarded := leftmostForwardedFor(req.Header)
+	if viewer == nil || forwarded == nil || viewer.Equal(forwarded) {
+		return true
+	}
+
+	cf.state.spoofed.Add(1)
+	cf.logger.infof("CloudFrontGate %s: spoofed forwarding from %s: %s %s disagrees with %s %s",
+		cf.name, peer, headerViewerAddress, viewer, headerForwardedFor, forwarded)
+	return cf.spoofMode != spoofDeny
+}
+
+// parseViewerAddress parses the "ip:port" value of CloudFront-Viewer-Address.
+// IPv6 addresses are not bracketed, so the port follows the last colon.
+func parseViewerAddress(value string) net.IP {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(value); err == nil && strings.HasPrefix(value, "[") {
+		return net.ParseIP(host)
+	}
+	if i := strings.LastIndex(value, ":"); i > 0 {
+		if ip := net.ParseIP(value[:i]); ip != nil {
+			return ip
+		}
+	}
+	return net.ParseIP(value)
+}
+
+// leftmostForwardedFor returns the first address of the X-Forwarded-For
+// chain across all header lines.
+func leftmostForwardedFor(header http.Header) net.IP {
+	for _, line := range header.Values(headerForwardedFor) {
+		for _, entry := range strings.Split(line, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				return parseForwardedIP(entry)
+			}
+		}
+	}
+	return nil
+}
+
+// parseForwardedIP parses an X-Forwarded-For entry, tolerating a port suffix
+// and brackets around IPv6 addresses.
+func parseForwardedIP(entry string) net.IP {
+	if ip := net.ParseIP(entry); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.Trim(entry, "[]"))
+}
+
+// applyForwardedPolicy removes the client address headers that no trusted
+// hop set before req reaches the backend. X-Forwarded-For keeps the entries
+// appended by the trusted proxies of ipStrategy and, when the checked
+// address is a CDN edge, the one that edge appended. X-Real-IP and
+// Forwarded are removed, and CloudFront-Viewer-Address is only kept from an
+// edge. The rewrite policy then sets X-Real-IP to the verified viewer
+// address: CloudFront-Viewer-Address, else the entry appended by the edge,
+// or the checked address when it is not an edge.
+func (cf *CloudFrontGate) applyForwardedPolicy(req *http.Request) {
+	if cf.forwardedPolicy != forwardedSanitize && cf.forwardedPolicy != forwardedRewrite {
+		return
+	}
+
+	ip := cf.clientIP(req)
+	edge := false
+	if ip != nil {
+		source, ok := cf.ips.match(addrOf(ip))
+		edge = ok && source != sourceCustom
+	}
+
+	// The entries right of the checked address were appended by trusted
+	// proxies; without a strategy the checked address is the peer, which
+	// appended nothing yet.
+	chain := forwardedChain(req.Header)
+	first := len(chain)
+	if ip != nil && !ip.Equal(peerIP(req)) {
+		for i := len(chain) - 1; i >= 0; i-- {
+			if ip.Equal(normalizeIP(parseForwardedIP(chain[i]))) {
+				first = i
+				break
+			}
+		}
+	}
+	var hop net.IP
+	if edge && first > 0 {
+		first--
+		hop = normalizeIP(parseForwardedIP(chain[first]))
+	}
+
+	req.Header.Del(headerForwardedFor)
+	if first < len(chain) {
+		req.Header.Set(headerForwardedFor, strings.Join(chain[first:], ", "))
+	}
+	req.Header.Del(headerRealIP)
+	req.Header.Del(headerForwarded)
+	var viewer net.IP
+	if edge {
+		viewer = normalizeIP(parseViewerAddress(req.Header.Get(headerViewerAddress)))
+	} else {
+		req.Header.Del(headerViewerAddress)
+	}
+	if cf.forwardedPolicy != forwardedRewrite {
+		return
+	}
+
+	realIP := ip
+	if edge {
+		realIP = viewer
+		if realIP == nil {
+			realIP = hop
+		}
+	}
+	if realIP != nil {
+		req.Header.Set(headerRealIP, realIP.String())
+	}
+}
@@ -0,0 +1,269 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseViewerAddress(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "198.51.100.10:46532", want: "198.51.100.10"},
+		{value: "2001:db8:85a3::8a2e:370:7334:46532", want: "2001:db8:85a3::8a2e:370:7334"},
+		{value: "[2001:db8::1]:443", want: "2001:db8::1"},
+		{value: "198.51.100.10", want: "198.51.100.10"},
+		{value: "", want: ""},
+		{value: "garbage", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got := parseViewerAddress(tt.value)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("parseViewerAddress(%q) = %s, want nil", tt.value, got)
+				}
+				return
+			}
+			if !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("parseViewerAddress(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeftmostForwardedFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   string
+	}{
+		{name: "Single entry", values: []string{"198.51.100.10"}, want: "198.51.100.10"},
+		{name: "Chain", values: []string{"198.51.100.10, 130.176.1.1"}, want: "198.51.100.10"},
+		{name: "Multiple headers", values: []string{" 198.51.100.10 ", "130.176.1.1"}, want: "198.51.100.10"},
+		{name: "Port suffix", values: []string{"198.51.100.10:1234"}, want: "198.51.100.10"},
+		{name: "Bracketed IPv6 with port", values: []string{"[2001:db8::1]:443, 130.176.1.1"}, want: "2001:db8::1"},
+		{name: "Empty", values: []string{""}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, v := range tt.values {
+				header.Add(headerForwardedFor, v)
+			}
+
+			got := leftmostForwardedFor(header)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("leftmostForwardedFor() = %s, want nil", got)
+				}
+				return
+			}
+			if !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("leftmostForwardedFor() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectSpoofedForwarding(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		remoteAddr string
+		viewer     string
+		forwarded  string
+		status     int
+		spoofed    uint64
+	}{
+		{
+			name: "Consistent headers", mode: spoofDeny, remoteAddr: "205.251.249.10:1234",
+			viewer: "198.51.100.10:46532", forwarded: "198.51.100.10, 205.251.249.10",
+			status: http.StatusOK,
+		},
+		{
+			name: "IPv6 textual variants agree", mode: spoofDeny, remoteAddr: "205.251.249.10:1234",
+			viewer: "2001:0db8:0000::0001:443", forwarded: "[2001:db8::1]:8080",
+			status: http.StatusOK,
+		},
+		{
+			name: "Smuggled XFF is denied", mode: spoofDeny, remoteAddr: "205.251.249.10:1234",
+			viewer: "198.51.100.10:46532", forwarded: "203.0.113.7, 198.51.100.10",
+			status: http.StatusForbidden, spoofed: 1,
+		},
+		{
+			name: "Smuggled XFF is logged", mode: spoofLog, remoteAddr: "205.251.249.10:1234",
+			viewer: "198.51.100.10:46532", forwarded: "203.0.113.7",
+			status: http.StatusOK, spoofed: 1,
+		},
+		{
+			name: "Detection off", mode: "", remoteAddr: "205.251.249.10:1234",
+			viewer: "198.51.100.10:46532", forwarded: "203.0.113.7",
+			status: http.StatusOK,
+		},
+		{
+			name: "Missing viewer header", mode: spoofDeny, remoteAddr: "205.251.249.10:1234",
+			forwarded: "203.0.113.7",
+			status:    http.StatusOK,
+		},
+		{
+			name: "Not checked for non-CloudFront peers", mode: spoofDeny, remoteAddr: "192.0.2.1:1234",
+			viewer: "198.51.100.10:46532", forwarded: "203.0.113.7",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips := newIPStore("")
+			ipNets, _ := parsePrefixes([]string{"205.251.249.0/24"})
+			ips.store(ipNets)
+
+			cf := &CloudFrontGate{
+				ips:       ips,
+				state:     &gateState{},
+				spoofMode: tt.mode,
+				next: http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+					rw.WriteHeader(http.StatusOK)
+				}),
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.viewer != "" {
+				req.Header.Set(headerViewerAddress, tt.viewer)
+			}
+			if tt.forwarded != "" {
+				req.Header.Set(headerForwardedFor, tt.forwarded)
+			}
+			rw := httptest.NewRecorder()
+			cf.ServeHTTP(rw, req)
+
+			if rw.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, rw.Code)
+			}
+			if got := cf.state.spoofed.Load(); got != tt.spoofed {
+				t.Errorf("Expected %d spoof detections, got %d", tt.spoofed, got)
+			}
+		})
+	}
+}
+
+func TestForwardedHeaderPolicy(t *testing.T) {
+	// The client pre-seeds every address header; CloudFront appends the
+	// viewer 198.51.100.10 to X-Forwarded-For.
+	seeded := http.Header{
+		headerForwardedFor:  {"203.0.113.7, 198.51.100.10"},
+		headerRealIP:        {"203.0.113.7"},
+		headerForwarded:     {"for=203.0.113.7"},
+		headerViewerAddress: {"2001:db8::1:46532"},
+		"X-Forwarded-Proto": {"https"},
+	}
+	tests := []struct {
+		name       string
+		policy     string
+		strategy   *IPStrategyConfig
+		remoteAddr string
+		header     http.Header
+		want       http.Header
+	}{
+		{
+			name: "Passthrough", policy: "", remoteAddr: "205.251.249.10:1234", header: seeded,
+			want: seeded,
+		},
+		{
+			name: "Sanitize keeps the edge hop", policy: forwardedSanitize, remoteAddr: "205.251.249.10:1234", header: seeded,
+			want: http.Header{
+				headerForwardedFor:  {"198.51.100.10"},
+				headerViewerAddress: {"2001:db8::1:46532"},
+				"X-Forwarded-Proto": {"https"},
+			},
+		},
+		{
+			name: "Sanitize drops everything from allowedIPs", policy: forwardedSanitize, remoteAddr: "192.0.2.1:1234", header: seeded,
+			want: http.Header{"X-Forwarded-Proto": {"https"}},
+		},
+		{
+			name: "Rewrite from the viewer address", policy: forwardedRewrite, remoteAddr: "205.251.249.10:1234", header: seeded,
+			want: http.Header{
+				headerForwardedFor:  {"198.51.100.10"},
+				headerRealIP:        {"2001:db8::1"},
+				headerViewerAddress: {"2001:db8::1:46532"},
+				"X-Forwarded-Proto": {"https"},
+			},
+		},
+		{
+			name: "Rewrite falls back to the edge hop", policy: forwardedRewrite, remoteAddr: "205.251.249.10:1234",
+			header: http.Header{headerForwardedFor: {"203.0.113.7, 198.51.100.10"}, headerRealIP: {"203.0.113.7"}},
+			want:   http.Header{headerForwardedFor: {"198.51.100.10"}, headerRealIP: {"198.51.100.10"}},
+		},
+		{
+			name: "Rewrite from allowedIPs uses the peer", policy: forwardedRewrite, remoteAddr: "192.0.2.1:1234", header: seeded,
+			want: http.Header{headerRealIP: {"192.0.2.1"}, "X-Forwarded-Proto": {"https"}},
+		},
+		{
+			name: "Rewrite behind a trusted proxy", policy: forwardedRewrite, remoteAddr: "10.0.0.5:1234",
+			strategy: &IPStrategyConfig{Depth: 1, TrustedProxies: []string{"10.0.0.0/8"}},
+			header: http.Header{
+				headerForwardedFor:  {"203.0.113.7, 198.51.100.10", "205.251.249.10"},
+				headerViewerAddress: {"198.51.100.10:46532"},
+			},
+			want: http.Header{
+				headerForwardedFor:  {"198.51.100.10, 205.251.249.10"},
+				headerRealIP:        {"198.51.100.10"},
+				headerViewerAddress: {"198.51.100.10:46532"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.AllowedIPs = []string{"192.0.2.1"}
+			cfg.ForwardedHeaderPolicy = tt.policy
+			cfg.IPStrategy = tt.strategy
+			var got http.Header
+			next := http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+				got = req.Header
+			})
+			handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header = canonicalHeader(tt.header)
+			cf.ServeHTTP(httptest.NewRecorder(), req)
+			if want := canonicalHeader(tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected the backend to receive %v, got %v", want, got)
+			}
+		})
+	}
+
+	cfg := CreateConfig()
+	cfg.ForwardedHeaderPolicy = "strip"
+	if _, err := NewWithOptions(context.Background(), http.NotFoundHandler(), cfg, t.Name(), withFixture()); err == nil {
+		t.Error("Expected an invalid forwardedHeaderPolicy to be rejected")
+	}
+}
+
+// canonicalHeader copies h with canonical keys, as the server would read it.
+func canonicalHeader(h http.Header) http.Header {
+	out := http.Header{}
+	for name, values := range h {
+		for _, value := range values {
+			out.Add(name, value)
+		}
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package cloudfrontgate
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Enforcement modes reported by the health endpoint, along with
+// modeReportOnly.
+const (
+	modeEnforce  = "enforce"
+	modeAudit    = "audit"
+	modeLearning = "learning"
+)
+
+// healthResponse is the optional body of the health endpoint.
+type healthResponse struct {
+	Status string `json:"status"`
+	Mode   string `json:"mode"`
+	// DataAgeSeconds is the age of the enforced data, when populated.
+	DataAgeSeconds *int64 `json:"dataAgeSeconds,omitempty"`
+}
+
+// mode returns how the gate enforces its decisions.
+func (cf *CloudFrontGate) mode() string {
+	switch {
+	case cf.learning:
+		return modeLearning
+	case cf.reportOnly:
+		return modeReportOnly
+	case cf.audit:
+		return modeAudit
+	default:
+		return modeEnforce
+	}
+}
+
+// healthy reports whether the gate has data that is not stale.
+func (cf *CloudFrontGate) healthy() bool {
+	if _, degraded := cf.degraded(); degraded {
+		return false
+	}
+	if cf.staleWarningAfter <= 0 {
+		return true
+	}
+	age, ok := cf.dataAge()
+	return ok && age < cf.staleWarningAfter
+}
+
+// serveHealth answers the health path itself, whatever the peer's address
+// within healthAllowedIPs; the request is never forwarded.
+func (cf *CloudFrontGate) serveHealth(rw http.ResponseWriter, req *http.Request) {
+	if len(cf.healthAllowedIPs) > 0 {
+		if peer := peerIP(req); peer == nil || !containsIP(cf.healthAllowedIPs, peer) {
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	status, code := "ok", http.StatusOK
+	if !cf.healthy() {
+		status, code = "unhealthy", http.StatusServiceUnavailable
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	if !cf.healthBody {
+		http.Error(rw, status, code)
+		return
+	}
+
+	body := healthResponse{Status: status, Mode: cf.mode()}
+	if age, ok := cf.dataAge(); ok {
+		seconds := int64(age / time.Second)
+		body.DataAgeSeconds = &seconds
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	_ = json.NewEncoder(rw).Encode(body)
+}
@@ -0,0 +1,93 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServeHealth(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		t.Error("Expected the health path never to be forwarded")
+	})
+	cfg := CreateConfig()
+	cfg.HealthPath = "/_health"
+	cfg.HealthAllowedIPs = []string{"192.0.2.0/24"}
+	cfg.HealthBody = true
+	cfg.StaleWarningAfter = "1h"
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/_health", nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// The probe is not a CloudFront address, yet it is answered.
+	rw := serve("192.0.2.10:1234")
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 while healthy, got %d", rw.Code)
+	}
+	var body healthResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Status != "ok" || body.Mode != modeEnforce || body.DataAgeSeconds == nil {
+		t.Errorf("Unexpected body %+v", body)
+	}
+
+	if rw := serve("10.0.0.1:1234"); rw.Code != http.StatusForbidden {
+		t.Errorf("Expected peers outside healthAllowedIPs to get 403, got %d", rw.Code)
+	}
+
+	cf.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if rw := serve("192.0.2.10:1234"); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 once the data is stale, got %d", rw.Code)
+	}
+	if got := cf.state.allowed.Load() + cf.state.denied.Load(); got != 0 {
+		t.Errorf("Expected health probes not to count as decisions, got %d", got)
+	}
+}
+
+func TestServeHealthDegraded(t *testing.T) {
+	cf := &CloudFrontGate{
+		ips:        newIPStore(""),
+		now:        time.Now,
+		state:      &gateState{},
+		healthPath: "/_health",
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/_health", nil)
+	rw := httptest.NewRecorder()
+	cf.ServeHTTP(rw, req)
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without data, got %d", rw.Code)
+	}
+}
+
+func TestHealthPathDisabledByDefault(t *testing.T) {
+	called := false
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) { called = true })
+	handler, err := NewWithOptions(context.Background(), next, CreateConfig(), t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/_health", nil)
+	req.RemoteAddr = "205.251.249.10:1234"
+	cf.ServeHTTP(httptest.NewRecorder(), req)
+	if !called {
+		t.Error("Expected the path to be forwarded when healthPath is unset")
+	}
+}
@@ -0,0 +1,55 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// hostPatterns is a list of normalized host names. A pattern starting with
+// "*." matches any subdomain of the rest, but not the domain itself.
+type hostPatterns []string
+
+// parseHostPatterns validates and normalizes host patterns.
+func parseHostPatterns(patterns []string) (hostPatterns, error) {
+	var hosts hostPatterns
+	for _, pattern := range patterns {
+		host := normalizeHost(pattern)
+		name := strings.TrimPrefix(host, "*.")
+		if name == "" || strings.ContainsAny(name, "*/ ") {
+			return nil, fmt.Errorf("invalid host pattern %q", pattern)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// matches reports whether the Host header value matches any pattern.
+func (h hostPatterns) matches(hostHeader string) bool {
+	if len(h) == 0 {
+		return false
+	}
+
+	host := normalizeHost(hostHeader)
+	for _, pattern := range h {
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHost lower-cases a host and strips its port and trailing dot.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return strings.TrimSuffix(host, ".")
+}
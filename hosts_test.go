@@ -0,0 +1,95 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostPatternsMatches(t *testing.T) {
+	patterns, err := parseHostPatterns([]string{"www.example.com", "*.cdn.example.com", "API.Example.org."})
+	if err != nil {
+		t.Fatalf("parseHostPatterns() error = %v", err)
+	}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "www.example.com", want: true},
+		{host: "WWW.Example.COM:8443", want: true},
+		{host: "www.example.com.", want: true},
+		{host: "api.example.org", want: true},
+		{host: "a.cdn.example.com", want: true},
+		{host: "a.b.cdn.example.com", want: true},
+		{host: "cdn.example.com", want: false},
+		{host: "evilcdn.example.com", want: false},
+		{host: "example.com", want: false},
+		{host: "www.example.com.evil.net", want: false},
+		{host: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := patterns.matches(tt.host); got != tt.want {
+				t.Errorf("matches(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHostPatternsRejectsInvalid(t *testing.T) {
+	for _, pattern := range []string{"", "*.", "*", "a.*.example.com", "example.com/path"} {
+		if _, err := parseHostPatterns([]string{pattern}); err == nil {
+			t.Errorf("Expected an error for %q", pattern)
+		}
+	}
+}
+
+func TestServeHTTPHosts(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	cfg := CreateConfig()
+	cfg.AllowedHosts = []string{"www.example.com", "*.example.com"}
+
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+
+	tests := []struct {
+		name       string
+		host       string
+		remoteAddr string
+		want       int
+	}{
+		{name: "expected host", host: "www.example.com", remoteAddr: "205.251.249.10:1234", want: http.StatusOK},
+		{name: "wildcard host", host: "shop.example.com:443", remoteAddr: "205.251.249.10:1234", want: http.StatusOK},
+		{name: "unexpected host", host: "attacker.net", remoteAddr: "205.251.249.10:1234", want: http.StatusForbidden},
+		{name: "unexpected host from non-CloudFront peer", host: "attacker.net", remoteAddr: "10.0.0.1:1234", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host, nil)
+			req.RemoteAddr = tt.remoteAddr
+			recorder := httptest.NewRecorder()
+			cf.ServeHTTP(recorder, req)
+			if recorder.Code != tt.want {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.want)
+			}
+		})
+	}
+
+	if got := cf.state.deniedBy[denyHost].Load(); got != 1 {
+		t.Errorf("Expected 1 %s denial, got %d", denyHost, got)
+	}
+	if got := cf.state.deniedBy[denyIP].Load(); got != 1 {
+		t.Errorf("Expected the IP check to run before the host check, got %d IP denials", got)
+	}
+}
@@ -0,0 +1,127 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errIntegrity is returned when a downloaded document does not match its
+// published checksum or signature.
+var errIntegrity = errors.New("integrity verification failed")
+
+// integrityConfig describes the sidecars a source document is verified
+// against. Both checks may be configured at once.
+type integrityConfig struct {
+	ChecksumURL  string `json:"checksumURL,omitempty"`
+	PublicKey    string `json:"publicKey,omitempty"`
+	SignatureURL string `json:"signatureURL,omitempty"`
+}
+
+// validate checks the configuration at construction time.
+func (c integrityConfig) validate() error {
+	for _, raw := range []string{c.ChecksumURL, c.SignatureURL} {
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid sidecar URL %q", raw)
+		}
+	}
+
+	if (c.PublicKey == "") != (c.SignatureURL == "") {
+		return errors.New("publicKey and signatureURL must be configured together")
+	}
+	if c.PublicKey != "" {
+		if _, err := c.publicKey(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c integrityConfig) publicKey() (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(c.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key size: got %d bytes, want %d", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// verify downloads the configured sidecars and checks body against them.
+// Sidecar download failures are returned as is; mismatches wrap errIntegrity.
+func (c integrityConfig) verify(ctx context.Context, client *http.Client, body []byte) error {
+	if c.ChecksumURL != "" {
+		sidecar, err := download(ctx, client, c.ChecksumURL)
+		if err != nil {
+			return fmt.Errorf("failed to fetch checksum: %w", err)
+		}
+		if err := verifyChecksum(body, sidecar); err != nil {
+			return err
+		}
+	}
+
+	if c.SignatureURL != "" {
+		key, err := c.publicKey()
+		if err != nil {
+			return err
+		}
+		sidecar, err := download(ctx, client, c.SignatureURL)
+		if err != nil {
+			return fmt.Errorf("failed to fetch signature: %w", err)
+		}
+		if err := verifySignature(key, body, sidecar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyChecksum checks body against a sha256sum style sidecar: a hex digest,
+// optionally followed by a file name.
+func verifyChecksum(body, sidecar []byte) error {
+	fields := strings.Fields(string(sidecar))
+	if len(fields) == 0 {
+		return fmt.Errorf("%w: empty checksum", errIntegrity)
+	}
+	want, err := hex.DecodeString(fields[0])
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("%w: malformed SHA-256 checksum", errIntegrity)
+	}
+
+	got := sha256.Sum256(body)
+	if subtle.ConstantTimeCompare(got[:], want) != 1 {
+		return fmt.Errorf("%w: SHA-256 checksum mismatch", errIntegrity)
+	}
+	return nil
+}
+
+// verifySignature checks a detached ed25519 signature, given either raw or
+// base64 encoded.
+func verifySignature(key ed25519.PublicKey, body, sidecar []byte) error {
+	sig := sidecar
+	if len(sig) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sidecar)))
+		if err != nil {
+			return fmt.Errorf("%w: malformed signature", errIntegrity)
+		}
+		sig = decoded
+	}
+	if len(sig) != ed25519.SignatureSize || !ed25519.Verify(key, body, sig) {
+		return fmt.Errorf("%w: invalid signature", errIntegrity)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const tamperedCFResponse = `{
+	"CLOUDFRONT_GLOBAL_IP_LIST": ["6.6.6.0/24"],
+	"CLOUDFRONT_REGIONAL_EDGE_IP_LIST": []
+}`
+
+// newIntegrityServer serves body at /ranges and the given sidecars at
+// /sha256 and /sig. A nil sidecar answers 404.
+func newIntegrityServer(body string, checksum, signature []byte) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ranges", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(body))
+	})
+	sidecar := func(content []byte) http.HandlerFunc {
+		return func(w http.ResponseWriter, _ *http.Request) {
+			if content == nil {
+				http.NotFound(w, nil)
+				return
+			}
+			_, _ = w.Write(content)
+		}
+	}
+	mux.HandleFunc("/sha256", sidecar(checksum))
+	mux.HandleFunc("/sig", sidecar(signature))
+	return httptest.NewServer(mux)
+}
+
+func TestIntegrityChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte(testCFResponse))
+	valid := []byte(hex.EncodeToString(sum[:]) + "  ranges.json\n")
+
+	tests := []struct {
+		name      string
+		body      string
+		checksum  []byte
+		wantErr   bool
+		integrity bool
+	}{
+		{name: "Valid body", body: testCFResponse, checksum: valid},
+		{name: "Tampered body", body: tamperedCFResponse, checksum: valid, wantErr: true, integrity: true},
+		{name: "Malformed checksum", body: testCFResponse, checksum: []byte("not-a-digest"), wantErr: true, integrity: true},
+		{name: "Missing sidecar", body: testCFResponse, checksum: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newIntegrityServer(tt.body, tt.checksum, nil)
+			defer server.Close()
+
+			ips := newIPStore(server.URL + "/ranges")
+			ips.integrity = integrityConfig{ChecksumURL: server.URL + "/sha256"}
+
+			err := ips.Update(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Update() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, errIntegrity) != tt.integrity {
+				t.Errorf("Expected errIntegrity = %v, got %v", tt.integrity, err)
+			}
+			if tt.wantErr && ips.version.Load() != 0 {
+				t.Errorf("Expected the store to stay unpopulated")
+			}
+		})
+	}
+}
+
+func TestIntegritySignature(t *testing.T) {
+	seed := sha256.Sum256([]byte("cloudfrontgate test key"))
+	private := ed25519.NewKeyFromSeed(seed[:])
+	public := base64.StdEncoding.EncodeToString(private.Public().(ed25519.PublicKey))
+
+	raw := ed25519.Sign(private, []byte(testCFResponse))
+	encoded := []byte(base64.StdEncoding.EncodeToString(raw) + "\n")
+
+	tests := []struct {
+		name      string
+		body      string
+		signature []byte
+		wantErr   bool
+		integrity bool
+	}{
+		{name: "Valid raw signature", body: testCFResponse, signature: raw},
+		{name: "Valid base64 signature", body: testCFResponse, signature: encoded},
+		{name: "Tampered body", body: tamperedCFResponse, signature: encoded, wantErr: true, integrity: true},
+		{name: "Garbage signature", body: testCFResponse, signature: []byte("???"), wantErr: true, integrity: true},
+		{name: "Missing sidecar", body: testCFResponse, signature: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newIntegrityServer(tt.body, nil, tt.signature)
+			defer server.Close()
+
+			ips := newIPStore(server.URL + "/ranges")
+			ips.integrity = integrityConfig{PublicKey: public, SignatureURL: server.URL + "/sig"}
+
+			err := ips.Update(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Update() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, errIntegrity) != tt.integrity {
+				t.Errorf("Expected errIntegrity = %v, got %v", tt.integrity, err)
+			}
+		})
+	}
+}
+
+func TestIntegrityConfigValidate(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize))
+
+	tests := []struct {
+		name    string
+		config  integrityConfig
+		wantErr bool
+	}{
+		{name: "Empty", config: integrityConfig{}},
+		{name: "Checksum only", config: integrityConfig{ChecksumURL: "https://example.com/ranges.sha256"}},
+		{name: "Signature", config: integrityConfig{PublicKey: key, SignatureURL: "https://example.com/ranges.sig"}},
+		{name: "Key without signature URL", config: integrityConfig{PublicKey: key}, wantErr: true},
+		{name: "Signature URL without key", config: integrityConfig{SignatureURL: "https://example.com/ranges.sig"}, wantErr: true},
+		{name: "Short key", config: integrityConfig{PublicKey: "AAAA", SignatureURL: "https://example.com/ranges.sig"}, wantErr: true},
+		{name: "Invalid URL", config: integrityConfig{ChecksumURL: "ftp://example.com/sum"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
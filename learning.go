@@ -0,0 +1,143 @@
+package cloudfrontgate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Learning mode defaults.
+const (
+	defaultLearningTTL         = 7 * 24 * time.Hour
+	defaultLearningMaxPrefixes = 10000
+)
+
+// learnedPrefix is a would-be-denied source prefix.
+type learnedPrefix struct {
+	Prefix    string    `json:"prefix"`
+	Requests  uint64    `json:"requests"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// learningReport is the document served by the learning admin endpoint.
+type learningReport struct {
+	TTL      string          `json:"ttl"`
+	Prefixes []learnedPrefix `json:"prefixes"`
+	// Suggested lists the prefixes as allowedIPs entries, by request volume.
+	Suggested []string `json:"suggestedAllowedIPs"`
+}
+
+// learner collects would-be-denied source prefixes, aggregated to /24 for
+// IPv4 and /48 for IPv6. It lives in the runtime state.
+type learner struct {
+	mu       sync.Mutex
+	prefixes map[string]*learnedPrefix
+}
+
+// learnPrefix returns the aggregate prefix of ip.
+func learnPrefix(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// record counts a request from ip. Prefixes not seen within ttl are
+// dropped; when the table is full the least recently seen prefix makes room.
+func (l *learner) record(ip net.IP, now time.Time, ttl time.Duration, maxPrefixes int) {
+	key := learnPrefix(ip)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.prefixes == nil {
+		l.prefixes = make(map[string]*learnedPrefix)
+	}
+	if p, ok := l.prefixes[key]; ok {
+		p.Requests++
+		p.LastSeen = now
+		return
+	}
+
+	if len(l.prefixes) >= maxPrefixes {
+		l.expire(now, ttl)
+	}
+	if len(l.prefixes) >= maxPrefixes {
+		var oldest *learnedPrefix
+		for _, p := range l.prefixes {
+			if oldest == nil || p.LastSeen.Before(oldest.LastSeen) {
+				oldest = p
+			}
+		}
+		delete(l.prefixes, oldest.Prefix)
+	}
+	l.prefixes[key] = &learnedPrefix{Prefix: key, Requests: 1, FirstSeen: now, LastSeen: now}
+}
+
+// expire drops prefixes not seen within ttl. Callers must hold mu.
+func (l *learner) expire(now time.Time, ttl time.Duration) {
+	for key, p := range l.prefixes {
+		if now.Sub(p.LastSeen) > ttl {
+			delete(l.prefixes, key)
+		}
+	}
+}
+
+// report returns the current prefixes by request volume.
+func (l *learner) report(now time.Time, ttl time.Duration) learningReport {
+	l.mu.Lock()
+	l.expire(now, ttl)
+	prefixes := make([]learnedPrefix, 0, len(l.prefixes))
+	for _, p := range l.prefixes {
+		prefixes = append(prefixes, *p)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Requests != prefixes[j].Requests {
+			return prefixes[i].Requests > prefixes[j].Requests
+		}
+		return prefixes[i].Prefix < prefixes[j].Prefix
+	})
+
+	report := learningReport{TTL: ttl.String(), Prefixes: prefixes, Suggested: make([]string, 0, len(prefixes))}
+	for _, p := range prefixes {
+		report.Suggested = append(report.Suggested, p.Prefix)
+	}
+	return report
+}
+
+// parseLearning validates the learning settings.
+func parseLearning(config *Config) (ttl time.Duration, maxPrefixes int, err error) {
+	ttl = defaultLearningTTL
+	if config.LearningTTL != "" {
+		ttl, err = time.ParseDuration(config.LearningTTL)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to parse learning TTL: %w", err)
+		}
+		if ttl <= 0 {
+			return 0, 0, errors.New("learningTTL must be positive")
+		}
+	}
+
+	maxPrefixes = defaultLearningMaxPrefixes
+	if config.LearningMaxPrefixes != 0 {
+		maxPrefixes = config.LearningMaxPrefixes
+		if maxPrefixes < 0 {
+			return 0, 0, fmt.Errorf("invalid learningMaxPrefixes %d: must be positive", maxPrefixes)
+		}
+	}
+	return ttl, maxPrefixes, nil
+}
+
+// serveLearning writes the learning report.
+func (cf *CloudFrontGate) serveLearning(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(cf.state.learner.report(cf.now(), cf.learningTTL))
+}
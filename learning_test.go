@@ -0,0 +1,86 @@
+package cloudfrontgate
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLearnPrefix(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.77":          "192.0.2.0/24",
+		"2001:db8:1:2::5":     "2001:db8:1::/48",
+		"::ffff:198.51.100.9": "198.51.100.0/24",
+	}
+	for ip, want := range tests {
+		if got := learnPrefix(net.ParseIP(ip)); got != want {
+			t.Errorf("learnPrefix(%s) = %s, want %s", ip, got, want)
+		}
+	}
+}
+
+func TestLearnerBoundsAndExpiry(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var l learner
+
+	l.record(net.ParseIP("192.0.2.1"), start, time.Hour, 2)
+	l.record(net.ParseIP("192.0.2.2"), start.Add(time.Minute), time.Hour, 2)
+	l.record(net.ParseIP("198.51.100.1"), start.Add(2*time.Minute), time.Hour, 2)
+	// The table is full: the least recently seen prefix makes room.
+	l.record(net.ParseIP("203.0.113.1"), start.Add(3*time.Minute), time.Hour, 2)
+
+	report := l.report(start.Add(3*time.Minute), time.Hour)
+	if len(report.Prefixes) != 2 {
+		t.Fatalf("Expected the table to stay bounded at 2, got %+v", report.Prefixes)
+	}
+	for _, prefix := range report.Suggested {
+		if prefix == "192.0.2.0/24" {
+			t.Errorf("Expected the least recently seen prefix to be evicted, got %v", report.Suggested)
+		}
+	}
+
+	// Prefixes not seen within the TTL age out.
+	l.record(net.ParseIP("203.0.113.9"), start.Add(50*time.Minute), time.Hour, 2)
+	report = l.report(start.Add(90*time.Minute), time.Hour)
+	if len(report.Prefixes) != 1 || report.Prefixes[0].Prefix != "203.0.113.0/24" || report.Prefixes[0].Requests != 2 {
+		t.Errorf("Expected only the recent prefix with 2 requests, got %+v", report.Prefixes)
+	}
+}
+
+func TestServeLearning(t *testing.T) {
+	cf := newAdminGate(t, func(cfg *Config) { cfg.LearningMode = true })
+
+	for _, addr := range []string{"192.0.2.1:1", "192.0.2.200:1", "198.51.100.7:1", "192.0.2.9:1"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = addr
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		if rw.Code != http.StatusTeapot {
+			t.Fatalf("Expected learning mode to let %s through, got %d", addr, rw.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/_cfgate/learning", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rw := httptest.NewRecorder()
+	cf.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rw.Code)
+	}
+
+	var report learningReport
+	if err := json.Unmarshal(rw.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid report: %v", err)
+	}
+	want := []string{"192.0.2.0/24", "198.51.100.0/24"}
+	if len(report.Suggested) != 2 || report.Suggested[0] != want[0] || report.Suggested[1] != want[1] {
+		t.Errorf("Suggested = %v, want %v", report.Suggested, want)
+	}
+	if report.Prefixes[0].Requests != 3 {
+		t.Errorf("Expected 3 requests from %s, got %d", want[0], report.Prefixes[0].Requests)
+	}
+}
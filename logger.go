@@ -0,0 +1,210 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Log levels of the logLevel option.
+const (
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelError = "error"
+)
+
+// Logger receives the leveled log lines of an instance. Embedders using the
+// package directly can install their own with SetLogger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger writes to the standard logger with a level prefix, so that the
+// lines stay parseable in Traefik's plugin environment.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) { log.Printf("DEBUG: "+format, args...) }
+func (stdLogger) Infof(format string, args ...interface{})  { log.Printf("INFO: "+format, args...) }
+func (stdLogger) Errorf(format string, args ...interface{}) { log.Printf("ERROR: "+format, args...) }
+
+// loggerBox wraps a Logger so that implementations of different types can
+// share an atomic.Value.
+type loggerBox struct {
+	Logger
+}
+
+// gateLogger drops the lines below its level and forwards the others to the
+// installed Logger. A nil gateLogger logs at info level to the standard
+// logger.
+type gateLogger struct {
+	level int
+	out   atomic.Value
+}
+
+// parseLogLevel returns the severity of level: 0 for debug, 1 for info, the
+// default, and 2 for error.
+func parseLogLevel(level string) (int, error) {
+	switch level {
+	case logLevelDebug:
+		return 0, nil
+	case "", logLevelInfo:
+		return 1, nil
+	case logLevelError:
+		return 2, nil
+	}
+	return 0, fmt.Errorf("invalid logLevel %q: must be %q, %q or %q", level, logLevelDebug, logLevelInfo, logLevelError)
+}
+
+func newGateLogger(level int) *gateLogger {
+	l := &gateLogger{level: level}
+	l.out.Store(loggerBox{stdLogger{}})
+	return l
+}
+
+func (l *gateLogger) logger() Logger {
+	if l == nil {
+		return stdLogger{}
+	}
+	return l.out.Load().(loggerBox).Logger
+}
+
+func (l *gateLogger) enabled(level int) bool {
+	if l == nil {
+		return level >= 1
+	}
+	return level >= l.level
+}
+
+func (l *gateLogger) debugf(format string, args ...interface{}) {
+	if l.enabled(0) {
+		l.logger().Debugf(format, args...)
+	}
+}
+
+func (l *gateLogger) infof(format string, args ...interface{}) {
+	if l.enabled(1) {
+		l.logger().Infof(format, args...)
+	}
+}
+
+func (l *gateLogger) errorf(format string, args ...interface{}) {
+	if l.enabled(2) {
+		l.logger().Errorf(format, args...)
+	}
+}
+
+// sourceLogger is the logger of a shared source. Rather than follow the
+// instance that acquired the source last, which may be closed while the
+// others still use it, it writes every line once to each distinct Logger
+// of the instances holding the source, filtered by the most verbose of
+// their levels. A nil or unheld sourceLogger logs like a nil gateLogger.
+type sourceLogger struct {
+	mu      sync.Mutex
+	holders []*gateLogger
+}
+
+// hold adds the logger of an instance acquiring the source.
+func (s *sourceLogger) hold(l *gateLogger) {
+	if s == nil || l == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holders = append(s.holders, l)
+}
+
+// drop removes a logger added by hold.
+func (s *sourceLogger) drop(l *gateLogger) {
+	if s == nil || l == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, holder := range s.holders {
+		if holder == l {
+			s.holders = append(s.holders[:i], s.holders[i+1:]...)
+			return
+		}
+	}
+}
+
+// outputs returns the distinct Loggers of the holders, each with the most
+// verbose level it is used at.
+func (s *sourceLogger) outputs() ([]Logger, []int) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var outs []Logger
+	var levels []int
+next:
+	for _, holder := range s.holders {
+		out := holder.logger()
+		// Loggers of an incomparable type cannot be told equal.
+		if reflect.TypeOf(out).Comparable() {
+			for i, seen := range outs {
+				if reflect.TypeOf(seen) == reflect.TypeOf(out) && seen == out {
+					if holder.level < levels[i] {
+						levels[i] = holder.level
+					}
+					continue next
+				}
+			}
+		}
+		outs = append(outs, out)
+		levels = append(levels, holder.level)
+	}
+	return outs, levels
+}
+
+func (s *sourceLogger) logf(level int, format string, args ...interface{}) {
+	outs, levels := s.outputs()
+	if len(outs) == 0 {
+		var fallback *gateLogger
+		switch level {
+		case 0:
+			fallback.debugf(format, args...)
+		case 1:
+			fallback.infof(format, args...)
+		default:
+			fallback.errorf(format, args...)
+		}
+		return
+	}
+	for i, out := range outs {
+		if level < levels[i] {
+			continue
+		}
+		switch level {
+		case 0:
+			out.Debugf(format, args...)
+		case 1:
+			out.Infof(format, args...)
+		default:
+			out.Errorf(format, args...)
+		}
+	}
+}
+
+func (s *sourceLogger) debugf(format string, args ...interface{}) { s.logf(0, format, args...) }
+func (s *sourceLogger) infof(format string, args ...interface{})  { s.logf(1, format, args...) }
+func (s *sourceLogger) errorf(format string, args ...interface{}) { s.logf(2, format, args...) }
+
+// SetLogger replaces the logger of the instance, and of the refreshes of
+// its sources; nil restores the standard logger. The logLevel option still
+// filters the lines.
+func (cf *CloudFrontGate) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = stdLogger{}
+	}
+	if cf.logger == nil {
+		cf.logger = newGateLogger(1)
+	}
+	cf.logger.out.Store(loggerBox{logger})
+}
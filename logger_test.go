@@ -0,0 +1,226 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// capturingLogger records the lines it receives with their level.
+type capturingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (c *capturingLogger) add(level, format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lines = append(c.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (c *capturingLogger) Debugf(format string, args ...interface{}) { c.add("debug", format, args...) }
+func (c *capturingLogger) Infof(format string, args ...interface{})  { c.add("info", format, args...) }
+func (c *capturingLogger) Errorf(format string, args ...interface{}) { c.add("error", format, args...) }
+
+func (c *capturingLogger) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strings.Join(c.lines, "\n")
+}
+
+func TestLogLevelFiltering(t *testing.T) {
+	tests := []struct {
+		level string
+		want  []string
+	}{
+		{level: "debug", want: []string{"debug d", "info i", "error e"}},
+		{level: "", want: []string{"info i", "error e"}},
+		{level: "info", want: []string{"info i", "error e"}},
+		{level: "error", want: []string{"error e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			level, err := parseLogLevel(tt.level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			capture := &capturingLogger{}
+			cf := &CloudFrontGate{logger: newGateLogger(level)}
+			cf.SetLogger(capture)
+
+			cf.logger.debugf("d")
+			cf.logger.infof("i")
+			cf.logger.errorf("e")
+			if got := capture.String(); got != strings.Join(tt.want, "\n") {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := parseLogLevel("warn"); err == nil {
+		t.Error("Expected an invalid level to be rejected")
+	}
+}
+
+func TestLogBlocked(t *testing.T) {
+	for _, level := range []string{"info", "error"} {
+		t.Run(level, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.LogLevel = level
+			cfg.LogBlocked = true
+			handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+			capture := &capturingLogger{}
+			cf.SetLogger(capture)
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/admin", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			cf.ServeHTTP(httptest.NewRecorder(), req)
+
+			got := capture.String()
+			if level == "info" && (!strings.Contains(got, "info ") || !strings.Contains(got, "192.0.2.1") || !strings.Contains(got, "/admin")) {
+				t.Errorf("Expected an info line with the client IP and path, got %q", got)
+			}
+			if level == "error" && got != "" {
+				t.Errorf("Expected no line at error level, got %q", got)
+			}
+		})
+	}
+}
+
+func TestRefreshLogs(t *testing.T) {
+	var fail atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if fail.Load() {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = rw.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+
+	capture := &capturingLogger{}
+	logger := newGateLogger(0)
+	logger.out.Store(loggerBox{capture})
+	entry, _, err := acquireEntry(context.Background(), sourceConfig{URL: server.URL, AllowPrivate: true}, "test ranges", startupPolicy{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseEntry(entry, logger)
+
+	if got := capture.String(); !strings.HasPrefix(got, "debug Updated test ranges: 8 prefixes fetched in ") {
+		t.Errorf("Expected a debug line with the count and duration, got %q", got)
+	}
+
+	fail.Store(true)
+	other, _, err := acquireEntry(context.Background(), sourceConfig{URL: server.URL + "/other", AllowPrivate: true}, "other ranges", startupPolicy{failOpen: true}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseEntry(other, logger)
+	if got := capture.String(); !strings.Contains(got, "\nerror Failed to update other ranges") {
+		t.Errorf("Expected an error line for the failed fetch, got %q", got)
+	}
+}
+
+func TestSourceLogger(t *testing.T) {
+	newLogger := func(level int, out Logger) *gateLogger {
+		l := newGateLogger(level)
+		l.out.Store(loggerBox{out})
+		return l
+	}
+	shared, own := &capturingLogger{}, &capturingLogger{}
+	first, second := newLogger(2, shared), newLogger(0, shared)
+	third := newLogger(1, own)
+
+	logs := &sourceLogger{}
+	logs.hold(first)
+	logs.hold(second)
+	logs.hold(third)
+	logs.debugf("d")
+	logs.errorf("e")
+	// A Logger shared by two holders gets every line once, at the most
+	// verbose of their levels.
+	if got := shared.String(); got != "debug d\nerror e" {
+		t.Errorf("Expected the shared logger to get each line once, got %q", got)
+	}
+	if got := own.String(); got != "error e" {
+		t.Errorf("Expected the info logger to get the error only, got %q", got)
+	}
+
+	// The source keeps logging to the holders left, whichever came last.
+	logs.drop(third)
+	logs.drop(second)
+	logs.infof("i")
+	if got := own.String(); got != "error e" {
+		t.Errorf("Expected a dropped holder to get nothing more, got %q", got)
+	}
+	if got := shared.String(); got != "debug d\nerror e" {
+		t.Errorf("Expected the error level holder left to drop the info line, got %q", got)
+	}
+
+	// Loggers of an incomparable type are not told apart, nor compared.
+	funcs := &sourceLogger{}
+	var lines []string
+	out := funcLogger(func(line string) { lines = append(lines, line) })
+	funcs.hold(newLogger(1, out))
+	funcs.hold(newLogger(1, out))
+	funcs.infof("i")
+	if len(lines) != 2 {
+		t.Errorf("Expected a line per holder of an incomparable Logger, got %q", lines)
+	}
+}
+
+// funcLogger is a Logger of an incomparable type.
+type funcLogger func(line string)
+
+func (f funcLogger) Debugf(format string, args ...interface{}) { f(fmt.Sprintf(format, args...)) }
+func (f funcLogger) Infof(format string, args ...interface{})  { f(fmt.Sprintf(format, args...)) }
+func (f funcLogger) Errorf(format string, args ...interface{}) { f(fmt.Sprintf(format, args...)) }
+
+// TestNoUnleveledLogs fails on a use of the log package outside stdLogger,
+// which would bypass the logLevel option and SetLogger.
+func TestNoUnleveledLogs(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatalf("ParseFile(%s) error = %v", name, err)
+		}
+		for _, decl := range file.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv != nil {
+				if recv, ok := fn.Recv.List[0].Type.(*ast.Ident); ok && recv.Name == "stdLogger" {
+					continue
+				}
+			}
+			ast.Inspect(decl, func(n ast.Node) bool {
+				if sel, ok := n.(*ast.SelectorExpr); ok {
+					if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "log" {
+						t.Errorf("%s: log.%s bypasses the leveled logger", fset.Position(sel.Pos()), sel.Sel.Name)
+					}
+				}
+				return true
+			})
+		}
+	}
+}
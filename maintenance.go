@@ -0,0 +1,187 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// week is the period of recurring maintenance windows.
+const week = 7 * 24 * time.Hour
+
+// MaintenanceWindow temporarily trusts CIDRs as if they were in AllowedIPs.
+type MaintenanceWindow struct {
+	// Name identifies the window in logs and status output
+	Name string `json:"name,omitempty"`
+	// CIDRs are trusted while the window is active; entries may be @group references
+	CIDRs []string `json:"cidrs,omitempty"`
+	// Schedule defines when the window is active
+	Schedule WindowSchedule `json:"schedule,omitempty"`
+}
+
+// WindowSchedule bounds a maintenance window. Start and End are either both
+// RFC3339 times, or both weekly times such as "Mon 09:00" in UTC; a weekly
+// window whose end precedes its start spans the turn of the week.
+type WindowSchedule struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// maintenanceWindow is a parsed MaintenanceWindow.
+type maintenanceWindow struct {
+	name     string
+	prefixes []net.IPNet
+
+	// start and end bound an absolute window.
+	start, end time.Time
+
+	// weekly windows are bounded by offsets from Monday 00:00 UTC.
+	weekly                 bool
+	startOffset, endOffset time.Duration
+
+	// active tracks the last evaluation, to log transitions.
+	active atomic.Bool
+}
+
+// parseMaintenanceWindows validates the windows and expands their CIDRs.
+func parseMaintenanceWindows(windows []MaintenanceWindow, groups cidrGroups) ([]*maintenanceWindow, error) {
+	parsed := make([]*maintenanceWindow, 0, len(windows))
+	for i, window := range windows {
+		name := window.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+
+		prefixes, _, err := groups.parse(window.CIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %s: %w", name, err)
+		}
+		if len(prefixes) == 0 {
+			return nil, fmt.Errorf("invalid maintenance window %s: no CIDRs", name)
+		}
+
+		mw := &maintenanceWindow{name: name, prefixes: prefixes}
+		if err := mw.parseSchedule(window.Schedule); err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %s: %w", name, err)
+		}
+		parsed = append(parsed, mw)
+	}
+	return parsed, nil
+}
+
+// parseSchedule sets the window bounds from an absolute or weekly schedule.
+func (mw *maintenanceWindow) parseSchedule(schedule WindowSchedule) error {
+	start, startErr := time.Parse(time.RFC3339, schedule.Start)
+	end, endErr := time.Parse(time.RFC3339, schedule.End)
+	if startErr == nil && endErr == nil {
+		if !end.After(start) {
+			return fmt.Errorf("end %s is not after start %s", schedule.End, schedule.Start)
+		}
+		mw.start, mw.end = start, end
+		return nil
+	}
+
+	startOffset, err := parseWeeklyTime(schedule.Start)
+	if err != nil {
+		return err
+	}
+	endOffset, err := parseWeeklyTime(schedule.End)
+	if err != nil {
+		return err
+	}
+	if startOffset == endOffset {
+		return fmt.Errorf("weekly window %s - %s is empty", schedule.Start, schedule.End)
+	}
+	mw.weekly = true
+	mw.startOffset, mw.endOffset = startOffset, endOffset
+	return nil
+}
+
+// parseWeeklyTime parses "Mon 09:00" into an offset from Monday 00:00 UTC.
+func parseWeeklyTime(value string) (time.Duration, error) {
+	day, clock, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok {
+		return 0, fmt.Errorf("invalid schedule time %q: must be RFC3339 or a weekly time like \"Mon 09:00\"", value)
+	}
+
+	days := []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+	index := -1
+	for i, d := range days {
+		if strings.EqualFold(day, d) {
+			index = i
+		}
+	}
+	if index < 0 {
+		return 0, fmt.Errorf("invalid schedule day %q", day)
+	}
+
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, fmt.Errorf("invalid schedule time %q: %w", value, err)
+	}
+	return time.Duration(index)*24*time.Hour + time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// weekOffset returns the offset of now from the preceding Monday 00:00 UTC.
+func weekOffset(now time.Time) time.Duration {
+	now = now.UTC()
+	weekday := (int(now.Weekday()) + 6) % 7 // Monday is 0
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return time.Duration(weekday)*24*time.Hour + now.Sub(midnight)
+}
+
+// occurrence returns the bounds of the window containing now, or of the next
+// one. ok is false when an absolute window is over.
+func (mw *maintenanceWindow) occurrence(now time.Time) (start, end time.Time, ok bool) {
+	if !mw.weekly {
+		return mw.start, mw.end, now.Before(mw.end)
+	}
+
+	monday := now.UTC().Add(-weekOffset(now))
+	length := mw.endOffset - mw.startOffset
+	if length < 0 {
+		length += week
+	}
+
+	// The occurrence that started last week may still be running.
+	for _, base := range []time.Time{monday.Add(-week), monday, monday.Add(week)} {
+		start = base.Add(mw.startOffset)
+		end = start.Add(length)
+		if now.Before(end) {
+			return start, end, true
+		}
+	}
+	return start, end, true
+}
+
+// isActive reports whether the window is active at now, logging transitions.
+func (cf *CloudFrontGate) isActive(mw *maintenanceWindow, now time.Time) bool {
+	start, end, ok := mw.occurrence(now)
+	active := ok && !now.Before(start)
+
+	if mw.active.CompareAndSwap(!active, active) {
+		if active {
+			cf.logger.infof("CloudFrontGate %s: maintenance window %s activated until %s", cf.name, mw.name, end.Format(time.RFC3339))
+		} else {
+			cf.logger.infof("CloudFrontGate %s: maintenance window %s deactivated", cf.name, mw.name)
+		}
+	}
+	return active
+}
+
+// windowAllows reports whether ip is trusted by an active maintenance window.
+func (cf *CloudFrontGate) windowAllows(ip net.IP) bool {
+	if len(cf.windows) == 0 {
+		return false
+	}
+
+	now := cf.now()
+	for _, mw := range cf.windows {
+		if cf.isActive(mw, now) && containsIP(mw.prefixes, ip) {
+			return true
+		}
+	}
+	return false
+}
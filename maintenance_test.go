@@ -0,0 +1,177 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseWeeklyTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "Mon 00:00", want: 0},
+		{value: "mon 09:30", want: 9*time.Hour + 30*time.Minute},
+		{value: "Sun 23:59", want: 6*24*time.Hour + 23*time.Hour + 59*time.Minute},
+		{value: "Funday 09:00", wantErr: true},
+		{value: "Mon 25:00", wantErr: true},
+		{value: "09:00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseWeeklyTime(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseWeeklyTime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseWeeklyTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaintenanceWindowOccurrence(t *testing.T) {
+	// 2024-01-03 is a Wednesday.
+	wednesday := time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		schedule   WindowSchedule
+		now        time.Time
+		wantActive bool
+		wantStart  time.Time
+		wantOK     bool
+	}{
+		{
+			name:       "absolute active",
+			schedule:   WindowSchedule{Start: "2024-01-01T00:00:00Z", End: "2024-01-08T00:00:00Z"},
+			now:        wednesday,
+			wantActive: true,
+			wantStart:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantOK:     true,
+		},
+		{
+			name:      "absolute upcoming",
+			schedule:  WindowSchedule{Start: "2024-02-01T00:00:00Z", End: "2024-02-08T00:00:00Z"},
+			now:       wednesday,
+			wantStart: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+			wantOK:    true,
+		},
+		{
+			name:     "absolute over",
+			schedule: WindowSchedule{Start: "2023-12-01T00:00:00Z", End: "2023-12-08T00:00:00Z"},
+			now:      wednesday,
+		},
+		{
+			name:       "weekly active",
+			schedule:   WindowSchedule{Start: "Wed 09:00", End: "Wed 17:00"},
+			now:        wednesday,
+			wantActive: true,
+			wantStart:  time.Date(2024, 1, 3, 9, 0, 0, 0, time.UTC),
+			wantOK:     true,
+		},
+		{
+			name:      "weekly later this week",
+			schedule:  WindowSchedule{Start: "Fri 22:00", End: "Sat 02:00"},
+			now:       wednesday,
+			wantStart: time.Date(2024, 1, 5, 22, 0, 0, 0, time.UTC),
+			wantOK:    true,
+		},
+		{
+			name:      "weekly next week",
+			schedule:  WindowSchedule{Start: "Mon 09:00", End: "Mon 17:00"},
+			now:       wednesday,
+			wantStart: time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC),
+			wantOK:    true,
+		},
+		{
+			name:       "weekly spanning the turn of the week",
+			schedule:   WindowSchedule{Start: "Sun 22:00", End: "Mon 02:00"},
+			now:        time.Date(2024, 1, 8, 1, 0, 0, 0, time.UTC),
+			wantActive: true,
+			wantStart:  time.Date(2024, 1, 7, 22, 0, 0, 0, time.UTC),
+			wantOK:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mw := &maintenanceWindow{name: tt.name}
+			if err := mw.parseSchedule(tt.schedule); err != nil {
+				t.Fatalf("parseSchedule() error = %v", err)
+			}
+
+			start, _, ok := mw.occurrence(tt.now)
+			if ok != tt.wantOK {
+				t.Fatalf("occurrence() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && !start.Equal(tt.wantStart) {
+				t.Errorf("occurrence() start = %s, want %s", start, tt.wantStart)
+			}
+
+			cf := &CloudFrontGate{name: "test"}
+			if got := cf.isActive(mw, tt.now); got != tt.wantActive {
+				t.Errorf("isActive() = %v, want %v", got, tt.wantActive)
+			}
+		})
+	}
+}
+
+func TestParseMaintenanceWindowsRejectsInvalid(t *testing.T) {
+	groups := cidrGroups(builtinGroups)
+	tests := map[string]MaintenanceWindow{
+		"no CIDRs":      {Name: "empty", Schedule: WindowSchedule{Start: "Mon 09:00", End: "Mon 17:00"}},
+		"bad CIDR":      {Name: "bad", CIDRs: []string{"nope"}, Schedule: WindowSchedule{Start: "Mon 09:00", End: "Mon 17:00"}},
+		"reversed":      {Name: "rev", CIDRs: []string{"192.0.2.0/24"}, Schedule: WindowSchedule{Start: "2024-01-08T00:00:00Z", End: "2024-01-01T00:00:00Z"}},
+		"mixed formats": {Name: "mix", CIDRs: []string{"192.0.2.0/24"}, Schedule: WindowSchedule{Start: "2024-01-01T00:00:00Z", End: "Mon 17:00"}},
+		"empty weekly":  {Name: "zero", CIDRs: []string{"192.0.2.0/24"}, Schedule: WindowSchedule{Start: "Mon 09:00", End: "Mon 09:00"}},
+	}
+
+	for name, window := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseMaintenanceWindows([]MaintenanceWindow{window}, groups); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+func TestServeHTTPMaintenanceWindow(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.Groups = map[string][]string{"pentest": {"198.51.100.0/24"}}
+	cfg.MaintenanceWindows = []MaintenanceWindow{{
+		Name:     "pentest",
+		CIDRs:    []string{"@pentest"},
+		Schedule: WindowSchedule{Start: "2024-01-01T00:00:00Z", End: "2024-01-08T00:00:00Z"},
+	}}
+
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+
+	ip := net.ParseIP("198.51.100.7")
+	for _, tt := range []struct {
+		now  time.Time
+		want bool
+	}{
+		{now: time.Date(2023, 12, 31, 23, 59, 0, 0, time.UTC), want: false},
+		{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), want: true},
+		{now: time.Date(2024, 1, 7, 23, 59, 0, 0, time.UTC), want: true},
+		{now: time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), want: false},
+	} {
+		cf.now = func() time.Time { return tt.now }
+		if got := cf.allowed(ip); got != tt.want {
+			t.Errorf("allowed(%s) at %s = %v, want %v", ip, tt.now, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package cloudfrontgate
+
+import (
+	"net/netip"
+	"time"
+)
+
+// divergenceLogInterval limits how often matcher divergences are logged.
+const divergenceLogInterval = 10 * time.Second
+
+// matchStore matches addr in ips. With verifyMatcher, the trie lookup is
+// repeated with a linear scan of the same prefix set, and the scan's
+// verdict is served; any disagreement is counted and logged. Otherwise the
+// matches of the CloudFront store go through the decision cache.
+func (cf *CloudFrontGate) matchStore(ips *ipstore, addr netip.Addr) (trustSource, bool) {
+	if !cf.verifyMatcher {
+		// Quarantined prefixes change with time rather than with the set.
+		if ips == cf.ips && cf.decisions != nil && ips.quarantine == 0 {
+			return cf.decisions.match(ips, addr)
+		}
+		return ips.match(addr)
+	}
+
+	var now time.Time
+	if ips.quarantine > 0 {
+		now = ips.now()
+	}
+	triePrefix, _, trieOK := ips.find(addr, now, false)
+	prefix, source, ok := ips.find(addr, now, true)
+	if triePrefix != prefix || trieOK != ok {
+		cf.state.matcherDivergences.Add(1)
+		logged := cf.now().UnixNano()
+		last := cf.state.divergenceLoggedAt.Load()
+		if logged-last >= int64(divergenceLogInterval) && cf.state.divergenceLoggedAt.CompareAndSwap(last, logged) {
+			cf.logger.errorf("CloudFrontGate %s: matcher divergence for %s: linear scan %s, trie %s",
+				cf.name, addr, matchVerdict(prefix, ok), matchVerdict(triePrefix, trieOK))
+		}
+	}
+	return source, ok
+}
+
+// matchVerdict describes the outcome of a lookup.
+func matchVerdict(prefix string, ok bool) string {
+	if !ok {
+		return "no match"
+	}
+	return "match " + prefix
+}
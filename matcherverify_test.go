@@ -0,0 +1,50 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyMatcher(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	ips := newIPStore("")
+	ips.store(mustParseCIDRs(t, "13.32.0.0/15", "205.251.249.0/24"))
+	cf := &CloudFrontGate{name: t.Name(), ips: ips, now: time.Now, state: &gateState{}, verifyMatcher: true}
+
+	for _, addr := range []string{"13.32.0.1", "205.251.249.10", "192.0.2.1"} {
+		cf.matchStore(ips, netip.MustParseAddr(addr))
+	}
+	if got := cf.state.matcherDivergences.Load(); got != 0 {
+		t.Fatalf("Expected no divergence, got %d", got)
+	}
+
+	// A trie built from other prefixes stands in for a faulty matcher.
+	set := newPrefixSet(mustParseCIDRs(t, "13.32.0.0/15", "205.251.249.0/24"))
+	set.v4 = newPrefixSet(mustParseCIDRs(t, "198.51.100.0/24")).v4
+	ips.set.Store(set)
+
+	if _, ok := cf.matchStore(ips, netip.MustParseAddr("205.251.249.10")); !ok {
+		t.Error("Expected the linear scan's verdict to be served")
+	}
+	if _, ok := cf.matchStore(ips, netip.MustParseAddr("198.51.100.1")); ok {
+		t.Error("Expected the linear scan's verdict to be served")
+	}
+	if got := cf.status().MatcherDivergences; got != 2 {
+		t.Errorf("Expected 2 divergences, got %d", got)
+	}
+	got := logs.String()
+	if !strings.Contains(got, "matcher divergence for 205.251.249.10: linear scan match 205.251.249.0/24, trie no match") {
+		t.Errorf("Expected the address and both verdicts in the log, got %q", got)
+	}
+	if strings.Contains(got, "198.51.100.1") {
+		t.Errorf("Expected the second divergence within the interval not to be logged, got %q", got)
+	}
+}
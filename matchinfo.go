@@ -0,0 +1,142 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"math/bits"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// headerMatch tells the client, with debugHeaders, which list admitted it.
+const headerMatch = "X-CFGate-Match"
+
+// addrFamily is the address family of a client, counted separately to see
+// how much traffic arrives over IPv6.
+type addrFamily int
+
+const (
+	familyIPv4 addrFamily = iota
+	familyIPv6
+	addrFamilyCount
+)
+
+// String returns the family label.
+func (f addrFamily) String() string {
+	if f == familyIPv4 {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// familyOf returns the family of addr; IPv4-mapped addresses are IPv4.
+func familyOf(addr netip.Addr) addrFamily {
+	if addr.Unmap().Is4() {
+		return familyIPv4
+	}
+	return familyIPv6
+}
+
+// matchLabel returns the list that admitted a request: allowedIPs, the
+// source of the CloudFront or health checker ranges, or the stage.
+func matchLabel(verdict decision) string {
+	if verdict.Stage == stageCloudFront || verdict.Stage == stageRoute53HealthChecks {
+		return verdict.Source.String()
+	}
+	return verdict.Stage
+}
+
+// nearMiss is the prefix of a list sharing the most leading bits with a
+// denied address.
+type nearMiss struct {
+	list   string
+	prefix netip.Prefix
+	bits   int
+}
+
+// logNearMisses logs at debug level the prefix of each list closest to the
+// address of a request that matched none, to tell which list it would have
+// needed to be in. It is only called with debug logging enabled.
+func (cf *CloudFrontGate) logNearMisses(req *http.Request, addr netip.Addr) {
+	if !addr.IsValid() {
+		return
+	}
+	var misses []string
+	for _, miss := range cf.nearMisses(addr) {
+		misses = append(misses, fmt.Sprintf("%s %s (%d of %d bits)", miss.list, miss.prefix, miss.bits, miss.prefix.Bits()))
+	}
+	nearest := "no list of the family"
+	if len(misses) > 0 {
+		nearest = strings.Join(misses, ", ")
+	}
+	cf.logger.debugf("CloudFrontGate %s: %s %s from %s (%s) matched no list; nearest: %s",
+		cf.name, req.Method, req.URL.Path, addr, familyOf(addr), nearest)
+}
+
+// nearMisses returns, for allowedIPs and each source of the stored ranges,
+// the prefix sharing the most leading bits with addr, in the order of the
+// lists. Lists without a prefix of the family of addr are left out.
+func (cf *CloudFrontGate) nearMisses(addr netip.Addr) []nearMiss {
+	addr = addr.Unmap()
+	var best [trustSourceCount + 1]nearMiss
+	consider := func(slot int, list string, prefix netip.Prefix) {
+		if !prefix.IsValid() || prefix.Addr().Is4() != addr.Is4() {
+			return
+		}
+		n := commonBits(addr, prefix.Addr())
+		if n > prefix.Bits() {
+			n = prefix.Bits()
+		}
+		if !best[slot].prefix.IsValid() || n > best[slot].bits {
+			best[slot] = nearMiss{list: list, prefix: prefix, bits: n}
+		}
+	}
+
+	for _, cidr := range cf.allowedPrefixes() {
+		consider(0, stageAllowedIPs, netipPrefix(cidr))
+	}
+	stores := []*ipstore{cf.ips, cf.healthChecks}
+	for _, ips := range stores {
+		if ips == nil {
+			continue
+		}
+		set, _ := ips.set.Load().(*prefixSet)
+		if set == nil {
+			continue
+		}
+		sources, _ := ips.sources.Load().(map[string]trustSource)
+		for i, prefix := range set.prefixes {
+			source, ok := sources[set.keys[i]]
+			if !ok {
+				source = sourceCloudFrontGlobal
+			}
+			if ips == cf.healthChecks {
+				source = sourceRoute53HealthChecks
+			}
+			consider(1+int(source), source.String(), prefix)
+		}
+	}
+
+	var misses []nearMiss
+	for _, miss := range best {
+		if miss.prefix.IsValid() {
+			misses = append(misses, miss)
+		}
+	}
+	return misses
+}
+
+// commonBits returns the number of leading bits a and b, of the same
+// family, have in common.
+func commonBits(a, b netip.Addr) int {
+	x, y := a.As16(), b.As16()
+	n := 0
+	for i := range x {
+		if d := x[i] ^ y[i]; d != 0 {
+			n += bits.LeadingZeros8(d)
+			break
+		}
+		n += 8
+	}
+	return n - addrOffset(a)
+}
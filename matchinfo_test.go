@@ -0,0 +1,139 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommonBits(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"192.0.2.1", "192.0.2.1", 32},
+		{"192.0.2.1", "192.0.3.1", 23},
+		{"10.0.0.0", "138.0.0.0", 0},
+		{"2001:db8::1", "2001:db8::1", 128},
+		{"2001:db8::", "2001:db9::", 31},
+	}
+	for _, tt := range tests {
+		if got := commonBits(netip.MustParseAddr(tt.a), netip.MustParseAddr(tt.b)); got != tt.want {
+			t.Errorf("commonBits(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestFamilyOf(t *testing.T) {
+	for addr, want := range map[string]addrFamily{
+		"192.0.2.1":        familyIPv4,
+		"::ffff:192.0.2.1": familyIPv4,
+		"2001:db8::1":      familyIPv6,
+	} {
+		if got := familyOf(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("familyOf(%s) = %s, want %s", addr, got, want)
+		}
+	}
+}
+
+func TestNearMisses(t *testing.T) {
+	cf, _ := newAllowedIPsGate(t, "192.0.2.0/24", "2001:db8::/32")
+
+	var got []string
+	for _, miss := range cf.nearMisses(netip.MustParseAddr("192.0.3.1")) {
+		got = append(got, fmt.Sprintf("%s %s %d", miss.list, miss.prefix, miss.bits))
+	}
+	want := []string{"allowedIPs 192.0.2.0/24 23", "cloudfront-global 205.251.249.0/24 4", "cloudfront-regional 13.113.196.64/26 0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nearMisses() = %q, want %q", got, want)
+	}
+
+	// The CloudFront ranges of the test source are all IPv4.
+	misses := cf.nearMisses(netip.MustParseAddr("2001:db8:ffff::1"))
+	if len(misses) != 1 || misses[0].prefix.String() != "2001:db8::/32" || misses[0].bits != 32 {
+		t.Errorf("Expected only the IPv6 allowedIPs prefix, got %+v", misses)
+	}
+}
+
+func TestNearMissDebugLog(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	for _, level := range []string{"info", "debug"} {
+		logs.Reset()
+		cfg := CreateConfig()
+		cfg.LogLevel = level
+		cfg.AllowedIPs = []string{"192.0.2.0/24"}
+		handler, err := NewWithOptions(context.Background(), http.NotFoundHandler(), cfg, t.Name()+"-"+level, withFixture())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		if code := serveFrom(cf, "192.0.3.1:1234"); code != http.StatusForbidden {
+			t.Fatalf("Expected 192.0.3.1 to be blocked, got %d", code)
+		}
+		_ = cf.Close()
+
+		logged := strings.Contains(logs.String(), "from 192.0.3.1 (ipv4) matched no list; nearest: allowedIPs 192.0.2.0/24 (23 of 24 bits), cloudfront-global ")
+		if logged != (level == "debug") {
+			t.Errorf("logLevel %s: near miss logged = %v, logs:\n%s", level, logged, logs.String())
+		}
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		server, _, _ := countingSource(t)
+		cfg := CreateConfig()
+		cfg.IPListURL = server.URL
+		cfg.AllowPrivateSources = true
+		cfg.AllowedIPs = []string{"192.0.2.0/24"}
+		cfg.DebugHeaders = enabled
+		handler, err := New(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+
+		for remoteAddr, want := range map[string]string{
+			"192.0.2.1:1234":     "allowedIPs",
+			"205.251.249.1:1234": "cloudfront-global",
+			"13.113.203.1:1234":  "cloudfront-regional",
+			"198.51.100.1:1234":  "",
+		} {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = remoteAddr
+			rw := httptest.NewRecorder()
+			cf.ServeHTTP(rw, req)
+			if !enabled {
+				want = ""
+			}
+			if got := rw.Header().Get(headerMatch); got != want {
+				t.Errorf("debugHeaders %v, %s: %s = %q, want %q", enabled, remoteAddr, headerMatch, got, want)
+			}
+		}
+		_ = cf.Close()
+	}
+}
+
+func TestFamilyCounters(t *testing.T) {
+	cf, _ := newAllowedIPsGate(t, "2001:db8::/32")
+	for _, remoteAddr := range []string{"205.251.249.1:1", "[::ffff:205.251.249.1]:1", "[2001:db8::1]:1", "192.0.2.1:1", "[2001:db9::1]:1", "[2001:db9::2]:1"} {
+		serveFrom(cf, remoteAddr)
+	}
+
+	status := cf.status()
+	if status.AllowedByFamily["ipv4"] != 2 || status.AllowedByFamily["ipv6"] != 1 ||
+		status.DeniedByFamily["ipv4"] != 1 || status.DeniedByFamily["ipv6"] != 2 {
+		t.Errorf("Expected 2/1 allowed and 1/2 denied per family, got %v and %v", status.AllowedByFamily, status.DeniedByFamily)
+	}
+}
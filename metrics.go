@@ -0,0 +1,109 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prometheus text exposition of the metrics path.
+const (
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+	metricsPrefix      = "cloudfrontgate_"
+)
+
+// metric is a sample of the metrics path. labels holds the labels beyond
+// the middleware name, as `key="value"` pairs; samples of the same name
+// follow each other.
+type metric struct {
+	name   string
+	kind   string
+	help   string
+	labels string
+	value  float64
+}
+
+// metrics returns the samples of the instance. The request counters live in
+// the gateState and survive reloads, and the refresh counters are those of
+// the shared CloudFront store.
+func (cf *CloudFrontGate) metrics() []metric {
+	metrics := []metric{
+		{name: "requests_allowed_total", kind: "counter", help: "Requests admitted by the gate.", value: float64(cf.state.allowed.Load())},
+		{name: "requests_blocked_total", kind: "counter", help: "Requests denied by the gate.", value: float64(cf.state.denied.Load())},
+		{name: "requests_blocked_unparsable_total", kind: "counter", help: "Requests refused because their client address could not be determined.", value: float64(cf.state.unparsable.Load())},
+		{name: "requests_allowed_unparsable_total", kind: "counter", help: "Requests without an address in RemoteAddr admitted unchecked by onUnparsableRemoteAddr.", value: float64(cf.state.unparsableAllowed.Load())},
+		{name: "refresh_success_total", kind: "counter", help: "Successful fetches of the CloudFront IP ranges.", value: float64(cf.ips.succeeded.Load())},
+		{name: "refresh_failure_total", kind: "counter", help: "Failed fetches of the CloudFront IP ranges.", value: float64(cf.ips.failed.Load())},
+	}
+	for source := trustSource(0); source < trustSourceCount; source++ {
+		metrics = append(metrics, metric{
+			name: "requests_allowed_by_source_total", kind: "counter", help: "Requests admitted by the gate per matching source.",
+			labels: `source="` + source.String() + `"`, value: float64(cf.state.allowedBy[source].Load()),
+		})
+	}
+	for family := addrFamily(0); family < addrFamilyCount; family++ {
+		metrics = append(metrics, metric{
+			name: "requests_allowed_by_family_total", kind: "counter", help: "Requests admitted by the gate per client address family.",
+			labels: `family="` + family.String() + `"`, value: float64(cf.state.allowedByFamily[family].Load()),
+		})
+	}
+	for family := addrFamily(0); family < addrFamilyCount; family++ {
+		metrics = append(metrics, metric{
+			name: "requests_blocked_by_family_total", kind: "counter", help: "Requests denied by the gate per client address family.",
+			labels: `family="` + family.String() + `"`, value: float64(cf.state.deniedByFamily[family].Load()),
+		})
+	}
+	for i := 0; i < responseClasses; i++ {
+		metrics = append(metrics, metric{
+			name: "responses_total", kind: "counter", help: "Responses of the backend to forwarded requests per status class.",
+			labels: `code="` + statusClass(i) + `"`, value: float64(cf.state.responses.byClass[i].Load()),
+		})
+	}
+	metrics = append(metrics,
+		metric{name: "response_bytes_total", kind: "counter", help: "Body bytes of the backend responses to forwarded requests.", value: float64(cf.state.responses.bytes.Load())},
+		metric{name: "upgraded_connections_total", kind: "counter", help: "Connections the backend took over, such as WebSocket upgrades.", value: float64(cf.state.responses.upgrades.Load())},
+	)
+	if updated, ok := cf.ips.updated.Load().(time.Time); ok {
+		metrics = append(metrics, metric{
+			name: "last_refresh_timestamp_seconds", kind: "gauge",
+			help:  "Unix time of the last successful refresh of the CloudFront IP ranges.",
+			value: float64(updated.UnixNano()) / float64(time.Second),
+		})
+	}
+	return append(metrics, metric{
+		name: "cidr_count", kind: "gauge", help: "Stored CloudFront prefixes.",
+		value: float64(len(cf.ips.prefixes())),
+	})
+}
+
+// serveMetricsPath writes the metrics in the Prometheus text format, each
+// labeled with the middleware name.
+func (cf *CloudFrontGate) serveMetricsPath(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethod(rw, req, http.MethodGet) {
+		return
+	}
+	label := `middleware="` + metricsEscaper.Replace(cf.name) + `"`
+	var b strings.Builder
+	previous := ""
+	for _, m := range cf.metrics() {
+		name := metricsPrefix + m.name
+		if name != previous {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, m.help, name, m.kind)
+			previous = name
+		}
+		labels := label
+		if m.labels != "" {
+			labels += "," + m.labels
+		}
+		fmt.Fprintf(&b, "%s{%s} %s\n", name, labels, strconv.FormatFloat(m.value, 'f', -1, 64))
+	}
+
+	rw.Header().Set("Content-Type", metricsContentType)
+	rw.Header().Set("Cache-Control", "no-store")
+	_, _ = rw.Write([]byte(b.String()))
+}
+
+// metricsEscaper escapes a label value of the text format.
+var metricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,107 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsPath(t *testing.T) {
+	server, _, failing := countingSource(t)
+	cfg := CreateConfig()
+	cfg.IPListURL = server.URL
+	cfg.AllowPrivateSources = true
+	cfg.AllowedIPs = []string{"198.51.100.0/24"}
+	cfg.MetricsPath = "/_cloudfrontgate/metrics"
+	forwarded := 0
+	next := http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == cfg.MetricsPath {
+			t.Error("Expected the metrics path not to be forwarded")
+		}
+		forwarded++
+	})
+	handler, err := New(context.Background(), next, cfg, t.Name())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	serve := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		return rw
+	}
+	scrape := func() string {
+		t.Helper()
+		rw := serve(cfg.MetricsPath, "198.51.100.7:1234")
+		if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != metricsContentType {
+			t.Fatalf("Expected the metrics, got %d %q", rw.Code, rw.Header().Get("Content-Type"))
+		}
+		return rw.Body.String()
+	}
+	sample := func(name, value string) string {
+		return "cloudfrontgate_" + name + `{middleware="` + t.Name() + `"} ` + value + "\n"
+	}
+
+	body := scrape()
+	for _, want := range []string{
+		"# TYPE cloudfrontgate_requests_allowed_total counter\n",
+		sample("requests_allowed_total", "0"),
+		sample("requests_blocked_total", "0"),
+		sample("refresh_success_total", "1"),
+		sample("refresh_failure_total", "0"),
+		"# TYPE cloudfrontgate_last_refresh_timestamp_seconds gauge\n",
+		sample("cidr_count", "8"),
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in the metrics, got:\n%s", want, body)
+		}
+	}
+
+	if rw := serve("/", "192.0.2.1:1234"); rw.Code != http.StatusForbidden {
+		t.Errorf("Expected an unknown client to be blocked, got %d", rw.Code)
+	}
+	if rw := serve("/", "205.251.249.10:1234"); rw.Code != http.StatusOK || forwarded != 1 {
+		t.Errorf("Expected a CloudFront peer to be forwarded, got %d", rw.Code)
+	}
+	if rw := serve(cfg.MetricsPath, "205.251.249.10:1234"); rw.Code != http.StatusForbidden {
+		t.Errorf("Expected a CloudFront peer to be refused the metrics, got %d", rw.Code)
+	}
+	failing.Store(1)
+	_ = cf.Refresh(context.Background())
+
+	body = scrape()
+	// Scrapes are not counted, but the one refused to a CloudFront peer is.
+	for _, want := range []string{
+		sample("requests_allowed_total", "1"),
+		sample("requests_blocked_total", "2"),
+		sample("refresh_failure_total", "1"),
+		"cloudfrontgate_requests_allowed_by_source_total{middleware=\"" + t.Name() + "\",source=\"cloudfront-global\"} 1\n",
+		"cloudfrontgate_requests_blocked_by_family_total{middleware=\"" + t.Name() + "\",family=\"ipv4\"} 2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in the metrics, got:\n%s", want, body)
+		}
+	}
+	if n := strings.Count(body, "# TYPE cloudfrontgate_requests_allowed_by_family_total "); n != 1 {
+		t.Errorf("Expected one TYPE line per labeled metric, got %d", n)
+	}
+}
+
+func TestNewRejectsInvalidMetricsPath(t *testing.T) {
+	for _, path := range []string{"metrics", "/health", "/status", "/refresh"} {
+		cfg := CreateConfig()
+		cfg.HealthPath = "/health"
+		cfg.StatusPath = "/status"
+		cfg.RefreshPath = "/refresh"
+		cfg.MetricsPath = path
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name()); err == nil {
+			t.Errorf("Expected metricsPath %q to be rejected", path)
+		}
+	}
+}
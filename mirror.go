@@ -0,0 +1,263 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the denial mirror.
+const (
+	defaultMirrorMaxEventsPerMinute = 60
+	defaultMirrorMaxHeaderLength    = 256
+	// mirrorQueueSize bounds the events waiting to be sent.
+	mirrorQueueSize = 64
+	// mirrorMaxPathLength truncates the mirrored request paths.
+	mirrorMaxPathLength = 1024
+	// mirrorRequestTimeout bounds each post to the sink.
+	mirrorRequestTimeout = 5 * time.Second
+)
+
+// DenialMirrorConfig configures mirroring a sample of denied requests to an
+// HTTP sink. Request bodies are never read or forwarded.
+type DenialMirrorConfig struct {
+	// URL receives one JSON event per mirrored denial, posted asynchronously
+	URL string `json:"url,omitempty"`
+	// Headers lists the request headers captured with each event; no header is captured by default
+	Headers []string `json:"headers,omitempty"`
+	// MaxEventsPerMinute caps the mirrored events, 60 by default; denials beyond it are dropped and counted
+	MaxEventsPerMinute int `json:"maxEventsPerMinute,omitempty"`
+	// MaxHeaderLength truncates captured header values, 256 bytes by default
+	MaxHeaderLength int `json:"maxHeaderLength,omitempty"`
+}
+
+// mirrorEvent is the document posted for a mirrored denial.
+type mirrorEvent struct {
+	Time       time.Time         `json:"time"`
+	Middleware string            `json:"middleware"`
+	Method     string            `json:"method"`
+	Host       string            `json:"host"`
+	Path       string            `json:"path"`
+	SourceIP   string            `json:"sourceIP"`
+	Reason     string            `json:"reason"`
+	Headers    map[string]string `json:"headers,omitempty"`
+}
+
+// denialMirror posts sampled denials from a single background goroutine.
+// Events beyond the per-minute cap or a full queue are dropped and counted
+// in the gateState.
+type denialMirror struct {
+	cf              *CloudFrontGate
+	url             string
+	headers         []string
+	maxPerMinute    int
+	maxHeaderLength int
+	client          *http.Client
+
+	mu          sync.Mutex
+	windowStart time.Time
+	inWindow    int
+	closed      bool
+
+	queue chan mirrorEvent
+	stop  chan struct{}
+	done  chan struct{}
+
+	warned atomic.Bool
+	// lastErr is the error of the last post, owned by the sender.
+	lastErr error
+}
+
+// newDenialMirror validates config. It returns nil when no URL is set.
+func newDenialMirror(cf *CloudFrontGate, config *DenialMirrorConfig) (*denialMirror, error) {
+	if config == nil || config.URL == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(config.URL, "https://") && !strings.HasPrefix(config.URL, "http://") {
+		return nil, fmt.Errorf("invalid denialMirror url %q: must be http or https", config.URL)
+	}
+	if config.MaxEventsPerMinute < 0 {
+		return nil, fmt.Errorf("invalid denialMirror maxEventsPerMinute %d: must not be negative", config.MaxEventsPerMinute)
+	}
+	if config.MaxHeaderLength < 0 {
+		return nil, fmt.Errorf("invalid denialMirror maxHeaderLength %d: must not be negative", config.MaxHeaderLength)
+	}
+
+	headers := make([]string, 0, len(config.Headers))
+	for _, name := range config.Headers {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			return nil, errors.New("denialMirror headers must not be empty")
+		}
+		if name == "Authorization" || name == "Cookie" || name == "Proxy-Authorization" {
+			return nil, fmt.Errorf("denialMirror must not capture the %s header", name)
+		}
+		headers = append(headers, name)
+	}
+
+	m := &denialMirror{
+		cf:              cf,
+		url:             config.URL,
+		headers:         headers,
+		maxPerMinute:    config.MaxEventsPerMinute,
+		maxHeaderLength: config.MaxHeaderLength,
+		client:          &http.Client{Timeout: mirrorRequestTimeout},
+		queue:           make(chan mirrorEvent, mirrorQueueSize),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	if m.maxPerMinute == 0 {
+		m.maxPerMinute = defaultMirrorMaxEventsPerMinute
+	}
+	if m.maxHeaderLength == 0 {
+		m.maxHeaderLength = defaultMirrorMaxHeaderLength
+	}
+	return m, nil
+}
+
+// start runs the sender in the background.
+func (m *denialMirror) start() {
+	go func() {
+		defer close(m.done)
+
+		for {
+			select {
+			case <-m.stop:
+				m.drain()
+				return
+			case event := <-m.queue:
+				m.send(event)
+			}
+		}
+	}()
+}
+
+// drain sends the events queued before close.
+func (m *denialMirror) drain() {
+	for {
+		select {
+		case event := <-m.queue:
+			m.send(event)
+		default:
+			return
+		}
+	}
+}
+
+// close stops accepting events, sends the queued ones and stops the sender.
+// It reports whether the last post failed.
+func (m *denialMirror) close() error {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	close(m.stop)
+	<-m.done
+	return m.lastErr
+}
+
+// mirror queues the event of a denial, unless the per-minute cap is reached
+// or the queue is full.
+func (m *denialMirror) mirror(req *http.Request, now time.Time, reason denyReason) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	if now.Sub(m.windowStart) >= time.Minute {
+		m.windowStart = now
+		m.inWindow = 0
+	}
+	if m.inWindow >= m.maxPerMinute {
+		m.mu.Unlock()
+		m.cf.state.mirrorDropped.Add(1)
+		return
+	}
+	m.inWindow++
+	m.mu.Unlock()
+
+	select {
+	case m.queue <- m.event(req, now, reason):
+	default:
+		m.cf.state.mirrorDropped.Add(1)
+	}
+}
+
+// event captures the metadata of req. The body is never touched.
+func (m *denialMirror) event(req *http.Request, now time.Time, reason denyReason) mirrorEvent {
+	event := mirrorEvent{
+		Time:       now.UTC(),
+		Middleware: m.cf.name,
+		Method:     req.Method,
+		Host:       truncate(req.Host, m.maxHeaderLength),
+		Path:       truncate(req.URL.Path, mirrorMaxPathLength),
+		Reason:     reason.String(),
+	}
+	if ip := m.cf.clientIP(req); ip != nil {
+		event.SourceIP = ip.String()
+	}
+	for _, name := range m.headers {
+		value := req.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		if event.Headers == nil {
+			event.Headers = make(map[string]string, len(m.headers))
+		}
+		event.Headers[name] = truncate(value, m.maxHeaderLength)
+	}
+	return event
+}
+
+// send posts event to the sink.
+func (m *denialMirror) send(event mirrorEvent) {
+	m.lastErr = m.post(event)
+	if m.lastErr != nil {
+		m.cf.state.mirrorFailed.Add(1)
+		if m.warned.CompareAndSwap(false, true) {
+			m.cf.logger.errorf("CloudFrontGate %s: failed to mirror a denial, further errors are not logged: %v", m.cf.name, m.lastErr)
+		}
+		return
+	}
+	m.cf.state.mirrored.Add(1)
+}
+
+func (m *denialMirror) post(event mirrorEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode mirror event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create mirror request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post mirror event: %w", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected mirror response status: %s", res.Status)
+	}
+	return nil
+}
+
+// truncate shortens s to at most limit bytes.
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	return s[:limit]
+}
@@ -0,0 +1,127 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDenialMirrorCapsAndFlushesOnClose(t *testing.T) {
+	var mu sync.Mutex
+	var events []mirrorEvent
+	sink := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var event mirrorEvent
+		if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+			t.Errorf("Failed to decode mirror event: %v", err)
+		}
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer sink.Close()
+
+	cfg := CreateConfig()
+	cfg.DenialMirror = &DenialMirrorConfig{
+		URL:                sink.URL,
+		Headers:            []string{"user-agent"},
+		MaxEventsPerMinute: 3,
+		MaxHeaderLength:    8,
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	now := time.Now()
+	cf.now = func() time.Time { return now }
+
+	read := false
+	for range 5 {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/wp-login.php?x=1", &trackingReader{read: &read})
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("User-Agent", "scanner/1.0 (long)")
+		req.Header.Set("X-Secret", "not captured")
+		cf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	_ = cf.Close()
+
+	if read {
+		t.Error("Expected the request body never to be read")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 mirrored events after Close, got %d", len(events))
+	}
+	event := events[0]
+	if event.Method != http.MethodPost || event.Path != "/wp-login.php" || event.SourceIP != "10.0.0.1" || event.Reason != "ip" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if len(event.Headers) != 1 || event.Headers["User-Agent"] != "scanner/" {
+		t.Errorf("Expected only the truncated User-Agent, got %v", event.Headers)
+	}
+	if got := cf.state.mirrorDropped.Load(); got != 2 {
+		t.Errorf("Expected 2 dropped events, got %d", got)
+	}
+	if got := cf.state.mirrored.Load(); got != 3 {
+		t.Errorf("Expected 3 sent events, got %d", got)
+	}
+}
+
+func TestDenialMirrorWindowResets(t *testing.T) {
+	m, err := newDenialMirror(&CloudFrontGate{state: &gateState{}}, &DenialMirrorConfig{URL: "http://127.0.0.1:1", MaxEventsPerMinute: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	m.mirror(req, now, denyIP)
+	m.mirror(req, now.Add(30*time.Second), denyIP)
+	m.mirror(req, now.Add(time.Minute), denyIP)
+
+	if got := len(m.queue); got != 2 {
+		t.Errorf("Expected 2 queued events, got %d", got)
+	}
+	if got := m.cf.state.mirrorDropped.Load(); got != 1 {
+		t.Errorf("Expected 1 dropped event, got %d", got)
+	}
+}
+
+func TestNewDenialMirrorValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *DenialMirrorConfig
+		want   string
+	}{
+		{name: "Scheme", config: &DenialMirrorConfig{URL: "ftp://sink"}, want: "must be http or https"},
+		{name: "Negative cap", config: &DenialMirrorConfig{URL: "https://sink", MaxEventsPerMinute: -1}, want: "maxEventsPerMinute"},
+		{name: "Credentials", config: &DenialMirrorConfig{URL: "https://sink", Headers: []string{"cookie"}}, want: "Cookie"},
+		{name: "Empty header", config: &DenialMirrorConfig{URL: "https://sink", Headers: []string{" "}}, want: "must not be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newDenialMirror(&CloudFrontGate{}, tt.config)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("newDenialMirror() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// trackingReader records whether it was read.
+type trackingReader struct {
+	read *bool
+}
+
+func (r *trackingReader) Read(_ []byte) (int, error) {
+	*r.read = true
+	return 0, io.EOF
+}
@@ -0,0 +1,159 @@
+package cloudfrontgate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Formats of the additional IP list sources.
+const (
+	formatCloudFrontTools = "cloudfront-tools"
+	formatPlainCIDRLines  = "plain-cidr-lines"
+	formatJSONArray       = "json-array"
+)
+
+// IPListSourceConfig is an additional IP list, such as the edge list of
+// another CDN, fetched with every refresh and trusted along the primary
+// list.
+type IPListSourceConfig struct {
+	// URL of the list, http or https
+	URL string `json:"url,omitempty"`
+	// Format is "cloudfront-tools" (default), "plain-cidr-lines" for one CIDR per line, or "json-array" for a JSON array of CIDR strings
+	Format string `json:"format,omitempty"`
+}
+
+// extraSource is an additional list in a sourceConfig.
+type extraSource struct {
+	URL    string `json:"url"`
+	Format string `json:"format"`
+}
+
+// parseExtraSources validates the additional sources.
+func parseExtraSources(configs []IPListSourceConfig) ([]extraSource, error) {
+	sources := make([]extraSource, 0, len(configs))
+	for _, config := range configs {
+		if !strings.HasPrefix(config.URL, "https://") && !strings.HasPrefix(config.URL, "http://") {
+			return nil, fmt.Errorf("invalid sources url %q: must be http or https", config.URL)
+		}
+		format := config.Format
+		switch format {
+		case "":
+			format = formatCloudFrontTools
+		case formatCloudFrontTools, formatPlainCIDRLines, formatJSONArray:
+		default:
+			return nil, fmt.Errorf("invalid sources format %q: must be %q, %q or %q",
+				config.Format, formatCloudFrontTools, formatPlainCIDRLines, formatJSONArray)
+		}
+		sources = append(sources, extraSource{URL: config.URL, Format: format})
+	}
+	return sources, nil
+}
+
+// parseExtra parses the document of an additional source.
+func parseExtra(body []byte, format string) ([]netip.Prefix, error) {
+	var entries []string
+	switch format {
+	case formatPlainCIDRLines:
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			entries = append(entries, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read CIDR lines: %w", err)
+		}
+	case formatJSONArray:
+		if err := json.Unmarshal(body, &entries); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal CIDR array: %w", err)
+		}
+	default:
+		resp := CFResponse{}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		return parseResponse(resp)
+	}
+	return parsePrefixes(entries)
+}
+
+// fetchExtra downloads and parses an additional source.
+func fetchExtra(ctx context.Context, client *http.Client, src extraSource) ([]netip.Prefix, error) {
+	body, err := download(ctx, client, src.URL)
+	if err != nil {
+		return nil, err
+	}
+	return parseExtra(body, src.Format)
+}
+
+// fetchAll fetches the primary and the additional sources and merges them
+// into one deduplicated dataset, failing when any source fails. With
+// partialOK, a failed source keeps its previously fetched list instead, and
+// only a refresh where every source failed is an error.
+func (ips *ipstore) fetchAll(ctx context.Context, client *http.Client) (*dataset, error) {
+	primary, err := ips.fetchPrimary(ctx, client)
+	failed := 0
+	if err != nil {
+		ips.logs.errorf("Failed to fetch source %s: %v", ips.cfAPI, err)
+		if !ips.partialOK {
+			return nil, fmt.Errorf("failed to fetch source %s: %w", ips.cfAPI, err)
+		}
+		failed++
+		primary = ips.lastPrimary
+		if primary == nil {
+			primary = &dataset{}
+		}
+	} else {
+		ips.lastPrimary = primary
+	}
+
+	merged := &dataset{
+		cidrs:      append([]netip.Prefix(nil), primary.cidrs...),
+		samples:    primary.samples,
+		sources:    make(map[string]trustSource, len(primary.sources)),
+		validators: primary.validators,
+	}
+	for prefix, source := range primary.sources {
+		merged.sources[prefix] = source
+	}
+	seen := make(map[string]bool, len(merged.cidrs))
+	for _, cidr := range merged.cidrs {
+		seen[cidr.String()] = true
+	}
+
+	for i, src := range ips.extra {
+		cidrs, err := fetchExtra(ctx, client, src)
+		if err != nil {
+			ips.logs.errorf("Failed to fetch source %s: %v", src.URL, err)
+			if !ips.partialOK {
+				return nil, newFetchError(src.URL, fmt.Errorf("failed to fetch source %s: %w", src.URL, err))
+			}
+			failed++
+			cidrs = ips.lastExtra[i]
+		} else {
+			ips.lastExtra[i] = cidrs
+		}
+		for _, cidr := range cidrs {
+			prefix := cidr.String()
+			if seen[prefix] {
+				continue
+			}
+			seen[prefix] = true
+			merged.cidrs = append(merged.cidrs, cidr)
+			merged.sources[prefix] = sourceAdditional
+		}
+	}
+	if failed == len(ips.extra)+1 {
+		return nil, errors.New("failed to fetch every source")
+	}
+	return merged, nil
+}
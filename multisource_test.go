@@ -0,0 +1,161 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseExtra(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "Plain lines", format: formatPlainCIDRLines, body: "# Fastly\n151.101.0.0/16\n\n  157.52.64.0/18 \n2a04:4e40::/32\n", want: []string{"151.101.0.0/16", "157.52.64.0/18", "2a04:4e40::/32"}},
+		{name: "JSON array", format: formatJSONArray, body: `["151.101.0.0/16", "2a04:4e40::/32"]`, want: []string{"151.101.0.0/16", "2a04:4e40::/32"}},
+		{name: "CloudFront tools", format: formatCloudFrontTools, body: `{"CLOUDFRONT_GLOBAL_IP_LIST": ["205.251.249.0/24"]}`, want: []string{"205.251.249.0/24"}},
+		{name: "Invalid line", format: formatPlainCIDRLines, body: "151.101.0.0/16\nnot-a-cidr\n", wantErr: true},
+		{name: "Invalid array", format: formatJSONArray, body: `{"addresses": []}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cidrs, err := parseExtra([]byte(tt.body), tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExtra() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, cidr := range cidrs {
+				got = append(got, cidr.String())
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("parseExtra() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExtraSources(t *testing.T) {
+	sources, err := parseExtraSources([]IPListSourceConfig{{URL: "https://example.com/list"}})
+	if err != nil || sources[0].Format != formatCloudFrontTools {
+		t.Errorf("Expected the cloudfront-tools format by default, got %+v, %v", sources, err)
+	}
+	for _, config := range []IPListSourceConfig{
+		{URL: "ftp://example.com/list"},
+		{URL: "https://example.com/list", Format: "csv"},
+	} {
+		if _, err := parseExtraSources([]IPListSourceConfig{config}); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+
+	cfg := CreateConfig()
+	cfg.IPListURL = "https://example.com/ips"
+	cfg.PinnedSHA256 = []string{"sha256//47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}
+	cfg.Sources = []IPListSourceConfig{{URL: "https://example.com/list"}}
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name()); err == nil {
+		t.Error("Expected pins combined with sources to be rejected")
+	}
+}
+
+func TestMultipleSources(t *testing.T) {
+	var failing atomic.Bool
+	serve := func(body string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			if failing.Load() {
+				http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = rw.Write([]byte(body))
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	fastly := serve(`["151.101.0.0/16", "13.32.0.0/15"]`)
+	plain := serve("157.52.64.0/18\n")
+
+	build := func(t *testing.T, partialOK bool) *CloudFrontGate {
+		t.Helper()
+		cfg := CreateConfig()
+		cfg.AllowPrivateSources = true
+		cfg.PartialOK = partialOK
+		cfg.Sources = []IPListSourceConfig{
+			{URL: fastly.URL, Format: formatJSONArray},
+			{URL: plain.URL, Format: formatPlainCIDRLines},
+		}
+		handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), withFixture())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		t.Cleanup(func() { _ = cf.Close() })
+		return cf
+	}
+	allowed := func(cf *CloudFrontGate, addr string) bool {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = addr + ":443"
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		return rw.Code == http.StatusOK
+	}
+
+	failing.Store(false)
+	cf := build(t, false)
+	for _, addr := range []string{"205.251.249.10", "151.101.1.1", "157.52.64.1"} {
+		if !allowed(cf, addr) {
+			t.Errorf("Expected %s to be allowed by the merged sources", addr)
+		}
+	}
+	// 13.32.0.0/15 is published by the primary source as well.
+	if got := len(cf.ips.prefixes()); got != 10 {
+		t.Errorf("Expected 10 deduplicated prefixes, got %d", got)
+	}
+	if got := cf.status().AllowedBy[sourceAdditional.String()]; got != 2 {
+		t.Errorf("Expected 2 requests admitted by the additional sources, got %d", got)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	failing.Store(true)
+	version := cf.ips.version.Load()
+	if err := cf.ips.Update(context.Background()); err == nil || !strings.Contains(err.Error(), fastly.URL) {
+		t.Errorf("Expected the failed source to fail the update, got %v", err)
+	}
+	if cf.ips.version.Load() != version || !allowed(cf, "151.101.1.1") {
+		t.Error("Expected the previous data to be kept")
+	}
+	if !strings.Contains(logs.String(), "Failed to fetch source "+fastly.URL) {
+		t.Errorf("Expected the failed source in the logs, got %q", logs.String())
+	}
+
+	failing.Store(false)
+	partial := build(t, true)
+	failing.Store(true)
+	if err := partial.ips.Update(context.Background()); err != nil {
+		t.Fatalf("Expected partialOk to accept the primary source alone, got %v", err)
+	}
+	if !allowed(partial, "151.101.1.1") || !allowed(partial, "157.52.64.1") {
+		t.Error("Expected the previous lists of the failed sources to be kept")
+	}
+}
+
+func TestFetchAllFailsWhenEverySourceFails(t *testing.T) {
+	ips := newIPStore("http://127.0.0.1:1/ips")
+	ips.extra = []extraSource{{URL: "http://127.0.0.1:1/extra", Format: formatJSONArray}}
+	ips.lastExtra = make([][]netip.Prefix, 1)
+	ips.partialOK = true
+	if _, err := ips.fetchAll(context.Background(), http.DefaultClient); err == nil {
+		t.Error("Expected an error when no source could be fetched")
+	}
+}
@@ -0,0 +1,93 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Option customizes an instance built by NewWithOptions.
+type Option func(*options)
+
+// options are the settings of a NewWithOptions call that a Config cannot
+// carry.
+type options struct {
+	client *http.Client
+	// checker builds the instance behind a Checker.
+	checker bool
+}
+
+// WithHTTPClient fetches the IP lists with client instead of a client built
+// from the configuration, such as one with tracing or a custom resolver.
+// The timeout of client wins when set, httpTimeout applies otherwise; its
+// CheckRedirect, when nil, enforces maxRedirects and sameHostRedirects, and
+// sigV4 signs on top of its transport. The transport options (proxyURL,
+// caBundleFile, insecureSkipVerify, pinnedSHA256 and resolveOverrides) are
+// rejected, and client being the operator's, the private address guard does
+// not apply. Instances share a store only when they share the client.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// NewWithOptions is New for use as a library.
+func NewWithOptions(ctx context.Context, next http.Handler, config *Config, name string, opts ...Option) (http.Handler, error) {
+	o, err := applyOptions(config, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newGate(ctx, next, config, name, o)
+}
+
+// applyOptions returns the settings of opts, checked against config.
+func applyOptions(config *Config, opts []Option) (options, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.client != nil {
+		if err := validateHTTPClient(config); err != nil {
+			return options{}, err
+		}
+	}
+	return o, nil
+}
+
+// validateHTTPClient rejects the options that configure the transport an
+// injected client replaces.
+func validateHTTPClient(config *Config) error {
+	for _, option := range []struct {
+		name string
+		set  bool
+	}{
+		{name: "proxyURL", set: config.ProxyURL != ""},
+		{name: "caBundleFile", set: config.CABundleFile != ""},
+		{name: "insecureSkipVerify", set: config.InsecureSkipVerify},
+		{name: "pinnedSHA256", set: len(config.PinnedSHA256) > 0},
+		{name: "resolveOverrides", set: len(config.ResolveOverrides) > 0},
+	} {
+		if option.set {
+			return invalidConfig(option.name, fmt.Errorf("%s cannot be combined with an injected HTTP client", option.name))
+		}
+	}
+	return nil
+}
+
+// injectedClient returns a copy of the client of WithHTTPClient completed
+// with the timeout, the redirect policy and the signing of the store.
+func (ips *ipstore) injectedClient() *http.Client {
+	client := *ips.httpClient
+	if client.Timeout == 0 {
+		client.Timeout = ips.httpTimeout
+	}
+	if client.CheckRedirect == nil {
+		client.CheckRedirect = ips.checkRedirect
+	}
+	if ips.sigV4 != nil {
+		if signing, err := ips.signingTransport(client.Transport); err == nil {
+			client.Transport = signing
+		}
+	}
+	return &client
+}
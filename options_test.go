@@ -0,0 +1,125 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// roundTripperFunc serves the requests of a client in process.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// stubClient returns a client answering every request with testCFResponse,
+// and the number of requests it served.
+func stubClient() (*http.Client, *atomic.Int32) {
+	var requests atomic.Int32
+	return &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requests.Add(1)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(testCFResponse)),
+			Request:    req,
+		}, nil
+	})}, &requests
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	client, requests := stubClient()
+	build := func(t *testing.T, client *http.Client) *CloudFrontGate {
+		t.Helper()
+		cfg := CreateConfig()
+		cfg.IPListURL = "https://ip-ranges.example.com/ips"
+		handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), WithHTTPClient(client))
+		if err != nil {
+			t.Fatalf("NewWithOptions() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		t.Cleanup(func() { _ = cf.Close() })
+		return cf
+	}
+
+	cf := build(t, client)
+	if requests.Load() != 1 {
+		t.Errorf("Expected the list to be fetched with the injected client, got %d requests", requests.Load())
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "205.251.249.10:443"
+	rw := httptest.NewRecorder()
+	cf.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected a CloudFront peer to be allowed, got %d", rw.Code)
+	}
+
+	if shared := build(t, client); shared.ips != cf.ips {
+		t.Error("Expected the instances of one client to share the store")
+	}
+	other, _ := stubClient()
+	if separate := build(t, other); separate.ips == cf.ips {
+		t.Error("Expected the instances of different clients to have their own store")
+	}
+}
+
+func TestWithHTTPClientTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		config  string
+		want    time.Duration
+	}{
+		{name: "default", want: HTTPTimeoutDefault * time.Second},
+		{name: "config", config: "3s", want: 3 * time.Second},
+		{name: "client wins", timeout: time.Second, config: "3s", want: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := stubClient()
+			client.Timeout = tt.timeout
+			cfg := CreateConfig()
+			cfg.IPListURL = "https://ip-ranges.example.com/ips"
+			cfg.HTTPTimeout = tt.config
+			handler, err := NewWithOptions(context.Background(), http.NotFoundHandler(), cfg, t.Name(), WithHTTPClient(client))
+			if err != nil {
+				t.Fatalf("NewWithOptions() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+
+			fetching := cf.ips.fetchClient()
+			if fetching.Timeout != tt.want {
+				t.Errorf("Expected a %s timeout, got %s", tt.want, fetching.Timeout)
+			}
+			if fetching.CheckRedirect == nil || client.Timeout != tt.timeout {
+				t.Error("Expected the redirect policy on a copy of the injected client")
+			}
+		})
+	}
+}
+
+func TestWithHTTPClientRejectsTransportOptions(t *testing.T) {
+	client, _ := stubClient()
+	for name, configure := range map[string]func(*Config){
+		"proxyURL":           func(cfg *Config) { cfg.ProxyURL = "http://proxy.example.com:3128" },
+		"insecureSkipVerify": func(cfg *Config) { cfg.InsecureSkipVerify = true },
+		"resolveOverrides": func(cfg *Config) {
+			cfg.ResolveOverrides = map[string][]string{"ip-ranges.example.com": {"192.0.2.1:443"}}
+		},
+	} {
+		cfg := CreateConfig()
+		configure(cfg)
+		_, err := NewWithOptions(context.Background(), http.NotFoundHandler(), cfg, t.Name(), WithHTTPClient(client))
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected %s to be rejected with an injected client, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package cloudfrontgate
+
+import (
+	"net"
+	"net/netip"
+)
+
+// prefixSet is the immutable lookup structure of a prefix list, built once
+// per update and swapped atomically, so lookups take no lock. A lookup walks
+// one bit per trie level, at most 32 for IPv4 and 128 for IPv6, whatever the
+// number of prefixes, and allocates nothing.
+type prefixSet struct {
+	// prefixes is the list in its stored order and keys their String
+	// forms.
+	prefixes []netip.Prefix
+	keys     []string
+	v4       *trieNode
+	v6       *trieNode
+}
+
+// trieNode is a node of a binary trie. index is the lowest list index of
+// the prefixes ending at the node, or -1.
+type trieNode struct {
+	children [2]*trieNode
+	index    int
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{index: -1}
+}
+
+// newPrefixSet builds the lookup structure of prefixes, which it keeps.
+// Invalid prefixes never match.
+func newPrefixSet(prefixes []netip.Prefix) *prefixSet {
+	s := &prefixSet{
+		prefixes: prefixes,
+		keys:     make([]string, len(prefixes)),
+		v4:       newTrieNode(),
+		v6:       newTrieNode(),
+	}
+	for i, prefix := range prefixes {
+		s.keys[i] = prefix.String()
+		s.insert(i, prefix)
+	}
+	return s
+}
+
+// netipPrefix converts a prefix following the address families of
+// net.IPNet.Contains: prefixes of IPv4 or IPv4-mapped addresses become IPv4
+// prefixes. An IPv4 mask over an IPv6 address, which never matches, and a
+// non-contiguous mask, which no netip.Prefix can represent, become the zero
+// Prefix.
+func netipPrefix(cidr net.IPNet) netip.Prefix {
+	ones, bits := cidr.Mask.Size()
+	addr, ok := netip.AddrFromSlice(cidr.IP)
+	if !ok || bits == 0 {
+		return netip.Prefix{}
+	}
+	if addr.Is4In6() || addr.Is4() {
+		addr = addr.Unmap()
+		if bits == 8*net.IPv6len {
+			ones -= 8 * (net.IPv6len - net.IPv4len)
+		}
+		if ones < 0 {
+			ones = 0
+		}
+	} else if bits != 8*net.IPv6len {
+		return netip.Prefix{}
+	}
+	return netip.PrefixFrom(addr, ones).Masked()
+}
+
+// maskedPrefix masks the host bits of prefix and turns an IPv4-mapped
+// prefix into the IPv4 one it matches.
+func maskedPrefix(prefix netip.Prefix) netip.Prefix {
+	prefix = prefix.Masked()
+	if addr := prefix.Addr(); addr.Is4In6() {
+		return netip.PrefixFrom(addr.Unmap(), prefix.Bits()-8*(net.IPv6len-net.IPv4len))
+	}
+	return prefix
+}
+
+// insert adds prefix at index i.
+func (s *prefixSet) insert(i int, prefix netip.Prefix) {
+	if !prefix.IsValid() {
+		return
+	}
+	root := s.v6
+	if prefix.Addr().Is4() {
+		root = s.v4
+	}
+	addr := prefix.Addr().As16()
+	offset := addrOffset(prefix.Addr())
+
+	node := root
+	for bit := 0; bit < prefix.Bits(); bit++ {
+		b := addrBit(addr, offset+bit)
+		if node.children[b] == nil {
+			node.children[b] = newTrieNode()
+		}
+		node = node.children[b]
+	}
+	if node.index < 0 {
+		node.index = i
+	}
+}
+
+// scan returns the index lookup returns by scanning the list in order, the
+// matcher the trie replaced; verifyMatcher checks one against the other.
+func (s *prefixSet) scan(addr netip.Addr, skip func(int) bool) (int, bool) {
+	addr = addr.Unmap()
+	for i, prefix := range s.prefixes {
+		if prefix.Contains(addr) && (skip == nil || !skip(i)) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// addrOffset is the bit at which the address bits start in As16 form.
+func addrOffset(addr netip.Addr) int {
+	if addr.Is4() {
+		return 8 * (net.IPv6len - net.IPv4len)
+	}
+	return 0
+}
+
+// addrBit returns the bit of addr at position bit, counted from the left.
+func addrBit(addr [net.IPv6len]byte, bit int) int {
+	return int(addr[bit/8]>>(7-uint(bit%8))) & 1
+}
+
+// lookup returns the lowest list index of the prefixes containing addr,
+// which is the prefix a scan of the list would find first. IPv4-mapped
+// addresses match as IPv4. Prefixes for which skip returns true are passed
+// over; skip may be nil.
+func (s *prefixSet) lookup(addr netip.Addr, skip func(int) bool) (int, bool) {
+	if !addr.IsValid() {
+		return 0, false
+	}
+	addr = addr.Unmap()
+	root := s.v6
+	if addr.Is4() {
+		root = s.v4
+	}
+	bits := addr.As16()
+	offset := addrOffset(addr)
+
+	best := -1
+	node := root
+	for bit := 0; node != nil; bit++ {
+		if i := node.index; i >= 0 && (best < 0 || i < best) && (skip == nil || !skip(i)) {
+			best = i
+		}
+		if offset+bit == 8*net.IPv6len {
+			break
+		}
+		node = node.children[addrBit(bits, offset+bit)]
+	}
+	return best, best >= 0
+}
+
+// addrOf returns ip as a netip.Addr, IPv4-mapped addresses unmapped, or the
+// zero Addr when ip is not an address.
+func addrOf(ip net.IP) netip.Addr {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// addrIP returns addr as a net.IP backed by buf, 4 bytes long for IPv4, so
+// that helpers taking a net.IP can be called without allocating. It returns
+// nil for the zero Addr.
+func addrIP(addr netip.Addr, buf *[net.IPv6len]byte) net.IP {
+	if !addr.IsValid() {
+		return nil
+	}
+	*buf = addr.As16()
+	if addr.Is4() {
+		return buf[net.IPv6len-net.IPv4len:]
+	}
+	return buf[:]
+}
+
+// netipPrefixes converts cidrs with netipPrefix, dropping those no address
+// can match.
+func netipPrefixes(cidrs []net.IPNet) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if prefix := netipPrefix(cidr); prefix.IsValid() {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// containsAddr reports whether one of prefixes contains addr, IPv4-mapped
+// addresses matching as IPv4.
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixIPNet returns prefix as a net.IPNet, 4 bytes long for IPv4.
+func prefixIPNet(prefix netip.Prefix) net.IPNet {
+	return net.IPNet{IP: netIP(prefix.Addr()), Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen())}
+}
+
+// netIP returns addr as a new net.IP, nil for the zero Addr.
+func netIP(addr netip.Addr) net.IP {
+	if !addr.IsValid() {
+		return nil
+	}
+	return net.IP(addr.AsSlice())
+}
@@ -0,0 +1,199 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func mustParseCIDRs(t testing.TB, values ...string) []netip.Prefix {
+	t.Helper()
+	cidrs, err := parsePrefixes(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cidrs
+}
+
+func mustParseIPNets(t testing.TB, values ...string) []net.IPNet {
+	t.Helper()
+	cidrs, err := parseCIDRs(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cidrs
+}
+
+func TestPrefixSetBoundaries(t *testing.T) {
+	set := newPrefixSet(mustParseCIDRs(t,
+		"13.32.0.0/15", "13.34.0.0/16", "52.84.0.0/15", "205.251.249.0/24",
+		"2600:9000::/28", "2600:9010::/32", "1.2.3.4/32", "0.0.0.0/0",
+	))
+	tests := []struct {
+		ip    string
+		want  int
+		found bool
+	}{
+		{ip: "13.31.255.255", want: 7, found: true},
+		{ip: "13.32.0.0", want: 0, found: true},
+		{ip: "13.33.255.255", want: 0, found: true},
+		{ip: "13.34.0.0", want: 1, found: true},
+		{ip: "13.34.255.255", want: 1, found: true},
+		{ip: "13.35.0.0", want: 7, found: true},
+		{ip: "205.251.248.255", want: 7, found: true},
+		{ip: "205.251.249.0", want: 3, found: true},
+		{ip: "205.251.249.255", want: 3, found: true},
+		{ip: "1.2.3.4", want: 6, found: true},
+		{ip: "::ffff:13.32.0.1", want: 0, found: true},
+		{ip: "2600:8fff:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{ip: "2600:9000::", want: 4, found: true},
+		{ip: "2600:900f:ffff:ffff:ffff:ffff:ffff:ffff", want: 4, found: true},
+		{ip: "2600:9010::1", want: 5, found: true},
+		{ip: "2600:9011::"},
+	}
+	for _, tt := range tests {
+		got, found := set.lookup(netip.MustParseAddr(tt.ip), nil)
+		if found != tt.found || (found && got != tt.want) {
+			t.Errorf("lookup(%s) = %d, %t, want %d, %t", tt.ip, got, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestPrefixSetFirstMatch(t *testing.T) {
+	set := newPrefixSet(mustParseCIDRs(t, "10.0.0.0/24", "10.0.0.0/8", "10.0.0.0/24"))
+	ip := netip.MustParseAddr("10.0.0.1")
+	if got, _ := set.lookup(ip, nil); got != 0 {
+		t.Errorf("Expected the first listed prefix, got %d", got)
+	}
+	if got, _ := set.lookup(ip, func(i int) bool { return set.keys[i] == "10.0.0.0/24" }); got != 1 {
+		t.Errorf("Expected the skipped prefixes to be passed over, got %d", got)
+	}
+	set = newPrefixSet([]netip.Prefix{{}, netip.MustParsePrefix("10.0.0.0/8")})
+	if got, found := set.lookup(ip, nil); !found || got != 1 {
+		t.Errorf("Expected the invalid prefix never to match, got %d, %t", got, found)
+	}
+}
+
+func TestPrefixSetMatchesLinearScan(t *testing.T) {
+	cidrs := randomPrefixes(rand.New(rand.NewSource(1)), 400)
+	set := newPrefixSet(netipPrefixes(cidrs))
+	r := rand.New(rand.NewSource(2))
+	for n := 0; n < 20000; n++ {
+		ip := addrOf(randomAddress(r, cidrs))
+		want, wantFound := set.scan(ip, nil)
+		got, found := set.lookup(ip, nil)
+		if found != wantFound || got != want {
+			t.Fatalf("lookup(%s) = %d, %t, want %d, %t", ip, got, found, want, wantFound)
+		}
+	}
+}
+
+// TestPrefixSetMatchesIPNetContains checks lookup against the matcher it
+// replaced, net.IPNet.Contains over the list in order, for prefixes of
+// IPv4-mapped addresses and mismatched masks as converted by netipPrefix,
+// and for addresses in their 4-byte, 16-byte and IPv4-mapped forms.
+func TestPrefixSetMatchesIPNetContains(t *testing.T) {
+	random := randomPrefixes(rand.New(rand.NewSource(3)), 200)
+	cidrs := append(random,
+		net.IPNet{IP: net.ParseIP("::ffff:13.32.0.0"), Mask: net.CIDRMask(111, 128)},
+		net.IPNet{IP: net.ParseIP("13.34.0.0"), Mask: net.CIDRMask(16, 32)},
+		net.IPNet{IP: net.ParseIP("2600:9000::"), Mask: net.CIDRMask(16, 32)},
+	)
+	prefixes := make([]netip.Prefix, len(cidrs))
+	for i, cidr := range cidrs {
+		prefixes[i] = netipPrefix(cidr)
+	}
+	set := newPrefixSet(prefixes)
+	legacy := func(ip net.IP) (int, bool) {
+		for i, cidr := range cidrs {
+			if cidr.Contains(ip) {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	ips := []net.IP{net.ParseIP("13.33.0.1"), net.ParseIP("13.34.1.1"), net.ParseIP("2600:9000::1")}
+	r := rand.New(rand.NewSource(4))
+	for n := 0; n < 20000; n++ {
+		ips = append(ips, randomAddress(r, random))
+	}
+	for _, ip := range ips {
+		forms := []net.IP{ip, ip.To16()}
+		if v4 := ip.To4(); v4 != nil {
+			forms = append(forms, net.ParseIP("::ffff:"+v4.String()))
+		}
+		for _, form := range forms {
+			want, wantFound := legacy(form)
+			got, found := set.lookup(addrOf(form), nil)
+			if found != wantFound || (found && got != want) {
+				t.Fatalf("lookup(%s) = %d, %t, want %d, %t", form, got, found, want, wantFound)
+			}
+		}
+	}
+}
+
+// randomPrefixes returns n overlapping IPv4 and IPv6 prefixes.
+func randomPrefixes(r *rand.Rand, n int) []net.IPNet {
+	cidrs := make([]net.IPNet, 0, n)
+	for i := 0; i < n; i++ {
+		size, ones := net.IPv4len, 8+r.Intn(25)
+		if i%4 == 3 {
+			size, ones = net.IPv6len, 16+r.Intn(49)
+		}
+		ip := make(net.IP, size)
+		r.Read(ip)
+		ip[0] = byte(r.Intn(4))
+		mask := net.CIDRMask(ones, 8*size)
+		cidrs = append(cidrs, net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+	return cidrs
+}
+
+// randomAddress returns an address near one of cidrs, often at an edge.
+func randomAddress(r *rand.Rand, cidrs []net.IPNet) net.IP {
+	cidr := cidrs[r.Intn(len(cidrs))]
+	ip := append(net.IP(nil), cidr.IP...)
+	switch r.Intn(3) {
+	case 0:
+		for i := range ip {
+			ip[i] |= ^cidr.Mask[i]
+		}
+	case 1:
+		for i := range ip {
+			ip[i] |= byte(r.Intn(256)) &^ cidr.Mask[i]
+		}
+	}
+	// Step just past either edge now and then.
+	if r.Intn(4) == 0 {
+		last := len(ip) - 1
+		ip[last] += byte(1 - 2*r.Intn(2))
+	}
+	return ip
+}
+
+func BenchmarkContains(b *testing.B) {
+	for _, n := range []int{190, 800} {
+		cidrs := randomPrefixes(rand.New(rand.NewSource(1)), n)
+		set := newPrefixSet(netipPrefixes(cidrs))
+		r := rand.New(rand.NewSource(2))
+		addrs := make([]netip.Addr, 1024)
+		for i := range addrs {
+			addrs[i] = addrOf(randomAddress(r, cidrs))
+		}
+
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				set.scan(addrs[i%len(addrs)], nil)
+			}
+		})
+		b.Run(fmt.Sprintf("trie/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				set.lookup(addrs[i%len(addrs)], nil)
+			}
+		})
+	}
+}
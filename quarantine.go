@@ -0,0 +1,130 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// Quarantine policies for requests that only match quarantined prefixes.
+const (
+	quarantineDeny  = "deny"
+	quarantineLog   = "log"
+	quarantineAllow = "allow"
+)
+
+// validateQuarantinePolicy checks a quarantinePolicy value.
+func validateQuarantinePolicy(policy string) error {
+	switch policy {
+	case "", quarantineDeny, quarantineLog, quarantineAllow:
+		return nil
+	default:
+		return fmt.Errorf("invalid quarantinePolicy %q: must be %q, %q or %q",
+			policy, quarantineDeny, quarantineLog, quarantineAllow)
+	}
+}
+
+// quarantinedPrefix is a prefix that is not trusted before Until.
+type quarantinedPrefix struct {
+	prefix netip.Prefix
+	until  time.Time
+}
+
+// quarantinedStatus describes a quarantined prefix in the status.
+type quarantinedStatus struct {
+	Prefix string    `json:"prefix"`
+	Until  time.Time `json:"until"`
+}
+
+// updateQuarantine computes the quarantine for a dataset about to replace
+// the loaded one. Prefixes not covered by the loaded data enter quarantine;
+// prefixes that are already quarantined keep their deadline, and removed or
+// expired ones are dropped. The first dataset is trusted as a whole.
+// Callers must hold updateMu.
+func (ips *ipstore) updateQuarantine(cidrs []netip.Prefix, now time.Time) {
+	if ips.quarantine <= 0 {
+		return
+	}
+
+	previous, _ := ips.quarantined.Load().(map[string]quarantinedPrefix)
+	loaded := ips.fetchedPrefixes()
+	next := make(map[string]quarantinedPrefix)
+	if ips.version.Load() != 0 {
+		for _, cidr := range cidrs {
+			key := cidr.String()
+			if q, ok := previous[key]; ok {
+				if now.Before(q.until) {
+					next[key] = q
+				}
+				continue
+			}
+			if !coveredBy(cidr, loaded) {
+				next[key] = quarantinedPrefix{prefix: cidr, until: now.Add(ips.quarantine)}
+				ips.logs.infof("SECURITY: new prefix %s from %s is quarantined until %s",
+					key, ips.cfAPI, next[key].until.Format(time.RFC3339))
+			}
+		}
+	}
+	ips.quarantined.Store(next)
+}
+
+// fetchedPrefixes returns the loaded prefixes that were fetched rather than
+// trusted, which Update stores after the trusted IPs.
+func (ips *ipstore) fetchedPrefixes() []netip.Prefix {
+	cidrs := ips.prefixes()
+	fetched := int(ips.fetched.Load())
+	if fetched > len(cidrs) {
+		return cidrs
+	}
+	return cidrs[len(cidrs)-fetched:]
+}
+
+// coveredBy reports whether every address of prefix is in one of prefixes.
+func coveredBy(prefix netip.Prefix, prefixes []netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Bits() <= prefix.Bits() && p.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// isQuarantined reports whether prefix is quarantined at now.
+func (ips *ipstore) isQuarantined(prefix string, now time.Time) bool {
+	quarantined, _ := ips.quarantined.Load().(map[string]quarantinedPrefix)
+	q, ok := quarantined[prefix]
+	return ok && now.Before(q.until)
+}
+
+// matchQuarantined returns the source of a quarantined prefix containing
+// addr.
+func (ips *ipstore) matchQuarantined(addr netip.Addr, now time.Time) (trustSource, bool) {
+	quarantined, _ := ips.quarantined.Load().(map[string]quarantinedPrefix)
+	for key, q := range quarantined {
+		if now.Before(q.until) && q.prefix.Contains(addr) {
+			sources, _ := ips.sources.Load().(map[string]trustSource)
+			if source, ok := sources[key]; ok {
+				return source, true
+			}
+			return sourceCloudFrontGlobal, true
+		}
+	}
+	return 0, false
+}
+
+// quarantineStatus returns the quarantined prefixes, sorted.
+func (ips *ipstore) quarantineStatus(now time.Time) []quarantinedStatus {
+	quarantined, _ := ips.quarantined.Load().(map[string]quarantinedPrefix)
+	prefixes := make([]netip.Prefix, 0, len(quarantined))
+	for _, q := range quarantined {
+		if now.Before(q.until) {
+			prefixes = append(prefixes, q.prefix)
+		}
+	}
+
+	status := make([]quarantinedStatus, 0, len(prefixes))
+	for _, prefix := range sortedPrefixes(prefixes) {
+		status = append(status, quarantinedStatus{Prefix: prefix, Until: quarantined[prefix].until})
+	}
+	return status
+}
@@ -0,0 +1,134 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+const testGrownResponse = `{
+	"CLOUDFRONT_GLOBAL_IP_LIST": ["120.52.22.96/27", "205.251.249.0/24", "180.163.57.128/26", "13.32.0.0/15", "54.192.0.0/17", "54.192.128.0/17", "6.6.6.0/24"],
+	"CLOUDFRONT_REGIONAL_EDGE_IP_LIST": ["13.113.196.64/26", "13.113.203.0/24", "52.199.127.192/26"]
+}`
+
+func TestUpdateQuarantinesNewPrefixes(t *testing.T) {
+	response := testCFResponse
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ips := sourceConfig{URL: server.URL, AllowPrivate: true, Quarantine: time.Hour}.newStore()
+	ips.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	update := func() {
+		t.Helper()
+		if err := ips.Update(ctx); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+	}
+
+	// The first dataset is trusted as a whole.
+	update()
+	if got := ips.quarantineStatus(now); len(got) != 0 {
+		t.Fatalf("Expected no quarantine after the first update, got %v", got)
+	}
+
+	// A new prefix is quarantined; splitting a known prefix is not new.
+	response = testGrownResponse
+	update()
+	newIP := net.ParseIP("6.6.6.6")
+	if _, ok := ips.match(addrOf(newIP)); ok {
+		t.Errorf("Expected %s not to match while quarantined", newIP)
+	}
+	if _, ok := ips.matchQuarantined(addrOf(newIP), now); !ok {
+		t.Errorf("Expected %s to match a quarantined prefix", newIP)
+	}
+	if _, ok := ips.match(netip.MustParseAddr("54.192.200.1")); !ok {
+		t.Errorf("Expected a split known prefix to be trusted")
+	}
+	want := []quarantinedStatus{{Prefix: "6.6.6.0/24", Until: now.Add(time.Hour)}}
+	if got := ips.quarantineStatus(now); len(got) != 1 || got[0] != want[0] {
+		t.Fatalf("quarantineStatus() = %v, want %v", got, want)
+	}
+
+	// Refreshes within the window keep the original deadline.
+	now = now.Add(30 * time.Minute)
+	update()
+	if got := ips.quarantineStatus(now); len(got) != 1 || got[0] != want[0] {
+		t.Errorf("Expected the quarantine to survive a refresh, got %v", got)
+	}
+
+	// The quarantine expires on its own.
+	now = now.Add(31 * time.Minute)
+	if _, ok := ips.match(addrOf(newIP)); !ok {
+		t.Errorf("Expected %s to be trusted after the quarantine", newIP)
+	}
+
+	// Removals take effect immediately, and a prefix that reappears later
+	// is quarantined again.
+	response = testCFResponse
+	update()
+	if _, ok := ips.match(addrOf(newIP)); ok {
+		t.Errorf("Expected %s to be removed", newIP)
+	}
+	response = testGrownResponse
+	update()
+	if _, ok := ips.match(addrOf(newIP)); ok {
+		t.Errorf("Expected a reappearing prefix to be quarantined again")
+	}
+}
+
+func TestServeHTTPQuarantinePolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   int
+	}{
+		{policy: "", want: http.StatusForbidden},
+		{policy: quarantineDeny, want: http.StatusForbidden},
+		{policy: quarantineLog, want: http.StatusOK},
+		{policy: quarantineAllow, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			ips := newIPStore("")
+			ips.now = func() time.Time { return now }
+			ips.quarantine = time.Hour
+			prefixes, _ := parsePrefixes([]string{"6.6.6.0/24"})
+			ips.quarantined.Store(map[string]quarantinedPrefix{
+				"6.6.6.0/24": {prefix: prefixes[0], until: now.Add(time.Hour)},
+			})
+			ips.store(prefixes)
+			ips.fetched.Store(1)
+			ips.version.Store(1)
+
+			cf := &CloudFrontGate{
+				name: "test",
+				ips:  ips,
+				next: http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+					rw.WriteHeader(http.StatusOK)
+				}),
+				state:            &gateState{},
+				quarantinePolicy: tt.policy,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+			req.RemoteAddr = "6.6.6.6:1234"
+			rw := httptest.NewRecorder()
+			cf.ServeHTTP(rw, req)
+			if rw.Code != tt.want {
+				t.Errorf("Expected status %d, got %d", tt.want, rw.Code)
+			}
+			if tt.want == http.StatusForbidden && cf.state.deniedBy[denyQuarantined].Load() != 1 {
+				t.Errorf("Expected the denial to be counted as %s", denyQuarantined)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// refreshSummary is the response of the refresh path.
+type refreshSummary struct {
+	Prefixes   int    `json:"prefixes,omitempty"`
+	DurationMS int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Refresh updates the IP ranges of the instance now, including the Route 53
+// health check ranges when enabled, and rereads the allowedIPsFile. It
+// joins a refresh already in flight rather than fetching twice, and a
+// success restarts the wait of the refresh loop.
+func (cf *CloudFrontGate) Refresh(ctx context.Context) error {
+	if err := refreshEntry(ctx, cf.entry, cf.ips); err != nil {
+		return err
+	}
+	if cf.healthChecks != nil {
+		if err := refreshEntry(ctx, cf.healthEntry, cf.healthChecks); err != nil {
+			return fmt.Errorf("failed to update Route 53 health check ranges: %w", err)
+		}
+	}
+	if cf.allowedIPsFile != nil {
+		if err := cf.allowedIPsFile.reload(); err != nil && !cf.allowedIPsFile.missing(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshEntry refreshes entry, or only ips for an instance built without
+// the registry.
+func refreshEntry(ctx context.Context, entry *registryEntry, ips *ipstore) error {
+	if entry == nil {
+		return ips.Update(ctx)
+	}
+	if err := entry.refresh(ctx); err != nil {
+		return err
+	}
+	entry.rearm()
+	return nil
+}
+
+// serveRefreshPath refreshes the IP ranges on a POST and writes a summary:
+// 202 with the prefix count and duration, or 502 with the error. Other
+// methods do not refresh.
+func (cf *CloudFrontGate) serveRefreshPath(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethod(rw, req, http.MethodPost) {
+		return
+	}
+
+	start := time.Now()
+	err := cf.Refresh(req.Context())
+	summary := refreshSummary{DurationMS: time.Since(start).Milliseconds()}
+	status := http.StatusAccepted
+	if err != nil {
+		summary.Error = err.Error()
+		status = http.StatusBadGateway
+	} else {
+		summary.Prefixes = len(cf.ips.prefixes())
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(summary)
+}
@@ -0,0 +1,128 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSource serves testCFResponse, or 503 while failing is set, and
+// counts the requests.
+func countingSource(t *testing.T) (server *httptest.Server, requests, failing *atomic.Int32) {
+	t.Helper()
+
+	requests, failing = &atomic.Int32{}, &atomic.Int32{}
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		if failing.Load() != 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	t.Cleanup(server.Close)
+	return server, requests, failing
+}
+
+func TestRefreshPath(t *testing.T) {
+	server, requests, failing := countingSource(t)
+	cfg := CreateConfig()
+	cfg.IPListURL = server.URL
+	cfg.AllowPrivateSources = true
+	cfg.AllowedIPs = []string{"198.51.100.0/24"}
+	cfg.RefreshPath = "/_cloudfrontgate/refresh"
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		t.Error("Expected the refresh path not to be forwarded")
+	})
+	handler, err := New(context.Background(), next, cfg, t.Name())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	serve := func(method, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com/_cloudfrontgate/refresh", nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := serve(http.MethodGet, "198.51.100.7:1234"); rw.Code != http.StatusMethodNotAllowed || rw.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("Expected GET to be refused with 405, got %d", rw.Code)
+	}
+	if rw := serve(http.MethodPost, "205.251.249.10:1234"); rw.Code != http.StatusForbidden {
+		t.Errorf("Expected a CloudFront peer to be denied, got %d", rw.Code)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Fatalf("Expected only the initial fetch so far, got %d", got)
+	}
+
+	rw := serve(http.MethodPost, "198.51.100.7:1234")
+	var summary refreshSummary
+	if err := json.Unmarshal(rw.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Code != http.StatusAccepted || summary.Prefixes != 8 || summary.Error != "" {
+		t.Errorf("Expected 202 with 8 prefixes, got %d %+v", rw.Code, summary)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("Expected the POST to fetch, got %d requests", got)
+	}
+
+	failing.Store(1)
+	rw = serve(http.MethodPost, "198.51.100.7:1234")
+	summary = refreshSummary{}
+	_ = json.Unmarshal(rw.Body.Bytes(), &summary)
+	if rw.Code != http.StatusBadGateway || summary.Error == "" {
+		t.Errorf("Expected 502 with the error, got %d %+v", rw.Code, summary)
+	}
+	if cf.Status().ConsecutiveFailures != 1 {
+		t.Errorf("Expected the failed refresh to be recorded, got %+v", cf.Status())
+	}
+}
+
+func TestRefreshRearmsLoop(t *testing.T) {
+	server, requests, _ := countingSource(t)
+	src := sourceConfig{URL: server.URL, RefreshInterval: time.Second, AllowPrivate: true}
+	entry := &registryEntry{source: src, ips: src.newStore(), wake: make(chan struct{}, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		entry.refreshLoop(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The loop would fire between 0.9s and 1s; the manual refresh at 0.6s
+	// pushes it past 1.5s.
+	time.Sleep(600 * time.Millisecond)
+	cf := &CloudFrontGate{ips: entry.ips, entry: entry}
+	if err := cf.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	time.Sleep(700 * time.Millisecond)
+	if got := requests.Load(); got != 1 {
+		t.Errorf("Expected the scheduled refresh to be postponed, got %d requests", got)
+	}
+	waitFor(t, "the next scheduled refresh", func() bool { return requests.Load() == 2 })
+}
+
+func TestNewRejectsInvalidRefreshPath(t *testing.T) {
+	for _, path := range []string{"refresh", "/status"} {
+		cfg := CreateConfig()
+		cfg.StatusPath = "/status"
+		cfg.RefreshPath = path
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name()); err == nil {
+			t.Errorf("Expected refreshPath %q to be rejected", path)
+		}
+	}
+}
@@ -0,0 +1,636 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Released entries that hold data are retained for retainReleasedFor, so
+// that a reconstruction during an outage can adopt them, but at most
+// maxRetainedEntries of them at a time, the most recently released first.
+const (
+	retainReleasedFor  = 24 * time.Hour
+	maxRetainedEntries = 4
+)
+
+// releaseTimeout bounds how long the last release of an entry waits for its
+// refresh loop and the update in flight.
+const releaseTimeout = 5 * time.Second
+
+// staleRetryInterval is how often a source whose data could not be refreshed
+// at construction time is retried in the background, unless the source sets
+// its own retry interval.
+const staleRetryInterval = 30 * time.Second
+
+// sourceConfig describes where an IP range dataset comes from. Instances
+// whose source configuration is identical share a single store.
+type sourceConfig struct {
+	URL             string        `json:"url"`
+	RefreshInterval time.Duration `json:"refreshInterval"`
+	// RetryInterval replaces staleRetryInterval when set.
+	RetryInterval time.Duration `json:"retryInterval,omitempty"`
+	// Anchors holds canonical CIDRs that every fetched dataset must cover.
+	Anchors []string `json:"anchors,omitempty"`
+	// Integrity configures sidecar verification of the document.
+	Integrity integrityConfig `json:"integrity"`
+	// Pins lists acceptable SPKI SHA-256 fingerprints of the server.
+	Pins []string `json:"pins,omitempty"`
+	// AllowPrivate permits custom sources on non-public addresses.
+	AllowPrivate bool `json:"allowPrivate,omitempty"`
+	// MaxRedirects and SameHostRedirects restrict followed redirects.
+	MaxRedirects      int  `json:"maxRedirects"`
+	SameHostRedirects bool `json:"sameHostRedirects,omitempty"`
+	// ResolveOverrides maps lower-case host names to "ip:port" addresses.
+	ResolveOverrides map[string][]string `json:"resolveOverrides,omitempty"`
+	// SigV4 signs the requests to the source host.
+	SigV4 *sigV4Credentials `json:"sigV4,omitempty"`
+	// Service selects a service of an AWS ip-ranges.json document.
+	Service string `json:"service,omitempty"`
+	// Regions restricts an ip-ranges.json document to these regions.
+	Regions []string `json:"regions,omitempty"`
+	// IPLists restricts the CloudFront prefixes to these lists.
+	IPLists []string `json:"ipLists,omitempty"`
+	// Aggregate merges sibling prefixes of the same list.
+	Aggregate bool `json:"aggregate,omitempty"`
+	// DetectFormat parses ip-ranges.json documents when Service is empty.
+	DetectFormat bool `json:"detectFormat,omitempty"`
+	// Shadow is compared with the source after every update.
+	Shadow *shadowSource `json:"shadow,omitempty"`
+	// MaxShrinkPercent rejects updates that drop more of the prefixes.
+	MaxShrinkPercent int `json:"maxShrinkPercent,omitempty"`
+	// Quarantine delays trusting prefixes that newly appear.
+	Quarantine time.Duration `json:"quarantine,omitempty"`
+	// HTTPTimeout replaces the default timeout of each fetch when set.
+	HTTPTimeout time.Duration `json:"httpTimeout,omitempty"`
+	// ProxyURL replaces the proxy of the environment; CABundle holds PEM
+	// roots replacing the system ones; InsecureSkipVerify disables the
+	// verification of the server certificate.
+	ProxyURL           string `json:"proxyURL,omitempty"`
+	CABundle           string `json:"caBundle,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+	// HTTPClient is the client of WithHTTPClient, and ClientID tells the
+	// stores of different clients apart.
+	HTTPClient *http.Client `json:"-"`
+	ClientID   string       `json:"clientID,omitempty"`
+	// CacheFile persists the data, loaded when a construction cannot fetch.
+	CacheFile   string        `json:"cacheFile,omitempty"`
+	CacheMaxAge time.Duration `json:"cacheMaxAge,omitempty"`
+	// Extra lists additional sources merged into the data; PartialOK
+	// keeps the previous list of a failed one.
+	Extra     []extraSource `json:"extra,omitempty"`
+	PartialOK bool          `json:"partialOK,omitempty"`
+}
+
+// custom reports whether any URL of the source was configured by the
+// operator rather than being the built-in default.
+func (s sourceConfig) custom() bool {
+	return (s.URL != ipListURL && s.URL != awsIPRangesURL) || s.Integrity.ChecksumURL != "" || s.Integrity.SignatureURL != "" ||
+		len(s.ResolveOverrides) > 0 || len(s.Extra) > 0
+}
+
+// setHTTPClient makes the source fetch with client, when not nil.
+func (s *sourceConfig) setHTTPClient(client *http.Client) {
+	if client == nil {
+		return
+	}
+	s.HTTPClient = client
+	s.ClientID = fmt.Sprintf("%p", client)
+}
+
+// key returns a canonical hash of the source configuration.
+func (s sourceConfig) key() string {
+	// Marshalling a struct is deterministic (fields in declaration order).
+	raw, err := json.Marshal(s)
+	if err != nil {
+		raw = []byte(s.URL)
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// newStore creates an empty store for the source.
+func (s sourceConfig) newStore() *ipstore {
+	ips := newIPStore(s.URL)
+	// The anchors are canonical CIDRs validated by New, so parsing cannot fail.
+	ips.anchors, _ = parsePrefixes(s.Anchors)
+	ips.integrity = s.Integrity
+	// The pins are validated by New as well.
+	ips.pins, _ = parsePins(s.Pins)
+	ips.guardPrivate = s.custom() && !s.AllowPrivate
+	ips.maxRedirects = s.MaxRedirects
+	ips.sameHostRedirects = s.SameHostRedirects
+	ips.resolveOverrides = s.ResolveOverrides
+	ips.awsService = s.Service
+	ips.awsRegions = s.Regions
+	ips.ipLists = s.IPLists
+	ips.aggregate = s.Aggregate
+	ips.detectFormat = s.DetectFormat
+	ips.sigV4 = s.SigV4
+	ips.maxShrinkPercent = s.MaxShrinkPercent
+	ips.quarantine = s.Quarantine
+	if s.HTTPTimeout > 0 {
+		ips.httpTimeout = s.HTTPTimeout
+	}
+	// The proxy URL and the bundle are validated by New too.
+	if s.ProxyURL != "" {
+		ips.proxyURL, _ = parseProxyURL(s.ProxyURL)
+	}
+	if s.CABundle != "" {
+		ips.rootCAs = x509.NewCertPool()
+		ips.rootCAs.AppendCertsFromPEM([]byte(s.CABundle))
+	}
+	ips.insecureSkipVerify = s.InsecureSkipVerify
+	ips.httpClient = s.HTTPClient
+	ips.cacheFile = s.CacheFile
+	ips.cacheMaxAge = s.CacheMaxAge
+	ips.extra = s.Extra
+	ips.partialOK = s.PartialOK
+	ips.lastExtra = make([][]netip.Prefix, len(s.Extra))
+	ips.logs = &sourceLogger{}
+
+	if s.Shadow != nil {
+		shadow := sourceConfig{
+			URL:                s.Shadow.URL,
+			Service:            s.Shadow.Service,
+			IPLists:            s.IPLists,
+			AllowPrivate:       s.AllowPrivate,
+			MaxRedirects:       s.MaxRedirects,
+			SameHostRedirects:  s.SameHostRedirects,
+			ResolveOverrides:   s.ResolveOverrides,
+			HTTPTimeout:        s.HTTPTimeout,
+			ProxyURL:           s.ProxyURL,
+			CABundle:           s.CABundle,
+			InsecureSkipVerify: s.InsecureSkipVerify,
+		}
+		shadow.setHTTPClient(s.HTTPClient)
+		ips.shadow = shadow.newStore()
+		ips.shadow.logs = ips.logs
+	}
+	return ips
+}
+
+// registry shares stores between plugin instances with the same source
+// configuration, so that many routers cost one copy of the prefix data.
+type registry struct {
+	mu      sync.Mutex
+	entries map[string]*registryEntry
+	states  map[instanceName]*stateEntry
+
+	// generation is bumped by every construction; instances holds the
+	// latest construction of each name.
+	generation uint64
+	instances  map[instanceName]*instanceRef
+}
+
+// instanceName identifies a middleware, or a Checker, in the registry:
+// the two are named apart, so that neither supersedes the other.
+type instanceName struct {
+	name    string
+	checker bool
+}
+
+// instanceRef is the construction of a named middleware that holds
+// references on shared entries.
+type instanceRef struct {
+	generation uint64
+	release    func()
+}
+
+// stateEntry is the runtime state of a named middleware together with the
+// key of the source and client address strategy it was built for.
+type stateEntry struct {
+	key   string
+	state *gateState
+}
+
+// registryEntry is a reference counted store shared by plugin instances. It
+// owns the single refresh loop for its source. Entries that were populated
+// once are retained for a while after their last release, so that a later
+// construction can fall back to their data when the source is unreachable.
+type registryEntry struct {
+	key    string
+	source sourceConfig
+	ips    *ipstore
+
+	refs int
+	// releasedAt is when the last reference was dropped.
+	releasedAt time.Time
+
+	// stale is set while the entry serves data that a construction failed
+	// to refresh; the loop then retries at the source's retry interval.
+	stale atomic.Bool
+	wake  chan struct{}
+	// immediate makes the loop refresh right away until it does, for the
+	// first fetch of an asynchronous startup.
+	immediate atomic.Bool
+	// failures counts the refreshes failed since the last success;
+	// lastErr holds the message of the last failure, and lastErrKind its
+	// errorKind.
+	failures    atomic.Int64
+	lastErr     atomic.Value
+	lastErrKind atomic.Value
+	// retryAfter is the Retry-After of the last failure, in nanoseconds,
+	// which replaces the backoff of the next retry.
+	retryAfter atomic.Int64
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+var sharedRegistry = newRegistry()
+
+func newRegistry() *registry {
+	return &registry{
+		entries:   make(map[string]*registryEntry),
+		states:    make(map[instanceName]*stateEntry),
+		instances: make(map[instanceName]*instanceRef),
+	}
+}
+
+// acquire returns the entry for src, creating it if needed, and takes a
+// reference on it. The first reference starts the refresh loop and is
+// reported by fresh, meaning the caller should refresh the entry's data.
+// Every acquire must be paired with a release.
+func (r *registry) acquire(src sourceConfig) (entry *registryEntry, fresh bool) {
+	key := src.key()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pruneLocked(time.Now())
+	entry, ok := r.entries[key]
+	if !ok {
+		entry = &registryEntry{
+			key:    key,
+			source: src,
+			ips:    src.newStore(),
+			wake:   make(chan struct{}, 1),
+		}
+		r.entries[key] = entry
+	}
+	entry.refs++
+
+	if entry.refs == 1 && entry.source.RefreshInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		entry.cancel = cancel
+		entry.done = make(chan struct{})
+
+		go func(done chan struct{}) {
+			defer close(done)
+			entry.refreshLoop(ctx)
+		}(entry.done)
+	}
+	return entry, entry.refs == 1
+}
+
+// defaultStartupTimeout bounds the first fetch of a construction.
+const defaultStartupTimeout = 10 * time.Second
+
+// startupPolicy is how a construction obtains the first data of a source.
+type startupPolicy struct {
+	// failOpen keeps an entry whose first fetch failed, without data.
+	failOpen bool
+	// timeout bounds the first fetch; zero leaves it to the fetches.
+	timeout time.Duration
+	// async skips the first fetch: the cache file, when valid, is loaded
+	// and the refresh loop fetches right away in the background.
+	async bool
+}
+
+// acquireEntry acquires the shared entry for src and makes sure it holds
+// data. Only a first-ever construction fails when the source cannot be
+// fetched within the startup timeout, unless failOpen keeps the empty
+// entry; otherwise the data a previous instance fetched is kept, retried in
+// the background and reported through inherited. The source logs to logger,
+// among the loggers of its other holders, until releaseEntry.
+func acquireEntry(ctx context.Context, src sourceConfig, what string, startup startupPolicy, logger *gateLogger) (entry *registryEntry, inherited bool, err error) {
+	entry, fresh := sharedRegistry.acquire(src)
+	entry.ips.logs.hold(logger)
+	if !fresh && entry.ips.version.Load() != 0 {
+		return entry, false, nil
+	}
+	// Without a refresh loop, as in some tests, nothing would fetch later.
+	if startup.async && src.RefreshInterval > 0 {
+		return entry, entry.startAsync(what, logger), nil
+	}
+
+	if startup.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, startup.timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	if err := entry.ips.Update(ctx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil {
+			err = fmt.Errorf("startupTimeout of %s exceeded: %w", startup.timeout, err)
+		}
+		entry.recordFailure(err)
+		if entry.ips.version.Load() == 0 && entry.ips.cacheFile != "" {
+			if cacheErr := entry.ips.loadCache(time.Now()); cacheErr != nil {
+				logger.errorf("Failed to update %s, ignoring the cache file %s: %v", what, entry.ips.cacheFile, cacheErr)
+			} else {
+				logger.errorf("Failed to update %s, using the cache file %s: %v", what, entry.ips.cacheFile, err)
+				entry.markStale()
+				return entry, true, nil
+			}
+		}
+		if entry.ips.version.Load() == 0 {
+			if startup.failOpen {
+				logger.errorf("Failed to update %s, admitting all requests until a fetch succeeds: %v", what, err)
+				entry.markStale()
+				return entry, false, nil
+			}
+			if ctx.Err() != nil {
+				// The fetch outlives the timeout, and the release would
+				// wait for it to land.
+				go func(entry *registryEntry) { _ = releaseEntry(entry, logger) }(entry)
+			} else {
+				_ = releaseEntry(entry, logger)
+			}
+			return nil, false, fmt.Errorf("failed to update %s: %w", what, err)
+		}
+		logger.errorf("Failed to update %s, using previously fetched data: %v", what, err)
+		entry.markStale()
+		return entry, true, nil
+	}
+	entry.failures.Store(0)
+	entry.logRefreshed(what, time.Since(start))
+	return entry, false, nil
+}
+
+// startAsync prepares entry for an asynchronous startup: the cache file,
+// when set and valid, is loaded first, and the refresh loop is woken to
+// fetch the source right away. It reports whether the cache was loaded.
+func (e *registryEntry) startAsync(what string, logger *gateLogger) (cached bool) {
+	if e.ips.version.Load() == 0 && e.ips.cacheFile != "" {
+		if err := e.ips.loadCache(time.Now()); err != nil {
+			logger.errorf("Ignoring the cache file %s of %s: %v", e.ips.cacheFile, what, err)
+		} else {
+			logger.infof("Using the cache file %s for %s until the first fetch", e.ips.cacheFile, what)
+			cached = true
+		}
+	}
+	logger.infof("Fetching %s in the background", what)
+	e.immediate.Store(true)
+	e.markStale()
+	return cached
+}
+
+// release drops a reference on entry. The last reference stops the refresh
+// loop and waits, at most releaseTimeout, for it to exit and for the update
+// in flight to land, so that no goroutine of the entry survives; an error
+// reports that they did not in time. Entries that never held data are
+// forgotten.
+func (r *registry) release(entry *registryEntry) error {
+	r.mu.Lock()
+	entry.refs--
+	if entry.refs > 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	entry.releasedAt = time.Now()
+	if entry.ips.version.Load() == 0 {
+		delete(r.entries, entry.key)
+	}
+	r.pruneLocked(entry.releasedAt)
+
+	cancel, done := entry.cancel, entry.done
+	entry.cancel, entry.done = nil, nil
+	r.mu.Unlock()
+
+	var err error
+	timer := time.NewTimer(releaseTimeout)
+	defer timer.Stop()
+	if cancel != nil {
+		cancel()
+		select {
+		case <-done:
+		case <-timer.C:
+			err = fmt.Errorf("refresh loop of %s did not exit within %s", entry.source.URL, releaseTimeout)
+		}
+	}
+	// An update outlives the cancellation of the loop that started it.
+	if err == nil && !entry.ips.flight.wait(releaseTimeout) {
+		err = fmt.Errorf("update of %s did not finish within %s", entry.source.URL, releaseTimeout)
+	}
+	entry.ips.closeIdleConnections()
+	return err
+}
+
+// releaseEntry releases an entry of acquireEntry, whose source stops
+// logging to logger.
+func releaseEntry(entry *registryEntry, logger *gateLogger) error {
+	entry.ips.logs.drop(logger)
+	return sharedRegistry.release(entry)
+}
+
+// pruneLocked forgets released entries retained for longer than
+// retainReleasedFor, and the oldest ones beyond maxRetainedEntries.
+func (r *registry) pruneLocked(now time.Time) {
+	var retained []*registryEntry
+	for key, entry := range r.entries {
+		if entry.refs > 0 {
+			continue
+		}
+		if now.Sub(entry.releasedAt) > retainReleasedFor {
+			delete(r.entries, key)
+			continue
+		}
+		retained = append(retained, entry)
+	}
+	if len(retained) <= maxRetainedEntries {
+		return
+	}
+
+	sort.Slice(retained, func(i, j int) bool { return retained[i].releasedAt.After(retained[j].releasedAt) })
+	for _, entry := range retained[maxRetainedEntries:] {
+		delete(r.entries, entry.key)
+	}
+}
+
+// state returns the runtime state of the middleware called name. The state
+// of a previous instance is reused when it was built for the same key, that
+// of stateKey; otherwise a new state replaces it.
+func (r *registry) state(name instanceName, key string) (state *gateState, reused bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if prev, ok := r.states[name]; ok && prev.key == key {
+		return prev.state, true
+	}
+
+	state = &gateState{}
+	r.states[name] = &stateEntry{key: key, state: state}
+	return state, false
+}
+
+// stateKey returns the key of the runtime state of an instance checking
+// the addresses strategy selects against src: counters of another source,
+// or of other addresses, would not carry over.
+func stateKey(src sourceConfig, strategy *ipStrategy) string {
+	return src.key() + "/" + strategy.key()
+}
+
+// register records a construction of the middleware called name and returns
+// its generation. Traefik never closes the instance a reload replaces, so
+// the previous construction of the name is treated as dead and release,
+// which closes it, is called for it: its watchers, sinks and references
+// go, which stops the refresh loops of sources no longer configured. Routers built together from the same
+// configuration share its sources, so their entries stay referenced by the
+// latest construction.
+func (r *registry) register(name instanceName, release func()) uint64 {
+	r.mu.Lock()
+	r.generation++
+	generation := r.generation
+	prev := r.instances[name]
+	r.instances[name] = &instanceRef{generation: generation, release: release}
+	r.mu.Unlock()
+
+	if prev != nil {
+		prev.release()
+	}
+	return generation
+}
+
+// unregister forgets the construction of name with generation, unless a
+// later one replaced it, and then the runtime state of name as well.
+func (r *registry) unregister(name instanceName, generation uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if ref, ok := r.instances[name]; ok && ref.generation == generation {
+		delete(r.instances, name)
+		delete(r.states, name)
+	}
+}
+
+// size returns the number of referenced entries.
+func (r *registry) size() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, entry := range r.entries {
+		if entry.refs > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// markStale flags the entry as serving data that could not be refreshed and
+// reschedules the refresh loop to retry soon.
+func (e *registryEntry) markStale() {
+	e.stale.Store(true)
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// recordFailure counts a failed refresh and returns the failures in a row.
+func (e *registryEntry) recordFailure(err error) int {
+	e.lastErr.Store(err.Error())
+	e.lastErrKind.Store(errorKind(err))
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		e.retryAfter.Store(int64(statusErr.RetryAfter))
+	} else {
+		e.retryAfter.Store(0)
+	}
+	return int(e.failures.Add(1))
+}
+
+// refreshLoop periodically updates the IP ranges. Failed refreshes are
+// retried with an exponential backoff until one succeeds.
+func (e *registryEntry) refreshLoop(ctx context.Context) {
+	for {
+		wait := jitter(e.source.RefreshInterval)
+		if retry := e.retryWait(); e.stale.Load() && retry < wait {
+			wait = retry
+		}
+		if e.immediate.Load() {
+			wait = 0
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+
+		case <-e.wake:
+			timer.Stop()
+			continue
+
+		case <-timer.C:
+			e.immediate.Store(false)
+			_ = e.refresh(ctx)
+		}
+	}
+}
+
+// refresh updates the IP ranges once and records the outcome. Concurrent
+// refreshes share the fetch of the first one.
+func (e *registryEntry) refresh(ctx context.Context) error {
+	start := time.Now()
+	if err := e.ips.Update(ctx); err != nil {
+		e.recordFailure(err)
+		var statusErr *StatusError
+		switch {
+		case errors.As(err, &statusErr) && statusErr.permanent():
+			e.log().errorf("Failed to update IP ranges from %s, which answered %s: retrying is unlikely to help, check the source URL and its credentials: %v",
+				e.source.URL, statusErr.Status, err)
+		case errors.Is(err, ErrListRejected):
+			e.log().errorf("Rejected IP ranges from %s, keeping the previous data and retrying in about %s: %v", e.source.URL, e.retryWait(), err)
+		default:
+			e.log().errorf("Failed to update IP ranges from %s, retrying in about %s: %v", e.source.URL, e.retryWait(), err)
+		}
+		e.stale.Store(true)
+		return err
+	}
+	e.failures.Store(0)
+	e.retryAfter.Store(0)
+	e.stale.Store(false)
+	e.logRefreshed("IP ranges from "+e.source.URL, time.Since(start))
+	return nil
+}
+
+// retryWait returns how long the loop waits before retrying a failed
+// refresh: the Retry-After of the last failure when the source sent one,
+// otherwise the jittered backoff.
+func (e *registryEntry) retryWait() time.Duration {
+	if retryAfter := time.Duration(e.retryAfter.Load()); retryAfter > 0 {
+		return retryAfter
+	}
+	return jitter(e.source.retryBackoff(int(e.failures.Load())))
+}
+
+// rearm restarts the wait of the refresh loop, so that a manual refresh is
+// not followed by a scheduled one soon after.
+func (e *registryEntry) rearm() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// log returns the logger of the entry.
+func (e *registryEntry) log() *sourceLogger {
+	return e.ips.logs
+}
+
+// logRefreshed logs a successful refresh at debug level.
+func (e *registryEntry) logRefreshed(what string, took time.Duration) {
+	e.log().debugf("Updated %s: %d prefixes fetched in %s", what, e.ips.fetched.Load(), took.Round(time.Millisecond))
+}
@@ -0,0 +1,657 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSourceConfigKey(t *testing.T) {
+	a := sourceConfig{URL: "https://example.com/a"}
+	b := sourceConfig{URL: "https://example.com/b"}
+
+	if a.key() != (sourceConfig{URL: "https://example.com/a"}).key() {
+		t.Errorf("Expected identical sources to produce the same key")
+	}
+	if a.key() == b.key() {
+		t.Errorf("Expected different sources to produce different keys")
+	}
+}
+
+func TestRegistryAcquireRelease(t *testing.T) {
+	r := newRegistry()
+	src := sourceConfig{URL: "https://example.com/ranges"}
+
+	first, fresh := r.acquire(src)
+	if !fresh {
+		t.Errorf("Expected the first reference to be fresh")
+	}
+	second, fresh := r.acquire(src)
+	if first != second {
+		t.Fatalf("Expected the same entry for identical sources")
+	}
+	if fresh {
+		t.Errorf("Expected the second reference not to be fresh")
+	}
+	if r.size() != 1 {
+		t.Fatalf("Expected 1 entry, got %d", r.size())
+	}
+
+	other, _ := r.acquire(sourceConfig{URL: "https://example.com/other"})
+	if other == first {
+		t.Fatalf("Expected a separate entry for a different source")
+	}
+
+	r.release(first)
+	if r.size() != 2 {
+		t.Fatalf("Expected entry to survive while referenced, got %d entries", r.size())
+	}
+	r.release(second)
+	r.release(other)
+	if r.size() != 0 {
+		t.Fatalf("Expected all entries released, got %d", r.size())
+	}
+}
+
+func TestRegistryRetainsReleasedEntries(t *testing.T) {
+	r := newRegistry()
+
+	var entries []*registryEntry
+	for i := range maxRetainedEntries + 2 {
+		entry, _ := r.acquire(sourceConfig{URL: fmt.Sprintf("https://example.com/%d", i)})
+		entry.ips.version.Add(1)
+		entries = append(entries, entry)
+	}
+	for _, entry := range entries {
+		r.release(entry)
+	}
+	if got := len(r.entries); got != maxRetainedEntries {
+		t.Fatalf("Expected %d retained entries, got %d", maxRetainedEntries, got)
+	}
+	for _, entry := range entries[:2] {
+		if _, ok := r.entries[entry.key]; ok {
+			t.Errorf("Expected the oldest released entries to be forgotten")
+		}
+	}
+
+	// Entries released longer ago than the retention are forgotten.
+	for _, entry := range r.entries {
+		entry.releasedAt = time.Now().Add(-retainReleasedFor - time.Minute)
+	}
+	_, _ = r.acquire(sourceConfig{URL: "https://example.com/new"})
+	if got := len(r.entries); got != 1 {
+		t.Errorf("Expected expired entries to be forgotten, got %d entries", got)
+	}
+}
+
+func TestNewSharesStore(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	var gates []*CloudFrontGate
+	for i, allowed := range [][]string{{"192.168.1.0/24"}, {"10.0.0.0/8"}, nil} {
+		cfg := CreateConfig()
+		cfg.AllowedIPs = allowed
+
+		handler, err := NewWithOptions(context.Background(), next, cfg, "test", withFixture())
+		if err != nil {
+			t.Fatalf("New() #%d error = %v", i, err)
+		}
+		cf, ok := handler.(*CloudFrontGate)
+		if !ok {
+			t.Fatalf("New() = %T", handler)
+		}
+		gates = append(gates, cf)
+	}
+	defer func() {
+		for _, cf := range gates {
+			_ = cf.Close()
+		}
+		if sharedRegistry.size() != 0 {
+			t.Errorf("Expected registry to be empty after Close, got %d entries", sharedRegistry.size())
+		}
+	}()
+
+	first := gates[0].ips.prefixes()
+	if len(first) == 0 {
+		t.Fatalf("Expected a populated store")
+	}
+	for i, cf := range gates[1:] {
+		if cf.ips != gates[0].ips {
+			t.Fatalf("Instance %d does not share the store", i+1)
+		}
+		cidrs := cf.ips.prefixes()
+		if &cidrs[0] != &first[0] {
+			t.Errorf("Instance %d holds its own copy of the prefixes", i+1)
+		}
+	}
+	if len(first) != 8 {
+		t.Errorf("Expected trusted IPs to stay out of the shared store, got %d prefixes", len(first))
+	}
+
+	// Trusted entries apply only to the instance that configured them.
+	ip := net.ParseIP("192.168.1.10")
+	if !gates[0].allowed(ip) {
+		t.Errorf("Expected %s to be allowed by the first instance", ip)
+	}
+	if gates[1].allowed(ip) || gates[2].allowed(ip) {
+		t.Errorf("Expected %s to be denied by the other instances", ip)
+	}
+}
+
+func TestCloseIsIdempotent(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	a, err := NewWithOptions(context.Background(), next, CreateConfig(), "a", withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	b, err := NewWithOptions(context.Background(), next, CreateConfig(), "b", withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	cfA, _ := a.(*CloudFrontGate)
+	cfB, _ := b.(*CloudFrontGate)
+
+	_ = cfA.Close()
+	_ = cfA.Close()
+	if sharedRegistry.size() != 1 {
+		t.Fatalf("Expected double Close to release a single reference, got %d entries", sharedRegistry.size())
+	}
+	_ = cfB.Close()
+	if sharedRegistry.size() != 0 {
+		t.Fatalf("Expected registry to be empty, got %d entries", sharedRegistry.size())
+	}
+}
+
+func TestRefreshLoopPerKey(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	baseline := settledGoroutines()
+
+	cfg := CreateConfig()
+	cfg.RefreshInterval = "1h"
+
+	var gates []*CloudFrontGate
+	for range 5 {
+		handler, err := NewWithOptions(context.Background(), next, cfg, "test", withFixture())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		gates = append(gates, cf)
+	}
+	if got := settledGoroutines() - baseline; got != 1 {
+		t.Errorf("Expected exactly one refresh loop for five instances, got %d goroutines", got)
+	}
+	for _, cf := range gates {
+		_ = cf.Close()
+	}
+	waitForGoroutines(t, baseline)
+}
+
+func TestRefreshLoopStopsAfterClose(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	baseline := settledGoroutines()
+
+	for i := range 50 {
+		handler, err := NewWithOptions(context.Background(), next, CreateConfig(), "test", withFixture())
+		if err != nil {
+			t.Fatalf("New() #%d error = %v", i, err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		_ = cf.Close()
+	}
+
+	waitForGoroutines(t, baseline)
+	if sharedRegistry.size() != 0 {
+		t.Errorf("Expected registry to be empty, got %d entries", sharedRegistry.size())
+	}
+}
+
+func TestNewSupersedesPreviousConstruction(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	// Every feature with a goroutine or a handle of its own is enabled.
+	dir := t.TempDir()
+	denylist := filepath.Join(dir, "denylist.txt")
+	allowlist := filepath.Join(dir, "allowlist.txt")
+	for _, path := range []string{denylist, allowlist} {
+		if err := os.WriteFile(path, []byte("198.51.100.0/24\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "audit"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	useResolver(t, &stubResolver{addrs: map[string][]string{"office.example.net": {"203.0.113.9"}}})
+	statsd, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer statsd.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer mirror.Close()
+	build := func(i int) *CloudFrontGate {
+		t.Helper()
+		cfg := CreateConfig()
+		cfg.RefreshInterval = fmt.Sprintf("%dh", i+1)
+		cfg.AllowedIPs = []string{"office.example.net"}
+		cfg.AllowedIPsFile = allowlist
+		cfg.DenylistFile = denylist
+		cfg.AuditDir = filepath.Join(dir, "audit")
+		cfg.DecisionLogFile = filepath.Join(dir, "decisions.log")
+		cfg.Fail2banLog = filepath.Join(dir, "fail2ban.log")
+		cfg.DenialMirror = &DenialMirrorConfig{URL: mirror.URL}
+		cfg.StatsD = &StatsDConfig{Address: statsd.LocalAddr().String()}
+		handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+		if err != nil {
+			t.Fatalf("New() #%d error = %v", i, err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		return cf
+	}
+
+	baseline := settledGoroutines()
+	last := build(0)
+	perConstruction := settledGoroutines() - baseline
+
+	// Every reload changes the source, and Traefik never closes the
+	// instances it replaces.
+	for i := 1; i < 50; i++ {
+		last = build(i)
+	}
+	if got := settledGoroutines() - baseline; got != perConstruction {
+		t.Errorf("Expected only the latest construction's %d goroutines, got %d", perConstruction, got)
+	}
+	if sharedRegistry.size() != 1 {
+		t.Errorf("Expected 1 referenced entry, got %d", sharedRegistry.size())
+	}
+
+	_ = last.Close()
+	waitForGoroutines(t, baseline)
+	if sharedRegistry.size() != 0 {
+		t.Errorf("Expected registry to be empty, got %d entries", sharedRegistry.size())
+	}
+}
+
+func TestSupersededSiblingsShareEntry(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.RefreshInterval = "1h"
+	var gates []*CloudFrontGate
+	for range 2 {
+		handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		gates = append(gates, cf)
+	}
+
+	// Both routers stay served by the entry the latest construction holds.
+	if gates[0].entry != gates[1].entry || gates[1].entry.refs != 1 {
+		t.Errorf("Expected the superseded sibling to drop its reference only")
+	}
+	if !gates[0].allowed(net.ParseIP("205.251.249.10")) {
+		t.Errorf("Expected the superseded sibling to keep serving the shared data")
+	}
+
+	// Closing the superseded sibling does not release twice.
+	_ = gates[0].Close()
+	if sharedRegistry.size() != 1 {
+		t.Errorf("Expected the entry to stay referenced, got %d entries", sharedRegistry.size())
+	}
+	_ = gates[1].Close()
+	if sharedRegistry.size() != 0 {
+		t.Errorf("Expected registry to be empty, got %d entries", sharedRegistry.size())
+	}
+}
+
+func TestReleaseOnContextCancel(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := NewWithOptions(ctx, next, CreateConfig(), "test", withFixture()); err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if sharedRegistry.size() != 1 {
+		t.Fatalf("Expected 1 entry, got %d", sharedRegistry.size())
+	}
+
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for sharedRegistry.size() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sharedRegistry.size() != 0 {
+		t.Errorf("Expected the reference to be dropped when the context ends")
+	}
+}
+
+// settledGoroutines returns the goroutine count once idle HTTP connections
+// left behind by earlier tests are gone.
+func settledGoroutines() int {
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+	time.Sleep(100 * time.Millisecond)
+	return runtime.NumGoroutine()
+}
+
+// waitForGoroutines fails the test if the goroutine count does not drop back
+// to baseline within a second.
+func waitForGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+			transport.CloseIdleConnections()
+		}
+		got := runtime.NumGoroutine()
+		if got <= baseline {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("Expected goroutine count to return to %d, got %d", baseline, got)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewInheritsDataWhenSourceIsDown(t *testing.T) {
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+
+	client := WithHTTPClient(fixtureClient(map[string]string{ipListURL: server.URL}))
+
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	// A first-ever construction fails hard while the source is down.
+	failing.Store(true)
+	if _, err := NewWithOptions(context.Background(), next, CreateConfig(), "test", client); err == nil {
+		t.Fatalf("Expected first construction to fail without prior data")
+	}
+
+	failing.Store(false)
+	first, err := NewWithOptions(context.Background(), next, CreateConfig(), "test", client)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	_ = first.(*CloudFrontGate).Close()
+
+	// A reconstruction during an outage adopts the previously fetched data.
+	failing.Store(true)
+	handler, err := NewWithOptions(context.Background(), next, CreateConfig(), "test", client)
+	if err != nil {
+		t.Fatalf("Expected reconstruction to succeed with prior data, got %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+
+	if !cf.inherited || !cf.status().Inherited {
+		t.Errorf("Expected instance to be marked as inherited in its status")
+	}
+	if !cf.entry.stale.Load() {
+		t.Errorf("Expected shared entry to be marked stale")
+	}
+	if !cf.allowed(net.ParseIP("205.251.249.10")) {
+		t.Errorf("Expected inherited ranges to be enforced")
+	}
+}
+
+func TestSoftReloadKeepsState(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	serve := func(cf *CloudFrontGate, remoteAddr string) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.RemoteAddr = remoteAddr
+		cf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	build := func(cfg *Config) *CloudFrontGate {
+		t.Helper()
+		handler, err := NewWithOptions(context.Background(), next, cfg, "soft-reload", withFixture())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		t.Cleanup(func() { _ = cf.Close() })
+		return cf
+	}
+
+	cfg := CreateConfig()
+	cfg.AllowedIPs = []string{"192.168.1.0/24"}
+	first := build(cfg)
+	serve(first, "192.168.1.1:1234")
+	serve(first, "10.0.0.1:1234")
+
+	// Adding a CIDR is a soft change: counters persist and the new entry applies.
+	cfg.AllowedIPs = []string{"192.168.1.0/24", "10.0.0.0/8"}
+	second := build(cfg)
+	if second.state != first.state {
+		t.Fatalf("Expected runtime state to be carried forward")
+	}
+	if got := second.state.allowed.Load(); got != 1 {
+		t.Errorf("Expected 1 allowed request carried forward, got %d", got)
+	}
+	if got := second.state.denied.Load(); got != 1 {
+		t.Errorf("Expected 1 denied request carried forward, got %d", got)
+	}
+	serve(second, "10.0.0.1:1234")
+	if got := second.state.allowed.Load(); got != 2 {
+		t.Errorf("Expected the new allowed entry to apply, got %d allowed", got)
+	}
+
+	// Changing the source schedule is structural and starts over.
+	cfg.RefreshInterval = "12h"
+	third := build(cfg)
+	if third.state == second.state {
+		t.Fatalf("Expected a structural change to rebuild the runtime state")
+	}
+	if got := third.state.allowed.Load(); got != 0 {
+		t.Errorf("Expected fresh counters after a rebuild, got %d allowed", got)
+	}
+
+	// So is changing which address is checked.
+	cfg.IPStrategy = &IPStrategyConfig{Depth: 1, TrustedProxies: []string{"10.0.0.0/8"}}
+	fourth := build(cfg)
+	if fourth.state == third.state {
+		t.Fatalf("Expected an ipStrategy change to rebuild the runtime state")
+	}
+	if again := build(cfg); again.state != fourth.state {
+		t.Fatalf("Expected the same ipStrategy to keep the runtime state")
+	}
+}
+
+func TestCloseForgetsState(t *testing.T) {
+	build := func() *CloudFrontGate {
+		t.Helper()
+		handler, err := NewWithOptions(context.Background(), http.NotFoundHandler(), CreateConfig(), t.Name(), withFixture())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		return cf
+	}
+	stateOf := func() *stateEntry {
+		sharedRegistry.mu.Lock()
+		defer sharedRegistry.mu.Unlock()
+		return sharedRegistry.states[instanceName{name: t.Name()}]
+	}
+
+	first := build()
+	second := build()
+	// Closing a superseded construction keeps the state of the latest one.
+	_ = first.Close()
+	if entry := stateOf(); entry == nil || entry.state != second.state {
+		t.Fatal("Expected the state to survive the close of a superseded construction")
+	}
+	_ = second.Close()
+	if stateOf() != nil {
+		t.Error("Expected the state to be forgotten with the last construction")
+	}
+}
+
+func TestStartupTimeout(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	build := func(t *testing.T, failOpen bool) (*CloudFrontGate, error) {
+		t.Helper()
+		server, _, _, release := slowSource(t)
+		defer func() { t.Cleanup(func() { close(release) }) }()
+		cfg := CreateConfig()
+		cfg.IPListURL = server.URL
+		cfg.AllowPrivateSources = true
+		cfg.StartupTimeout = "100ms"
+		cfg.FailOpenOnStartup = failOpen
+		start := time.Now()
+		handler, err := New(context.Background(), next, cfg, t.Name())
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("Expected New() to give up after startupTimeout, took %s", took)
+		}
+		if err != nil {
+			return nil, err
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		t.Cleanup(func() { _ = cf.Close() })
+		return cf, nil
+	}
+
+	t.Run("Sync", func(t *testing.T) {
+		if _, err := build(t, false); err == nil || !strings.Contains(err.Error(), "startupTimeout of 100ms exceeded") {
+			t.Errorf("Expected the startup timeout to fail New(), got %v", err)
+		}
+	})
+	t.Run("Sync fail open", func(t *testing.T) {
+		cf, err := build(t, true)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK || cf.state.failedOpen.Load() != 1 {
+			t.Errorf("Expected the request to be admitted unchecked, got %d", rw.Code)
+		}
+	})
+
+	cfg := CreateConfig()
+	cfg.StartupTimeout = "0s"
+	if _, err := New(context.Background(), next, cfg, t.Name()); err == nil {
+		t.Error("Expected a non-positive startupTimeout to be rejected")
+	}
+}
+
+func TestAsyncStartup(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	serve := func(cf *CloudFrontGate, remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	build := func(t *testing.T, server *httptest.Server, configure func(*Config)) *CloudFrontGate {
+		t.Helper()
+		cfg := CreateConfig()
+		cfg.IPListURL = server.URL
+		cfg.AllowPrivateSources = true
+		cfg.AsyncStartup = true
+		cfg.StartupTimeout = "100ms"
+		if configure != nil {
+			configure(cfg)
+		}
+		start := time.Now()
+		handler, err := New(context.Background(), next, cfg, t.Name())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		if took := time.Since(start); took > 50*time.Millisecond {
+			t.Errorf("Expected New() not to wait for the fetch, took %s", took)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		t.Cleanup(func() { _ = cf.Close() })
+		return cf
+	}
+
+	t.Run("Fail closed", func(t *testing.T) {
+		server, _, _, release := slowSource(t)
+		cf := build(t, server, nil)
+		// The fetch outlasts startupTimeout, which only bounds a synchronous
+		// startup.
+		time.Sleep(200 * time.Millisecond)
+		if code := serve(cf, "205.251.249.10:1234"); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 until the first fetch, got %d", code)
+		}
+		close(release)
+		waitFor(t, "the background fetch", func() bool { return cf.ips.version.Load() != 0 })
+		if code := serve(cf, "205.251.249.10:1234"); code != http.StatusOK {
+			t.Errorf("Expected a CloudFront peer to be allowed after the fetch, got %d", code)
+		}
+		if code := serve(cf, "192.0.2.1:1234"); code != http.StatusForbidden {
+			t.Errorf("Expected an unknown peer to be denied after the fetch, got %d", code)
+		}
+	})
+	t.Run("Fail open", func(t *testing.T) {
+		server, _, _, release := slowSource(t)
+		cf := build(t, server, func(cfg *Config) { cfg.FailOpenOnStartup = true })
+		t.Cleanup(func() { close(release) })
+		if code := serve(cf, "192.0.2.1:1234"); code != http.StatusOK {
+			t.Errorf("Expected failOpenOnStartup to admit requests until the first fetch, got %d", code)
+		}
+	})
+	t.Run("Cache first", func(t *testing.T) {
+		server, _, _, release := slowSource(t)
+		path := filepath.Join(t.TempDir(), "ranges.json")
+		body, err := json.Marshal(cacheDocument{
+			URL:       server.URL,
+			FetchedAt: time.Now().Add(-time.Hour),
+			Prefixes:  []cachedRange{{Prefix: "205.251.249.0/24", Source: "cloudfront-global"}, {Prefix: "13.32.0.0/15", Source: "cloudfront-global"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, body, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cf := build(t, server, func(cfg *Config) {
+			cfg.CacheFile = path
+			cfg.SkipAnchorCheck = true
+		})
+		if !cf.inherited || serve(cf, "205.251.249.10:1234") != http.StatusOK {
+			t.Errorf("Expected the cache to admit CloudFront peers before the first fetch")
+		}
+		if code := serve(cf, "54.192.0.1:1234"); code != http.StatusForbidden {
+			t.Errorf("Expected a prefix missing from the cache to be denied, got %d", code)
+		}
+		close(release)
+		waitFor(t, "the background fetch", func() bool { return len(cf.ips.prefixes()) == 8 })
+		if code := serve(cf, "54.192.0.1:1234"); code != http.StatusOK {
+			t.Errorf("Expected the fetched ranges to replace the cache, got %d", code)
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package cloudfrontgate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// defaultRejectBody is the body of the default 403, as written by http.Error.
+const defaultRejectBody = "Forbidden\n"
+
+// rejection is the response written for denied requests.
+type rejection struct {
+	status      int
+	body        string
+	contentType string
+}
+
+// defaultRejection is used by instances built without New.
+var defaultRejection = rejection{status: http.StatusForbidden, body: defaultRejectBody, contentType: "text/plain; charset=utf-8"}
+
+// parseRejection validates the rejection response options. Without an
+// explicit content type, a JSON body is served as application/json and any
+// other body as plain text.
+func parseRejection(config *Config) (rejection, error) {
+	r := defaultRejection
+	if config.RejectStatusCode != 0 {
+		if config.RejectStatusCode < 200 || config.RejectStatusCode > 599 {
+			return rejection{}, fmt.Errorf("invalid rejectStatusCode %d: must be between 200 and 599", config.RejectStatusCode)
+		}
+		r.status = config.RejectStatusCode
+	}
+	if config.RejectBody != "" {
+		r.body = config.RejectBody
+		if trimmed := strings.TrimSpace(r.body); (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+			r.contentType = "application/json"
+		}
+	}
+	if config.RejectContentType != "" {
+		if strings.ContainsAny(config.RejectContentType, "\r\n") {
+			return rejection{}, fmt.Errorf("invalid rejectContentType %q", config.RejectContentType)
+		}
+		r.contentType = config.RejectContentType
+	}
+	return r, nil
+}
+
+// write writes the rejection.
+func (r rejection) write(rw http.ResponseWriter) {
+	h := rw.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", r.contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(r.status)
+	_, _ = io.WriteString(rw, r.body)
+}
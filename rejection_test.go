@@ -0,0 +1,74 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRejectionResponse(t *testing.T) {
+	tests := []struct {
+		name            string
+		statusCode      int
+		body            string
+		contentType     string
+		wantStatus      int
+		wantBody        string
+		wantContentType string
+	}{
+		{name: "Default", wantStatus: http.StatusForbidden, wantBody: "Forbidden\n", wantContentType: "text/plain; charset=utf-8"},
+		{name: "Stealth", statusCode: http.StatusNotFound, body: "Not Found", wantStatus: http.StatusNotFound, wantBody: "Not Found", wantContentType: "text/plain; charset=utf-8"},
+		{name: "JSON", body: `{"error":"access restricted"}`, wantStatus: http.StatusForbidden, wantBody: `{"error":"access restricted"}`, wantContentType: "application/json"},
+		{name: "Explicit content type", body: "<p>no</p>", contentType: "text/html", wantStatus: http.StatusForbidden, wantBody: "<p>no</p>", wantContentType: "text/html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.RejectStatusCode = tt.statusCode
+			cfg.RejectBody = tt.body
+			cfg.RejectContentType = tt.contentType
+			next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+				t.Error("Expected the request not to be forwarded")
+			})
+			handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			rw := httptest.NewRecorder()
+			cf.ServeHTTP(rw, req)
+
+			if rw.Code != tt.wantStatus || rw.Body.String() != tt.wantBody {
+				t.Errorf("Expected %d %q, got %d %q", tt.wantStatus, tt.wantBody, rw.Code, rw.Body.String())
+			}
+			if got := rw.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Expected content type %q, got %q", tt.wantContentType, got)
+			}
+		})
+	}
+}
+
+func TestParseRejectionValidation(t *testing.T) {
+	for _, config := range []*Config{
+		{RejectStatusCode: 199},
+		{RejectStatusCode: 600},
+		{RejectContentType: "text/plain\r\nX-Injected: 1"},
+	} {
+		if _, err := parseRejection(config); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+
+	cfg := CreateConfig()
+	cfg.RejectStatusCode = http.StatusOK
+	cfg.ForwardAuth = &ForwardAuthConfig{Path: "/_verdict", AllowedCallers: []string{"127.0.0.0/8"}}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := New(context.Background(), next, cfg, t.Name()); err == nil {
+		t.Error("Expected a 2xx rejection to be refused with forward-auth")
+	}
+}
@@ -0,0 +1,207 @@
+package cloudfrontgate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// Resolution stages, in the order they are consulted by default.
+const (
+	stageDenylist            = "denylist"
+	stageAllowedIPs          = "allowedIPs"
+	stageCloudFront          = "cloudfront"
+	stageMaintenanceWindows  = "maintenanceWindows"
+	stageRoute53HealthChecks = "route53HealthChecks"
+	stageQuarantine          = "quarantine"
+)
+
+// decision is the verdict of a resolution stage.
+type decision struct {
+	Stage  string      `json:"stage"`
+	Allow  bool        `json:"allow"`
+	Source trustSource `json:"-"`
+	Reason denyReason  `json:"-"`
+	Why    string      `json:"why"`
+}
+
+// resolutionStage decides for the addresses it knows about. Allow sources
+// only ever admit and make up the trusted set of match.
+type resolutionStage struct {
+	name        string
+	allowSource bool
+	decide      func(cf *CloudFrontGate, addr netip.Addr) (decision, bool)
+}
+
+// resolutionStages maps the stage names to their implementations.
+var resolutionStages = map[string]resolutionStage{
+	stageDenylist: {name: stageDenylist, decide: func(cf *CloudFrontGate, addr netip.Addr) (decision, bool) {
+		if containsAddr(cf.blockedIPs, addr) {
+			return decision{Reason: denyDenylist, Why: "listed in blockedIPs"}, true
+		}
+		var buf [net.IPv6len]byte
+		if cf.denylist == nil || !cf.denylist.contains(addrIP(addr, &buf)) {
+			return decision{}, false
+		}
+		return decision{Reason: denyDenylist, Why: "listed in denylistFile"}, true
+	}},
+	stageAllowedIPs: {name: stageAllowedIPs, allowSource: true, decide: func(cf *CloudFrontGate, addr netip.Addr) (decision, bool) {
+		var buf [net.IPv6len]byte
+		if !cf.allowedIP(addrIP(addr, &buf)) {
+			return decision{}, false
+		}
+		return decision{Allow: true, Source: sourceCustom, Why: "listed in allowedIPs"}, true
+	}},
+	stageCloudFront: {name: stageCloudFront, allowSource: true, decide: func(cf *CloudFrontGate, addr netip.Addr) (decision, bool) {
+		source, ok := cf.matchStore(cf.ips, addr)
+		if !ok {
+			return decision{}, false
+		}
+		return decision{Allow: true, Source: source, Why: rangesWhy[source]}, true
+	}},
+	stageMaintenanceWindows: {name: stageMaintenanceWindows, allowSource: true, decide: func(cf *CloudFrontGate, addr netip.Addr) (decision, bool) {
+		var buf [net.IPv6len]byte
+		if !cf.windowAllows(addrIP(addr, &buf)) {
+			return decision{}, false
+		}
+		return decision{Allow: true, Source: sourceCustom, Why: "in an active maintenance window"}, true
+	}},
+	stageRoute53HealthChecks: {name: stageRoute53HealthChecks, allowSource: true, decide: func(cf *CloudFrontGate, addr netip.Addr) (decision, bool) {
+		if cf.healthChecks == nil {
+			return decision{}, false
+		}
+		if _, ok := cf.matchStore(cf.healthChecks, addr); !ok {
+			return decision{}, false
+		}
+		return decision{Allow: true, Source: sourceRoute53HealthChecks, Why: "in the Route 53 health checker ranges"}, true
+	}},
+	stageQuarantine: {name: stageQuarantine, decide: func(cf *CloudFrontGate, addr netip.Addr) (decision, bool) {
+		if cf.ips.quarantine <= 0 {
+			return decision{}, false
+		}
+		source, ok := cf.ips.matchQuarantined(addr, cf.ips.now())
+		if !ok {
+			return decision{}, false
+		}
+		if cf.quarantinePolicy == quarantineAllow || cf.quarantinePolicy == quarantineLog {
+			return decision{Allow: true, Source: source, Why: "in a quarantined prefix, allowed by quarantinePolicy"}, true
+		}
+		return decision{Reason: denyQuarantined, Why: "in a quarantined prefix"}, true
+	}},
+}
+
+// rangesWhy is the Why of the CloudFront stage for each source, built once
+// so that allowed requests do not each build it.
+var rangesWhy = func() [trustSourceCount]string {
+	var why [trustSourceCount]string
+	for source := range why {
+		why[source] = "in the " + trustSource(source).String() + " ranges"
+	}
+	return why
+}()
+
+// defaultResolutionOrder is the documented order of the stages. The first
+// stage that knows an address decides; an address no stage knows is denied.
+var defaultResolutionOrder = []string{
+	stageDenylist, stageAllowedIPs, stageCloudFront, stageMaintenanceWindows, stageRoute53HealthChecks, stageQuarantine,
+}
+
+// reorderableStages may be given in either order through resolutionOrder:
+// whether a local denylist entry beats a local allowlist entry is a policy
+// choice, while every other pair has one sensible answer.
+var reorderableStages = []string{stageDenylist, stageAllowedIPs}
+
+// parseResolutionOrder returns the stages in the configured order.
+func parseResolutionOrder(order []string) ([]resolutionStage, error) {
+	names := defaultResolutionOrder
+	if len(order) > 0 {
+		if len(order) != len(reorderableStages) || order[0] == order[1] ||
+			!containsString(reorderableStages, order[0]) || !containsString(reorderableStages, order[1]) {
+			return nil, fmt.Errorf("invalid resolutionOrder %q: must order %q and %q", order, stageDenylist, stageAllowedIPs)
+		}
+		names = append([]string{order[0], order[1]}, defaultResolutionOrder[len(reorderableStages):]...)
+	}
+
+	stages := make([]resolutionStage, 0, len(names))
+	for _, name := range names {
+		stages = append(stages, resolutionStages[name])
+	}
+	return stages, nil
+}
+
+// defaultStages is used by instances without a parsed resolution order.
+var defaultStages, _ = parseResolutionOrder(nil)
+
+// stageList returns the stages of the instance in order.
+func (cf *CloudFrontGate) stageList() []resolutionStage {
+	if cf.stages != nil {
+		return cf.stages
+	}
+	return defaultStages
+}
+
+// resolve returns the decision of the first stage that knows addr.
+func (cf *CloudFrontGate) resolve(addr netip.Addr) (decision, bool) {
+	for _, stage := range cf.stageList() {
+		if d, ok := stage.decide(cf, addr); ok {
+			d.Stage = stage.name
+			return d, true
+		}
+	}
+	return decision{}, false
+}
+
+// explanation is the document served by the explain admin endpoint.
+type explanation struct {
+	IP        string     `json:"ip"`
+	Stages    []decision `json:"stages"`
+	DecidedBy string     `json:"decidedBy"`
+	Decision  string     `json:"decision"`
+	Detail    string     `json:"detail"`
+}
+
+// explain walks every stage for addr and reports which one decides.
+func (cf *CloudFrontGate) explain(addr netip.Addr) explanation {
+	e := explanation{IP: addr.String(), Stages: []decision{}}
+	for _, stage := range cf.stageList() {
+		d, ok := stage.decide(cf, addr)
+		if !ok {
+			continue
+		}
+		d.Stage = stage.name
+		e.Stages = append(e.Stages, d)
+		if e.DecidedBy != "" {
+			continue
+		}
+		e.DecidedBy = stage.name
+		if d.Allow {
+			e.Decision, e.Detail = "allow", d.Source.String()
+		} else {
+			e.Decision, e.Detail = "deny", d.Reason.String()
+		}
+	}
+
+	if e.DecidedBy == "" {
+		e.DecidedBy = "default"
+		if cause, degraded := cf.degraded(); degraded {
+			e.Decision, e.Detail = "unavailable", cause
+		} else {
+			e.Decision, e.Detail = "deny", denyIP.String()
+		}
+	}
+	return e
+}
+
+// serveExplain explains the decision for the address in the ip parameter.
+func (cf *CloudFrontGate) serveExplain(rw http.ResponseWriter, req *http.Request) {
+	ip := net.ParseIP(req.URL.Query().Get("ip"))
+	if ip == nil {
+		http.Error(rw, "missing or invalid ip parameter", http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(cf.explain(addrOf(ip)))
+}
@@ -0,0 +1,160 @@
+package cloudfrontgate
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newResolutionGate returns an instance where the stages in enabled know
+// 192.0.2.1 and nothing else does.
+func newResolutionGate(t *testing.T, order []string, enabled ...string) *CloudFrontGate {
+	t.Helper()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	parse := func(cidrs ...string) []net.IPNet {
+		prefixes, err := parseCIDRs(cidrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return prefixes
+	}
+
+	stages, err := parseResolutionOrder(order)
+	if err != nil {
+		t.Fatalf("parseResolutionOrder() error = %v", err)
+	}
+	cf := &CloudFrontGate{
+		name:   "test",
+		now:    func() time.Time { return now },
+		ips:    newIPStore(""),
+		state:  &gateState{},
+		stages: stages,
+	}
+	cf.ips.now = cf.now
+	stored := mustParseCIDRs(t, "198.51.100.0/24")
+
+	for _, stage := range enabled {
+		switch stage {
+		case stageDenylist:
+			cf.denylist = &cidrFile{}
+			cf.denylist.prefixes.Store(parse("192.0.2.1/32"))
+		case stageAllowedIPs:
+			cf.allowedIPs.Store(&allowedSet{prefixes: parse("192.0.2.0/28")})
+		case stageCloudFront:
+			stored = append(stored, mustParseCIDRs(t, "192.0.2.0/24")...)
+		case stageMaintenanceWindows:
+			cf.windows = []*maintenanceWindow{{name: "w", prefixes: parse("192.0.2.0/26"), start: now.Add(-time.Hour), end: now.Add(time.Hour)}}
+		case stageRoute53HealthChecks:
+			cf.healthChecks = newIPStore("")
+			cf.healthChecks.store(mustParseCIDRs(t, "192.0.2.0/27", "203.0.113.0/24"))
+		case stageQuarantine:
+			quarantined := mustParseCIDRs(t, "192.0.2.0/25")
+			stored = append(stored, quarantined...)
+			cf.ips.quarantine = time.Hour
+			cf.ips.quarantined.Store(map[string]quarantinedPrefix{
+				"192.0.2.0/25": {prefix: quarantined[0], until: now.Add(time.Hour)},
+			})
+		default:
+			t.Fatalf("unknown stage %s", stage)
+		}
+	}
+	cf.ips.store(stored)
+	return cf
+}
+
+// stageAllows reports the verdict of a stage that decides.
+var stageAllows = map[string]bool{
+	stageDenylist:            false,
+	stageAllowedIPs:          true,
+	stageCloudFront:          true,
+	stageMaintenanceWindows:  true,
+	stageRoute53HealthChecks: true,
+	stageQuarantine:          false,
+}
+
+func TestResolutionOrderConflicts(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	orders := map[string][]string{
+		"default":   nil,
+		"allowlist": {stageAllowedIPs, stageDenylist},
+	}
+	for name, order := range orders {
+		stages, _ := parseResolutionOrder(order)
+		var names []string
+		for _, stage := range stages {
+			names = append(names, stage.name)
+		}
+
+		// Every stage decides alone, and the earlier of every pair wins.
+		for i, first := range names {
+			cf := newResolutionGate(t, order, first)
+			d, ok := cf.resolve(ip)
+			if !ok || d.Stage != first || d.Allow != stageAllows[first] {
+				t.Errorf("%s: %s alone decided %+v, %v", name, first, d, ok)
+			}
+
+			for _, second := range names[i+1:] {
+				cf := newResolutionGate(t, order, first, second)
+				d, ok := cf.resolve(ip)
+				if !ok || d.Stage != first || d.Allow != stageAllows[first] {
+					t.Errorf("%s: %s vs %s decided by %s (allow %v), want %s", name, first, second, d.Stage, d.Allow, first)
+				}
+				if got := cf.explain(ip); got.DecidedBy != first || len(got.Stages) != 2 {
+					t.Errorf("%s: explain(%s vs %s) = %+v", name, first, second, got)
+				}
+			}
+		}
+	}
+
+	cf := newResolutionGate(t, nil)
+	if _, ok := cf.resolve(ip); ok {
+		t.Errorf("Expected no stage to know %s", ip)
+	}
+	if got := cf.explain(ip); got.DecidedBy != "default" || got.Decision != "deny" {
+		t.Errorf("Expected the default deny, got %+v", got)
+	}
+}
+
+func TestParseResolutionOrder(t *testing.T) {
+	invalid := [][]string{
+		{stageDenylist},
+		{stageDenylist, stageDenylist},
+		{stageCloudFront, stageDenylist},
+		{stageAllowedIPs, stageDenylist, stageCloudFront},
+	}
+	for _, order := range invalid {
+		if _, err := parseResolutionOrder(order); err == nil {
+			t.Errorf("Expected resolutionOrder %v to be rejected", order)
+		}
+	}
+}
+
+func TestServeExplain(t *testing.T) {
+	cf := newAdminGate(t, nil)
+
+	explain := func(query string) (int, explanation) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/_cfgate/explain"+query, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+
+		var e explanation
+		_ = json.Unmarshal(rw.Body.Bytes(), &e)
+		return rw.Code, e
+	}
+
+	if code, _ := explain(""); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without an ip, got %d", code)
+	}
+	code, e := explain("?ip=205.251.249.10")
+	if code != http.StatusOK || e.DecidedBy != stageCloudFront || e.Decision != "allow" || e.Detail != sourceCloudFrontGlobal.String() {
+		t.Errorf("Unexpected explanation %d %+v", code, e)
+	}
+}
@@ -0,0 +1,192 @@
+package cloudfrontgate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// responseRecorder records the status and body size of a forwarded response
+// for the metrics. The backend gets it through wrap, which keeps exactly the
+// optional Flush, Hijack and ReadFrom methods of the writer it wraps, so
+// that feature checks such as rw.(http.Hijacker) answer as they would
+// without the gate; Unwrap lets http.ResponseController find the others.
+// Once hijacked, the connection belongs to the backend and nothing more is
+// recorded.
+type responseRecorder struct {
+	rw       http.ResponseWriter
+	status   int
+	written  int64
+	hijacked bool
+}
+
+// Header returns the header of the wrapped writer.
+func (r *responseRecorder) Header() http.Header {
+	return r.rw.Header()
+}
+
+// WriteHeader records the final status; informational statuses other than
+// 101 Switching Protocols may precede it.
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 || (r.status < http.StatusOK && r.status != http.StatusSwitchingProtocols) {
+		r.status = code
+	}
+	r.rw.WriteHeader(code)
+}
+
+// Write counts the body bytes.
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.rw.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.rw
+}
+
+// readFrom keeps the sendfile path of the wrapped io.ReaderFrom.
+func (r *responseRecorder) readFrom(src io.Reader) (int64, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.rw.(io.ReaderFrom).ReadFrom(src)
+	r.written += n
+	return n, err
+}
+
+// flush flushes the wrapped http.Flusher.
+func (r *responseRecorder) flush() {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.rw.(http.Flusher).Flush()
+}
+
+// hijack hands the connection of the wrapped http.Hijacker over, as
+// WebSocket upgrades do.
+func (r *responseRecorder) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := r.rw.(http.Hijacker).Hijack()
+	if err == nil {
+		r.hijacked = true
+		if r.status == 0 {
+			r.status = http.StatusSwitchingProtocols
+		}
+	}
+	return conn, brw, err
+}
+
+// wrap returns r with the optional methods of the wrapped writer.
+func (r *responseRecorder) wrap() http.ResponseWriter {
+	_, flusher := r.rw.(http.Flusher)
+	_, hijacker := r.rw.(http.Hijacker)
+	_, readerFrom := r.rw.(io.ReaderFrom)
+	switch {
+	case flusher && hijacker && readerFrom:
+		return flushHijackReadFromRecorder{r}
+	case flusher && hijacker:
+		return flushHijackRecorder{r}
+	case flusher && readerFrom:
+		return flushReadFromRecorder{r}
+	case hijacker && readerFrom:
+		return hijackReadFromRecorder{r}
+	case flusher:
+		return flushRecorder{r}
+	case hijacker:
+		return hijackRecorder{r}
+	case readerFrom:
+		return readFromRecorder{r}
+	}
+	return r
+}
+
+// The recorders of wrap, one per combination of the optional methods.
+type (
+	flushRecorder               struct{ *responseRecorder }
+	hijackRecorder              struct{ *responseRecorder }
+	readFromRecorder            struct{ *responseRecorder }
+	flushHijackRecorder         struct{ *responseRecorder }
+	flushReadFromRecorder       struct{ *responseRecorder }
+	hijackReadFromRecorder      struct{ *responseRecorder }
+	flushHijackReadFromRecorder struct{ *responseRecorder }
+)
+
+func (r flushRecorder) Flush() { r.flush() }
+
+func (r hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) { return r.hijack() }
+
+func (r readFromRecorder) ReadFrom(src io.Reader) (int64, error) { return r.readFrom(src) }
+
+func (r flushHijackRecorder) Flush() { r.flush() }
+
+func (r flushHijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) { return r.hijack() }
+
+func (r flushReadFromRecorder) Flush() { r.flush() }
+
+func (r flushReadFromRecorder) ReadFrom(src io.Reader) (int64, error) { return r.readFrom(src) }
+
+func (r hijackReadFromRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) { return r.hijack() }
+
+func (r hijackReadFromRecorder) ReadFrom(src io.Reader) (int64, error) { return r.readFrom(src) }
+
+func (r flushHijackReadFromRecorder) Flush() { r.flush() }
+
+func (r flushHijackReadFromRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return r.hijack()
+}
+
+func (r flushHijackReadFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	return r.readFrom(src)
+}
+
+// responseClasses is the number of counted status classes, 1xx to 5xx.
+const responseClasses = 5
+
+// responseCounters counts the responses of the backend to the forwarded
+// requests.
+type responseCounters struct {
+	// byClass counts the statuses 1xx to 5xx; byClass[0] is 1xx.
+	byClass [responseClasses]atomic.Uint64
+	bytes   atomic.Uint64
+	// upgrades counts the connections hijacked by the backend.
+	upgrades atomic.Uint64
+}
+
+// recordsResponses reports whether the forwarded responses are recorded,
+// which only the metrics path and StatsD read.
+func (cf *CloudFrontGate) recordsResponses() bool {
+	return cf.metricsPath != "" || cf.statsd != nil
+}
+
+// serveRecorded forwards req to the backend through a responseRecorder and
+// counts the response.
+func (cf *CloudFrontGate) serveRecorded(rw http.ResponseWriter, req *http.Request) {
+	rec := &responseRecorder{rw: rw}
+	cf.next.ServeHTTP(rec.wrap(), req)
+
+	counters := &cf.state.responses
+	status := rec.status
+	if status == 0 {
+		// net/http answers 200 for a handler that wrote nothing.
+		status = http.StatusOK
+	}
+	if class := status/100 - 1; class >= 0 && class < responseClasses {
+		counters.byClass[class].Add(1)
+	}
+	counters.bytes.Add(uint64(rec.written))
+	if rec.hijacked {
+		counters.upgrades.Add(1)
+	}
+}
+
+// statusClass returns the label of the class at index i of byClass.
+func statusClass(i int) string {
+	return fmt.Sprintf("%dxx", i+1)
+}
@@ -0,0 +1,285 @@
+package cloudfrontgate
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRecordingGate builds an instance forwarding to next with the metrics
+// path set, so that the responses are recorded, admitting the loopback
+// clients of httptest servers.
+func newRecordingGate(t *testing.T, next http.Handler) *CloudFrontGate {
+	t.Helper()
+	cfg := CreateConfig()
+	cfg.AllowLoopback = true
+	cfg.MetricsPath = "/_cloudfrontgate/metrics"
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	t.Cleanup(func() { _ = cf.Close() })
+	if !cf.recordsResponses() {
+		t.Fatal("Expected the responses to be recorded with metricsPath")
+	}
+	return cf
+}
+
+func TestResponseRecorder(t *testing.T) {
+	inner := httptest.NewRecorder()
+	rec := &responseRecorder{rw: inner}
+	rw := rec.wrap()
+	rw.WriteHeader(http.StatusCreated)
+	rw.WriteHeader(http.StatusInternalServerError)
+	_, _ = rw.Write([]byte("hello "))
+	if _, err := io.Copy(rw, strings.NewReader("world")); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	rw.(http.Flusher).Flush()
+
+	if rec.status != http.StatusCreated || rec.written != 11 || inner.Body.String() != "hello world" || !inner.Flushed {
+		t.Errorf("Expected 201 and 11 flushed bytes, got %d, %d, %q, flushed %v", rec.status, rec.written, inner.Body.String(), inner.Flushed)
+	}
+	if rw.(interface{ Unwrap() http.ResponseWriter }).Unwrap() != inner {
+		t.Error("Expected Unwrap to return the wrapped writer")
+	}
+	if _, ok := rw.(http.Hijacker); ok {
+		t.Error("Expected a writer without Hijack not to gain it")
+	}
+	if err := http.NewResponseController(rw).SetWriteDeadline(time.Now().Add(time.Second)); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Expected the ResponseController to reach the wrapped writer, got %v", err)
+	}
+}
+
+// The optional methods of a writer, for TestResponseRecorderMethods.
+type (
+	plainWriter       struct{ http.ResponseWriter }
+	flushingWriter    struct{}
+	hijackingWriter   struct{}
+	readingFromWriter struct{}
+)
+
+func (flushingWriter) Flush() {}
+
+func (hijackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("not a connection")
+}
+
+func (readingFromWriter) ReadFrom(src io.Reader) (int64, error) {
+	return io.Copy(io.Discard, src)
+}
+
+func TestResponseRecorderMethods(t *testing.T) {
+	p := plainWriter{httptest.NewRecorder()}
+	f, h, r := flushingWriter{}, hijackingWriter{}, readingFromWriter{}
+	for _, inner := range []http.ResponseWriter{
+		p,
+		struct {
+			http.ResponseWriter
+			http.Flusher
+		}{p, f},
+		struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{p, h},
+		struct {
+			http.ResponseWriter
+			io.ReaderFrom
+		}{p, r},
+		struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{p, f, h},
+		struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{p, f, r},
+		struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{p, h, r},
+		struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{p, f, h, r},
+	} {
+		_, wantFlusher := inner.(http.Flusher)
+		_, wantHijacker := inner.(http.Hijacker)
+		_, wantReaderFrom := inner.(io.ReaderFrom)
+
+		rec := &responseRecorder{rw: inner}
+		rw := rec.wrap()
+		flusher, gotFlusher := rw.(http.Flusher)
+		hijacker, gotHijacker := rw.(http.Hijacker)
+		readerFrom, gotReaderFrom := rw.(io.ReaderFrom)
+		if gotFlusher != wantFlusher || gotHijacker != wantHijacker || gotReaderFrom != wantReaderFrom {
+			t.Errorf("%T: Flusher, Hijacker, ReaderFrom = %v, %v, %v, want %v, %v, %v", inner,
+				gotFlusher, gotHijacker, gotReaderFrom, wantFlusher, wantHijacker, wantReaderFrom)
+			continue
+		}
+		if gotFlusher {
+			flusher.Flush()
+		}
+		if gotHijacker {
+			if _, _, err := hijacker.Hijack(); err == nil || rec.hijacked {
+				t.Errorf("%T: expected the error of the wrapped Hijack, got %v", inner, err)
+			}
+		}
+		if gotReaderFrom {
+			if n, err := readerFrom.ReadFrom(strings.NewReader("hello")); n != 5 || err != nil || rec.written != 5 {
+				t.Errorf("%T: ReadFrom() = %d, %v, recorded %d bytes, want 5", inner, n, err, rec.written)
+			}
+		}
+	}
+}
+
+func TestWebSocketUpgradeThroughGate(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "websocket" {
+			http.Error(rw, "expected an upgrade", http.StatusBadRequest)
+			return
+		}
+		hijacker, ok := rw.(http.Hijacker)
+		if !ok {
+			t.Error("Expected the writer to implement http.Hijacker")
+			return
+		}
+		conn, brw, err := hijacker.Hijack()
+		if err != nil {
+			t.Errorf("Hijack() error = %v", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			_ = brw.Flush()
+			// Echo a line, as a stand-in for the frames.
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			_, _ = brw.WriteString(line)
+			_ = brw.Flush()
+		}()
+	})
+	cf := newRecordingGate(t, next)
+	server := httptest.NewServer(cf)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(conn, "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() error = %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101 Switching Protocols, got %d", resp.StatusCode)
+	}
+	_, _ = io.WriteString(conn, "ping\n")
+	if line, err := reader.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("Expected the upgraded connection to echo, got %q, %v", line, err)
+	}
+
+	waitFor(t, "the upgrade to be counted", func() bool { return cf.state.responses.upgrades.Load() == 1 })
+	if got := cf.state.responses.byClass[0].Load(); got != 1 {
+		t.Errorf("Expected the upgrade to count as 1xx, got %d", got)
+	}
+}
+
+func TestFlushThroughGate(t *testing.T) {
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(rw, "first\n")
+		if err := http.NewResponseController(rw).Flush(); err != nil {
+			t.Errorf("Flush() error = %v", err)
+		}
+		<-release
+		_, _ = io.WriteString(rw, "second\n")
+	})
+	cf := newRecordingGate(t, next)
+	server := httptest.NewServer(cf)
+	defer server.Close()
+	defer close(release)
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "first\n" {
+		t.Fatalf("Expected the flushed line before the handler finished, got %q, %v", line, err)
+	}
+}
+
+func TestResponseMetrics(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(rw, req)
+			return
+		}
+		_, _ = io.WriteString(rw, "hello")
+	})
+	cf := newRecordingGate(t, next)
+	for _, path := range []string{"/", "/", "/missing"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		cf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/_cloudfrontgate/metrics", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rw := httptest.NewRecorder()
+	cf.ServeHTTP(rw, req)
+	label := `{middleware="` + t.Name() + `"`
+	for _, want := range []string{
+		"cloudfrontgate_responses_total" + label + `,code="2xx"} 2` + "\n",
+		"cloudfrontgate_responses_total" + label + `,code="4xx"} 1` + "\n",
+		"cloudfrontgate_response_bytes_total" + label + "} 29\n",
+		"cloudfrontgate_upgraded_connections_total" + label + "} 0\n",
+	} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("Expected %q in the metrics, got:\n%s", want, rw.Body.String())
+		}
+	}
+}
+
+func TestResponsesNotRecordedByDefault(t *testing.T) {
+	var got http.ResponseWriter
+	cfg := CreateConfig()
+	cfg.AllowLoopback = true
+	handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) { got = rw }), cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rw := httptest.NewRecorder()
+	cf.ServeHTTP(rw, req)
+	if got != rw {
+		t.Errorf("Expected the backend to get the writer of the request as is, got %T", got)
+	}
+}
@@ -0,0 +1,130 @@
+package cloudfrontgate
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultEnforcePercent enforces every denial.
+const defaultEnforcePercent = 100
+
+// modeReportOnly audits every denial, like enforcePercent 0.
+const modeReportOnly = "reportOnly"
+
+// defaultReportLogInterval limits the audit lines to one per address and
+// minute.
+const defaultReportLogInterval = time.Minute
+
+// maxReportLogAddresses bounds the addresses whose audit lines are limited.
+const maxReportLogAddresses = 10000
+
+// validateMode checks a mode value.
+func validateMode(mode string) error {
+	switch mode {
+	case "", modeEnforce, modeReportOnly:
+		return nil
+	default:
+		return fmt.Errorf("invalid mode %q: must be %q or %q", mode, modeEnforce, modeReportOnly)
+	}
+}
+
+// parseReportLogInterval parses reportLogInterval; zero logs every audit.
+func parseReportLogInterval(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultReportLogInterval, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse report log interval: %w", err)
+	}
+	if interval < 0 {
+		return 0, errors.New("reportLogInterval must not be negative")
+	}
+	return interval, nil
+}
+
+// validateEnforcePercent checks an enforcePercent value.
+func validateEnforcePercent(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("invalid enforcePercent %d: must be between 0 and 100", percent)
+	}
+	return nil
+}
+
+// enforced reports whether a denial of ip is enforced rather than audited.
+// The bucket of an address is stable, so that a viewer is treated the same
+// on every request and raising the percentage only adds buckets.
+func (cf *CloudFrontGate) enforced(ip net.IP) bool {
+	if !cf.audit || ip == nil {
+		return true
+	}
+	return enforceBucket(ip) < cf.enforcePercent
+}
+
+// enforceBucket maps ip to one of 100 buckets.
+func enforceBucket(ip net.IP) int {
+	h := fnv.New32a()
+	_, _ = h.Write(ip.To16())
+	return int(h.Sum32() % 100)
+}
+
+// auditDenial lets a request through that would have been denied for
+// reason, counting and logging it as audit-only.
+func (cf *CloudFrontGate) auditDenial(rw http.ResponseWriter, req *http.Request, ip net.IP, reason denyReason) {
+	cf.state.audited.Add(1)
+	cf.state.auditedBy[reason].Add(1)
+	if cf.state.auditLines.allow(ip, cf.now(), cf.reportLogInterval) {
+		cf.logger.infof("CloudFrontGate %s: audit: would deny client=%s host=%q path=%q reason=%s matched=%t",
+			cf.name, ip, req.Host, req.URL.Path, reason, ip != nil && cf.allowed(ip))
+	}
+	if cf.learning && reason == denyIP {
+		cf.state.learner.record(ip, cf.now(), cf.learningTTL, cf.learningMaxPrefixes)
+	}
+	if cf.decisionLog != nil {
+		cf.decisionLog.write(req, cf.now(), 0, "audit", reason.String(), cf.distributionLabel(req.Host))
+	}
+	cf.forward(rw, req)
+}
+
+// auditLimiter limits the audit lines of each address to one per interval.
+type auditLimiter struct {
+	mu     sync.Mutex
+	logged map[string]time.Time
+}
+
+// allow reports whether an audit line for ip may be written at now. When
+// too many addresses are tracked, the expired ones are forgotten, or all of
+// them if none has expired.
+func (l *auditLimiter) allow(ip net.IP, now time.Time, interval time.Duration) bool {
+	if interval <= 0 || ip == nil {
+		return true
+	}
+	key := ip.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if last, ok := l.logged[key]; ok && now.Sub(last) < interval {
+		return false
+	}
+	if l.logged == nil {
+		l.logged = make(map[string]time.Time)
+	}
+	if len(l.logged) >= maxReportLogAddresses {
+		for addr, last := range l.logged {
+			if now.Sub(last) >= interval {
+				delete(l.logged, addr)
+			}
+		}
+		if len(l.logged) >= maxReportLogAddresses {
+			l.logged = make(map[string]time.Time)
+		}
+	}
+	l.logged[key] = now
+	return true
+}
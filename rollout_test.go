@@ -0,0 +1,160 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnforcePercent(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	for _, percent := range []int{0, 50, 100} {
+		t.Run(fmt.Sprint(percent), func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.EnforcePercent = percent
+			handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer cf.Close()
+
+			var denied, audited uint64
+			for i := range 200 {
+				ip := net.IPv4(10, 0, byte(i), 1)
+				req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+				req.RemoteAddr = ip.String() + ":1234"
+				rw := httptest.NewRecorder()
+				cf.ServeHTTP(rw, req)
+
+				want := http.StatusOK
+				if enforceBucket(ip) < percent {
+					want = http.StatusForbidden
+					denied++
+				} else {
+					audited++
+				}
+				if rw.Code != want {
+					t.Fatalf("%s: expected status %d, got %d", ip, want, rw.Code)
+				}
+			}
+
+			if got := cf.state.denied.Load(); got != denied {
+				t.Errorf("Expected %d real denials, got %d", denied, got)
+			}
+			if got := cf.state.audited.Load(); got != audited {
+				t.Errorf("Expected %d audited denials, got %d", audited, got)
+			}
+			if got := cf.state.auditedBy[denyIP].Load(); got != audited {
+				t.Errorf("Expected audited denials counted under %s, got %d", denyIP, got)
+			}
+			if percent == 100 && audited != 0 {
+				t.Errorf("Expected no audits at 100%%")
+			}
+		})
+	}
+}
+
+func TestEnforcePercentValidation(t *testing.T) {
+	for _, percent := range []int{-1, 101} {
+		cfg := CreateConfig()
+		cfg.EnforcePercent = percent
+		next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+		if _, err := New(context.Background(), next, cfg, t.Name()); err == nil {
+			t.Errorf("Expected enforcePercent %d to be rejected", percent)
+		}
+	}
+}
+
+func TestReportOnlyMode(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	serve := func(cf *CloudFrontGate, remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/login", nil)
+		req.RemoteAddr = remoteAddr
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	for _, mode := range []string{modeEnforce, modeReportOnly} {
+		t.Run(mode, func(t *testing.T) {
+			logs.Reset()
+			cfg := CreateConfig()
+			cfg.Mode = mode
+			handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+
+			want := http.StatusForbidden
+			if mode == modeReportOnly {
+				want = http.StatusOK
+			}
+			for range 3 {
+				if got := serve(cf, "10.0.0.1:1234"); got != want {
+					t.Fatalf("Expected status %d, got %d", want, got)
+				}
+			}
+			if got := serve(cf, "205.251.249.10:1234"); got != http.StatusOK {
+				t.Errorf("Expected CloudFront to be allowed, got %d", got)
+			}
+
+			lines := strings.Count(logs.String(), "audit: would deny")
+			if mode == modeEnforce {
+				if lines != 0 {
+					t.Errorf("Expected no audit lines when enforcing, got %q", logs.String())
+				}
+				return
+			}
+			if lines != 1 || !strings.Contains(logs.String(), `client=10.0.0.1 host="example.com" path="/login" reason=ip matched=false`) {
+				t.Errorf("Expected one structured audit line per address, got %q", logs.String())
+			}
+			if cf.state.audited.Load() != 3 || cf.state.denied.Load() != 0 {
+				t.Errorf("Expected 3 audited and no denied requests, got %d and %d", cf.state.audited.Load(), cf.state.denied.Load())
+			}
+			if cf.mode() != modeReportOnly {
+				t.Errorf("mode() = %q, want %q", cf.mode(), modeReportOnly)
+			}
+		})
+	}
+
+	cfg := CreateConfig()
+	cfg.Mode = "observe"
+	if _, err := NewWithOptions(context.Background(), next, cfg, t.Name()+"invalid", withFixture()); err == nil {
+		t.Error("Expected an invalid mode to be rejected")
+	}
+}
+
+func TestAuditLimiter(t *testing.T) {
+	var l auditLimiter
+	now := time.Now()
+	ip := net.ParseIP("10.0.0.1")
+	if !l.allow(ip, now, time.Minute) || l.allow(ip, now.Add(59*time.Second), time.Minute) {
+		t.Error("Expected one line per address within the interval")
+	}
+	if !l.allow(ip, now.Add(time.Minute), time.Minute) || !l.allow(net.ParseIP("10.0.0.2"), now, time.Minute) {
+		t.Error("Expected a line after the interval and for other addresses")
+	}
+	if !l.allow(ip, now, 0) || !l.allow(ip, now, 0) {
+		t.Error("Expected a zero interval to log every line")
+	}
+}
@@ -0,0 +1,209 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetryBackoff caps the backoff between retries of a failing source,
+// unless its retry interval is longer.
+const maxRetryBackoff = 30 * time.Minute
+
+// jitterFraction is the largest share of a wait removed at random, so that
+// instances started together do not refresh in lockstep.
+const jitterFraction = 10
+
+// defaultMinRefreshInterval is the shortest refresh interval accepted
+// unless minRefreshInterval lowers it, so that a typo cannot flood the
+// source from every replica.
+const defaultMinRefreshInterval = time.Minute
+
+// parseMinRefreshInterval parses the minRefreshInterval option. Empty means
+// defaultMinRefreshInterval.
+func parseMinRefreshInterval(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultMinRefreshInterval, nil
+	}
+	floor, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse minRefreshInterval: %w", err)
+	}
+	if floor <= 0 {
+		return 0, fmt.Errorf("invalid minRefreshInterval %q: must be positive", value)
+	}
+	return floor, nil
+}
+
+// parseRefreshInterval parses the refresh interval of a source, which must
+// be at least floor. Shorter intervals are rejected rather than clamped.
+func parseRefreshInterval(value, option string, floor time.Duration) (time.Duration, error) {
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", option, err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be positive", option, value)
+	}
+	if interval < floor {
+		return 0, fmt.Errorf("invalid %s %q: must be at least minRefreshInterval %s", option, value, floor)
+	}
+	return interval, nil
+}
+
+// parseRetryInterval parses the retry interval of a source. Empty means
+// staleRetryInterval.
+func parseRetryInterval(value, option string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	retry, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", option, err)
+	}
+	if retry < time.Second {
+		return 0, fmt.Errorf("%s must be at least 1s", option)
+	}
+	return retry, nil
+}
+
+// retryInterval returns how often a failing source is retried.
+func (s sourceConfig) retryInterval() time.Duration {
+	if s.RetryInterval > 0 {
+		return s.RetryInterval
+	}
+	return staleRetryInterval
+}
+
+// retryBackoff returns the wait before the next retry after failures
+// consecutive failed refreshes: the retry interval, doubled after each
+// further failure up to maxRetryBackoff.
+func (s sourceConfig) retryBackoff(failures int) time.Duration {
+	backoff := s.retryInterval()
+	limit := maxRetryBackoff
+	if backoff > limit {
+		limit = backoff
+	}
+	for i := 1; i < failures && backoff < limit; i++ {
+		backoff *= 2
+	}
+	if backoff > limit {
+		return limit
+	}
+	return backoff
+}
+
+// StatusError is the error of a fetch answered with an unexpected status.
+// For 429 and 503 responses, RetryAfter is the delay asked for by their
+// Retry-After header, if any, which the retries of the source honor.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+	// Err explains the status, as parsed from the body, when known.
+	Err error
+}
+
+func (e *StatusError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("unexpected response status: %s: %v", e.Status, e.Err)
+	}
+	return "unexpected response status: " + e.Status
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// permanent reports whether retrying is unlikely to help: a client error
+// other than a timeout or throttling, such as a 404 for a moved endpoint.
+func (e *StatusError) permanent() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 &&
+		e.StatusCode != http.StatusRequestTimeout && e.StatusCode != http.StatusTooManyRequests
+}
+
+// newStatusError describes res, reading Retry-After from 429 and 503
+// responses.
+func newStatusError(res *http.Response, detail error, now time.Time) *StatusError {
+	e := &StatusError{StatusCode: res.StatusCode, Status: res.Status, Err: detail}
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		e.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), now)
+	}
+	return e
+}
+
+// parseRetryAfter parses a Retry-After value in seconds or as an HTTP date.
+// It returns zero when the value is missing, invalid or in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	at, err := http.ParseTime(value)
+	if err != nil || !at.After(now) {
+		return 0
+	}
+	return at.Sub(now)
+}
+
+// jitter shortens d by up to a tenth at random.
+func jitter(d time.Duration) time.Duration {
+	if spread := int64(d) / jitterFraction; spread > 0 {
+		return d - time.Duration(rand.Int63n(spread))
+	}
+	return d
+}
+
+// sourceStatus describes the schedule and last refresh of a shared source.
+type sourceStatus struct {
+	Source          string     `json:"source"`
+	RefreshInterval string     `json:"refreshInterval"`
+	RetryInterval   string     `json:"retryInterval"`
+	LastRefresh     *time.Time `json:"lastRefresh,omitempty"`
+	Stale           bool       `json:"stale"`
+	// Refreshing is set while a fetch is in flight; concurrent refreshes
+	// wait for it and share its result.
+	Refreshing bool `json:"refreshing"`
+	// ConsecutiveFailures counts the refreshes failed since the last
+	// success; LastError is the last failure, kept after a success, and
+	// LastErrorKind its class.
+	ConsecutiveFailures int64  `json:"consecutiveFailures"`
+	LastError           string `json:"lastError,omitempty"`
+	LastErrorKind       string `json:"lastErrorKind,omitempty"`
+	// Prefixes counts the stored prefixes.
+	Prefixes int `json:"prefixes"`
+	// Rejected counts the fetched datasets refused as implausible, without
+	// an anchor or shrinking too sharply; LastRejection is the last reason.
+	Rejected      uint64 `json:"rejected"`
+	LastRejection string `json:"lastRejection,omitempty"`
+}
+
+// status returns the schedule and last refresh of the entry.
+func (e *registryEntry) status(source string) sourceStatus {
+	status := sourceStatus{
+		Source:              source,
+		RefreshInterval:     e.source.RefreshInterval.String(),
+		RetryInterval:       e.source.retryInterval().String(),
+		Stale:               e.stale.Load(),
+		Refreshing:          e.ips.flight.running(),
+		Rejected:            e.ips.rejected.Load(),
+		ConsecutiveFailures: e.failures.Load(),
+		Prefixes:            len(e.ips.prefixes()),
+	}
+	status.LastError, _ = e.lastErr.Load().(string)
+	status.LastErrorKind, _ = e.lastErrKind.Load().(string)
+	status.LastRejection, _ = e.ips.lastRejection.Load().(string)
+	if updated, ok := e.ips.updated.Load().(time.Time); ok {
+		status.LastRefresh = &updated
+	}
+	return status
+}
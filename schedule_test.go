@@ -0,0 +1,329 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryInterval(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "5m", want: 5 * time.Minute},
+		{value: "500ms", wantErr: true},
+		{value: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRetryInterval(tt.value, "retryInterval")
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseRetryInterval(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("parseRetryInterval(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	if got := (sourceConfig{}).retryInterval(); got != staleRetryInterval {
+		t.Errorf("Expected the default retry interval %v, got %v", staleRetryInterval, got)
+	}
+	if (sourceConfig{RetryInterval: time.Minute}).key() == (sourceConfig{}).key() {
+		t.Errorf("Expected the retry interval to be part of the source key")
+	}
+}
+
+func TestParseRefreshInterval(t *testing.T) {
+	tests := []struct {
+		value   string
+		min     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "1m", want: time.Minute},
+		{value: "59s", wantErr: true},
+		{value: "1s", wantErr: true},
+		{value: "0s", wantErr: true},
+		{value: "0", wantErr: true},
+		{value: "-1h", wantErr: true},
+		{value: "", wantErr: true},
+		{value: "soon", wantErr: true},
+		{value: "1s", min: "1s", want: time.Second},
+		{value: "999ms", min: "1s", wantErr: true},
+		{value: "0s", min: "1ns", wantErr: true},
+		{value: "1h", min: "0s", wantErr: true},
+		{value: "1h", min: "-1m", wantErr: true},
+		{value: "1h", min: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value+"/"+tt.min, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.RefreshInterval = tt.value
+			cfg.MinRefreshInterval = tt.min
+			handler, err := NewWithOptions(context.Background(), http.NotFoundHandler(), cfg, t.Name(), withFixture())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+			if cf.refreshInterval != tt.want {
+				t.Errorf("Expected refresh interval %v, got %v", tt.want, cf.refreshInterval)
+			}
+		})
+	}
+
+	cfg := CreateConfig()
+	cfg.AllowRoute53HealthChecks = true
+	cfg.Route53HealthChecksRefreshInterval = "30s"
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name()); err == nil {
+		t.Error("Expected a short route53HealthChecksRefreshInterval to be rejected")
+	}
+}
+
+func TestPerSourceSchedules(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testAWSIPRanges))
+	}))
+	defer server.Close()
+
+	client := WithHTTPClient(fixtureClient(map[string]string{ipListURL: fixtureURL, awsIPRangesURL: server.URL}))
+
+	cfg := CreateConfig()
+	cfg.RefreshInterval = "168h"
+	cfg.RetryInterval = "10m"
+	cfg.AllowRoute53HealthChecks = true
+	cfg.Route53HealthChecksRefreshInterval = "1h"
+	cfg.Route53HealthChecksRetryInterval = "1m"
+
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), client)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+
+	sources := cf.status().Sources
+	if len(sources) != 2 {
+		t.Fatalf("Expected 2 sources in the status, got %+v", sources)
+	}
+	want := []struct{ source, refresh, retry string }{
+		{"cloudfront", "168h0m0s", "10m0s"},
+		{"route53-healthchecks", "1h0m0s", "1m0s"},
+	}
+	for i, w := range want {
+		got := sources[i]
+		if got.Source != w.source || got.RefreshInterval != w.refresh || got.RetryInterval != w.retry {
+			t.Errorf("Source %d = %+v, want %s refreshed every %s, retried every %s", i, got, w.source, w.refresh, w.retry)
+		}
+		if got.LastRefresh == nil {
+			t.Errorf("Expected a last refresh time for %s", w.source)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	src := sourceConfig{RetryInterval: time.Minute}
+	want := []time.Duration{time.Minute, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, 30 * time.Minute, 30 * time.Minute}
+	for failures, w := range want {
+		if got := src.retryBackoff(failures); got != w {
+			t.Errorf("retryBackoff(%d) = %s, want %s", failures, got, w)
+		}
+	}
+	if got := (sourceConfig{RetryInterval: time.Hour}).retryBackoff(5); got != time.Hour {
+		t.Errorf("Expected a retry interval above the cap to be kept, got %s", got)
+	}
+	if got := (sourceConfig{}).retryBackoff(1); got != staleRetryInterval {
+		t.Errorf("Expected the default retry interval first, got %s", got)
+	}
+
+	for range 100 {
+		if got := jitter(time.Hour); got > time.Hour || got <= 54*time.Minute {
+			t.Fatalf("jitter(1h) = %s, want within the last tenth", got)
+		}
+	}
+}
+
+func TestRefreshLoopRetriesWithBackoff(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if requests.Add(1) <= 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+
+	src := sourceConfig{URL: server.URL, RefreshInterval: time.Hour, RetryInterval: 10 * time.Millisecond, AllowPrivate: true}
+	entry := &registryEntry{source: src, ips: src.newStore(), wake: make(chan struct{}, 1)}
+	// As after a failed construction: retried right away, not in an hour.
+	entry.markStale()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		entry.refreshLoop(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for entry.ips.version.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the store to be updated after %d requests", requests.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := requests.Load(); got != 4 {
+		t.Errorf("Expected 3 failures and a success, got %d requests", got)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the refresh loop to exit on cancellation")
+	}
+	if entry.stale.Load() {
+		t.Error("Expected the entry not to be stale after a successful retry")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "120", want: 2 * time.Minute},
+		{value: " 1 ", want: time.Second},
+		{value: now.Add(90 * time.Second).Format(http.TimeFormat), want: 90 * time.Second},
+		{value: now.Add(-time.Minute).Format(http.TimeFormat), want: 0},
+		{value: "0", want: 0},
+		{value: "-5", want: 0},
+		{value: "soon", want: 0},
+		{value: "", want: 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadStatusError(t *testing.T) {
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/429-seconds":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/429-date":
+			w.Header().Set("Retry-After", date)
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/503":
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/500":
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path      string
+		status    int
+		min, max  time.Duration
+		permanent bool
+	}{
+		{path: "/429-seconds", status: http.StatusTooManyRequests, min: 30 * time.Second, max: 30 * time.Second},
+		{path: "/429-date", status: http.StatusTooManyRequests, min: 58 * time.Minute, max: time.Hour},
+		{path: "/503", status: http.StatusServiceUnavailable, min: 5 * time.Second, max: 5 * time.Second},
+		{path: "/500", status: http.StatusInternalServerError},
+		{path: "/moved", status: http.StatusNotFound, permanent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, err := download(context.Background(), http.DefaultClient, server.URL+tt.path)
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) {
+				t.Fatalf("Expected a *StatusError, got %v", err)
+			}
+			if statusErr.StatusCode != tt.status || statusErr.RetryAfter < tt.min || statusErr.RetryAfter > tt.max {
+				t.Errorf("Expected status %d with Retry-After in [%s, %s], got %d with %s",
+					tt.status, tt.min, tt.max, statusErr.StatusCode, statusErr.RetryAfter)
+			}
+			if statusErr.permanent() != tt.permanent {
+				t.Errorf("Expected permanent() = %t", tt.permanent)
+			}
+		})
+	}
+}
+
+func TestRefreshLoopHonorsRetryAfter(t *testing.T) {
+	var requests atomic.Int32
+	var failedAt atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if requests.Add(1) == 1 {
+			failedAt.Store(time.Now().UnixNano())
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+
+	src := sourceConfig{URL: server.URL, RefreshInterval: time.Hour, RetryInterval: 10 * time.Millisecond, AllowPrivate: true}
+	entry := &registryEntry{source: src, ips: src.newStore(), wake: make(chan struct{}, 1)}
+	if err := entry.refresh(context.Background()); err == nil {
+		t.Fatal("Expected the throttled refresh to fail")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		entry.refreshLoop(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor(t, "the retry", func() bool { return entry.ips.version.Load() != 0 })
+	// The backoff alone would have retried after 10ms.
+	if waited := time.Since(time.Unix(0, failedAt.Load())); waited < 900*time.Millisecond {
+		t.Errorf("Expected the retry to wait for Retry-After, waited %s", waited)
+	}
+	// The data is stored before the refresh records its success.
+	waitFor(t, "a success to clear the Retry-After", func() bool { return entry.retryAfter.Load() == 0 })
+}
+
+func TestRefreshLogsPermanentFailure(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	capture := &capturingLogger{}
+	logger := newGateLogger(0)
+	logger.out.Store(loggerBox{capture})
+	src := sourceConfig{URL: server.URL, RefreshInterval: time.Hour, AllowPrivate: true}
+	entry := &registryEntry{source: src, ips: src.newStore(), wake: make(chan struct{}, 1)}
+	entry.ips.logs.hold(logger)
+
+	_ = entry.refresh(context.Background())
+	if got := capture.String(); !strings.Contains(got, "404 Not Found: retrying is unlikely to help") {
+		t.Errorf("Expected the 404 to be reported as permanent, got %q", got)
+	}
+}
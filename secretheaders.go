@@ -0,0 +1,289 @@
+package cloudfrontgate
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SecretHeaderRule requires a secret header on requests below a path prefix.
+type SecretHeaderRule struct {
+	// PathPrefix selects the requests the rule applies to
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	// Name of the header
+	Name string `json:"name,omitempty"`
+	// Values lists the accepted header values; list several to rotate
+	Values []string `json:"values,omitempty"`
+	// Label names the rule in metrics, "rule<N>" by default
+	Label string `json:"label,omitempty"`
+}
+
+// secretHeaderRule is a validated SecretHeaderRule.
+type secretHeaderRule struct {
+	pathPrefix string
+	name       string
+	values     [][]byte
+	label      string
+}
+
+// decisionCounters counts the decisions under one label.
+type decisionCounters struct {
+	allowed atomic.Uint64
+	denied  atomic.Uint64
+}
+
+// labeledCounters holds decision counters by label. It lives in the
+// runtime state, so counts survive reloads that keep a label.
+type labeledCounters struct {
+	counters sync.Map
+}
+
+// get returns the counters of label.
+func (s *labeledCounters) get(label string) *decisionCounters {
+	if c, ok := s.counters.Load(label); ok {
+		return c.(*decisionCounters)
+	}
+	c, _ := s.counters.LoadOrStore(label, &decisionCounters{})
+	return c.(*decisionCounters)
+}
+
+// secretHeaderStatus describes a rule in the status endpoint.
+type secretHeaderStatus struct {
+	Label      string `json:"label"`
+	PathPrefix string `json:"pathPrefix"`
+	Header     string `json:"header"`
+	Matched    uint64 `json:"matched"`
+	Denied     uint64 `json:"denied"`
+}
+
+// defaultMinSecretLength is the default minimum length of secret values.
+const defaultMinSecretLength = 16
+
+// placeholderSecrets are values that protect nothing, compared
+// case-insensitively.
+var placeholderSecrets = []string{
+	"test", "secret", "changeme", "change-me", "password", "example", "default", "xxx", "todo",
+}
+
+// secretPolicy is the strength required of secret values. Weak values fail
+// in strict mode and are logged otherwise.
+type secretPolicy struct {
+	minLength int
+	strict    bool
+	// logger receives the weak secrets tolerated without strict.
+	logger *gateLogger
+}
+
+// check validates the strength of the values of the secret described by
+// what. The values are never part of the message.
+func (p secretPolicy) check(what string, values []string) error {
+	for i, value := range values {
+		var weakness string
+		switch {
+		case containsFold(placeholderSecrets, value):
+			weakness = "is a well-known placeholder"
+		case len(value) < p.minLength:
+			weakness = fmt.Sprintf("is shorter than %d characters", p.minLength)
+		default:
+			continue
+		}
+
+		err := fmt.Errorf("value %d of %s %s", i+1, what, weakness)
+		if p.strict {
+			return err
+		}
+		p.logger.errorf("SECURITY: weak secret: %v", err)
+	}
+	return nil
+}
+
+// checkRules validates the strength of the values of parsed rules.
+func (p secretPolicy) checkRules(rules []secretHeaderRule) error {
+	for _, rule := range rules {
+		values := make([]string, 0, len(rule.values))
+		for _, value := range rule.values {
+			values = append(values, string(value))
+		}
+		if err := p.check("secret header rule "+rule.label, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// containsFold reports whether values contains value, ignoring case.
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSecretHeaderRules validates rules, keeping their order.
+func parseSecretHeaderRules(rules []SecretHeaderRule) ([]secretHeaderRule, error) {
+	parsed := make([]secretHeaderRule, 0, len(rules))
+	labels := make(map[string]bool, len(rules))
+	for i, rule := range rules {
+		if !strings.HasPrefix(rule.PathPrefix, "/") {
+			return nil, fmt.Errorf("invalid secret header rule %d: pathPrefix %q must start with /", i+1, rule.PathPrefix)
+		}
+		if rule.Name == "" {
+			return nil, fmt.Errorf("invalid secret header rule %d: name is required", i+1)
+		}
+		if len(rule.Values) == 0 {
+			return nil, fmt.Errorf("invalid secret header rule %d: values are required", i+1)
+		}
+
+		label := rule.Label
+		if label == "" {
+			label = fmt.Sprintf("rule%d", i+1)
+		}
+		if !validMetricLabel(label) {
+			return nil, fmt.Errorf("invalid secret header rule label %q: use letters, digits, - and _", label)
+		}
+		if labels[label] {
+			return nil, fmt.Errorf("duplicate secret header rule label %q", label)
+		}
+		labels[label] = true
+
+		values := make([][]byte, 0, len(rule.Values))
+		for _, value := range rule.Values {
+			if value == "" {
+				return nil, errors.New("secret header values must not be empty")
+			}
+			values = append(values, []byte(value))
+		}
+		parsed = append(parsed, secretHeaderRule{
+			pathPrefix: rule.PathPrefix,
+			name:       http.CanonicalHeaderKey(rule.Name),
+			values:     values,
+			label:      label,
+		})
+	}
+	return parsed, nil
+}
+
+// originVerifyLabel labels the origin verify header in the status and metrics.
+const originVerifyLabel = "origin-verify"
+
+// parseOriginVerify returns the rule of the origin verify header, or nil
+// when none is configured. Secrets read from a file are held to the same
+// policy as inline ones.
+func parseOriginVerify(config *Config, policy secretPolicy) (*secretHeaderRule, error) {
+	values := config.OriginVerifySecrets
+	if config.OriginVerifySecretsFile != "" {
+		if len(values) > 0 {
+			return nil, errors.New("originVerifySecrets and originVerifySecretsFile are mutually exclusive")
+		}
+		raw, err := os.ReadFile(config.OriginVerifySecretsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read origin verify secrets file: %w", err)
+		}
+		for _, line := range strings.Split(string(raw), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				values = append(values, line)
+			}
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("origin verify secrets file %s holds no secret", config.OriginVerifySecretsFile)
+		}
+	}
+	if config.OriginVerifyHeader == "" && len(values) == 0 {
+		return nil, nil
+	}
+	if config.OriginVerifyHeader == "" || len(values) == 0 {
+		return nil, errors.New("originVerifyHeader requires originVerifySecrets or originVerifySecretsFile, and the reverse")
+	}
+
+	rules, err := parseSecretHeaderRules([]SecretHeaderRule{
+		{PathPrefix: "/", Name: config.OriginVerifyHeader, Values: values, Label: originVerifyLabel},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid origin verify header: %w", err)
+	}
+	if err := policy.check("originVerifySecrets", values); err != nil {
+		return nil, err
+	}
+	return &rules[0], nil
+}
+
+// checkOriginVerify checks the origin verify header, when configured.
+func (cf *CloudFrontGate) checkOriginVerify(req *http.Request) bool {
+	if cf.originVerify == nil {
+		return true
+	}
+	counters := cf.state.secretHeaders.get(cf.originVerify.label)
+	if cf.originVerify.accepts(req.Header.Get(cf.originVerify.name)) {
+		counters.allowed.Add(1)
+		return true
+	}
+	counters.denied.Add(1)
+	return false
+}
+
+// validMetricLabel reports whether label is safe in metric names.
+func validMetricLabel(label string) bool {
+	for _, r := range label {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return label != ""
+}
+
+// checkSecretHeader applies the first rule whose prefix matches the path.
+// Paths without a rule have no header requirement.
+func (cf *CloudFrontGate) checkSecretHeader(req *http.Request) bool {
+	for i := range cf.secretHeaderRules {
+		rule := &cf.secretHeaderRules[i]
+		if !strings.HasPrefix(req.URL.Path, rule.pathPrefix) {
+			continue
+		}
+
+		counters := cf.state.secretHeaders.get(rule.label)
+		if rule.accepts(req.Header.Get(rule.name)) {
+			counters.allowed.Add(1)
+			return true
+		}
+		counters.denied.Add(1)
+		return false
+	}
+	return true
+}
+
+// accepts reports whether value is one of the rule's values, comparing in
+// constant time.
+func (r *secretHeaderRule) accepts(value string) bool {
+	ok := 0
+	for _, want := range r.values {
+		ok |= subtle.ConstantTimeCompare([]byte(value), want)
+	}
+	return ok == 1
+}
+
+// secretHeaderStatus returns the counters of the configured rules.
+func (cf *CloudFrontGate) secretHeaderStatus() []secretHeaderStatus {
+	rules := cf.secretHeaderRules
+	if cf.originVerify != nil {
+		rules = append(append([]secretHeaderRule(nil), rules...), *cf.originVerify)
+	}
+	status := make([]secretHeaderStatus, 0, len(rules))
+	for _, rule := range rules {
+		counters := cf.state.secretHeaders.get(rule.label)
+		status = append(status, secretHeaderStatus{
+			Label:      rule.label,
+			PathPrefix: rule.pathPrefix,
+			Header:     rule.name,
+			Matched:    counters.allowed.Load(),
+			Denied:     counters.denied.Load(),
+		})
+	}
+	return status
+}
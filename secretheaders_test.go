@@ -0,0 +1,253 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSecretHeaderRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []SecretHeaderRule
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "valid", rules: []SecretHeaderRule{
+			{PathPrefix: "/api/", Name: "X-Edge-Secret", Values: []string{"a", "b"}, Label: "api"},
+			{PathPrefix: "/", Name: "X-Origin-Secret", Values: []string{"c"}},
+		}},
+		{name: "relative prefix", rules: []SecretHeaderRule{{PathPrefix: "api/", Name: "X", Values: []string{"a"}}}, wantErr: true},
+		{name: "missing name", rules: []SecretHeaderRule{{PathPrefix: "/", Values: []string{"a"}}}, wantErr: true},
+		{name: "missing values", rules: []SecretHeaderRule{{PathPrefix: "/", Name: "X"}}, wantErr: true},
+		{name: "empty value", rules: []SecretHeaderRule{{PathPrefix: "/", Name: "X", Values: []string{""}}}, wantErr: true},
+		{name: "bad label", rules: []SecretHeaderRule{{PathPrefix: "/", Name: "X", Values: []string{"a"}, Label: "a.b"}}, wantErr: true},
+		{name: "duplicate label", rules: []SecretHeaderRule{
+			{PathPrefix: "/a", Name: "X", Values: []string{"a"}, Label: "rule2"},
+			{PathPrefix: "/b", Name: "X", Values: []string{"a"}},
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseSecretHeaderRules(tt.rules)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSecretHeaderRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSecretPolicy(t *testing.T) {
+	strict := secretPolicy{minLength: defaultMinSecretLength, strict: true}
+	tests := []struct {
+		name    string
+		values  []string
+		wantErr bool
+	}{
+		{name: "strong", values: []string{"f3a9c1d0b7e24c6a"}},
+		{name: "short", values: []string{"f3a9c1d0b7e24c6a", "short-value"}, wantErr: true},
+		{name: "placeholder", values: []string{"ChangeMe"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := strict.check("secret header rule api", tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, value := range tt.values {
+				if err != nil && strings.Contains(err.Error(), value) {
+					t.Errorf("Expected the error not to echo the value, got %q", err)
+				}
+			}
+		})
+	}
+
+	if err := (secretPolicy{}).check("secret header rule api", []string{"a"}); err != nil {
+		t.Errorf("Expected a zero minimum length to accept short values, got %v", err)
+	}
+}
+
+func TestNewWarnsOnWeakSecret(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	cfg := CreateConfig()
+	cfg.SecretHeaderRules = []SecretHeaderRule{{PathPrefix: "/", Name: "X-Origin-Verify", Values: []string{"hunter2"}}}
+
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("Expected a weak secret to only warn, got %v", err)
+	}
+	_ = handler.(*CloudFrontGate).Close()
+	if !strings.Contains(logs.String(), "SECURITY: weak secret") {
+		t.Errorf("Expected a weak secret warning, got %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "hunter2") {
+		t.Errorf("Expected the warning not to echo the secret")
+	}
+
+	cfg.StrictSecrets = true
+	if _, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture()); err == nil {
+		t.Errorf("Expected a weak secret to fail with strictSecrets")
+	}
+}
+
+func TestServeHTTPSecretHeaderRules(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	cfg := CreateConfig()
+	cfg.SecretHeaderRules = []SecretHeaderRule{
+		{PathPrefix: "/api/", Name: "X-Edge-Secret", Values: []string{"edge-old", "edge-new"}, Label: "api"},
+		{PathPrefix: "/static/", Name: "X-Origin-Secret", Values: []string{"static"}},
+	}
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		path       string
+		header     string
+		value      string
+		want       int
+	}{
+		{name: "api rotated value", remoteAddr: "205.251.249.10:1234", path: "/api/users", header: "X-Edge-Secret", value: "edge-new", want: http.StatusOK},
+		{name: "api wrong header", remoteAddr: "205.251.249.10:1234", path: "/api/users", header: "X-Origin-Secret", value: "static", want: http.StatusForbidden},
+		{name: "static", remoteAddr: "205.251.249.10:1234", path: "/static/app.js", header: "X-Origin-Secret", value: "static", want: http.StatusOK},
+		{name: "static missing", remoteAddr: "205.251.249.10:1234", path: "/static/app.js", want: http.StatusForbidden},
+		{name: "unmatched path", remoteAddr: "205.251.249.10:1234", path: "/", want: http.StatusOK},
+		{name: "ip check first", remoteAddr: "10.0.0.1:1234", path: "/api/users", header: "X-Edge-Secret", value: "edge-new", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		if rw.Code != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.want, rw.Code)
+		}
+	}
+
+	want := []secretHeaderStatus{
+		{Label: "api", PathPrefix: "/api/", Header: "X-Edge-Secret", Matched: 1, Denied: 1},
+		{Label: "rule2", PathPrefix: "/static/", Header: "X-Origin-Secret", Matched: 1, Denied: 1},
+	}
+	got := cf.status().SecretHeaderRules
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d rules in the status, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Rule %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got := cf.state.deniedBy[denySecretHeader].Load(); got != 2 {
+		t.Errorf("Expected 2 %s denials, got %d", denySecretHeader, got)
+	}
+	if values := cf.snapshot().Config.SecretHeaderRules[0].Values; len(values) != 1 || values[0] != redacted {
+		t.Errorf("Expected secret header values to be redacted in the snapshot, got %v", values)
+	}
+}
+
+func TestServeHTTPOriginVerify(t *testing.T) {
+	secrets := filepath.Join(t.TempDir(), "origin-secrets")
+	if err := os.WriteFile(secrets, []byte("0123456789abcdef-current\n\n0123456789abcdef-next\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, mutate := range map[string]func(*Config){
+		"inline": func(cfg *Config) {
+			cfg.OriginVerifySecrets = []string{"0123456789abcdef-current", "0123456789abcdef-next"}
+		},
+		"file": func(cfg *Config) { cfg.OriginVerifySecretsFile = secrets },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.OriginVerifyHeader = "X-Origin-Verify"
+			mutate(cfg)
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if got := req.Header.Get("X-Origin-Verify"); got != "" {
+					t.Errorf("Expected the secret to be stripped, got %q", got)
+				}
+				rw.WriteHeader(http.StatusOK)
+			})
+			handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+
+			tests := []struct {
+				remoteAddr string
+				secret     string
+				want       int
+			}{
+				{remoteAddr: "205.251.249.10:1234", secret: "0123456789abcdef-current", want: http.StatusOK},
+				{remoteAddr: "205.251.249.10:1234", secret: "0123456789abcdef-next", want: http.StatusOK},
+				{remoteAddr: "205.251.249.10:1234", secret: "0123456789abcdef-wrong", want: http.StatusForbidden},
+				{remoteAddr: "205.251.249.10:1234", want: http.StatusForbidden},
+				{remoteAddr: "10.0.0.1:1234", secret: "0123456789abcdef-current", want: http.StatusForbidden},
+			}
+			for _, tt := range tests {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+				req.RemoteAddr = tt.remoteAddr
+				if tt.secret != "" {
+					req.Header.Set("X-Origin-Verify", tt.secret)
+				}
+				rw := httptest.NewRecorder()
+				cf.ServeHTTP(rw, req)
+				if rw.Code != tt.want {
+					t.Errorf("%s with %q: status = %d, want %d", tt.remoteAddr, tt.secret, rw.Code, tt.want)
+				}
+			}
+			if got := cf.state.deniedBy[denySecretHeader].Load(); got != 2 {
+				t.Errorf("Expected 2 secret header denials, got %d", got)
+			}
+			status := cf.secretHeaderStatus()
+			if len(status) != 1 || status[0].Label != originVerifyLabel || status[0].Matched != 2 || status[0].Denied != 2 {
+				t.Errorf("Unexpected origin verify status %+v", status)
+			}
+		})
+	}
+}
+
+func TestParseOriginVerifyValidation(t *testing.T) {
+	weak := filepath.Join(t.TempDir(), "weak")
+	if err := os.WriteFile(weak, []byte("changeme\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	strict := secretPolicy{minLength: defaultMinSecretLength, strict: true}
+	for name, config := range map[string]*Config{
+		"header only":  {OriginVerifyHeader: "X-Origin-Verify"},
+		"secrets only": {OriginVerifySecrets: []string{"0123456789abcdef"}},
+		"both sources": {OriginVerifyHeader: "X-Origin-Verify", OriginVerifySecrets: []string{"0123456789abcdef"}, OriginVerifySecretsFile: weak},
+		"missing file": {OriginVerifyHeader: "X-Origin-Verify", OriginVerifySecretsFile: weak + ".missing"},
+		"weak file":    {OriginVerifyHeader: "X-Origin-Verify", OriginVerifySecretsFile: weak},
+		"weak inline":  {OriginVerifyHeader: "X-Origin-Verify", OriginVerifySecrets: []string{"short"}},
+	} {
+		if _, err := parseOriginVerify(config, strict); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if rule, err := parseOriginVerify(&Config{}, strict); rule != nil || err != nil {
+		t.Errorf("Expected no rule without configuration, got %+v, %v", rule, err)
+	}
+}
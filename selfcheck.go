@@ -0,0 +1,75 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Self-check modes.
+const (
+	selfCheckLog    = "log"
+	selfCheckStrict = "strict"
+	selfCheckOff    = "off"
+)
+
+// selfCheckDenied is an address that must never be allowed by a sane
+// configuration (TEST-NET-1, reserved for documentation).
+var selfCheckDenied = net.ParseIP("192.0.2.1")
+
+func validateSelfCheck(mode string) error {
+	switch mode {
+	case "", selfCheckLog, selfCheckStrict, selfCheckOff:
+		return nil
+	default:
+		return fmt.Errorf("invalid selfCheck %q: must be %q, %q or %q", mode, selfCheckLog, selfCheckStrict, selfCheckOff)
+	}
+}
+
+// responseSamples returns the first address of each published list.
+func responseSamples(resp CFResponse) []net.IP {
+	var samples []net.IP
+	for _, list := range [][]string{resp.GlobalIPList, resp.RegionalEdgeIPList} {
+		if len(list) == 0 {
+			continue
+		}
+		ipNets, err := parseCIDRs(list[:1])
+		if err != nil {
+			continue
+		}
+		samples = append(samples, ipNets[0].IP)
+	}
+	return samples
+}
+
+// selfCheck evaluates addresses taken from the fetched data, which must be
+// allowed, and a known-bad address, which must be denied, through every
+// resolution stage, including the denylist. A mismatch is logged, or
+// returned in strict mode.
+func (cf *CloudFrontGate) selfCheck(mode string) error {
+	if mode == selfCheckOff {
+		return nil
+	}
+
+	var failures []string
+	samples, _ := cf.ips.samples.Load().([]net.IP)
+	for _, ip := range samples {
+		if d, ok := cf.resolve(addrOf(ip)); !ok || !d.Allow {
+			failures = append(failures, fmt.Sprintf("CloudFront address %s is denied", ip))
+		}
+	}
+	if d, ok := cf.resolve(addrOf(selfCheckDenied)); ok && d.Allow {
+		failures = append(failures, fmt.Sprintf("non-CloudFront address %s is allowed", selfCheckDenied))
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	err := fmt.Errorf("self-check failed: %s", strings.Join(failures, "; "))
+	if mode == selfCheckStrict {
+		return err
+	}
+	cf.logger.errorf("CloudFrontGate %s: %v", cf.name, err)
+	return nil
+}
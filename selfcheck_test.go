@@ -0,0 +1,96 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResponseSamples(t *testing.T) {
+	resp := CFResponse{
+		GlobalIPList:       []string{"120.52.22.96/27", "205.251.249.0/24"},
+		RegionalEdgeIPList: []string{"13.113.196.64/26"},
+	}
+
+	samples := responseSamples(resp)
+	want := []string{"120.52.22.96", "13.113.196.64"}
+	if len(samples) != len(want) {
+		t.Fatalf("Expected %d samples, got %d", len(want), len(samples))
+	}
+	for i, ip := range want {
+		if !samples[i].Equal(net.ParseIP(ip)) {
+			t.Errorf("Expected sample %s, got %s", ip, samples[i])
+		}
+	}
+
+	if got := responseSamples(CFResponse{GlobalIPList: []string{"1.1.1.0/24"}}); len(got) != 1 {
+		t.Errorf("Expected empty lists to be skipped, got %d samples", len(got))
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	tests := []struct {
+		name       string
+		mode       string
+		allowedIPs []string
+		wantErr    bool
+	}{
+		{name: "Healthy configuration", mode: selfCheckStrict},
+		{name: "Allow-all configuration in log mode", mode: selfCheckLog, allowedIPs: []string{"0.0.0.0/0"}},
+		{name: "Allow-all configuration in strict mode", mode: selfCheckStrict, allowedIPs: []string{"0.0.0.0/0"}, wantErr: true},
+		{name: "Allow-all configuration with self-check off", mode: selfCheckOff, allowedIPs: []string{"0.0.0.0/0"}},
+		{name: "Invalid mode", mode: "sometimes", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.SelfCheck = tt.mode
+			cfg.AllowedIPs = tt.allowedIPs
+
+			handler, err := NewWithOptions(context.Background(), next, cfg, "test", withFixture())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				_ = handler.(*CloudFrontGate).Close()
+			}
+		})
+	}
+	if sharedRegistry.size() != 0 {
+		t.Errorf("Expected failed self-checks to release the store, got %d entries", sharedRegistry.size())
+	}
+}
+
+func TestSelfCheckDetectsDeniedCloudFrontAddress(t *testing.T) {
+	ips := newIPStore("")
+	ips.samples.Store([]net.IP{net.ParseIP("13.32.0.1")})
+
+	cf := &CloudFrontGate{name: "test", ips: ips, state: &gateState{}}
+	if err := cf.selfCheck(selfCheckStrict); err == nil {
+		t.Errorf("Expected a CloudFront address missing from the store to fail the self-check")
+	}
+}
+
+func TestSelfCheckDetectsDenylistedCloudFrontAddress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist.txt")
+	if err := os.WriteFile(path, []byte("120.52.22.96/27\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.SelfCheck = selfCheckStrict
+	cfg.DenylistFile = path
+	if _, err := New(context.Background(), next, cfg, t.Name()); err == nil {
+		t.Errorf("Expected a denylist blocking CloudFront ranges to fail the self-check")
+	}
+	if sharedRegistry.size() != 0 {
+		t.Errorf("Expected the failed self-check to release the store, got %d entries", sharedRegistry.size())
+	}
+}
@@ -0,0 +1,116 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// Shadow source formats.
+const (
+	shadowFormatCloudFront = "cloudfront"
+	shadowFormatIPRanges   = "ip-ranges"
+)
+
+// ShadowSourceConfig configures a source that is fetched and compared with
+// the active source, but never enforced.
+type ShadowSourceConfig struct {
+	// URL of the shadow document
+	URL string `json:"url,omitempty"`
+	// Format is "cloudfront" (default) for the CloudFront API format, or "ip-ranges" for AWS ip-ranges.json
+	Format string `json:"format,omitempty"`
+	// Service selects the ip-ranges.json service, "CLOUDFRONT" by default
+	Service string `json:"service,omitempty"`
+}
+
+// shadowSource is the canonical form of ShadowSourceConfig in a
+// sourceConfig. An empty Service means the CloudFront API format.
+type shadowSource struct {
+	URL     string `json:"url"`
+	Service string `json:"service,omitempty"`
+}
+
+// parseShadowSource validates config. It returns nil when no URL is set.
+func parseShadowSource(config *ShadowSourceConfig) (*shadowSource, error) {
+	if config == nil || config.URL == "" {
+		return nil, nil
+	}
+
+	shadow := &shadowSource{URL: config.URL}
+	switch config.Format {
+	case "", shadowFormatCloudFront:
+		if config.Service != "" {
+			return nil, fmt.Errorf("shadowSource service requires format %q", shadowFormatIPRanges)
+		}
+	case shadowFormatIPRanges:
+		shadow.Service = config.Service
+		if shadow.Service == "" {
+			shadow.Service = "CLOUDFRONT"
+		}
+	default:
+		return nil, fmt.Errorf("invalid shadowSource format %q: must be %q or %q",
+			config.Format, shadowFormatCloudFront, shadowFormatIPRanges)
+	}
+	return shadow, nil
+}
+
+// shadowDiff is the result of the last comparison with the shadow source.
+type shadowDiff struct {
+	Source     string    `json:"source"`
+	CheckedAt  time.Time `json:"checkedAt"`
+	OnlyActive []string  `json:"onlyActive"`
+	OnlyShadow []string  `json:"onlyShadow"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// compareShadow fetches the shadow source and compares it with the active
+// prefixes. Both sides are aggregated first, so that splitting or merging
+// prefixes does not count as a difference. Failures never affect the
+// active source.
+func (ips *ipstore) compareShadow(ctx context.Context, active []netip.Prefix) {
+	if ips.shadow == nil {
+		return
+	}
+
+	diff := &shadowDiff{Source: ips.shadow.cfAPI, CheckedAt: time.Now().UTC()}
+	data, err := ips.shadow.fetch(ctx)
+	if err != nil {
+		ips.logs.errorf("Failed to fetch shadow source %s: %v", ips.shadow.cfAPI, err)
+		diff.Error = err.Error()
+		ips.shadowDiff.Store(diff)
+		return
+	}
+
+	diff.OnlyActive, diff.OnlyShadow = diffPrefixes(aggregate(active), aggregate(data.cidrs))
+	if len(diff.OnlyActive) > 0 || len(diff.OnlyShadow) > 0 {
+		ips.logs.errorf("Shadow source %s disagrees with %s: %d prefixes only in the active source, %d only in the shadow source",
+			ips.shadow.cfAPI, ips.cfAPI, len(diff.OnlyActive), len(diff.OnlyShadow))
+	}
+	ips.shadowDiff.Store(diff)
+}
+
+// diffPrefixes returns the sorted prefixes that are only in a or only in b.
+func diffPrefixes(a, b []netip.Prefix) (onlyA, onlyB []string) {
+	onlyA, onlyB = []string{}, []string{}
+	inA := make(map[string]bool, len(a))
+	for _, prefix := range a {
+		inA[prefix.String()] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, prefix := range b {
+		inB[prefix.String()] = true
+	}
+
+	for _, prefix := range sortedPrefixes(a) {
+		if !inB[prefix] {
+			onlyA = append(onlyA, prefix)
+		}
+	}
+	for _, prefix := range sortedPrefixes(b) {
+		if !inA[prefix] {
+			onlyB = append(onlyB, prefix)
+		}
+	}
+	return onlyA, onlyB
+}
@@ -0,0 +1,97 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseShadowSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *ShadowSourceConfig
+		want    *shadowSource
+		wantErr bool
+	}{
+		{name: "unset", config: nil, want: nil},
+		{name: "empty url", config: &ShadowSourceConfig{Format: shadowFormatIPRanges}, want: nil},
+		{name: "cloudfront", config: &ShadowSourceConfig{URL: "https://example.com/ips"}, want: &shadowSource{URL: "https://example.com/ips"}},
+		{
+			name:   "ip-ranges default service",
+			config: &ShadowSourceConfig{URL: "https://example.com/ip-ranges.json", Format: shadowFormatIPRanges},
+			want:   &shadowSource{URL: "https://example.com/ip-ranges.json", Service: "CLOUDFRONT"},
+		},
+		{name: "service without ip-ranges", config: &ShadowSourceConfig{URL: "https://example.com/ips", Service: "EC2"}, wantErr: true},
+		{name: "unknown format", config: &ShadowSourceConfig{URL: "https://example.com/ips", Format: "csv"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseShadowSource(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseShadowSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseShadowSource() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateComparesShadowSource(t *testing.T) {
+	// The shadow splits 54.192.0.0/16 into halves, which is not a difference,
+	// lacks 13.113.203.0/24 and adds 6.6.6.0/24.
+	shadowResponse := `{"prefixes": [
+		{"ip_prefix": "120.52.22.96/27", "service": "CLOUDFRONT"},
+		{"ip_prefix": "205.251.249.0/24", "service": "CLOUDFRONT"},
+		{"ip_prefix": "180.163.57.128/26", "service": "CLOUDFRONT"},
+		{"ip_prefix": "13.32.0.0/15", "service": "CLOUDFRONT"},
+		{"ip_prefix": "54.192.0.0/17", "service": "CLOUDFRONT"},
+		{"ip_prefix": "54.192.128.0/17", "service": "CLOUDFRONT"},
+		{"ip_prefix": "13.113.196.64/26", "service": "CLOUDFRONT"},
+		{"ip_prefix": "52.199.127.192/26", "service": "CLOUDFRONT"},
+		{"ip_prefix": "6.6.6.0/24", "service": "CLOUDFRONT"},
+		{"ip_prefix": "7.7.7.0/24", "service": "EC2"}
+	]}`
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(shadowResponse))
+	}))
+	defer shadowServer.Close()
+
+	src := sourceConfig{
+		URL:          fixtureURL,
+		AllowPrivate: true,
+		Shadow:       &shadowSource{URL: shadowServer.URL, Service: "CLOUDFRONT"},
+	}
+	ips := src.newStore()
+
+	ctx := context.Background()
+	if err := ips.Update(ctx); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	diff, ok := ips.shadowDiff.Load().(*shadowDiff)
+	if !ok {
+		t.Fatalf("Expected a shadow comparison after Update")
+	}
+	if diff.Error != "" {
+		t.Fatalf("Unexpected shadow error: %s", diff.Error)
+	}
+	if want := []string{"13.113.203.0/24"}; !reflect.DeepEqual(diff.OnlyActive, want) {
+		t.Errorf("OnlyActive = %v, want %v", diff.OnlyActive, want)
+	}
+	if want := []string{"6.6.6.0/24"}; !reflect.DeepEqual(diff.OnlyShadow, want) {
+		t.Errorf("OnlyShadow = %v, want %v", diff.OnlyShadow, want)
+	}
+
+	// A failing shadow is reported but never fails the update.
+	shadowServer.Close()
+	if err := ips.Update(ctx); err != nil {
+		t.Fatalf("Expected Update to ignore the shadow source, got %v", err)
+	}
+	diff, _ = ips.shadowDiff.Load().(*shadowDiff)
+	if diff.Error == "" {
+		t.Errorf("Expected the shadow failure to be recorded")
+	}
+}
@@ -0,0 +1,104 @@
+package cloudfrontgate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// defaultMaxShrinkPercent is the largest accepted drop in the number of
+// fetched prefixes between two updates.
+const defaultMaxShrinkPercent = 30
+
+// errShrinkRejected is returned by Update when a dataset is too much smaller
+// than the one currently loaded.
+var errShrinkRejected = errors.New("dataset shrinks too sharply")
+
+// pendingShrink is a rejected dataset awaiting confirmation.
+type pendingShrink struct {
+	trusted []netip.Prefix
+	data    *dataset
+	hash    string
+}
+
+// shrinkStatus describes a rejected shrink in the status endpoint.
+type shrinkStatus struct {
+	Current  int `json:"current"`
+	Proposed int `json:"proposed"`
+}
+
+// checkShrink reports whether data may replace the loaded dataset. A
+// dataset more than maxShrinkPercent smaller is rejected and kept pending;
+// it is accepted when the next fetch yields the same prefixes again.
+// Callers must hold updateMu.
+func (ips *ipstore) checkShrink(trusted []netip.Prefix, data *dataset) error {
+	current := int(ips.fetched.Load())
+	if ips.maxShrinkPercent <= 0 || current == 0 ||
+		len(data.cidrs)*100 >= current*(100-ips.maxShrinkPercent) {
+		ips.pending = nil
+		return nil
+	}
+
+	hash := datasetHash(data.cidrs)
+	if ips.pending != nil && ips.pending.hash == hash {
+		ips.logs.infof("SECURITY: accepting shrink of IP ranges from %s from %d to %d prefixes, seen twice in a row",
+			ips.cfAPI, current, len(data.cidrs))
+		ips.pending = nil
+		return nil
+	}
+
+	ips.pending = &pendingShrink{trusted: trusted, data: data, hash: hash}
+	ips.logs.errorf("SECURITY: rejecting IP ranges from %s, keeping previous data: shrink from %d to %d prefixes exceeds %d%%",
+		ips.cfAPI, current, len(data.cidrs), ips.maxShrinkPercent)
+	return fmt.Errorf("%w: from %d to %d prefixes", errShrinkRejected, current, len(data.cidrs))
+}
+
+// acceptShrink applies the pending dataset, if any.
+func (ips *ipstore) acceptShrink() (*shrinkStatus, bool) {
+	ips.updateMu.Lock()
+	defer ips.updateMu.Unlock()
+
+	if ips.pending == nil {
+		return nil, false
+	}
+	status := &shrinkStatus{Current: int(ips.fetched.Load()), Proposed: len(ips.pending.data.cidrs)}
+	ips.apply(ips.pending.trusted, ips.pending.data)
+	ips.pending = nil
+	return status, true
+}
+
+// pendingShrinkStatus returns the pending shrink, if any.
+func (ips *ipstore) pendingShrinkStatus() *shrinkStatus {
+	ips.updateMu.Lock()
+	defer ips.updateMu.Unlock()
+
+	if ips.pending == nil {
+		return nil
+	}
+	return &shrinkStatus{Current: int(ips.fetched.Load()), Proposed: len(ips.pending.data.cidrs)}
+}
+
+// datasetHash returns an order independent hash of prefixes.
+func datasetHash(prefixes []netip.Prefix) string {
+	sum := sha256.Sum256([]byte(strings.Join(sortedPrefixes(prefixes), "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// serveAcceptShrink applies a rejected shrink of the CloudFront ranges.
+func (cf *CloudFrontGate) serveAcceptShrink(rw http.ResponseWriter, _ *http.Request) {
+	status, ok := cf.ips.acceptShrink()
+	if !ok {
+		http.Error(rw, "no pending shrink", http.StatusConflict)
+		return
+	}
+	cf.logger.infof("SECURITY: CloudFrontGate %s: shrink of IP ranges from %d to %d prefixes accepted by an administrator",
+		cf.name, status.Current, status.Proposed)
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(status)
+}
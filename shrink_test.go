@@ -0,0 +1,135 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testShrunkResponse = `{
+	"CLOUDFRONT_GLOBAL_IP_LIST": ["120.52.22.96/27", "205.251.249.0/24", "54.192.0.0/16"],
+	"CLOUDFRONT_REGIONAL_EDGE_IP_LIST": []
+}`
+
+func TestUpdateRejectsSharpShrink(t *testing.T) {
+	var shrunk atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if shrunk.Load() {
+			_, _ = w.Write([]byte(testShrunkResponse))
+			return
+		}
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+
+	src := sourceConfig{URL: server.URL, AllowPrivate: true, MaxShrinkPercent: defaultMaxShrinkPercent}
+	ips := src.newStore()
+
+	ctx := context.Background()
+	if err := ips.Update(ctx); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	// 8 to 3 prefixes is rejected once, and the old data is kept.
+	shrunk.Store(true)
+	if err := ips.Update(ctx); !errors.Is(err, errShrinkRejected) {
+		t.Fatalf("Expected errShrinkRejected, got %v", err)
+	}
+	if !ips.Contains(net.ParseIP("13.32.0.1")) {
+		t.Errorf("Expected previous data to be kept")
+	}
+	if pending := ips.pendingShrinkStatus(); pending == nil || pending.Current != 8 || pending.Proposed != 3 {
+		t.Errorf("pendingShrinkStatus() = %+v, want 8 to 3", pending)
+	}
+
+	// The same shrink seen twice in a row is accepted.
+	if err := ips.Update(ctx); err != nil {
+		t.Fatalf("Expected the repeated shrink to be accepted, got %v", err)
+	}
+	if ips.Contains(net.ParseIP("13.32.0.1")) {
+		t.Errorf("Expected the shrunk data to be applied")
+	}
+	if ips.pendingShrinkStatus() != nil {
+		t.Errorf("Expected no pending shrink after accepting it")
+	}
+}
+
+func TestUpdateShrinkIgnoresTrustedIPs(t *testing.T) {
+	var shrunk atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if shrunk.Load() {
+			_, _ = w.Write([]byte(testShrunkResponse))
+			return
+		}
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+
+	src := sourceConfig{URL: server.URL, AllowPrivate: true, MaxShrinkPercent: defaultMaxShrinkPercent}
+	ips := src.newStore()
+
+	// Trusted IPs outnumbering the fetched prefixes must not hide the shrink.
+	trusted, _ := parsePrefixes([]string{"192.0.2.0/28", "192.0.2.16/28", "192.0.2.32/28", "192.0.2.48/28",
+		"192.0.2.64/28", "192.0.2.80/28", "192.0.2.96/28", "192.0.2.112/28", "192.0.2.128/28", "192.0.2.144/28"})
+	ips.setTrusted(trusted)
+	ctx := context.Background()
+	if err := ips.Update(ctx); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	shrunk.Store(true)
+	if err := ips.Update(ctx); !errors.Is(err, errShrinkRejected) {
+		t.Fatalf("Expected errShrinkRejected, got %v", err)
+	}
+	if got := len(ips.prefixes()); got != 18 {
+		t.Errorf("Expected the previous 18 prefixes to be kept, got %d", got)
+	}
+}
+
+func TestUpdateShrinkCheckDisabled(t *testing.T) {
+	response := testCFResponse
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	ips := sourceConfig{URL: server.URL, AllowPrivate: true}.newStore()
+	ctx := context.Background()
+	if err := ips.Update(ctx); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	response = testShrunkResponse
+	if err := ips.Update(ctx); err != nil {
+		t.Fatalf("Expected the shrink to be accepted without maxShrinkPercent, got %v", err)
+	}
+}
+
+func TestServeAcceptShrink(t *testing.T) {
+	cf := newAdminGate(t, func(cfg *Config) { cfg.MaxShrinkPercent = 50 })
+
+	if got := adminRequest(cf, http.MethodPost, "/_cfgate/accept-shrink", "10.0.0.1:1234", "s3cret"); got != http.StatusConflict {
+		t.Fatalf("Expected 409 without a pending shrink, got %d", got)
+	}
+
+	cf.ips.updateMu.Lock()
+	cf.ips.pending = &pendingShrink{data: &dataset{cidrs: []netip.Prefix{netip.MustParsePrefix("205.251.249.0/24")}}}
+	cf.ips.updateMu.Unlock()
+	t.Cleanup(func() {
+		ctx := context.Background()
+		_ = cf.ips.Update(ctx)
+	})
+
+	now := time.Now().Add(adminMutateInterval)
+	cf.now = func() time.Time { return now }
+	if got := adminRequest(cf, http.MethodPost, "/_cfgate/accept-shrink", "10.0.0.1:1234", "s3cret"); got != http.StatusOK {
+		t.Fatalf("Expected 200 accepting the shrink, got %d", got)
+	}
+	if cf.ips.Contains(net.ParseIP("13.32.0.1")) || !cf.ips.Contains(net.ParseIP("205.251.249.1")) {
+		t.Errorf("Expected the pending dataset to be applied")
+	}
+}
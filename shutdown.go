@@ -0,0 +1,86 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultShutdownTimeout bounds how long Close waits for the sinks.
+const defaultShutdownTimeout = 5 * time.Second
+
+// sink is an asynchronous output that must be flushed on shutdown.
+type sink struct {
+	name  string
+	close func() error
+}
+
+// sinks returns the configured asynchronous outputs.
+func (cf *CloudFrontGate) sinks() []sink {
+	var sinks []sink
+	if cf.statsd != nil {
+		sinks = append(sinks, sink{name: "statsd", close: cf.statsd.close})
+	}
+	if cf.decisionLog != nil {
+		sinks = append(sinks, sink{name: "decisionLog", close: cf.decisionLog.close})
+	}
+	if cf.fail2ban != nil {
+		sinks = append(sinks, sink{name: "fail2ban", close: cf.fail2ban.close})
+	}
+	if cf.mirror != nil {
+		sinks = append(sinks, sink{name: "denialMirror", close: cf.mirror.close})
+	}
+	return sinks
+}
+
+// closeSinks flushes and closes the sinks concurrently, waiting at most
+// timeout overall, and returns the outcome of each as "name=outcome".
+// Sinks that miss the deadline finish in the background.
+func closeSinks(sinks []sink, timeout time.Duration) []string {
+	type result struct {
+		index int
+		err   error
+	}
+	results := make(chan result, len(sinks))
+	for i, s := range sinks {
+		go func(i int, s sink) {
+			results <- result{index: i, err: s.close()}
+		}(i, s)
+	}
+
+	outcomes := make([]string, len(sinks))
+	for i, s := range sinks {
+		outcomes[i] = s.name + "=timeout"
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+wait:
+	for pending := len(sinks); pending > 0; pending-- {
+		select {
+		case r := <-results:
+			outcomes[r.index] = sinks[r.index].name + "=ok"
+			if r.err != nil {
+				outcomes[r.index] = fmt.Sprintf("%s=error (%v)", sinks[r.index].name, r.err)
+			}
+		case <-timer.C:
+			break wait
+		}
+	}
+	return outcomes
+}
+
+// shutdownSinks closes the sinks of the instance and logs the outcomes.
+func (cf *CloudFrontGate) shutdownSinks() {
+	sinks := cf.sinks()
+	if len(sinks) == 0 {
+		return
+	}
+
+	timeout := cf.shutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	start := time.Now()
+	outcomes := closeSinks(sinks, timeout)
+	cf.logger.infof("CloudFrontGate %s: closed in %s: %s", cf.name, time.Since(start).Round(time.Millisecond), strings.Join(outcomes, " "))
+}
@@ -0,0 +1,162 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCloseSinks(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	sinks := []sink{
+		{name: "fast", close: func() error { return nil }},
+		{name: "broken", close: func() error { return errors.New("disk full") }},
+		{name: "slow", close: func() error { <-release; return nil }},
+	}
+
+	start := time.Now()
+	got := closeSinks(sinks, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the deadline to bound the shutdown, took %s", elapsed)
+	}
+	want := []string{"fast=ok", "broken=error (disk full)", "slow=timeout"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("closeSinks() = %v, want %v", got, want)
+	}
+}
+
+func TestCloseFlushesSinksAndRacesServeHTTP(t *testing.T) {
+	dir := t.TempDir()
+	decisions := filepath.Join(dir, "decisions.log")
+	bans := filepath.Join(dir, "fail2ban.log")
+
+	cfg := CreateConfig()
+	cfg.DecisionLogFile = decisions
+	cfg.Fail2banLog = bans
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+
+	serve := func() {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		cf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve()
+
+	// Requests racing Close must neither panic nor reopen the files.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					serve()
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	_ = cf.Close()
+	_ = cf.Close()
+	close(stop)
+	wg.Wait()
+
+	for _, path := range []string{decisions, bans} {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Count(string(raw), "\n")
+		if lines == 0 {
+			t.Errorf("Expected %s to be flushed on Close", filepath.Base(path))
+		}
+
+		// Nothing is written after Close.
+		serve()
+		again, _ := os.ReadFile(path)
+		if len(again) != len(raw) {
+			t.Errorf("Expected %s not to change after Close", filepath.Base(path))
+		}
+	}
+}
+
+func TestCloseWaitsForRefreshInFlight(t *testing.T) {
+	var fetches atomic.Int32
+	hit := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		// The construction fetch answers at once, the next one is slow.
+		if fetches.Add(1) > 1 {
+			hit <- struct{}{}
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, _ = rw.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+	baseline := settledGoroutines()
+
+	cfg := CreateConfig()
+	cfg.IPListURL = server.URL
+	cfg.AllowPrivateSources = true
+	cfg.RefreshInterval = "1h"
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+
+	refreshed := make(chan error, 1)
+	go func() { refreshed <- cf.Refresh(context.Background()) }()
+	<-hit
+
+	start := time.Now()
+	if err := cf.Close(); err != nil {
+		t.Errorf("Expected a clean Close, got %v", err)
+	}
+	if took := time.Since(start); took > releaseTimeout {
+		t.Errorf("Expected Close to return within the release timeout, took %s", took)
+	}
+	if err := cf.Close(); err != nil {
+		t.Errorf("Expected a second Close to be a no-op, got %v", err)
+	}
+	if err := <-refreshed; err != nil {
+		t.Errorf("Expected the refresh in flight to complete, got %v", err)
+	}
+	// The loop, the update in flight and its connections are gone.
+	waitForGoroutines(t, baseline)
+}
+
+func TestNewWithCancelledContext(t *testing.T) {
+	baseline := settledGoroutines()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := New(ctx, http.NotFoundHandler(), CreateConfig(), t.Name()); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected construction to fail with context.Canceled, got %v", err)
+	}
+	waitForGoroutines(t, baseline)
+	if sharedRegistry.size() != 0 {
+		t.Errorf("Expected no entry to be acquired, got %d", sharedRegistry.size())
+	}
+}
@@ -0,0 +1,278 @@
+package cloudfrontgate
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SigV4 header names and constants.
+const (
+	headerAmzDate          = "X-Amz-Date"
+	headerAmzSecurityToken = "X-Amz-Security-Token"
+	headerAmzContentSHA256 = "X-Amz-Content-Sha256"
+	sigV4Algorithm         = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat        = "20060102T150405Z"
+	// emptyPayloadSHA256 is the SHA-256 of an empty body.
+	emptyPayloadSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// errCredentialsExpired is returned when S3 refuses expired credentials.
+var errCredentialsExpired = errors.New("AWS credentials expired: refresh the session token or access key")
+
+// errClockSkew is returned when S3 refuses a request signed with a clock
+// too far from its own.
+var errClockSkew = errors.New("request time too skewed: synchronize the system clock")
+
+// errCredentialsRejected is returned when S3 refuses the credentials or
+// the signature.
+var errCredentialsRejected = errors.New("AWS credentials rejected")
+
+// SigV4Config signs the IP list requests with AWS Signature Version 4, for
+// sources mirrored into a private S3 bucket. Unset fields are read from the
+// standard AWS environment variables.
+type SigV4Config struct {
+	// Region of the bucket; AWS_REGION or AWS_DEFAULT_REGION by default
+	Region string `json:"region,omitempty"`
+	// AccessKeyID is the access key; AWS_ACCESS_KEY_ID by default
+	AccessKeyID string `json:"accessKeyID,omitempty"`
+	// SecretAccessKey is the secret key; AWS_SECRET_ACCESS_KEY by default
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+	// SessionToken is the token of temporary credentials; AWS_SESSION_TOKEN by default
+	SessionToken string `json:"sessionToken,omitempty"`
+	// Service is the signing name, "s3" by default
+	Service string `json:"service,omitempty"`
+}
+
+// sigV4Credentials are the resolved signing settings in a sourceConfig.
+type sigV4Credentials struct {
+	Region          string `json:"region"`
+	Service         string `json:"service"`
+	AccessKeyID     string `json:"accessKeyID"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken,omitempty"`
+}
+
+// parseSigV4 resolves config against the environment. It returns nil when
+// config is nil.
+func parseSigV4(config *SigV4Config) (*sigV4Credentials, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	creds := &sigV4Credentials{
+		Region:          firstNonEmpty(config.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")),
+		Service:         firstNonEmpty(config.Service, "s3"),
+		AccessKeyID:     firstNonEmpty(config.AccessKeyID, os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretAccessKey: firstNonEmpty(config.SecretAccessKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		SessionToken:    firstNonEmpty(config.SessionToken, os.Getenv("AWS_SESSION_TOKEN")),
+	}
+	switch {
+	case creds.Region == "":
+		return nil, errors.New("sigV4 requires a region, or AWS_REGION")
+	case creds.AccessKeyID == "" || creds.SecretAccessKey == "":
+		return nil, errors.New("sigV4 requires an access key and secret, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return creds, nil
+}
+
+// firstNonEmpty returns the first non-empty value.
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// sign adds the SigV4 authorization to req, which must have no body. All
+// headers present on req are signed along with the host.
+func (c *sigV4Credentials) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format(sigV4TimeFormat)
+	date := amzDate[:8]
+
+	req.Header.Set(headerAmzDate, amzDate)
+	if c.SessionToken != "" {
+		req.Header.Set(headerAmzSecurityToken, c.SessionToken)
+	}
+	if c.Service == "s3" {
+		req.Header.Set(headerAmzContentSHA256, emptyPayloadSHA256)
+	}
+
+	canonical, signedHeaders := canonicalRequest(req, emptyPayloadSHA256)
+	scope := date + "/" + c.Region + "/" + c.Service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := signingKey(c.SecretAccessKey, date, c.Region, c.Service)
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, c.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalRequest returns the SigV4 canonical request of req and its
+// signed header list.
+func canonicalRequest(req *http.Request, payloadHash string) (canonical, signedHeaders string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if strings.EqualFold(name, "Authorization") {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(req.Method)
+	b.WriteByte('\n')
+	b.WriteString(canonicalURI(req.URL))
+	b.WriteByte('\n')
+	b.WriteString(canonicalQuery(req.URL))
+	b.WriteByte('\n')
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(headers[name])
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	signedHeaders = strings.Join(names, ";")
+	b.WriteString(signedHeaders)
+	b.WriteByte('\n')
+	b.WriteString(payloadHash)
+	return b.String(), signedHeaders
+}
+
+// canonicalURI URI-encodes each path segment once, as S3 expects.
+func canonicalURI(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if unescaped, err := url.PathUnescape(segment); err == nil {
+			segment = unescaped
+		}
+		segments[i] = sigV4Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery sorts and encodes the query parameters.
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, sigV4Escape(name)+"="+sigV4Escape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// sigV4Escape percent-encodes everything but the unreserved characters.
+func sigV4Escape(s string) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexDigits[c>>4])
+		b.WriteByte(hexDigits[c&0xf])
+	}
+	return b.String()
+}
+
+// signingKey derives the SigV4 signing key of a day, region and service.
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signingTransport signs the requests to the source host. Requests to other
+// hosts, such as after a cross-host redirect, are sent unsigned.
+type signingTransport struct {
+	next  http.RoundTripper
+	creds *sigV4Credentials
+	host  string
+	now   func() time.Time
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(req.URL.Host, t.host) {
+		return t.next.RoundTrip(req)
+	}
+	signed := req.Clone(req.Context())
+	t.creds.sign(signed, t.now())
+	return t.next.RoundTrip(signed)
+}
+
+// signingTransport wraps next, or the default transport when nil, to sign
+// the requests to the store's source host.
+func (ips *ipstore) signingTransport(next http.RoundTripper) (http.RoundTripper, error) {
+	u, err := url.Parse(ips.cfAPI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse source URL: %w", err)
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &signingTransport{next: next, creds: ips.sigV4, host: u.Host, now: time.Now}, nil
+}
+
+// s3Error classifies an S3 error document, returning nil when body is not
+// one of the errors that need operator action.
+func s3Error(body []byte) error {
+	var doc struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &doc) != nil {
+		return nil
+	}
+	switch doc.Code {
+	case "ExpiredToken", "TokenRefreshRequired":
+		return fmt.Errorf("%w: %s", errCredentialsExpired, doc.Message)
+	case "RequestTimeTooSkewed":
+		return fmt.Errorf("%w: %s", errClockSkew, doc.Message)
+	case "InvalidAccessKeyId", "SignatureDoesNotMatch", "InvalidToken":
+		return fmt.Errorf("%w: %s: %s", errCredentialsRejected, doc.Code, doc.Message)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package cloudfrontgate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redacted replaces secrets in the snapshot configuration.
+const redacted = "REDACTED"
+
+// headerStoreVersion carries the store version of a snapshot.
+const headerStoreVersion = "X-CFGate-Store-Version"
+
+// snapshot is a point-in-time document of everything an instance trusts.
+// It holds nothing process-local, such as the store version or fetch
+// times, so that replicas trusting the same prefixes produce byte-identical
+// documents. The store is identified by the hash of its prefixes.
+type snapshot struct {
+	Name    string           `json:"name"`
+	Config  *Config          `json:"config"`
+	Store   storeSnapshot    `json:"store"`
+	Sources []sourcePrefixes `json:"sources"`
+	Windows []windowStatus   `json:"maintenanceWindows"`
+	// Quarantined lists fetched prefixes that are not trusted yet.
+	Quarantined []string `json:"quarantined,omitempty"`
+}
+
+// storeSnapshot identifies the data of the shared store.
+type storeSnapshot struct {
+	Hash string `json:"hash"`
+}
+
+// sourcePrefixes lists the sorted prefixes that one source contributes.
+type sourcePrefixes struct {
+	Source   string   `json:"source"`
+	Labels   []string `json:"labels,omitempty"`
+	Active   *bool    `json:"active,omitempty"`
+	Prefixes []string `json:"prefixes"`
+}
+
+// redactConfig returns a copy of config with secrets replaced.
+func redactConfig(config *Config) *Config {
+	c := *config
+	if c.AdminToken != "" {
+		c.AdminToken = redacted
+	}
+	if c.SigV4 != nil {
+		sigV4 := *c.SigV4
+		if sigV4.SecretAccessKey != "" {
+			sigV4.SecretAccessKey = redacted
+		}
+		if sigV4.SessionToken != "" {
+			sigV4.SessionToken = redacted
+		}
+		c.SigV4 = &sigV4
+	}
+	if len(c.OriginVerifySecrets) > 0 {
+		c.OriginVerifySecrets = []string{redacted}
+	}
+	if len(c.SecretHeaderRules) > 0 {
+		rules := make([]SecretHeaderRule, len(c.SecretHeaderRules))
+		for i, rule := range c.SecretHeaderRules {
+			rule.Values = []string{redacted}
+			rules[i] = rule
+		}
+		c.SecretHeaderRules = rules
+	}
+	if len(c.Distributions) > 0 {
+		distributions := make(map[string]DistributionConfig, len(c.Distributions))
+		for host, d := range c.Distributions {
+			if len(d.SecretValues) > 0 {
+				d.SecretValues = []string{redacted}
+			}
+			distributions[host] = d
+		}
+		c.Distributions = distributions
+	}
+	return &c
+}
+
+// snapshot builds the snapshot document.
+func (cf *CloudFrontGate) snapshot() snapshot {
+	stored := cf.ips.prefixes()
+	prefixes := sortedPrefixes(stored)
+	sum := sha256.Sum256([]byte(strings.Join(prefixes, "\n")))
+
+	snap := snapshot{
+		Name:   cf.name,
+		Config: cf.config,
+		Store:  storeSnapshot{Hash: hex.EncodeToString(sum[:])},
+		Sources: []sourcePrefixes{
+			{Source: "cloudfront", Prefixes: prefixes},
+			{Source: "allowedIPs", Labels: cf.allowedSet().labels, Prefixes: sortedPrefixes(netipPrefixes(cf.allowedPrefixes()))},
+		},
+		Windows: cf.status().Windows,
+	}
+
+	if cf.healthChecks != nil {
+		health := cf.healthChecks.prefixes()
+		snap.Sources = append(snap.Sources, sourcePrefixes{
+			Source:   sourceRoute53HealthChecks.String(),
+			Prefixes: sortedPrefixes(health),
+		})
+	}
+
+	now := cf.now()
+	if cf.ips.quarantine > 0 {
+		for _, q := range cf.ips.quarantineStatus(cf.ips.now()) {
+			snap.Quarantined = append(snap.Quarantined, q.Prefix)
+		}
+	}
+	for _, mw := range cf.windows {
+		active := cf.isActive(mw, now)
+		snap.Sources = append(snap.Sources, sourcePrefixes{
+			Source:   "maintenanceWindow:" + mw.name,
+			Active:   &active,
+			Prefixes: sortedPrefixes(netipPrefixes(mw.prefixes)),
+		})
+	}
+	return snap
+}
+
+// serveSnapshot writes the snapshot as an indented JSON attachment. The
+// process-local store version and update time are sent as headers.
+func (cf *CloudFrontGate) serveSnapshot(rw http.ResponseWriter, _ *http.Request) {
+	snap := cf.snapshot()
+	body, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		http.Error(rw, "failed to encode snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("ETag", `"`+snap.Store.Hash+`"`)
+	rw.Header().Set(headerStoreVersion, strconv.FormatUint(cf.ips.version.Load(), 10))
+	if updated, ok := cf.ips.updated.Load().(time.Time); ok {
+		rw.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Disposition", `attachment; filename="cloudfrontgate-snapshot.json"`)
+	_, _ = rw.Write(append(body, '\n'))
+}
+
+// sortedPrefixes returns the prefixes in address order, shorter masks first.
+func sortedPrefixes(prefixes []netip.Prefix) []string {
+	sorted := append([]netip.Prefix(nil), prefixes...)
+	sort.Slice(sorted, func(i, j int) bool { return comparePrefixes(sorted[i], sorted[j]) < 0 })
+
+	out := make([]string, 0, len(sorted))
+	for _, prefix := range sorted {
+		out = append(out, prefix.String())
+	}
+	return out
+}
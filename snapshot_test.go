@@ -0,0 +1,143 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeSnapshot(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	build := func(name string, allowed []string) *CloudFrontGate {
+		t.Helper()
+		cfg := CreateConfig()
+		cfg.AdminPath = "/_cfgate"
+		cfg.AdminToken = "s3cret"
+		cfg.AllowedIPs = allowed
+		cfg.MaintenanceWindows = []MaintenanceWindow{
+			{Name: "pentest", CIDRs: []string{"198.51.100.0/24"}, Schedule: WindowSchedule{Start: "Mon 09:00", End: "Fri 17:00"}},
+		}
+
+		handler, err := NewWithOptions(context.Background(), next, cfg, name, withFixture())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		t.Cleanup(func() { _ = cf.Close() })
+		cf.now = func() time.Time { return time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC) }
+		return cf
+	}
+	var version string
+	fetch := func(cf *CloudFrontGate) []byte {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/_cfgate/snapshot", nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		recorder := httptest.NewRecorder()
+		cf.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+		}
+		version = recorder.Header().Get(headerStoreVersion)
+		if version == "" || recorder.Header().Get("Last-Modified") == "" || recorder.Header().Get("ETag") == "" {
+			t.Errorf("Expected the store version, update time and hash headers, got %v", recorder.Header())
+		}
+		return recorder.Body.Bytes()
+	}
+
+	// Replicas share the name and state; only the entry order differs.
+	a := build("replica", []string{"10.0.0.0/8", "192.168.1.0/24"})
+	b := build("replica", []string{"192.168.1.0/24", "10.0.0.0/8"})
+	// The replicas share the admin rate limit of their state.
+	b.now = func() time.Time { return time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC).Add(adminDumpInterval) }
+
+	first, second := fetch(a), fetch(b)
+	if bytes.Contains(first, []byte("s3cret")) {
+		t.Errorf("Expected the admin token to be redacted")
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(first, &snap); err != nil {
+		t.Fatalf("Failed to decode snapshot: %v", err)
+	}
+	if snap.Store.Hash == "" {
+		t.Errorf("Expected the store hash, got %+v", snap.Store)
+	}
+	if bytes.Contains(first, []byte("version")) || bytes.Contains(first, []byte("updatedAt")) {
+		t.Errorf("Expected no process-local fields in the snapshot:\n%s", first)
+	}
+	if len(snap.Sources) != 3 {
+		t.Fatalf("Expected cloudfront, allowedIPs and window sources, got %d", len(snap.Sources))
+	}
+	if got := strings.Join(snap.Sources[1].Prefixes, ","); got != "10.0.0.0/8,192.168.1.0/24" {
+		t.Errorf("Expected sorted prefixes, got %s", got)
+	}
+	if window := snap.Sources[2]; window.Active == nil || !*window.Active {
+		t.Errorf("Expected the window to be reported active, got %+v", window)
+	}
+
+	// Apart from the configured entry order, the documents are identical.
+	var snapB snapshot
+	if err := json.Unmarshal(second, &snapB); err != nil {
+		t.Fatalf("Failed to decode snapshot: %v", err)
+	}
+	snapB.Config.AllowedIPs = snap.Config.AllowedIPs
+	snapB.Sources[1].Labels = snap.Sources[1].Labels
+	normalized, _ := json.MarshalIndent(snapB, "", "  ")
+	if !bytes.Equal(append(normalized, '\n'), first) {
+		t.Errorf("Expected byte-identical snapshots:\n%s\n%s", first, normalized)
+	}
+
+	// A refresh that fetches the same prefixes changes the version only.
+	before := version
+	if err := a.ips.Update(context.Background()); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	a.now = func() time.Time { return time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC).Add(2 * adminDumpInterval) }
+	if again := fetch(a); !bytes.Equal(again, first) {
+		t.Errorf("Expected a refresh with unchanged prefixes to keep the snapshot identical:\n%s\n%s", first, again)
+	}
+	if version == before {
+		t.Errorf("Expected the refresh to change the store version header, got %s", version)
+	}
+}
+
+func TestSortedPrefixes(t *testing.T) {
+	prefixes, err := parsePrefixes([]string{"192.168.0.0/16", "10.0.0.0/16", "10.0.0.0/8", "9.255.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Join(sortedPrefixes(prefixes), " ")
+	if want := "9.255.0.0/16 10.0.0.0/8 10.0.0.0/16 192.168.0.0/16"; got != want {
+		t.Errorf("sortedPrefixes() = %s, want %s", got, want)
+	}
+}
+
+func TestRedactConfigSigV4(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SigV4 = &SigV4Config{Region: "us-east-1", AccessKeyID: "AKID", SecretAccessKey: "secret-key", SessionToken: "session"}
+
+	redactedConfig := redactConfig(cfg)
+	if got := redactedConfig.SigV4; got.SecretAccessKey != redacted || got.SessionToken != redacted || got.AccessKeyID != "AKID" {
+		t.Errorf("Expected the secret key and token to be redacted, got %+v", got)
+	}
+	if cfg.SigV4.SecretAccessKey != "secret-key" {
+		t.Error("Expected the original configuration to be unchanged")
+	}
+}
+
+func TestRedactConfigOriginVerify(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.OriginVerifyHeader = "X-Origin-Verify"
+	cfg.OriginVerifySecrets = []string{"0123456789abcdef-current", "0123456789abcdef-next"}
+
+	if got := redactConfig(cfg).OriginVerifySecrets; len(got) != 1 || got[0] != redacted {
+		t.Errorf("Expected the origin verify secrets to be redacted, got %q", got)
+	}
+}
@@ -0,0 +1,142 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// headerSource tells the backend which source admitted a request.
+const headerSource = "X-CFGate-Source"
+
+// trustSource identifies the source that admitted a request. The labels are
+// shared by the X-CFGate-Source header and the status counters.
+type trustSource int
+
+const (
+	sourceCloudFrontGlobal trustSource = iota
+	sourceCloudFrontRegional
+	sourceCustom
+	sourceRoute53HealthChecks
+	sourceAdditional
+	trustSourceCount
+)
+
+// String returns the source label.
+func (s trustSource) String() string {
+	switch s {
+	case sourceCloudFrontGlobal:
+		return "cloudfront-global"
+	case sourceCloudFrontRegional:
+		return "cloudfront-regional"
+	case sourceCustom:
+		return "custom"
+	case sourceRoute53HealthChecks:
+		return "route53-healthchecks"
+	case sourceAdditional:
+		return "additional"
+	default:
+		return "unknown"
+	}
+}
+
+// parseTrustSource returns the source of a label.
+func parseTrustSource(label string) (trustSource, bool) {
+	for source := trustSource(0); source < trustSourceCount; source++ {
+		if source.String() == label {
+			return source, true
+		}
+	}
+	return 0, false
+}
+
+// CloudFront lists of the ipLists option.
+const (
+	ipListGlobal   = "global"
+	ipListRegional = "regional"
+)
+
+// parseIPLists validates the ipLists option. Selecting both lists, the
+// default, returns nil so that the store is shared with instances that do
+// not set the option.
+func parseIPLists(lists []string) ([]string, error) {
+	global, regional := false, false
+	for _, list := range lists {
+		switch list {
+		case ipListGlobal:
+			global = true
+		case ipListRegional:
+			regional = true
+		default:
+			return nil, fmt.Errorf("invalid ipLists entry %q: must be %q or %q", list, ipListGlobal, ipListRegional)
+		}
+	}
+	switch {
+	case global == regional:
+		return nil, nil
+	case global:
+		return []string{ipListGlobal}, nil
+	default:
+		return []string{ipListRegional}, nil
+	}
+}
+
+// listSelected reports whether the prefixes of source are trusted under
+// lists; no lists select every one.
+func listSelected(lists []string, source trustSource) bool {
+	if len(lists) == 0 {
+		return true
+	}
+	switch source {
+	case sourceCloudFrontGlobal:
+		return containsString(lists, ipListGlobal)
+	case sourceCloudFrontRegional:
+		return containsString(lists, ipListRegional)
+	default:
+		return true
+	}
+}
+
+// selected returns resp without the lists that are not selected.
+func (resp CFResponse) selected(lists []string) CFResponse {
+	if !listSelected(lists, sourceCloudFrontGlobal) {
+		resp.GlobalIPList = nil
+	}
+	if !listSelected(lists, sourceCloudFrontRegional) {
+		resp.RegionalEdgeIPList = nil
+	}
+	return resp
+}
+
+// responseSources labels every prefix of the response with its list. A
+// prefix published in both lists counts as global.
+func responseSources(resp CFResponse) map[string]trustSource {
+	sources := make(map[string]trustSource, len(resp.GlobalIPList)+len(resp.RegionalEdgeIPList))
+	lists := []struct {
+		cidrs  []string
+		source trustSource
+	}{
+		{resp.RegionalEdgeIPList, sourceCloudFrontRegional},
+		{resp.GlobalIPList, sourceCloudFrontGlobal},
+	}
+	for _, list := range lists {
+		// The response was parsed already, so the entries are valid.
+		cidrs, _ := parseCIDRs(list.cidrs)
+		for _, cidr := range cidrs {
+			sources[cidr.String()] = list.source
+		}
+	}
+	return sources
+}
+
+// admit counts an admitted request by source and, when enabled, tells the
+// backend about it.
+func (cf *CloudFrontGate) admit(req *http.Request, source trustSource) {
+	cf.state.allowedBy[source].Add(1)
+	cf.countDistribution(req, true)
+	if cf.decisionLog != nil {
+		cf.decisionLog.write(req, cf.now(), 0, "allow", source.String(), cf.distributionLabel(req.Host))
+	}
+	if cf.sourceHeader {
+		req.Header.Set(headerSource, source.String())
+	}
+}
@@ -0,0 +1,157 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseSources(t *testing.T) {
+	sources := responseSources(CFResponse{
+		GlobalIPList:       []string{"205.251.249.0/24", "52.46.0.0/18"},
+		RegionalEdgeIPList: []string{"13.113.203.0/24", "52.46.0.0/18"},
+	})
+
+	tests := map[string]trustSource{
+		"205.251.249.0/24": sourceCloudFrontGlobal,
+		"13.113.203.0/24":  sourceCloudFrontRegional,
+		"52.46.0.0/18":     sourceCloudFrontGlobal,
+	}
+	for prefix, want := range tests {
+		if got, ok := sources[prefix]; !ok || got != want {
+			t.Errorf("source of %s = %s, want %s", prefix, got, want)
+		}
+	}
+}
+
+func TestServeHTTPSourceHeader(t *testing.T) {
+	var got string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header.Get(headerSource)
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		host       string
+		remoteAddr string
+		want       string
+	}{
+		{name: "off by default", remoteAddr: "205.251.249.10:1234", want: "spoofed"},
+		{name: "global", enabled: true, remoteAddr: "205.251.249.10:1234", want: "cloudfront-global"},
+		{name: "regional", enabled: true, remoteAddr: "13.113.203.10:1234", want: "cloudfront-regional"},
+		{name: "custom", enabled: true, remoteAddr: "192.168.1.10:1234", want: "custom"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.SourceHeader = tt.enabled
+			cfg.AllowedIPs = []string{"192.168.1.0/24"}
+
+			handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer cf.Close()
+
+			host := tt.host
+			if host == "" {
+				host = "www.example.com"
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://"+host, nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set(headerSource, "spoofed")
+			got = ""
+			cf.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Errorf("%s = %q, want %q", headerSource, got, tt.want)
+			}
+			if tt.enabled {
+				if n := cf.status().AllowedBy[tt.want]; n != 1 {
+					t.Errorf("Expected the %s counter to be 1, got %d", tt.want, n)
+				}
+			}
+		})
+	}
+}
+
+func TestParseResponseIPLists(t *testing.T) {
+	resp := CFResponse{
+		GlobalIPList:       []string{"205.251.249.0/24", "2600:9000::/28"},
+		RegionalEdgeIPList: []string{"13.113.203.0/24"},
+	}
+	tests := []struct {
+		lists []string
+		want  string
+		aws   int
+	}{
+		{lists: nil, want: "205.251.249.0/24 2600:9000::/28 13.113.203.0/24", aws: 5},
+		{lists: []string{ipListGlobal, ipListRegional}, want: "205.251.249.0/24 2600:9000::/28 13.113.203.0/24", aws: 5},
+		{lists: []string{ipListGlobal}, want: "205.251.249.0/24 2600:9000::/28", aws: 4},
+		{lists: []string{ipListRegional}, want: "13.113.203.0/24", aws: 1},
+	}
+	for _, tt := range tests {
+		lists, err := parseIPLists(tt.lists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cidrs, err := parseResponse(resp.selected(lists))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, cidr := range cidrs {
+			got = append(got, cidr.String())
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("parseResponse() with lists %v = %v, want %v", tt.lists, got, tt.want)
+		}
+
+		data, err := parseAWSIPRanges([]byte(testAWSCloudFrontRanges), serviceCloudFront, nil, lists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data.cidrs) != tt.aws {
+			t.Errorf("parseAWSIPRanges() with lists %v returned %d prefixes, want %d", tt.lists, len(data.cidrs), tt.aws)
+		}
+	}
+
+	if _, err := parseIPLists([]string{ipListGlobal, "edge"}); err == nil {
+		t.Error("Expected an unknown list to be rejected")
+	}
+}
+
+func TestIPLists(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.IPLists = []string{ipListGlobal}
+	handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	if got := cf.Status().Prefixes; got != 5 {
+		t.Errorf("Expected the 5 global prefixes, got %d", got)
+	}
+	for addr, want := range map[string]int{"205.251.249.10": http.StatusOK, "13.113.203.10": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = addr + ":443"
+		rw := httptest.NewRecorder()
+		cf.ServeHTTP(rw, req)
+		if rw.Code != want {
+			t.Errorf("Expected %s to get %d, got %d", addr, want, rw.Code)
+		}
+	}
+
+	cfg.IPLists = []string{"regional-edge"}
+	if _, err := NewWithOptions(context.Background(), http.NotFoundHandler(), cfg, t.Name(), withFixture()); err == nil {
+		t.Error("Expected an unknown list to be rejected at construction")
+	}
+}
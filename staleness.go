@@ -0,0 +1,102 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// headerDataAge reports the age of the enforced data in seconds.
+const headerDataAge = "X-CFGate-Data-Age"
+
+// dataAge returns how long ago the shared store was last updated. ok is
+// false when it never was.
+func (cf *CloudFrontGate) dataAge() (age time.Duration, ok bool) {
+	updated, ok := cf.ips.updated.Load().(time.Time)
+	if !ok {
+		return 0, false
+	}
+	return cf.now().Sub(updated), true
+}
+
+// signalDataAge sets the data age header on an allowed response while the
+// data is older than the staleness warning threshold but within
+// maxStaleness, past which staleAction decides instead.
+func (cf *CloudFrontGate) signalDataAge(rw http.ResponseWriter) {
+	if !cf.dataAgeHeader || cf.staleWarningAfter <= 0 {
+		return
+	}
+	// Stealth mode does not reveal anything about the gate.
+	if cf.admin != nil && cf.admin.stealth {
+		return
+	}
+
+	age, ok := cf.dataAge()
+	if !ok || age < cf.staleWarningAfter || (cf.maxStaleness > 0 && age >= cf.maxStaleness) {
+		return
+	}
+	rw.Header().Set(headerDataAge, strconv.FormatInt(int64(age/time.Second), 10))
+}
+
+// Actions of staleAction once the data is older than maxStaleness.
+const (
+	staleIgnore     = "ignore"
+	staleFailClosed = "failClosed"
+	staleFailOpen   = "failOpen"
+)
+
+// parseStaleness validates maxStaleness and staleAction.
+func parseStaleness(maxStaleness, action string) (time.Duration, error) {
+	switch action {
+	case "", staleIgnore, staleFailClosed, staleFailOpen:
+	default:
+		return 0, fmt.Errorf("invalid staleAction %q: must be %q, %q or %q", action, staleIgnore, staleFailClosed, staleFailOpen)
+	}
+	if maxStaleness == "" {
+		if action == staleFailClosed || action == staleFailOpen {
+			return 0, fmt.Errorf("staleAction %q requires maxStaleness", action)
+		}
+		return 0, nil
+	}
+	age, err := time.ParseDuration(maxStaleness)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse max staleness: %w", err)
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("invalid maxStaleness %q: must be positive", maxStaleness)
+	}
+	return age, nil
+}
+
+// stale reports whether staleAction applies, the data being older than
+// maxStaleness, and its age. It only loads the update time, so that it is
+// cheap on every request.
+func (cf *CloudFrontGate) stale() (time.Duration, bool) {
+	if cf.maxStaleness <= 0 || cf.staleAction == "" || cf.staleAction == staleIgnore {
+		return 0, false
+	}
+	age, ok := cf.dataAge()
+	return age, ok && age > cf.maxStaleness
+}
+
+// admitStale forwards a request that no stage decided while the data is
+// beyond maxStaleness under the failOpen staleAction.
+func (cf *CloudFrontGate) admitStale(rw http.ResponseWriter, req *http.Request, age time.Duration) {
+	cf.state.failedOpen.Add(1)
+	cf.logStale("admitting requests unchecked", age)
+	if cf.decisionLog != nil {
+		cf.decisionLog.write(req, cf.now(), 0, "allow", "stale-fail-open", cf.distributionLabel(req.Host))
+	}
+	cf.forward(rw, req)
+}
+
+// logStale logs the staleAction at most every unavailableLogInterval.
+func (cf *CloudFrontGate) logStale(action string, age time.Duration) {
+	now := cf.now().UnixNano()
+	last := cf.state.staleLoggedAt.Load()
+	if now-last >= int64(unavailableLogInterval) && cf.state.staleLoggedAt.CompareAndSwap(last, now) {
+		cf.logger.errorf("CloudFrontGate %s: %s, the CloudFront IP ranges are %s old, beyond maxStaleness %s",
+			cf.name, action, age.Round(time.Second), cf.maxStaleness)
+	}
+}
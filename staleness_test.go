@@ -0,0 +1,141 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignalDataAge(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name    string
+		header  bool
+		stealth bool
+		max     string
+		age     time.Duration
+		remote  string
+		want    string
+	}{
+		{name: "off by default", age: 26 * time.Hour, remote: "205.251.249.10:1234"},
+		{name: "fresh data", header: true, age: time.Hour, remote: "205.251.249.10:1234"},
+		{name: "stale data", header: true, age: 26 * time.Hour, remote: "205.251.249.10:1234", want: "93600"},
+		{name: "stealth mode", header: true, stealth: true, age: 26 * time.Hour, remote: "205.251.249.10:1234"},
+		{name: "denied request", header: true, age: 26 * time.Hour, remote: "10.0.0.1:1234"},
+		{name: "just below maxStaleness", header: true, max: "48h", age: 48*time.Hour - time.Second, remote: "205.251.249.10:1234", want: "172799"},
+		{name: "at maxStaleness", header: true, max: "48h", age: 48 * time.Hour, remote: "205.251.249.10:1234"},
+		{name: "beyond maxStaleness", header: true, max: "48h", age: 72 * time.Hour, remote: "205.251.249.10:1234"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.StaleWarningAfter = "25h"
+			cfg.DataAgeHeader = tt.header
+			cfg.MaxStaleness = tt.max
+			if tt.stealth {
+				cfg.AdminPath = "/_cfgate"
+				cfg.AdminToken = "s3cret"
+				cfg.AdminStealth = true
+			}
+
+			handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer cf.Close()
+
+			updated, _ := cf.ips.updated.Load().(time.Time)
+			cf.now = func() time.Time { return updated.Add(tt.age) }
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+			req.RemoteAddr = tt.remote
+			recorder := httptest.NewRecorder()
+			cf.ServeHTTP(recorder, req)
+
+			if got := recorder.Header().Get(headerDataAge); got != tt.want {
+				t.Errorf("%s = %q, want %q", headerDataAge, got, tt.want)
+			}
+			if got := cf.status().DataAgeSeconds; got == nil || *got != int64(tt.age/time.Second) {
+				t.Errorf("Expected the status gauge to report the data age, got %v", got)
+			}
+		})
+	}
+}
+
+func TestNewRejectsDataAgeHeaderWithoutThreshold(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.DataAgeHeader = true
+	if _, err := New(context.Background(), next, cfg, "test"); err == nil {
+		t.Errorf("Expected dataAgeHeader without staleWarningAfter to fail")
+	}
+}
+
+func TestStaleAction(t *testing.T) {
+	tests := []struct {
+		action string
+		age    time.Duration
+		want   map[string]int
+	}{
+		{action: staleIgnore, age: 2 * time.Hour, want: map[string]int{"205.251.249.10": 200, "198.51.100.1": 200, "192.0.2.1": 403}},
+		{action: staleFailClosed, age: 2 * time.Hour, want: map[string]int{"205.251.249.10": 403, "198.51.100.1": 200, "192.0.2.1": 403}},
+		{action: staleFailClosed, age: 30 * time.Minute, want: map[string]int{"205.251.249.10": 200, "198.51.100.1": 200, "192.0.2.1": 403}},
+		{action: staleFailOpen, age: 2 * time.Hour, want: map[string]int{"205.251.249.10": 200, "198.51.100.1": 200, "192.0.2.1": 200, "203.0.113.9": 403}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action+" "+tt.age.String(), func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.AllowedIPs = []string{"198.51.100.0/24"}
+			cfg.BlockedIPs = []string{"203.0.113.0/24"}
+			cfg.MaxStaleness = "1h"
+			cfg.StaleAction = tt.action
+			next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) { rw.WriteHeader(http.StatusOK) })
+			handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+
+			now := time.Now()
+			cf.now = func() time.Time { return now }
+			previous := cf.ips.updated.Load()
+			cf.ips.updated.Store(now.Add(-tt.age))
+			defer cf.ips.updated.Store(previous)
+
+			for addr, want := range tt.want {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+				req.RemoteAddr = addr + ":443"
+				rw := httptest.NewRecorder()
+				cf.ServeHTTP(rw, req)
+				if rw.Code != want {
+					t.Errorf("Expected %d for %s, got %d", want, addr, rw.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestParseStaleness(t *testing.T) {
+	if age, err := parseStaleness("168h", staleFailClosed); err != nil || age != 168*time.Hour {
+		t.Errorf("parseStaleness() = %s, %v", age, err)
+	}
+	for _, tt := range []struct{ age, action string }{
+		{"", staleFailOpen},
+		{"1h", "deny"},
+		{"-1h", staleFailClosed},
+		{"soon", staleFailClosed},
+	} {
+		if _, err := parseStaleness(tt.age, tt.action); err == nil {
+			t.Errorf("Expected maxStaleness %q with staleAction %q to be rejected", tt.age, tt.action)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package cloudfrontgate
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the StatsD push.
+const (
+	defaultStatsDPrefix        = "cloudfrontgate"
+	defaultStatsDFlushInterval = 10 * time.Second
+	// statsdMaxPacket keeps packets within a typical Ethernet MTU.
+	statsdMaxPacket = 1432
+)
+
+// StatsDConfig configures pushing metrics to a StatsD server over UDP.
+type StatsDConfig struct {
+	// Address is the "host:port" of the StatsD server
+	Address string `json:"address,omitempty"`
+	// Prefix is prepended to every metric name, "cloudfrontgate" by default
+	Prefix string `json:"prefix,omitempty"`
+	// Tags are DogStatsD tags such as "env:prod" added to every metric
+	Tags []string `json:"tags,omitempty"`
+	// FlushInterval is the interval between pushes, "10s" by default
+	FlushInterval string `json:"flushInterval,omitempty"`
+}
+
+// statsdCounters remembers the counter values last pushed for a middleware,
+// so that every push sends deltas. It lives in the gateState, which keeps
+// deltas correct across reloads.
+type statsdCounters struct {
+	mu   sync.Mutex
+	last map[string]uint64
+}
+
+// statsdPusher periodically pushes the metrics of an instance.
+type statsdPusher struct {
+	cf       *CloudFrontGate
+	conn     net.Conn
+	prefix   string
+	tags     string
+	interval time.Duration
+
+	warned atomic.Bool
+	// lastErr is the error of the last push, owned by the flusher.
+	lastErr error
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newStatsdPusher validates the configuration and connects the socket. It
+// returns nil when no address is configured.
+func newStatsdPusher(cf *CloudFrontGate, config *StatsDConfig) (*statsdPusher, error) {
+	if config == nil || config.Address == "" {
+		return nil, nil
+	}
+
+	interval := defaultStatsDFlushInterval
+	if config.FlushInterval != "" {
+		var err error
+		interval, err = time.ParseDuration(config.FlushInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse statsd flush interval: %w", err)
+		}
+		if interval <= 0 {
+			return nil, errors.New("statsd flush interval must be positive")
+		}
+	}
+
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultStatsDPrefix
+	}
+	for _, tag := range config.Tags {
+		if tag == "" || strings.ContainsAny(tag, ",|#\n") {
+			return nil, fmt.Errorf("invalid statsd tag %q", tag)
+		}
+	}
+
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to statsd: %w", err)
+	}
+
+	p := &statsdPusher{
+		cf:       cf,
+		conn:     conn,
+		prefix:   strings.TrimSuffix(prefix, "."),
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if len(config.Tags) > 0 {
+		p.tags = "|#" + strings.Join(config.Tags, ",")
+	}
+	return p, nil
+}
+
+// start runs the flusher in the background.
+func (p *statsdPusher) start() {
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				p.flush()
+				return
+			case <-ticker.C:
+				p.flush()
+			}
+		}
+	}()
+}
+
+// close pushes the last deltas, stops the flusher and closes the socket.
+// It reports whether the last push failed.
+func (p *statsdPusher) close() error {
+	close(p.stop)
+	<-p.done
+	_ = p.conn.Close()
+	return p.lastErr
+}
+
+// flush sends the counter deltas and gauges.
+func (p *statsdPusher) flush() {
+	p.lastErr = nil
+	for _, packet := range packLines(p.lines(), statsdMaxPacket) {
+		if _, err := p.conn.Write([]byte(packet)); err != nil {
+			p.lastErr = fmt.Errorf("failed to push statsd metrics: %w", err)
+			if p.warned.CompareAndSwap(false, true) {
+				p.cf.logger.errorf("CloudFrontGate %s: failed to push statsd metrics, further errors are not logged: %v", p.cf.name, err)
+			}
+		}
+	}
+}
+
+// lines returns the metric lines of the current state.
+func (p *statsdPusher) lines() []string {
+	state := p.cf.state
+	counters := map[string]uint64{
+		"requests.allowed":            state.allowed.Load(),
+		"requests.denied":             state.denied.Load(),
+		"requests.delegated":          state.delegated.Load(),
+		"requests.excluded":           state.excluded.Load(),
+		"requests.spoofed":            state.spoofed.Load(),
+		"requests.unavailable":        state.unavailable.Load(),
+		"requests.failed_open":        state.failedOpen.Load(),
+		"requests.unparsable":         state.unparsable.Load(),
+		"requests.unparsable_allowed": state.unparsableAllowed.Load(),
+		"requests.audited":            state.audited.Load(),
+		"matcher.divergences":         state.matcherDivergences.Load(),
+		"mirror.sent":                 state.mirrored.Load(),
+		"mirror.failed":               state.mirrorFailed.Load(),
+		"mirror.dropped":              state.mirrorDropped.Load(),
+	}
+	for source := trustSource(0); source < trustSourceCount; source++ {
+		counters["allowed."+source.String()] = state.allowedBy[source].Load()
+	}
+	for family := addrFamily(0); family < addrFamilyCount; family++ {
+		counters["family."+family.String()+".allowed"] = state.allowedByFamily[family].Load()
+		counters["family."+family.String()+".denied"] = state.deniedByFamily[family].Load()
+	}
+	for i := 0; i < responseClasses; i++ {
+		counters["responses."+statusClass(i)] = state.responses.byClass[i].Load()
+	}
+	counters["responses.bytes"] = state.responses.bytes.Load()
+	counters["responses.upgraded"] = state.responses.upgrades.Load()
+	for reason := denyReason(0); reason < denyReasonCount; reason++ {
+		counters["denied."+reason.String()] = state.deniedBy[reason].Load()
+		counters["audited."+reason.String()] = state.auditedBy[reason].Load()
+	}
+	for _, d := range p.cf.distributionStatus() {
+		counters["distribution."+metricName(d.Name)+".allowed"] = d.Allowed
+		counters["distribution."+metricName(d.Name)+".denied"] = d.Denied
+	}
+	for _, rule := range p.cf.secretHeaderStatus() {
+		counters["secret_header."+rule.Label+".matched"] = rule.Matched
+		counters["secret_header."+rule.Label+".denied"] = rule.Denied
+	}
+
+	var lines []string
+	for _, name := range sortedKeys(counters) {
+		if delta := state.statsd.delta(name, counters[name]); delta > 0 {
+			lines = append(lines, fmt.Sprintf("%s.%s:%d|c%s", p.prefix, name, delta, p.tags))
+		}
+	}
+
+	cidrs := p.cf.ips.prefixes()
+	lines = append(lines,
+		fmt.Sprintf("%s.ranges.cloudfront:%d|g%s", p.prefix, len(cidrs), p.tags),
+		fmt.Sprintf("%s.ranges.custom:%d|g%s", p.prefix, len(p.cf.allowedPrefixes()), p.tags))
+	if age, ok := p.cf.dataAge(); ok {
+		lines = append(lines, fmt.Sprintf("%s.data_age_seconds:%d|g%s", p.prefix, int64(age/time.Second), p.tags))
+	}
+	return lines
+}
+
+// delta records value as pushed and returns its increase since the last push.
+func (c *statsdCounters) delta(name string, value uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.last == nil {
+		c.last = make(map[string]uint64)
+	}
+	delta := value - c.last[name]
+	c.last[name] = value
+	return delta
+}
+
+// packLines joins lines into newline separated packets of at most limit bytes.
+// A line longer than limit gets a packet of its own.
+func packLines(lines []string, limit int) []string {
+	var packets []string
+	var b strings.Builder
+	for _, line := range lines {
+		if b.Len() > 0 && b.Len()+1+len(line) > limit {
+			packets = append(packets, b.String())
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(line)
+	}
+	if b.Len() > 0 {
+		packets = append(packets, b.String())
+	}
+	return packets
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,113 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPackLines(t *testing.T) {
+	lines := []string{"aaaa", "bbbb", "cccc", strings.Repeat("x", 12)}
+
+	packets := packLines(lines, 10)
+	want := []string{"aaaa\nbbbb", "cccc", strings.Repeat("x", 12)}
+	if strings.Join(packets, "|") != strings.Join(want, "|") {
+		t.Errorf("packLines() = %q, want %q", packets, want)
+	}
+	for _, packet := range packets[:2] {
+		if len(packet) > 10 {
+			t.Errorf("Packet %q exceeds the limit", packet)
+		}
+	}
+}
+
+func TestNewStatsdPusherValidates(t *testing.T) {
+	tests := map[string]*StatsDConfig{
+		"bad interval":      {Address: "127.0.0.1:8125", FlushInterval: "soon"},
+		"negative interval": {Address: "127.0.0.1:8125", FlushInterval: "-1s"},
+		"bad tag":           {Address: "127.0.0.1:8125", Tags: []string{"a|b"}},
+		"bad address":       {Address: "nope"},
+	}
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newStatsdPusher(&CloudFrontGate{}, config); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+
+	if p, err := newStatsdPusher(&CloudFrontGate{}, &StatsDConfig{}); p != nil || err != nil {
+		t.Errorf("Expected no pusher without an address, got %v, %v", p, err)
+	}
+}
+
+func TestStatsdPush(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	cfg := CreateConfig()
+	cfg.StatsD = &StatsDConfig{
+		Address:       conn.LocalAddr().String(),
+		Prefix:        "edge",
+		Tags:          []string{"env:test"},
+		FlushInterval: "1h",
+	}
+
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+
+	for _, remoteAddr := range []string{"205.251.249.10:1234", "10.0.0.1:1234", "10.0.0.2:1234"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.RemoteAddr = remoteAddr
+		cf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	read := func() string {
+		t.Helper()
+		buf := make([]byte, statsdMaxPacket)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Failed to read packet: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	cf.statsd.flush()
+	packet := read()
+	for _, line := range []string{
+		"edge.requests.allowed:1|c|#env:test",
+		"edge.requests.denied:2|c|#env:test",
+		"edge.denied.ip:2|c|#env:test",
+		"edge.allowed.cloudfront-global:1|c|#env:test",
+		"edge.ranges.cloudfront:8|g|#env:test",
+		"edge.data_age_seconds:",
+	} {
+		if !strings.Contains(packet, line) {
+			t.Errorf("Expected packet to contain %q, got:\n%s", line, packet)
+		}
+	}
+
+	// The next push only carries deltas, so unchanged counters are omitted.
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.RemoteAddr = "10.0.0.3:1234"
+	cf.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Close pushes once more and stops the flusher.
+	_ = cf.Close()
+	packet = read()
+	if !strings.Contains(packet, "edge.requests.denied:1|c") || strings.Contains(packet, "requests.allowed") {
+		t.Errorf("Expected only the new denial as a delta, got:\n%s", packet)
+	}
+}
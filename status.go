@@ -0,0 +1,230 @@
+package cloudfrontgate
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// gateStatus is the document served by the status admin endpoint.
+type gateStatus struct {
+	Name string `json:"name"`
+	// Inherited is set when construction adopted the data of a previous
+	// instance because the source could not be fetched.
+	Inherited bool   `json:"inherited"`
+	Allowed   uint64 `json:"allowed"`
+	Denied    uint64 `json:"denied"`
+	// Unavailable counts requests refused while the gate was degraded.
+	Unavailable uint64 `json:"unavailable"`
+	// Unparsable counts requests without a parsable client address.
+	Unparsable uint64 `json:"unparsable"`
+	// UnparsableAllowed counts the requests without an address in
+	// RemoteAddr admitted by onUnparsableRemoteAddr allow.
+	UnparsableAllowed uint64 `json:"unparsableAllowed"`
+	// Excluded counts requests that bypassed the gate by path or method.
+	Excluded uint64 `json:"excluded"`
+	// FailedOpen counts requests admitted by failOpenOnStartup.
+	FailedOpen uint64 `json:"failedOpen"`
+	// MatcherDivergences counts the disagreements found by verifyMatcher.
+	MatcherDivergences uint64 `json:"matcherDivergences"`
+	// DecisionCacheHits and DecisionCacheMisses count the lookups of the
+	// CloudFront ranges answered by the decision cache or not.
+	DecisionCacheHits   uint64            `json:"decisionCacheHits"`
+	DecisionCacheMisses uint64            `json:"decisionCacheMisses"`
+	DeniedBy            map[string]uint64 `json:"deniedBy"`
+	// Audited counts denials let through by a partial enforcePercent.
+	Audited   uint64            `json:"audited"`
+	AuditedBy map[string]uint64 `json:"auditedBy"`
+	// AllowedBy counts admitted requests per source label.
+	AllowedBy map[string]uint64 `json:"allowedBy"`
+	// AllowedByFamily and DeniedByFamily count the decisions per address
+	// family of the client, "ipv4" or "ipv6".
+	AllowedByFamily map[string]uint64 `json:"allowedByFamily"`
+	DeniedByFamily  map[string]uint64 `json:"deniedByFamily"`
+	// AllowedIPs lists the prefixes of allowedIPs, including those added
+	// by allowPrivateNetworks and allowLoopback and the resolved hosts.
+	AllowedIPs []string `json:"allowedIPs"`
+	// AllowedIPsCarveOuts lists the "!" prefixes of allowedIPs.
+	AllowedIPsCarveOuts []string        `json:"allowedIPsCarveOuts,omitempty"`
+	Windows             []windowStatus  `json:"maintenanceWindows"`
+	Denylist            *cidrFileStatus `json:"denylist,omitempty"`
+	// AllowedIPsFile describes the file merged into AllowedIPs.
+	AllowedIPsFile *cidrFileStatus `json:"allowedIPsFile,omitempty"`
+	// BlockSummary summarizes the blocked addresses of the period under
+	// way when blockSummaryInterval is enabled.
+	BlockSummary *blockSummaryStatus `json:"blockSummary,omitempty"`
+	// AllowedHosts describes the hostname entries of allowedIPs.
+	AllowedHosts []hostStatus `json:"allowedIPsHosts,omitempty"`
+	// Shadow is the last comparison with the shadow source.
+	Shadow *shadowDiff `json:"shadow,omitempty"`
+	// SecretHeaderRules counts the decisions of each secret header rule.
+	SecretHeaderRules []secretHeaderStatus `json:"secretHeaderRules"`
+	// Distributions counts the decisions of each distribution.
+	Distributions []distributionStatus `json:"distributions"`
+	// Sources holds the schedule and last refresh of each shared source.
+	Sources []sourceStatus `json:"sources"`
+	// Quarantined lists the quarantined prefixes with their deadlines.
+	Quarantined []quarantinedStatus `json:"quarantined,omitempty"`
+	// PendingShrink is a rejected shrink awaiting confirmation.
+	PendingShrink *shrinkStatus `json:"pendingShrink,omitempty"`
+	// DataAgeSeconds is the age of the shared store's data, when populated.
+	DataAgeSeconds *int64 `json:"dataAgeSeconds,omitempty"`
+}
+
+// windowStatus describes an active or upcoming maintenance window.
+type windowStatus struct {
+	Name   string    `json:"name"`
+	Active bool      `json:"active"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+// status returns the current status of the instance.
+func (cf *CloudFrontGate) status() gateStatus {
+	status := gateStatus{
+		Name:                cf.name,
+		Inherited:           cf.inherited,
+		Allowed:             cf.state.allowed.Load(),
+		Denied:              cf.state.denied.Load(),
+		Unavailable:         cf.state.unavailable.Load(),
+		Unparsable:          cf.state.unparsable.Load(),
+		UnparsableAllowed:   cf.state.unparsableAllowed.Load(),
+		FailedOpen:          cf.state.failedOpen.Load(),
+		Excluded:            cf.state.excluded.Load(),
+		MatcherDivergences:  cf.state.matcherDivergences.Load(),
+		DeniedBy:            make(map[string]uint64, denyReasonCount),
+		Audited:             cf.state.audited.Load(),
+		AuditedBy:           make(map[string]uint64, denyReasonCount),
+		AllowedBy:           make(map[string]uint64, trustSourceCount),
+		AllowedByFamily:     make(map[string]uint64, addrFamilyCount),
+		DeniedByFamily:      make(map[string]uint64, addrFamilyCount),
+		Windows:             []windowStatus{},
+		Sources:             []sourceStatus{},
+		AllowedIPs:          sortedPrefixes(netipPrefixes(cf.allowedPrefixes())),
+		AllowedIPsCarveOuts: sortedPrefixes(netipPrefixes(cf.allowedSet().carveOuts)),
+	}
+	if cf.decisions != nil {
+		status.DecisionCacheHits = cf.decisions.hits.Load()
+		status.DecisionCacheMisses = cf.decisions.misses.Load()
+	}
+	for reason := denyReason(0); reason < denyReasonCount; reason++ {
+		status.DeniedBy[reason.String()] = cf.state.deniedBy[reason].Load()
+		status.AuditedBy[reason.String()] = cf.state.auditedBy[reason].Load()
+	}
+
+	status.SecretHeaderRules = cf.secretHeaderStatus()
+	status.Distributions = cf.distributionStatus()
+	if cf.entry != nil {
+		status.Sources = append(status.Sources, cf.entry.status("cloudfront"))
+	}
+	if cf.healthEntry != nil {
+		status.Sources = append(status.Sources, cf.healthEntry.status(sourceRoute53HealthChecks.String()))
+	}
+	status.PendingShrink = cf.ips.pendingShrinkStatus()
+	if cf.ips.quarantine > 0 {
+		status.Quarantined = cf.ips.quarantineStatus(cf.ips.now())
+	}
+	if diff, ok := cf.ips.shadowDiff.Load().(*shadowDiff); ok {
+		status.Shadow = diff
+	}
+	if cf.denylist != nil {
+		status.Denylist = cf.denylist.status()
+	}
+	if cf.allowedIPsFile != nil {
+		status.AllowedIPsFile = cf.allowedIPsFile.status()
+	}
+	if cf.hostAllowlist != nil {
+		status.AllowedHosts = cf.hostAllowlist.status()
+	}
+	if cf.blockSummaryInterval > 0 {
+		status.BlockSummary = cf.blockedStatus()
+	}
+	if age, ok := cf.dataAge(); ok {
+		seconds := int64(age / time.Second)
+		status.DataAgeSeconds = &seconds
+	}
+
+	for source := trustSource(0); source < trustSourceCount; source++ {
+		status.AllowedBy[source.String()] = cf.state.allowedBy[source].Load()
+	}
+	for family := addrFamily(0); family < addrFamilyCount; family++ {
+		status.AllowedByFamily[family.String()] = cf.state.allowedByFamily[family].Load()
+		status.DeniedByFamily[family.String()] = cf.state.deniedByFamily[family].Load()
+	}
+
+	now := cf.now()
+	for _, mw := range cf.windows {
+		start, end, ok := mw.occurrence(now)
+		if !ok {
+			continue
+		}
+		status.Windows = append(status.Windows, windowStatus{
+			Name:   mw.name,
+			Active: cf.isActive(mw, now),
+			Start:  start,
+			End:    end,
+		})
+	}
+	return status
+}
+
+// serveStatus writes the status as JSON.
+func (cf *CloudFrontGate) serveStatus(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(cf.status())
+}
+
+// Status is a summary of the state of an instance, for programmatic use and
+// the statusPath endpoint.
+type Status struct {
+	// LastSuccessfulRefresh is when the CloudFront ranges were last stored.
+	LastSuccessfulRefresh *time.Time `json:"lastSuccessfulRefresh,omitempty"`
+	// LastError is the last failed refresh, kept after a success.
+	LastError string `json:"lastError,omitempty"`
+	// LastErrorKind classifies LastError: "fetch" for ErrFetchFailed,
+	// "rejected" for ErrListRejected, or empty.
+	LastErrorKind string `json:"lastErrorKind,omitempty"`
+	// ConsecutiveFailures counts the refreshes failed since the last success.
+	ConsecutiveFailures int64 `json:"consecutiveFailures"`
+	// Stale is set while the ranges are served after a failed refresh.
+	Stale bool `json:"stale"`
+	// Refreshing is set while a fetch of the CloudFront ranges is in flight.
+	Refreshing bool `json:"refreshing"`
+	// Prefixes counts the stored CloudFront prefixes, and AllowedIPs the
+	// prefixes of allowedIPs layered over them.
+	Prefixes   int    `json:"prefixes"`
+	AllowedIPs int    `json:"allowedIPs"`
+	Allowed    uint64 `json:"allowed"`
+	Blocked    uint64 `json:"blocked"`
+}
+
+// Status returns a summary of the state of the instance.
+func (cf *CloudFrontGate) Status() Status {
+	status := Status{
+		Refreshing: cf.ips.flight.running(),
+		Prefixes:   len(cf.ips.prefixes()),
+		AllowedIPs: len(cf.allowedPrefixes()),
+		Allowed:    cf.state.allowed.Load(),
+		Blocked:    cf.state.denied.Load(),
+	}
+	if updated, ok := cf.ips.updated.Load().(time.Time); ok {
+		status.LastSuccessfulRefresh = &updated
+	}
+	if cf.entry != nil {
+		status.LastError, _ = cf.entry.lastErr.Load().(string)
+		status.LastErrorKind, _ = cf.entry.lastErrKind.Load().(string)
+		status.ConsecutiveFailures = cf.entry.failures.Load()
+		status.Stale = cf.entry.stale.Load()
+	}
+	return status
+}
+
+// serveStatusPath writes the Status as JSON.
+func (cf *CloudFrontGate) serveStatusPath(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethod(rw, req, http.MethodGet) {
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(rw).Encode(cf.Status())
+}
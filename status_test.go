@@ -0,0 +1,148 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServeStatus(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.AdminPath = "/_cfgate"
+	cfg.AdminToken = "s3cret"
+	cfg.MaintenanceWindows = []MaintenanceWindow{
+		{Name: "past", CIDRs: []string{"192.0.2.0/24"}, Schedule: WindowSchedule{Start: "2023-12-01T00:00:00Z", End: "2023-12-08T00:00:00Z"}},
+		{Name: "current", CIDRs: []string{"192.0.2.0/24"}, Schedule: WindowSchedule{Start: "2024-01-01T00:00:00Z", End: "2024-01-08T00:00:00Z"}},
+		{Name: "weekly", CIDRs: []string{"192.0.2.0/24"}, Schedule: WindowSchedule{Start: "Sat 08:00", End: "Sat 12:00"}},
+	}
+
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+	cf.now = func() time.Time { return time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC) }
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/_cfgate/status", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	recorder := httptest.NewRecorder()
+	cf.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+
+	var status gateStatus
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if len(status.Windows) != 2 {
+		t.Fatalf("Expected the active and upcoming windows only, got %+v", status.Windows)
+	}
+	if status.Windows[0].Name != "current" || !status.Windows[0].Active {
+		t.Errorf("Expected window current to be active, got %+v", status.Windows[0])
+	}
+	if status.Windows[1].Name != "weekly" || status.Windows[1].Active {
+		t.Errorf("Expected window weekly to be upcoming, got %+v", status.Windows[1])
+	}
+	if _, ok := status.DeniedBy[denyIP.String()]; !ok {
+		t.Errorf("Expected denials per reason, got %v", status.DeniedBy)
+	}
+}
+
+func TestStatusPath(t *testing.T) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		t.Errorf("Expected %s not to be forwarded", req.URL.Path)
+	})
+	cfg := CreateConfig()
+	cfg.AllowedIPs = []string{"192.0.2.0/24"}
+	cfg.StatusPath = "/_cloudfrontgate/status"
+	handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantStatus int
+	}{
+		{name: "Allowed IP", remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusOK},
+		{name: "CloudFront peer", remoteAddr: "205.251.249.10:1234", wantStatus: http.StatusForbidden},
+		{name: "Other peer", remoteAddr: "198.51.100.7:1234", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/_cloudfrontgate/status", nil)
+			req.RemoteAddr = tt.remoteAddr
+			recorder := httptest.NewRecorder()
+			cf.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if recorder.Body.String() != "Forbidden\n" {
+					t.Errorf("Expected the normal denial, got %q", recorder.Body.String())
+				}
+				return
+			}
+			var status Status
+			if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+				t.Fatalf("Failed to decode status: %v", err)
+			}
+			if status.LastSuccessfulRefresh == nil || status.Prefixes != 8 || status.AllowedIPs != 1 || status.ConsecutiveFailures != 0 {
+				t.Errorf("Unexpected status %+v", status)
+			}
+		})
+	}
+	if status := cf.Status(); status.Blocked != 2 {
+		t.Errorf("Expected the refused status requests to count as blocked, got %+v", status)
+	}
+}
+
+func TestStatusRefreshFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	cfg := CreateConfig()
+	cfg.IPListURL = server.URL
+	cfg.AllowPrivateSources = true
+	cfg.FailOpenOnStartup = true
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer cf.Close()
+
+	status := cf.Status()
+	if status.ConsecutiveFailures != 1 || status.LastError == "" || !status.Stale || status.LastSuccessfulRefresh != nil {
+		t.Errorf("Expected one failed refresh, got %+v", status)
+	}
+	if sources := cf.status().Sources; len(sources) != 1 || sources[0].ConsecutiveFailures != 1 || sources[0].LastError == "" {
+		t.Errorf("Expected the failure in the source status, got %+v", sources)
+	}
+}
+
+func TestNewRejectsInvalidStatusPath(t *testing.T) {
+	for _, path := range []string{"status", "/healthz"} {
+		cfg := CreateConfig()
+		cfg.HealthPath = "/healthz"
+		cfg.StatusPath = path
+		if handler, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name()); err == nil {
+			_ = handler.(*CloudFrontGate).Close()
+			t.Errorf("Expected statusPath %q to be rejected", path)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// headerServerTiming reports the gate's evaluation time to the client.
+const headerServerTiming = "Server-Timing"
+
+// Server-Timing modes.
+const (
+	serverTimingOff   = "off"
+	serverTimingAllow = "allow"
+	serverTimingAll   = "all"
+)
+
+// validateServerTiming checks the serverTiming option.
+func validateServerTiming(mode string) error {
+	switch mode {
+	case "", serverTimingOff, serverTimingAllow, serverTimingAll:
+		return nil
+	default:
+		return fmt.Errorf("invalid serverTiming %q: must be %q, %q or %q",
+			mode, serverTimingOff, serverTimingAllow, serverTimingAll)
+	}
+}
+
+// timingStart returns the start of the evaluation, or the zero time when no
+// Server-Timing entry is emitted, so that the clock is not read needlessly.
+func (cf *CloudFrontGate) timingStart() time.Time {
+	if !cf.timeAllowed {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// writeServerTiming appends the evaluation time since start to the
+// Server-Timing header, keeping any entries already present. The duration
+// comes from the monotonic clock reading of start.
+func (cf *CloudFrontGate) writeServerTiming(rw http.ResponseWriter, start time.Time, decision string) {
+	if start.IsZero() {
+		return
+	}
+	if decision != "allow" && !cf.timeDenied {
+		return
+	}
+	ms := float64(time.Since(start)) / float64(time.Millisecond)
+	b := make([]byte, 0, 48)
+	b = append(b, "cfgate;dur="...)
+	b = strconv.AppendFloat(b, ms, 'f', 3, 64)
+	b = append(b, `;desc="`...)
+	b = append(b, decision...)
+	b = append(b, '"')
+	rw.Header().Add(headerServerTiming, string(b))
+}
@@ -0,0 +1,92 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+var serverTimingEntry = regexp.MustCompile(`^cfgate;dur=\d+\.\d{3};desc="(allow|deny)"$`)
+
+func TestServerTiming(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		remoteAddr string
+		want       string
+	}{
+		{name: "Off", remoteAddr: "205.251.249.10:1234"},
+		{name: "Allowed", mode: serverTimingAllow, remoteAddr: "205.251.249.10:1234", want: "allow"},
+		{name: "Denied without all", mode: serverTimingAllow, remoteAddr: "10.0.0.1:1234"},
+		{name: "Denied", mode: serverTimingAll, remoteAddr: "10.0.0.1:1234", want: "deny"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ServerTiming = tt.mode
+			next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+			handler, err := NewWithOptions(context.Background(), next, cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rw := httptest.NewRecorder()
+			rw.Header().Set(headerServerTiming, `db;dur=53`)
+			cf.ServeHTTP(rw, req)
+
+			values := rw.Header().Values(headerServerTiming)
+			if values[0] != `db;dur=53` {
+				t.Errorf("Expected the existing entry to be kept, got %v", values)
+			}
+			if tt.want == "" {
+				if len(values) != 1 {
+					t.Errorf("Expected no gate entry, got %v", values)
+				}
+				return
+			}
+			if len(values) != 2 {
+				t.Fatalf("Expected a gate entry, got %v", values)
+			}
+			match := serverTimingEntry.FindStringSubmatch(values[1])
+			if match == nil || match[1] != tt.want {
+				t.Errorf("Unexpected entry %q, want desc %q", values[1], tt.want)
+			}
+		})
+	}
+}
+
+func TestServerTimingDisabledAddsNoAllocations(t *testing.T) {
+	build := func(mode string) *CloudFrontGate {
+		cfg := CreateConfig()
+		cfg.ServerTiming = mode
+		handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name()+mode, withFixture())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		cf, _ := handler.(*CloudFrontGate)
+		t.Cleanup(func() { _ = cf.Close() })
+		return cf
+	}
+	allocs := func(cf *CloudFrontGate) float64 {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		return testing.AllocsPerRun(100, func() {
+			cf.ServeHTTP(httptest.NewRecorder(), req)
+		})
+	}
+
+	off, all := allocs(build(serverTimingOff)), allocs(build(serverTimingAll))
+	if off >= all {
+		t.Errorf("Expected Server-Timing to cost allocations only when enabled, got %.0f off and %.0f on", off, all)
+	}
+	cf := build("")
+	if start := cf.timingStart(); !start.IsZero() {
+		t.Error("Expected the clock not to be read while disabled")
+	}
+}
@@ -0,0 +1,271 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// errPinMismatch is returned when the server presents no pinned public key.
+var errPinMismatch = errors.New("server public key does not match any pin")
+
+// errPrivateDestination is returned when a guarded fetch would connect to a
+// loopback, link-local or private address.
+var errPrivateDestination = errors.New("refusing to connect to non-public address")
+
+// defaultMaxRedirects is the number of redirects followed by default.
+const defaultMaxRedirects = 3
+
+// errRedirectPolicy is returned when a fetch redirect violates the policy.
+var errRedirectPolicy = errors.New("redirect refused")
+
+// checkRedirect allows at most maxRedirects redirects, only to https URLs
+// and, when sameHostRedirects is set, only to the original host.
+func (ips *ipstore) checkRedirect(req *http.Request, via []*http.Request) error {
+	chain := make([]string, 0, len(via)+1)
+	for _, prev := range via {
+		chain = append(chain, prev.URL.String())
+	}
+	chain = append(chain, req.URL.String())
+
+	switch {
+	case len(via) > ips.maxRedirects:
+		return fmt.Errorf("%w: more than %d redirects: %s", errRedirectPolicy, ips.maxRedirects, strings.Join(chain, " -> "))
+	case req.URL.Scheme != "https":
+		return fmt.Errorf("%w: non-https target: %s", errRedirectPolicy, strings.Join(chain, " -> "))
+	case ips.sameHostRedirects && req.URL.Host != via[0].URL.Host:
+		return fmt.Errorf("%w: cross-host target: %s", errRedirectPolicy, strings.Join(chain, " -> "))
+	}
+	return nil
+}
+
+// parsePins decodes base64 SPKI SHA-256 fingerprints, with or without the
+// "sha256//" prefix used by curl and HPKP.
+func parsePins(pins []string) ([][]byte, error) {
+	parsed := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pin), "sha256//"))
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 pin %q", pin)
+		}
+		parsed = append(parsed, raw)
+	}
+	return parsed, nil
+}
+
+// spkiFingerprint returns the SHA-256 of the certificate's public key.
+func spkiFingerprint(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// fetchTransport returns the store's transport, built once. Every store has
+// its own, so that releasing the store closes its connections.
+func (ips *ipstore) fetchTransport() *http.Transport {
+	ips.transportOnce.Do(func() {
+		// The clone keeps http.ProxyFromEnvironment unless a proxy is set.
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			RootCAs:            ips.rootCAs,
+			InsecureSkipVerify: ips.insecureSkipVerify, //nolint:gosec // Opt-in for internal mirrors.
+		}
+		if len(ips.pins) > 0 {
+			transport.TLSClientConfig.VerifyPeerCertificate = ips.verifyPins
+		}
+		if ips.proxyURL != nil {
+			transport.Proxy = http.ProxyURL(ips.proxyURL)
+		}
+		if ips.guardPrivate || len(ips.resolveOverrides) > 0 {
+			transport.DialContext = ips.dialContext
+		}
+		ips.transport = transport
+	})
+	return ips.transport
+}
+
+// fetchClient returns the store's client, built once.
+func (ips *ipstore) fetchClient() *http.Client {
+	ips.clientOnce.Do(func() {
+		if ips.httpClient != nil {
+			ips.client = ips.injectedClient()
+			return
+		}
+		client := &http.Client{
+			Timeout:       ips.httpTimeout,
+			CheckRedirect: ips.checkRedirect,
+		}
+		client.Transport = ips.fetchTransport()
+		if ips.sigV4 != nil {
+			if signing, err := ips.signingTransport(client.Transport); err == nil {
+				client.Transport = signing
+			}
+		}
+		ips.client = client
+	})
+	return ips.client
+}
+
+// verifyPins accepts the connection when any certificate of a verified chain
+// carries a pinned public key. It runs after the regular chain verification.
+func (ips *ipstore) verifyPins(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			fingerprint := spkiFingerprint(cert)
+			for _, pin := range ips.pins {
+				if subtle.ConstantTimeCompare(fingerprint, pin) == 1 {
+					return nil
+				}
+			}
+		}
+	}
+
+	ips.logs.errorf("SECURITY: %s presented a public key matching none of the configured pins", ips.cfAPI)
+	return errPinMismatch
+}
+
+// dialContext connects to addr. Hosts with a resolve override are dialed at
+// the configured addresses, in order; other hosts are resolved here so that
+// guarded stores dial only vetted public addresses, and a DNS answer
+// changing between check and connect cannot redirect the connection. TLS
+// still validates against the original host name, which the transport
+// takes from the request.
+func (ips *ipstore) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	// The configured proxy resolves the source itself, and is usually on
+	// a private address.
+	if ips.proxyURL != nil && addr == proxyAddress(ips.proxyURL) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	targets, overridden := ips.resolveOverrides[strings.ToLower(host)]
+	if overridden {
+		ips.logs.debugf("Resolving %s via override: %s", host, strings.Join(targets, ", "))
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ipAddr := range addrs {
+			targets = append(targets, net.JoinHostPort(ipAddr.IP.String(), port))
+		}
+	}
+
+	var lastErr error
+	for _, target := range targets {
+		targetHost, _, _ := net.SplitHostPort(target)
+		if ip := net.ParseIP(targetHost); ips.guardPrivate && (ip == nil || !publicIP(ip)) {
+			lastErr = fmt.Errorf("%w: %s resolves to %s", errPrivateDestination, host, targetHost)
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, target)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses for %s", host)
+	}
+	return nil, lastErr
+}
+
+// parseResolveOverrides validates overrides mapping host names to "ip:port"
+// addresses and returns them keyed by lower-case host name.
+func parseResolveOverrides(overrides map[string][]string) (map[string][]string, error) {
+	parsed := make(map[string][]string, len(overrides))
+	for host, targets := range overrides {
+		if host == "" || len(targets) == 0 {
+			return nil, fmt.Errorf("invalid resolve override for %q: host and addresses are required", host)
+		}
+		for _, target := range targets {
+			targetHost, port, err := net.SplitHostPort(target)
+			if err != nil || net.ParseIP(targetHost) == nil || port == "" {
+				return nil, fmt.Errorf("invalid resolve override address %q for %s: must be ip:port", target, host)
+			}
+		}
+		parsed[strings.ToLower(host)] = targets
+	}
+	return parsed, nil
+}
+
+// publicIP reports whether ip is outside the loopback, link-local, private
+// (RFC 1918), unique local (ULA) and unspecified ranges.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsPrivate() &&
+		!ip.IsUnspecified()
+}
+
+// closeIdleConnections releases connections kept by the store's transport.
+// Those of an injected client are left to its owner.
+func (ips *ipstore) closeIdleConnections() {
+	if ips.httpClient != nil {
+		return
+	}
+	ips.fetchTransport().CloseIdleConnections()
+}
+
+// parseProxyURL validates the proxyURL option.
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse proxyURL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxyURL %q: must be http, https or socks5", raw)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxyURL %q: missing host", raw)
+	}
+	return u, nil
+}
+
+// proxyAddress returns the host:port the transport dials for proxy u.
+func proxyAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// loadCABundle reads the PEM file of caBundleFile and returns its contents,
+// failing unless it holds a certificate.
+func loadCABundle(path string) (string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read caBundleFile: %w", err)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(raw) {
+		return "", fmt.Errorf("invalid caBundleFile %s: no PEM certificate found", path)
+	}
+	return string(raw), nil
+}
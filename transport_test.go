@@ -0,0 +1,436 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPinnedSHA256(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	matching := base64.StdEncoding.EncodeToString(spkiFingerprint(server.Certificate()))
+	other := sha256.Sum256([]byte("another key"))
+	nonMatching := base64.StdEncoding.EncodeToString(other[:])
+
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr bool
+	}{
+		{name: "Matching pin", pins: []string{matching}},
+		{name: "Matching pin with prefix", pins: []string{"sha256//" + matching}},
+		{name: "Rotation with one matching pin", pins: []string{nonMatching, matching}},
+		{name: "Non-matching pin", pins: []string{nonMatching}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pins, err := parsePins(tt.pins)
+			if err != nil {
+				t.Fatalf("parsePins() = %v", err)
+			}
+
+			ips := newIPStore(server.URL)
+			ips.rootCAs = roots
+			ips.pins = pins
+			defer ips.closeIdleConnections()
+
+			err = ips.Update(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Update() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, errPinMismatch) {
+				t.Errorf("Expected errPinMismatch, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr bool
+	}{
+		{name: "Valid", pins: []string{valid, "sha256//" + valid}},
+		{name: "Not base64", pins: []string{"not base64!"}, wantErr: true},
+		{name: "Wrong length", pins: []string{"AAAA"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePins(tt.pins); (err != nil) != tt.wantErr {
+				t.Errorf("parsePins() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewRejectsPinsWithoutHTTPS(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.PinnedSHA256 = []string{base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))}
+
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := New(context.Background(), next, cfg, "test"); err == nil {
+		t.Errorf("Expected pins on an http source to be rejected")
+	}
+}
+
+func TestGuardPrivateDestinations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+
+	t.Run("Guarded store refuses loopback", func(t *testing.T) {
+		ips := newIPStore(server.URL)
+		ips.guardPrivate = true
+
+		err := ips.Update(context.Background())
+		if !errors.Is(err, errPrivateDestination) {
+			t.Fatalf("Expected errPrivateDestination, got %v", err)
+		}
+	})
+
+	t.Run("Unguarded store connects", func(t *testing.T) {
+		ips := newIPStore(server.URL)
+		defer ips.closeIdleConnections()
+
+		if err := ips.Update(context.Background()); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+	})
+
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	sum := sha256.Sum256([]byte(testCFResponse))
+	checksum := hex.EncodeToString(sum[:])
+	sidecar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(checksum))
+	}))
+	defer sidecar.Close()
+
+	t.Run("Custom source URL is refused", func(t *testing.T) {
+		cfg := CreateConfig()
+		cfg.IPListURL = server.URL
+		cfg.ChecksumURL = sidecar.URL
+
+		if _, err := New(context.Background(), next, cfg, "test"); !errors.Is(err, errPrivateDestination) {
+			t.Fatalf("Expected errPrivateDestination, got %v", err)
+		}
+	})
+
+	t.Run("Custom source URL with override", func(t *testing.T) {
+		cfg := CreateConfig()
+		cfg.IPListURL = server.URL
+		cfg.ChecksumURL = sidecar.URL
+		cfg.AllowPrivateSources = true
+
+		handler, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		_ = handler.(*CloudFrontGate).Close()
+	})
+}
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "127.0.0.1", want: false},
+		{ip: "::1", want: false},
+		{ip: "169.254.169.254", want: false},
+		{ip: "fe80::1", want: false},
+		{ip: "10.1.2.3", want: false},
+		{ip: "172.16.0.1", want: false},
+		{ip: "192.168.1.1", want: false},
+		{ip: "fd00::1", want: false},
+		{ip: "0.0.0.0", want: false},
+		{ip: "13.32.0.1", want: true},
+		{ip: "2600:9000::1", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := publicIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("publicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	// /hops/N redirects N times before serving the ranges.
+	mux.HandleFunc("/hops/", func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		_, _ = fmt.Sscanf(r.URL.Path, "/hops/%d", &n)
+		if n == 0 {
+			_, _ = w.Write([]byte(testCFResponse))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/hops/%d", n-1), http.StatusFound)
+	})
+	mux.HandleFunc("/cross-host", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://mirror.example.com/ranges", http.StatusFound)
+	})
+	mux.HandleFunc("/downgrade", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://"+r.Host+"/hops/0", http.StatusFound)
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tests := []struct {
+		name         string
+		path         string
+		maxRedirects int
+		sameHost     bool
+		wantErr      bool
+		wantInError  string
+	}{
+		{name: "Within limit", path: "/hops/3", maxRedirects: 3},
+		{name: "Over limit", path: "/hops/4", maxRedirects: 3, wantErr: true, wantInError: "more than 3 redirects"},
+		{name: "No redirects allowed", path: "/hops/1", maxRedirects: 0, wantErr: true, wantInError: "/hops/1 -> "},
+		{name: "Cross host refused", path: "/cross-host", maxRedirects: 3, sameHost: true, wantErr: true, wantInError: "mirror.example.com"},
+		{name: "Downgrade refused", path: "/downgrade", maxRedirects: 3, wantErr: true, wantInError: "non-https"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips := newIPStore(server.URL + tt.path)
+			ips.rootCAs = roots
+			ips.maxRedirects = tt.maxRedirects
+			ips.sameHostRedirects = tt.sameHost
+			defer ips.closeIdleConnections()
+
+			err := ips.Update(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Update() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				return
+			}
+			if !errors.Is(err, errRedirectPolicy) {
+				t.Errorf("Expected errRedirectPolicy, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tt.wantInError) {
+				t.Errorf("Expected error to contain %q, got %v", tt.wantInError, err)
+			}
+		})
+	}
+}
+
+func TestResolveOverrides(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	// The test certificate is valid for example.com but not example.net.
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	target := server.Listener.Addr().String()
+
+	tests := []struct {
+		name      string
+		url       string
+		overrides map[string][]string
+		guard     bool
+		wantErr   bool
+	}{
+		{
+			name:      "Override keeps TLS validation against the host name",
+			url:       "https://example.com:" + port + "/",
+			overrides: map[string][]string{"Example.com": {target}},
+		},
+		{
+			name:      "Addresses are tried in order",
+			url:       "https://example.com:" + port + "/",
+			overrides: map[string][]string{"example.com": {"127.0.0.1:1", target}},
+		},
+		{
+			name:      "Certificate not valid for the original host name",
+			url:       "https://example.net:" + port + "/",
+			overrides: map[string][]string{"example.net": {target}},
+			wantErr:   true,
+		},
+		{
+			name:      "Private override target is guarded",
+			url:       "https://example.com:" + port + "/",
+			overrides: map[string][]string{"example.com": {target}},
+			guard:     true,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			overrides, err := parseResolveOverrides(tt.overrides)
+			if err != nil {
+				t.Fatalf("parseResolveOverrides() = %v", err)
+			}
+
+			ips := newIPStore(tt.url)
+			ips.rootCAs = roots
+			ips.resolveOverrides = overrides
+			ips.guardPrivate = tt.guard
+			defer ips.closeIdleConnections()
+
+			err = ips.Update(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Update() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseResolveOverrides(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides map[string][]string
+		wantErr   bool
+	}{
+		{name: "Valid", overrides: map[string][]string{"ranges.example.com": {"10.20.30.40:443", "[2001:db8::1]:443"}}},
+		{name: "Missing port", overrides: map[string][]string{"ranges.example.com": {"10.20.30.40"}}, wantErr: true},
+		{name: "Host name target", overrides: map[string][]string{"ranges.example.com": {"mirror.example.com:443"}}, wantErr: true},
+		{name: "No addresses", overrides: map[string][]string{"ranges.example.com": {}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseResolveOverrides(tt.overrides); (err != nil) != tt.wantErr {
+				t.Errorf("parseResolveOverrides() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// A forward proxy receives the absolute URL of the target.
+		if req.URL.Host != "ips.example.invalid" {
+			http.Error(w, "unexpected target", http.StatusBadGateway)
+			return
+		}
+		proxied.Add(1)
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer proxy.Close()
+
+	// The source is custom, so dials are guarded, yet the private proxy
+	// address is allowed.
+	cfg := CreateConfig()
+	cfg.IPListURL = "http://ips.example.invalid/ips.json"
+	cfg.ProxyURL = proxy.URL
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cf, _ := handler.(*CloudFrontGate)
+	defer func() { _ = cf.Close() }()
+
+	if proxied.Load() != 1 || cf.ips.empty() {
+		t.Errorf("Expected the IP list to be fetched through the proxy, got %d requests", proxied.Load())
+	}
+}
+
+func TestCABundleFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(testCFResponse))
+	}))
+	defer server.Close()
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		bundle   string
+		insecure bool
+		wantErr  bool
+	}{
+		{name: "System roots", wantErr: true},
+		{name: "CA bundle", bundle: bundle},
+		{name: "Insecure", insecure: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.IPListURL = server.URL
+			cfg.AllowPrivateSources = true
+			cfg.CABundleFile = tt.bundle
+			cfg.InsecureSkipVerify = tt.insecure
+			handler, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				_ = handler.(*CloudFrontGate).Close()
+			}
+		})
+	}
+}
+
+func TestFetchTLSValidation(t *testing.T) {
+	invalid := filepath.Join(t.TempDir(), "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		want   string
+	}{
+		{name: "Proxy scheme", modify: func(cfg *Config) { cfg.ProxyURL = "ftp://proxy.internal:21" }, want: "must be http, https or socks5"},
+		{name: "Proxy host", modify: func(cfg *Config) { cfg.ProxyURL = "http://" }, want: "missing host"},
+		{name: "Missing bundle", modify: func(cfg *Config) { cfg.CABundleFile = filepath.Join(t.TempDir(), "missing.pem") }, want: "failed to read caBundleFile"},
+		{name: "Invalid bundle", modify: func(cfg *Config) { cfg.CABundleFile = invalid }, want: "no PEM certificate"},
+		{name: "Pins with insecure", modify: func(cfg *Config) {
+			cfg.IPListURL = "https://ips.example.com/ips.json"
+			cfg.PinnedSHA256 = []string{"sha256//47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}
+			cfg.InsecureSkipVerify = true
+		}, want: "insecureSkipVerify"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			tt.modify(cfg)
+			_, err := New(context.Background(), http.NotFoundHandler(), cfg, t.Name())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
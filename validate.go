@@ -0,0 +1,68 @@
+package cloudfrontgate
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// defaultAnchorCIDRs are long-stable CloudFront blocks expected in every
+// dataset published by the CloudFront API.
+var defaultAnchorCIDRs = []string{"13.32.0.0/24", "54.192.0.0/24"}
+
+// errAnchorMissing is returned when a fetched dataset lacks an anchor.
+var errAnchorMissing = errors.New("anchor CIDR missing from fetched data")
+
+// errBogusDataset is returned when a fetched dataset cannot be a genuine
+// list of CloudFront addresses.
+var errBogusDataset = errors.New("implausible fetched data")
+
+// Broadest fetched prefixes accepted; CloudFront publishes nothing near them.
+const (
+	minIPv4PrefixLength = 8
+	minIPv6PrefixLength = 16
+)
+
+// checkDataset rejects an empty dataset and prefixes too broad, such as
+// 0.0.0.0/0. With publicOnly, prefixes outside the public unicast space,
+// such as 10.0.0.0/8, are rejected too.
+func checkDataset(fetched []netip.Prefix, publicOnly bool) error {
+	if len(fetched) == 0 {
+		return fmt.Errorf("%w: no prefixes", errBogusDataset)
+	}
+	for _, prefix := range fetched {
+		addr := prefix.Addr()
+		limit := minIPv6PrefixLength
+		if addr.Is4() {
+			limit = minIPv4PrefixLength
+		}
+		switch {
+		case !prefix.IsValid() || prefix.Bits() < limit:
+			return fmt.Errorf("%w: prefix %s is too broad", errBogusDataset, prefix.String())
+		case publicOnly && (!addr.IsGlobalUnicast() || addr.IsPrivate()):
+			return fmt.Errorf("%w: prefix %s is not public unicast", errBogusDataset, prefix.String())
+		}
+	}
+	return nil
+}
+
+// checkAnchors verifies that every anchor is present in or covered by one of
+// the fetched prefixes.
+func checkAnchors(fetched, anchors []netip.Prefix) error {
+	for _, anchor := range anchors {
+		if !covered(fetched, anchor) {
+			return fmt.Errorf("%w: %s", errAnchorMissing, anchor.String())
+		}
+	}
+	return nil
+}
+
+// covered reports whether one of the prefixes contains the whole of target.
+func covered(prefixes []netip.Prefix, target netip.Prefix) bool {
+	for _, prefix := range prefixes {
+		if prefix.Bits() <= target.Bits() && prefix.Contains(target.Addr()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package cloudfrontgate
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckAnchors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fetched []string
+		anchors []string
+		wantErr bool
+	}{
+		{
+			name:    "Exact match",
+			fetched: []string{"13.32.0.0/24", "54.192.0.0/24"},
+			anchors: []string{"13.32.0.0/24", "54.192.0.0/24"},
+		},
+		{
+			name:    "Covered by broader prefix",
+			fetched: []string{"13.32.0.0/15", "54.192.0.0/16"},
+			anchors: []string{"13.32.0.0/24", "54.192.0.0/24"},
+		},
+		{
+			name:    "One anchor missing",
+			fetched: []string{"13.32.0.0/15"},
+			anchors: []string{"13.32.0.0/24", "54.192.0.0/24"},
+			wantErr: true,
+		},
+		{
+			name:    "More specific prefix does not cover anchor",
+			fetched: []string{"13.32.0.0/25", "54.192.0.0/16"},
+			anchors: []string{"13.32.0.0/24"},
+			wantErr: true,
+		},
+		{
+			name:    "No anchors",
+			fetched: []string{"1.1.1.0/24"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetched, err := parsePrefixes(tt.fetched)
+			if err != nil {
+				t.Fatalf("parsePrefixes() = %v", err)
+			}
+			anchors, err := parsePrefixes(tt.anchors)
+			if err != nil {
+				t.Fatalf("parsePrefixes() = %v", err)
+			}
+
+			err = checkAnchors(fetched, anchors)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkAnchors() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errAnchorMissing) {
+				t.Errorf("Expected errAnchorMissing, got %v", err)
+			}
+		})
+	}
+}
+
+func TestUpdateRejectsDataWithoutAnchors(t *testing.T) {
+	response := testCFResponse
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	src := sourceConfig{URL: server.URL, Anchors: defaultAnchorCIDRs, AllowPrivate: true}
+	ips := src.newStore()
+
+	ctx := context.Background()
+	if err := ips.Update(ctx); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	// An attacker-chosen document without the anchors must not replace the data.
+	response = `{"CLOUDFRONT_GLOBAL_IP_LIST": ["6.6.6.0/24"], "CLOUDFRONT_REGIONAL_EDGE_IP_LIST": []}`
+	if err := ips.Update(ctx); !errors.Is(err, errAnchorMissing) {
+		t.Fatalf("Expected errAnchorMissing, got %v", err)
+	}
+	if !ips.Contains(net.ParseIP("54.192.0.1")) || ips.Contains(net.ParseIP("6.6.6.6")) {
+		t.Errorf("Expected previous data to be kept")
+	}
+}
+
+func TestCheckDataset(t *testing.T) {
+	tests := []struct {
+		name       string
+		fetched    []string
+		publicOnly bool
+		wantErr    bool
+	}{
+		{name: "CloudFront prefixes", fetched: []string{"13.32.0.0/15", "2600:9000::/28"}, publicOnly: true},
+		{name: "Empty", wantErr: true},
+		{name: "IPv4 default route", fetched: []string{"13.32.0.0/15", "0.0.0.0/0"}, wantErr: true},
+		{name: "IPv6 default route", fetched: []string{"::/0"}, wantErr: true},
+		{name: "Too broad", fetched: []string{"12.0.0.0/7"}, wantErr: true},
+		{name: "Private", fetched: []string{"10.0.0.0/8"}, publicOnly: true, wantErr: true},
+		{name: "Private in a custom list", fetched: []string{"10.0.0.0/8"}},
+		{name: "Loopback", fetched: []string{"127.0.0.0/8"}, publicOnly: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetched, err := parsePrefixes(tt.fetched)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkDataset(fetched, tt.publicOnly)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkDataset() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errBogusDataset) {
+				t.Errorf("Expected errBogusDataset, got %v", err)
+			}
+		})
+	}
+}
+
+func TestUpdateRejectsImplausibleData(t *testing.T) {
+	response := testCFResponse
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	src := sourceConfig{URL: server.URL, Anchors: defaultAnchorCIDRs, AllowPrivate: true}
+	ips := src.newStore()
+	ctx := context.Background()
+	if err := ips.Update(ctx); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	for i, body := range []string{
+		`{"CLOUDFRONT_GLOBAL_IP_LIST": [], "CLOUDFRONT_REGIONAL_EDGE_IP_LIST": []}`,
+		`{"CLOUDFRONT_GLOBAL_IP_LIST": ["13.32.0.0/15", "54.192.0.0/16", "0.0.0.0/0"], "CLOUDFRONT_REGIONAL_EDGE_IP_LIST": []}`,
+		`{"CLOUDFRONT_GLOBAL_IP_LIST": ["13.32.0.0/15", "54.192.0.0/16", "192.168.0.0/16"], "CLOUDFRONT_REGIONAL_EDGE_IP_LIST": []}`,
+	} {
+		response = body
+		if err := ips.Update(ctx); !errors.Is(err, errBogusDataset) {
+			t.Fatalf("Expected errBogusDataset for %s, got %v", body, err)
+		}
+		if got := len(ips.prefixes()); got != 8 {
+			t.Errorf("Expected the previous 8 prefixes to be kept, got %d", got)
+		}
+		if ips.Contains(net.ParseIP("192.168.1.1")) {
+			t.Error("Expected the rejected prefixes not to be stored")
+		}
+		if got := ips.rejected.Load(); got != uint64(i+1) {
+			t.Errorf("Expected %d rejections, got %d", i+1, got)
+		}
+	}
+	entry := &registryEntry{source: src, ips: ips}
+	if status := entry.status("cloudfront"); status.Rejected != 3 || !strings.Contains(status.LastRejection, "192.168.0.0/16") {
+		t.Errorf("Expected the rejections in the source status, got %+v", status)
+	}
+}
@@ -0,0 +1,102 @@
+package cloudfrontgate
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// headerTrueClientIP carries the viewer address, without a port, when the
+// distribution forwards it.
+const headerTrueClientIP = "True-Client-IP"
+
+// viewerRules is the second layer checked against the viewer address once
+// the peer passed the IP check.
+type viewerRules struct {
+	header  string
+	allowed []net.IPNet
+	blocked []net.IPNet
+}
+
+// newViewerRules validates the viewer options. It returns nil when neither
+// list is set.
+func newViewerRules(config *Config, groups cidrGroups) (*viewerRules, error) {
+	var header string
+	switch http.CanonicalHeaderKey(config.ViewerHeader) {
+	case "", http.CanonicalHeaderKey(headerViewerAddress):
+		header = headerViewerAddress
+	case http.CanonicalHeaderKey(headerTrueClientIP):
+		header = headerTrueClientIP
+	default:
+		return nil, invalidConfig("viewerHeader", fmt.Errorf("invalid viewerHeader %q: must be %q or %q", config.ViewerHeader, headerViewerAddress, headerTrueClientIP))
+	}
+	if len(config.ViewerAllowedIPs) == 0 && len(config.ViewerBlockedIPs) == 0 {
+		return nil, nil
+	}
+
+	allowed, _, err := groups.parse(config.ViewerAllowedIPs)
+	if err != nil {
+		return nil, invalidConfig("viewerAllowedIPs", fmt.Errorf("failed to parse viewer allowed IPs: %w", err))
+	}
+	blocked, _, err := groups.parse(config.ViewerBlockedIPs)
+	if err != nil {
+		return nil, invalidConfig("viewerBlockedIPs", fmt.Errorf("failed to parse viewer blocked IPs: %w", err))
+	}
+	return &viewerRules{header: header, allowed: allowed, blocked: blocked}, nil
+}
+
+// parse returns the viewer address of a header value, or nil.
+// CloudFront-Viewer-Address ends in the viewer port, True-Client-IP is a
+// bare address.
+func (r *viewerRules) parse(value string) net.IP {
+	if r.header == headerTrueClientIP {
+		return normalizeIP(net.ParseIP(strings.TrimSpace(value)))
+	}
+	return normalizeIP(parseViewerAddress(value))
+}
+
+// allows applies the blocked list, then the allowed one when set.
+func (r *viewerRules) allows(viewer net.IP) bool {
+	if containsIP(r.blocked, viewer) {
+		return false
+	}
+	return len(r.allowed) == 0 || containsIP(r.allowed, viewer)
+}
+
+// checkViewerIP reports whether the viewer of the request passes the viewer
+// rules, or the reason it does not. It assumes the checked address addr
+// already passed the IP check: the header is read only when source is a
+// CDN edge, which sets it; other peers are their own viewer.
+func (cf *CloudFrontGate) checkViewerIP(req *http.Request, addr netip.Addr, source trustSource) (denyReason, bool) {
+	r := cf.viewerRules
+	if r == nil {
+		return 0, true
+	}
+
+	viewer := netIP(addr)
+	if source != sourceCustom && source != sourceRoute53HealthChecks {
+		viewer = r.parse(req.Header.Get(r.header))
+		if viewer == nil {
+			cf.logMissingViewer(req, addr)
+			return denyViewerMissing, false
+		}
+	}
+	if !r.allows(viewer) {
+		return denyViewerIP, false
+	}
+	return 0, true
+}
+
+// logMissingViewer warns, at most every unparsableLogInterval, about an
+// edge request without a parsable viewer address: the distribution likely
+// does not forward the header.
+func (cf *CloudFrontGate) logMissingViewer(req *http.Request, addr netip.Addr) {
+	now := cf.now()
+	last := cf.state.viewerLoggedAt.Load()
+	if now.UnixNano()-last >= int64(unparsableLogInterval) && cf.state.viewerLoggedAt.CompareAndSwap(last, now.UnixNano()) {
+		cf.logger.errorf("CloudFrontGate %s: blocking %s %s from edge %s without a parsable viewer address in %s %q; check that the distribution forwards the header",
+			cf.name, req.Method, req.URL.Path, addr, cf.viewerRules.header, req.Header.Get(cf.viewerRules.header))
+	}
+}
@@ -0,0 +1,106 @@
+package cloudfrontgate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewViewerRules(t *testing.T) {
+	rules, err := newViewerRules(&Config{ViewerHeader: "true-client-ip"}, nil)
+	if err != nil || rules != nil {
+		t.Errorf("Expected no rules without lists, got %+v, %v", rules, err)
+	}
+	rules, err = newViewerRules(&Config{ViewerHeader: "true-client-ip", ViewerBlockedIPs: []string{"192.0.2.0/24"}}, nil)
+	if err != nil || rules.header != headerTrueClientIP {
+		t.Errorf("Expected the True-Client-IP header, got %+v, %v", rules, err)
+	}
+
+	for field, config := range map[string]*Config{
+		"viewerHeader":     {ViewerHeader: "X-Forwarded-For", ViewerAllowedIPs: []string{"192.0.2.0/24"}},
+		"viewerAllowedIPs": {ViewerAllowedIPs: []string{"not-a-cidr"}},
+		"viewerBlockedIPs": {ViewerBlockedIPs: []string{"192.0.2.0/33"}},
+	} {
+		_, err := newViewerRules(config, nil)
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) || configErr.Field != field {
+			t.Errorf("Expected a %s error, got %v", field, err)
+		}
+	}
+}
+
+func TestServeHTTPViewerIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		viewer     string
+		want       int
+		wantReason denyReason
+	}{
+		{name: "allowed viewer", remoteAddr: "205.251.249.10:1234", viewer: "198.51.100.7:50000", want: http.StatusOK},
+		{name: "IPv6 viewer", remoteAddr: "205.251.249.10:1234", viewer: "2001:db8::7:50000", want: http.StatusOK},
+		{name: "bracketed IPv6 viewer", remoteAddr: "205.251.249.10:1234", viewer: "[2001:db8::7]:50000", want: http.StatusOK},
+		{name: "IPv4-mapped viewer", remoteAddr: "205.251.249.10:1234", viewer: "::ffff:198.51.100.7:50000", want: http.StatusOK},
+		{name: "blocked before allowed", remoteAddr: "205.251.249.10:1234", viewer: "198.51.100.66:50000", want: http.StatusForbidden, wantReason: denyViewerIP},
+		{name: "viewer outside the allowed list", remoteAddr: "205.251.249.10:1234", viewer: "203.0.113.1:50000", want: http.StatusForbidden, wantReason: denyViewerIP},
+		{name: "missing header", remoteAddr: "205.251.249.10:1234", want: http.StatusForbidden, wantReason: denyViewerMissing},
+		{name: "unparsable header", remoteAddr: "205.251.249.10:1234", viewer: "office", want: http.StatusForbidden, wantReason: denyViewerMissing},
+		{name: "True-Client-IP", header: headerTrueClientIP, remoteAddr: "205.251.249.10:1234", viewer: "198.51.100.7", want: http.StatusOK},
+		{name: "True-Client-IP IPv6", header: headerTrueClientIP, remoteAddr: "205.251.249.10:1234", viewer: "2001:db8::7:5", want: http.StatusOK},
+		{name: "True-Client-IP blocked", header: headerTrueClientIP, remoteAddr: "205.251.249.10:1234", viewer: "198.51.100.66", want: http.StatusForbidden, wantReason: denyViewerIP},
+		// The header of a peer that is not an edge is not trusted.
+		{name: "IP check comes first", remoteAddr: "10.0.0.1:1234", viewer: "198.51.100.7:50000", want: http.StatusForbidden, wantReason: denyIP},
+		{name: "allowedIPs peer is its own viewer", remoteAddr: "198.51.100.8:1234", viewer: "203.0.113.1:50000", want: http.StatusOK},
+		{name: "blocked allowedIPs peer", remoteAddr: "198.51.100.66:1234", viewer: "198.51.100.7:50000", want: http.StatusForbidden, wantReason: denyViewerIP},
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.AllowedIPs = []string{"198.51.100.0/25"}
+			cfg.ViewerAllowedIPs = []string{"198.51.100.0/24", "2001:db8::/32"}
+			cfg.ViewerBlockedIPs = []string{"198.51.100.64/26"}
+			header := tt.header
+			if header == "" {
+				header = headerViewerAddress
+			} else {
+				cfg.ViewerHeader = header
+			}
+			handler, err := NewWithOptions(context.Background(), http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}), cfg, t.Name(), withFixture())
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cf, _ := handler.(*CloudFrontGate)
+			defer func() { _ = cf.Close() }()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.viewer != "" {
+				req.Header.Set(header, tt.viewer)
+			}
+			rw := httptest.NewRecorder()
+			cf.ServeHTTP(rw, req)
+
+			if rw.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rw.Code, tt.want)
+			}
+			if tt.want == http.StatusForbidden && cf.state.deniedBy[tt.wantReason].Load() != 1 {
+				t.Errorf("Expected the denial to be counted as %s", tt.wantReason)
+			}
+		})
+	}
+	if !strings.Contains(logs.String(), "without a parsable viewer address in CloudFront-Viewer-Address") {
+		t.Errorf("Expected the missing viewer address to be logged, got %q", logs.String())
+	}
+}